@@ -1,11 +1,13 @@
 package gotun2socks
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"runtime"
 	"runtime/debug"
 	"runtime/pprof"
+	"syscall"
 
 	"github.com/dkwiebe/gotun2socks/internal/tun"
 	"github.com/dkwiebe/gotun2socks/internal/tun2socks"
@@ -15,6 +17,10 @@ type JavaUidCallback interface {
 	FindUid(sourceIp string, sourcePort int, destIp string, destPort int) int
 }
 
+type JavaProtectCallback interface {
+	Protect(fd int) bool
+}
+
 type Callbacks struct {
 	uidCallback JavaUidCallback
 }
@@ -37,6 +43,7 @@ var defaultProxy = &tun2socks.ProxyServer{
 }
 
 var callback *Callbacks = nil
+var protectCallback JavaProtectCallback = nil
 
 var proxyServerMap map[int]*tun2socks.ProxyServer
 
@@ -92,6 +99,35 @@ func SetUidCallback(javaCallback JavaUidCallback) {
 	log.Printf("Uid callback set")
 }
 
+// SetProtectCallback sets a callback to VpnService.protect() relay sockets,
+// needed unless the app excludes itself from the VPN.
+func SetProtectCallback(javaCallback JavaProtectCallback) {
+	protectCallback = javaCallback
+	if tun2SocksInstance != nil {
+		tun2SocksInstance.SetSocketControl(protectControl())
+	}
+}
+
+func protectControl() func(network, address string, c syscall.RawConn) error {
+	if protectCallback == nil {
+		return nil
+	}
+	cb := protectCallback
+	return func(network, address string, c syscall.RawConn) error {
+		protected := false
+		e := c.Control(func(fd uintptr) {
+			protected = cb.Protect(int(fd))
+		})
+		if e != nil {
+			return e
+		}
+		if !protected {
+			return fmt.Errorf("failed to protect socket for %s", address)
+		}
+		return nil
+	}
+}
+
 func Run(descriptor int, maxCpus int) {
 	runtime.GOMAXPROCS(maxCpus)
 
@@ -99,8 +135,13 @@ func Run(descriptor int, maxCpus int) {
 	var tunGW string = "10.0.0.1"
 	var enableDnsCache bool = true
 
-	f := tun.NewTunDev(uintptr(descriptor), "tun0", tunAddr, tunGW)
+	f, err := tun.NewAndroidTun(descriptor, tunAddr, tunGW, "255.255.255.255", nil)
+	if err != nil {
+		log.Printf("failed to open tun: %s", err)
+		return
+	}
 	tun2SocksInstance = tun2socks.New(f, enableDnsCache)
+	tun2SocksInstance.SetSocketControl(protectControl())
 
 	tun2SocksInstance.SetDefaultProxy(defaultProxy)
 	tun2SocksInstance.SetProxyServers(proxyServerMap)
@@ -0,0 +1,282 @@
+// Package config builds a Tun2Socks from a JSON configuration document, for
+// integrators that load the tunnel settings from a file rather than calling
+// the setters in code.
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/dkwiebe/gotun2socks/internal/gosocks"
+	"github.com/dkwiebe/gotun2socks/internal/tun2socks"
+)
+
+// Config is the tunnel configuration. Fields left out keep the defaults of
+// tun2socks.
+type Config struct {
+	// Proxy is the default proxy flows are relayed through.
+	Proxy *Proxy `json:"proxy"`
+	// MTU is the MTU of the tun device, which must be tun2socks.MTU if set.
+	MTU      int  `json:"mtu"`
+	DNSCache bool `json:"dns_cache"`
+	// DNSServers are the resolvers DNS queries are sent to instead of the
+	// one the client asked, raced against each other if more than one.
+	DNSServers []string `json:"dns_servers"`
+	// DNSForward routes queries by name, see tun2socks.SetDNSForwarding.
+	DNSForward []DNSForward `json:"dns_forward"`
+	Timeouts   Timeouts     `json:"timeouts"`
+	Rules      []Rule       `json:"rules"`
+}
+
+// Proxy is a proxy server.
+type Proxy struct {
+	// Type is "socks", "http" or "none".
+	Type string `json:"type"`
+	// Address is host:port, or unix:/path for a SOCKS server on a Unix
+	// domain socket.
+	Address    string `json:"address"`
+	Login      string `json:"login"`
+	Password   string `json:"password"`
+	AuthHeader string `json:"auth_header"`
+}
+
+// DNSForward sends queries for Suffix and its subdomains to Server.
+type DNSForward struct {
+	Suffix string `json:"suffix"`
+	Server string `json:"server"`
+}
+
+// Timeouts are the timeouts of flows.
+type Timeouts struct {
+	// Connect bounds connecting to a proxy, see
+	// Tun2Socks.SetSocksConnectTimeout.
+	Connect Duration `json:"connect"`
+	// UDPIdleMin and UDPIdleMax bound the idle timeout of UDP flows.
+	UDPIdleMin Duration `json:"udp_idle_min"`
+	UDPIdleMax Duration `json:"udp_idle_max"`
+	// DNSKeepAlive keeps DNS sessions open for more queries.
+	DNSKeepAlive Duration `json:"dns_keepalive"`
+}
+
+// Rule is a routing rule, see tun2socks.RoutingRule.
+type Rule struct {
+	// Proto is "tcp", "udp" or empty for both.
+	Proto string `json:"proto"`
+	// Net is a CIDR, empty for any destination.
+	Net  string `json:"net"`
+	Port uint16 `json:"port"`
+	// Decision is "direct", "proxy" or "drop".
+	Decision  string `json:"decision"`
+	RateLimit int    `json:"rate_limit"`
+}
+
+// Duration is a time.Duration written as a string, e.g. "30s".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if e := json.Unmarshal(b, &s); e != nil {
+		return fmt.Errorf("duration must be a string such as \"30s\": %s", b)
+	}
+	v, e := time.ParseDuration(s)
+	if e != nil {
+		return e
+	}
+	if v < 0 {
+		return fmt.Errorf("negative duration %q", s)
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+var proxyTypes = map[string]int{
+	"none":  tun2socks.PROXY_TYPE_NONE,
+	"socks": tun2socks.PROXY_TYPE_SOCKS,
+	"http":  tun2socks.PROXY_TYPE_HTTP,
+}
+
+var decisions = map[string]tun2socks.Decision{
+	"direct": tun2socks.ROUTE_DIRECT,
+	"proxy":  tun2socks.ROUTE_PROXY,
+	"drop":   tun2socks.ROUTE_DROP,
+}
+
+// LoadConfig reads and validates a JSON configuration. Unknown fields are
+// rejected, so that a misspelt option isn't silently ignored.
+func LoadConfig(r io.Reader) (*Config, error) {
+	d := json.NewDecoder(r)
+	d.DisallowUnknownFields()
+	cfg := &Config{}
+	if e := d.Decode(cfg); e != nil {
+		return nil, fmt.Errorf("config: %s", e)
+	}
+	if e := cfg.Validate(); e != nil {
+		return nil, e
+	}
+	return cfg, nil
+}
+
+// Validate reports the first invalid field of cfg.
+func (cfg *Config) Validate() error {
+	if p := cfg.Proxy; p != nil {
+		t, ok := proxyTypes[p.Type]
+		if !ok {
+			return fmt.Errorf("config: proxy.type: unknown type %q", p.Type)
+		}
+		if t != tun2socks.PROXY_TYPE_NONE {
+			if e := validAddress(p.Address, t == tun2socks.PROXY_TYPE_SOCKS); e != nil {
+				return fmt.Errorf("config: proxy.address: %s", e)
+			}
+		}
+	}
+	if cfg.MTU != 0 && cfg.MTU != tun2socks.MTU {
+		return fmt.Errorf("config: mtu: %d not supported, the tun MTU is %d", cfg.MTU, tun2socks.MTU)
+	}
+	for i, s := range cfg.DNSServers {
+		if e := validDNSServer(s); e != nil {
+			return fmt.Errorf("config: dns_servers[%d]: %s", i, e)
+		}
+	}
+	for i, f := range cfg.DNSForward {
+		if f.Suffix == "" {
+			return fmt.Errorf("config: dns_forward[%d].suffix: empty", i)
+		}
+		if e := validDNSServer(f.Server); e != nil {
+			return fmt.Errorf("config: dns_forward[%d].server: %s", i, e)
+		}
+	}
+	if t := cfg.Timeouts; t.UDPIdleMin > t.UDPIdleMax && t.UDPIdleMax != 0 {
+		return fmt.Errorf("config: timeouts.udp_idle_min: %s above udp_idle_max %s", time.Duration(t.UDPIdleMin), time.Duration(t.UDPIdleMax))
+	}
+	for i, r := range cfg.Rules {
+		if _, e := r.rule(); e != nil {
+			return fmt.Errorf("config: rules[%d].%s", i, e)
+		}
+	}
+	return nil
+}
+
+func validAddress(addr string, unix bool) error {
+	if strings.HasPrefix(addr, gosocks.UnixAddrPrefix) {
+		if !unix {
+			return fmt.Errorf("%q: only SOCKS proxies listen on Unix sockets", addr)
+		}
+		if len(addr) == len(gosocks.UnixAddrPrefix) {
+			return fmt.Errorf("empty socket path")
+		}
+		return nil
+	}
+	if _, _, e := net.SplitHostPort(addr); e != nil {
+		return fmt.Errorf("%q is not host:port", addr)
+	}
+	return nil
+}
+
+// validDNSServer checks server is "ip" or "ip:port", as tun2socks takes it.
+func validDNSServer(server string) error {
+	host := server
+	if h, _, e := net.SplitHostPort(server); e == nil {
+		host = h
+	}
+	if net.ParseIP(host) == nil {
+		return fmt.Errorf("%q is not an IP address", server)
+	}
+	return nil
+}
+
+// rule converts r, reporting the invalid field if any.
+func (r Rule) rule() (tun2socks.RoutingRule, error) {
+	rule := tun2socks.RoutingRule{Port: r.Port, RateLimit: r.RateLimit}
+	switch r.Proto {
+	case "", "tcp", "udp":
+		rule.Proto = r.Proto
+	default:
+		return rule, fmt.Errorf("proto: unknown protocol %q", r.Proto)
+	}
+	if r.Net != "" {
+		_, n, e := net.ParseCIDR(r.Net)
+		if e != nil {
+			return rule, fmt.Errorf("net: %q is not a CIDR", r.Net)
+		}
+		rule.Net = n
+	}
+	d, ok := decisions[r.Decision]
+	if !ok {
+		return rule, fmt.Errorf("decision: unknown decision %q", r.Decision)
+	}
+	rule.Decision = d
+	if r.RateLimit < -1 {
+		return rule, fmt.Errorf("rate_limit: %d below -1", r.RateLimit)
+	}
+	return rule, nil
+}
+
+// NewFromConfig creates a Tun2Socks on dev set up as cfg says.
+func NewFromConfig(dev io.ReadWriteCloser, cfg *Config) (*tun2socks.Tun2Socks, error) {
+	if e := cfg.Validate(); e != nil {
+		return nil, e
+	}
+	t2s := tun2socks.New(dev, cfg.DNSCache)
+	if p := cfg.Proxy; p != nil {
+		t2s.SetDefaultProxy(&tun2socks.ProxyServer{
+			ProxyType:  proxyTypes[p.Type],
+			IpAddress:  p.Address,
+			AuthHeader: p.AuthHeader,
+			Login:      p.Login,
+			Password:   p.Password,
+		})
+	}
+
+	forward := make([]tun2socks.DNSForwardRule, 0, len(cfg.DNSForward))
+	for _, f := range cfg.DNSForward {
+		forward = append(forward, tun2socks.DNSForwardRule{Suffix: f.Suffix, Server: f.Server})
+	}
+	def := ""
+	if len(cfg.DNSServers) == 1 {
+		def = cfg.DNSServers[0]
+	}
+	if e := t2s.SetDNSForwarding(forward, def); e != nil {
+		return nil, fmt.Errorf("config: dns_forward: %s", e)
+	}
+	if len(cfg.DNSServers) > 1 {
+		if e := t2s.SetDNSRaceAll(true, cfg.DNSServers); e != nil {
+			return nil, fmt.Errorf("config: dns_servers: %s", e)
+		}
+	}
+
+	t := cfg.Timeouts
+	if t.Connect != 0 {
+		t2s.SetSocksConnectTimeout(time.Duration(t.Connect))
+	}
+	if t.UDPIdleMin != 0 || t.UDPIdleMax != 0 {
+		min, max := time.Duration(t.UDPIdleMin), time.Duration(t.UDPIdleMax)
+		if min == 0 {
+			min = tun2socks.UDP_IDLE_TIMEOUT
+		}
+		if max == 0 {
+			max = tun2socks.UDP_IDLE_TIMEOUT
+		}
+		t2s.SetUDPIdleTimeout(min, max)
+	}
+	if t.DNSKeepAlive != 0 {
+		t2s.SetDNSKeepAlive(time.Duration(t.DNSKeepAlive))
+	}
+
+	if len(cfg.Rules) > 0 {
+		var rules tun2socks.RoutingRules
+		for _, r := range cfg.Rules {
+			rule, _ := r.rule()
+			rules.Rules = append(rules.Rules, rule)
+		}
+		t2s.SetRoutingRules(rules)
+	}
+	return t2s, nil
+}
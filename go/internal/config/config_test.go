@@ -0,0 +1,112 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dkwiebe/gotun2socks/internal/tun2socks"
+)
+
+const fullConfig = `{
+	"proxy": {"type": "socks", "address": "127.0.0.1:1080", "login": "u", "password": "p"},
+	"mtu": 15000,
+	"dns_cache": true,
+	"dns_servers": ["1.1.1.1", "8.8.8.8:53"],
+	"dns_forward": [{"suffix": "corp.example", "server": "10.0.0.1"}],
+	"timeouts": {"connect": "3s", "udp_idle_min": "10s", "udp_idle_max": "1m", "dns_keepalive": "2s"},
+	"rules": [
+		{"proto": "udp", "net": "10.0.0.0/8", "decision": "direct"},
+		{"port": 443, "decision": "drop", "rate_limit": -1}
+	]
+}`
+
+func TestLoadFullConfig(t *testing.T) {
+	cfg, e := LoadConfig(strings.NewReader(fullConfig))
+	if e != nil {
+		t.Fatal(e)
+	}
+	want := &Config{
+		Proxy:      &Proxy{Type: "socks", Address: "127.0.0.1:1080", Login: "u", Password: "p"},
+		MTU:        tun2socks.MTU,
+		DNSCache:   true,
+		DNSServers: []string{"1.1.1.1", "8.8.8.8:53"},
+		DNSForward: []DNSForward{{Suffix: "corp.example", Server: "10.0.0.1"}},
+		Timeouts: Timeouts{
+			Connect:      Duration(3 * time.Second),
+			UDPIdleMin:   Duration(10 * time.Second),
+			UDPIdleMax:   Duration(time.Minute),
+			DNSKeepAlive: Duration(2 * time.Second),
+		},
+		Rules: []Rule{
+			{Proto: "udp", Net: "10.0.0.0/8", Decision: "direct"},
+			{Port: 443, Decision: "drop", RateLimit: -1},
+		},
+	}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Fatalf("loaded %+v, want %+v", cfg, want)
+	}
+
+	rule, e := cfg.Rules[0].rule()
+	if e != nil {
+		t.Fatal(e)
+	}
+	if rule.Proto != "udp" || rule.Net.String() != "10.0.0.0/8" || rule.Decision != tun2socks.ROUTE_DIRECT {
+		t.Fatalf("converted %+v", rule)
+	}
+	if rule, _ := cfg.Rules[1].rule(); rule.Net != nil || rule.Port != 443 || rule.Decision != tun2socks.ROUTE_DROP || rule.RateLimit != -1 {
+		t.Fatalf("converted %+v", rule)
+	}
+
+	t2s, e := NewFromConfig(nil, cfg)
+	if e != nil || t2s == nil {
+		t.Fatalf("NewFromConfig: %v", e)
+	}
+}
+
+func TestLoadMinimalConfig(t *testing.T) {
+	for _, doc := range []string{
+		`{}`,
+		`{"proxy": {"type": "socks", "address": "unix:/run/socks.sock"}}`,
+		`{"proxy": {"type": "none"}}`,
+	} {
+		cfg, e := LoadConfig(strings.NewReader(doc))
+		if e != nil {
+			t.Fatalf("%s: %s", doc, e)
+		}
+		if cfg.MTU != 0 || cfg.DNSCache || len(cfg.Rules) != 0 || cfg.Timeouts != (Timeouts{}) {
+			t.Fatalf("%s: loaded %+v, want the defaults", doc, cfg)
+		}
+		if _, e := NewFromConfig(nil, cfg); e != nil {
+			t.Fatalf("%s: NewFromConfig: %s", doc, e)
+		}
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	for _, c := range []struct{ doc, field string }{
+		{`{"proxy": {"type": "ftp"}}`, "proxy.type"},
+		{`{"proxy": {"type": "socks", "address": "x"}}`, "proxy.address"},
+		{`{"proxy": {"type": "http", "address": "unix:/run/socks.sock"}}`, "proxy.address"},
+		{`{"proxy": {"type": "socks", "address": "unix:"}}`, "proxy.address"},
+		{`{"mtu": 1500}`, "mtu"},
+		{`{"dns_servers": ["nope"]}`, "dns_servers[0]"},
+		{`{"dns_forward": [{"suffix": "", "server": "10.0.0.1"}]}`, "dns_forward[0].suffix"},
+		{`{"dns_forward": [{"suffix": "corp.example", "server": "ns"}]}`, "dns_forward[0].server"},
+		{`{"timeouts": {"connect": 5}}`, "duration"},
+		{`{"timeouts": {"connect": "5 parsecs"}}`, "duration"},
+		{`{"timeouts": {"connect": "-1s"}}`, "negative"},
+		{`{"timeouts": {"udp_idle_min": "2m", "udp_idle_max": "1m"}}`, "timeouts.udp_idle_min"},
+		{`{"rules": [{"decision": "maybe"}]}`, "rules[0].decision"},
+		{`{"rules": [{"decision": "drop"}, {"net": "10/8", "decision": "drop"}]}`, "rules[1].net"},
+		{`{"rules": [{"proto": "icmp", "decision": "drop"}]}`, "rules[0].proto"},
+		{`{"rules": [{"decision": "drop", "rate_limit": -2}]}`, "rules[0].rate_limit"},
+		{`{"proxi": {}}`, "unknown field"},
+	} {
+		_, e := LoadConfig(strings.NewReader(c.doc))
+		if e == nil || !strings.Contains(e.Error(), c.field) {
+			t.Errorf("%s: got %v, want an error naming %s", c.doc, e, c.field)
+		}
+	}
+}
@@ -1,7 +1,6 @@
 package gosocks
 
 import (
-	"bufio"
 	"bytes"
 	"fmt"
 	"io"
@@ -17,6 +16,7 @@ const (
 	SocksReserved = 0x00
 
 	SocksNoAuthentication    = 0x00
+	SocksAuthMethodGSSAPI    = 0x01
 	SocksAuthMethodUsernamePassword  = 0x02
 	SocksNoAcceptableMethods = 0xFF
 
@@ -234,7 +234,8 @@ func packSocksHost(hostType byte, host string) (data []byte, err error) {
 
 func readSocksComm(r io.Reader) (data socksCommon, err error) {
 	var h [4]byte
-	r = bufio.NewReader(r)
+	// read unbuffered, data may follow right after, e.g. once a BIND is
+	// accepted
 	_, err = io.ReadFull(r, h[:])
 	if err != nil {
 		return
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"strings"
+	"syscall"
 	"time"
 )
 
@@ -15,6 +17,9 @@ type ClientAuthenticator interface {
 type SocksDialer struct {
 	Timeout time.Duration
 	Auth    ClientAuthenticator
+	// Control, if not nil, is called on the socket before connecting, e.g.
+	// to protect it from being routed back into a VPN.
+	Control func(network, address string, c syscall.RawConn) error
 }
 
 type AnonymousClientAuthenticator struct{}
@@ -24,6 +29,25 @@ type UserNamePasswordClientAuthenticator struct {
 	Password string
 }
 
+// GSSAPIProvider performs the GSSAPI security context exchange of SOCKS5
+// GSSAPI authentication (RFC 1961), e.g. on top of a kerberos library.
+type GSSAPIProvider interface {
+	// InitSecContext takes the token received from the server, nil at
+	// first, and returns the token to send, if any, and whether the
+	// context is established.
+	InitSecContext(token []byte) (out []byte, established bool, err error)
+	// Wrap and Unwrap protect the messages of the protection level
+	// subnegotiation.
+	Wrap(msg []byte) ([]byte, error)
+	Unwrap(token []byte) ([]byte, error)
+}
+
+// GSSAPIClientAuthenticator authenticates with GSSAPI and negotiates the
+// clear protection level, so no per-message protection is applied afterwards.
+type GSSAPIClientAuthenticator struct {
+	Provider GSSAPIProvider
+}
+
 type HttpAuthenticator struct {
 }
 
@@ -77,6 +101,10 @@ func (a *UserNamePasswordClientAuthenticator) ClientAuthenticate(conn *SocksConn
 	if err != nil {
 		return
 	}
+	if resp[0] == SocksVersion && resp[1] == SocksAuthMethodGSSAPI {
+		err = fmt.Errorf("SOCKS server demands GSSAPI authentication, no GSSAPI provider set")
+		return
+	}
 	if resp[0] != SocksVersion || resp[1] != SocksAuthMethodUsernamePassword {
 		err = fmt.Errorf("Fail to pass anonymous authentication: (0x%02x, 0x%02x)", resp[0], resp[1])
 		return
@@ -107,12 +135,151 @@ func (a *UserNamePasswordClientAuthenticator) ClientAuthenticate(conn *SocksConn
 	return
 }
 
+const (
+	gssapiVersion         = 0x01
+	gssapiMsgAuth         = 0x01
+	gssapiMsgProtection   = 0x02
+	gssapiMsgAbort        = 0xFF
+	gssapiProtectionClear = 0x00
+)
+
+func writeGSSAPIMessage(conn *SocksConn, mtyp byte, token []byte) error {
+	if len(token) > 0xFFFF {
+		return fmt.Errorf("GSSAPI token too long: %d bytes", len(token))
+	}
+	msg := make([]byte, 4+len(token))
+	msg[0] = gssapiVersion
+	msg[1] = mtyp
+	msg[2] = byte(len(token) >> 8)
+	msg[3] = byte(len(token))
+	copy(msg[4:], token)
+	conn.SetWriteDeadline(time.Now().Add(conn.Timeout))
+	_, err := conn.Write(msg)
+	return err
+}
+
+func readGSSAPIMessage(conn *SocksConn, r io.Reader, mtyp byte) ([]byte, error) {
+	conn.SetReadDeadline(time.Now().Add(conn.Timeout))
+	var h [4]byte
+	_, err := io.ReadFull(r, h[:2])
+	if err != nil {
+		return nil, err
+	}
+	if h[0] != gssapiVersion {
+		return nil, fmt.Errorf("unexpected GSSAPI message version 0x%02x", h[0])
+	}
+	if h[1] == gssapiMsgAbort {
+		return nil, fmt.Errorf("SOCKS server aborted GSSAPI authentication")
+	}
+	if h[1] != mtyp {
+		return nil, fmt.Errorf("unexpected GSSAPI message type 0x%02x", h[1])
+	}
+	_, err = io.ReadFull(r, h[2:])
+	if err != nil {
+		return nil, err
+	}
+	token := make([]byte, int(h[2])<<8|int(h[3]))
+	_, err = io.ReadFull(r, token)
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func (a *GSSAPIClientAuthenticator) ClientAuthenticate(conn *SocksConn) (err error) {
+	if a.Provider == nil {
+		return fmt.Errorf("no GSSAPI provider set")
+	}
+	conn.SetWriteDeadline(time.Now().Add(conn.Timeout))
+	_, err = conn.Write([]byte{SocksVersion, 1, SocksAuthMethodGSSAPI})
+	if err != nil {
+		return
+	}
+
+	conn.SetReadDeadline(time.Now().Add(conn.Timeout))
+	var resp [2]byte
+	r := bufio.NewReader(conn)
+	_, err = io.ReadFull(r, resp[:2])
+	if err != nil {
+		return
+	}
+	if resp[0] != SocksVersion || resp[1] != SocksAuthMethodGSSAPI {
+		err = fmt.Errorf("Fail to pass GSSAPI authentication: (0x%02x, 0x%02x)", resp[0], resp[1])
+		return
+	}
+
+	// security context exchange
+	var in []byte
+	for {
+		out, established, e := a.Provider.InitSecContext(in)
+		if e != nil {
+			writeGSSAPIMessage(conn, gssapiMsgAbort, nil)
+			return e
+		}
+		if len(out) > 0 {
+			err = writeGSSAPIMessage(conn, gssapiMsgAuth, out)
+			if err != nil {
+				return
+			}
+		}
+		if established {
+			break
+		}
+		in, err = readGSSAPIMessage(conn, r, gssapiMsgAuth)
+		if err != nil {
+			return
+		}
+	}
+
+	// protection level subnegotiation
+	token, err := a.Provider.Wrap([]byte{gssapiProtectionClear})
+	if err != nil {
+		return
+	}
+	err = writeGSSAPIMessage(conn, gssapiMsgProtection, token)
+	if err != nil {
+		return
+	}
+	token, err = readGSSAPIMessage(conn, r, gssapiMsgProtection)
+	if err != nil {
+		return
+	}
+	level, err := a.Provider.Unwrap(token)
+	if err != nil {
+		return
+	}
+	if len(level) != 1 || level[0] != gssapiProtectionClear {
+		err = fmt.Errorf("unsupported GSSAPI protection level %v", level)
+		return
+	}
+	return
+}
+
+// UnixAddrPrefix marks a SOCKS server address as the path of a Unix domain
+// socket, e.g. "unix:/run/socks.sock", rather than a TCP host:port.
+const UnixAddrPrefix = "unix:"
+
+// SplitDialAddr returns the network and the address to dial for the SOCKS
+// server address: "unix" and the socket path for a UnixAddrPrefix address,
+// "tcp" and address itself otherwise.
+func SplitDialAddr(address string) (network, addr string) {
+	if strings.HasPrefix(address, UnixAddrPrefix) {
+		return "unix", address[len(UnixAddrPrefix):]
+	}
+	return "tcp", address
+}
+
 func (d *SocksDialer) Dial(address string) (conn *SocksConn, err error) {
-	c, err := net.DialTimeout("tcp", address, d.Timeout)
+	network, addr := SplitDialAddr(address)
+	dialer := &net.Dialer{Timeout: d.Timeout}
+	if network == "tcp" {
+		dialer.Control = d.Control
+	}
+	c, err := dialer.Dial(network, addr)
 	if err != nil {
 		return
 	}
-	conn = &SocksConn{c.(*net.TCPConn), d.Timeout}
+	conn = &SocksConn{c, d.Timeout}
 	err = d.Auth.ClientAuthenticate(conn)
 	if err != nil {
 		conn.Close()
@@ -156,3 +323,33 @@ func ClientRequest(conn *SocksConn, req *SocksRequest) (reply *SocksReply, err e
 	reply, err = ReadSocksReply(conn)
 	return
 }
+
+// ClientBind sends a BIND request for an inbound connection from the host in
+// req and returns the first reply, carrying the address the proxy listens on
+// for the peer. ClientBindAccept then waits for the peer to connect.
+func ClientBind(conn *SocksConn, req *SocksRequest) (reply *SocksReply, err error) {
+	req.Cmd = SocksCmdBind
+	reply, err = ClientRequest(conn, req)
+	if err != nil {
+		return
+	}
+	if reply.Rep != SocksSucceeded {
+		err = fmt.Errorf("BIND request failed: 0x%02x", reply.Rep)
+	}
+	return
+}
+
+// ClientBindAccept waits, without a deadline, for the second reply to a BIND
+// request, carrying the address of the peer that connected. conn then
+// carries the connection of the peer.
+func ClientBindAccept(conn *SocksConn) (reply *SocksReply, err error) {
+	conn.SetReadDeadline(time.Time{})
+	reply, err = ReadSocksReply(conn)
+	if err != nil {
+		return
+	}
+	if reply.Rep != SocksSucceeded {
+		err = fmt.Errorf("BIND accept failed: 0x%02x", reply.Rep)
+	}
+	return
+}
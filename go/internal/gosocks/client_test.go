@@ -0,0 +1,125 @@
+package gosocks
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mockGSSAPI establishes its context once the server sent back each of
+// tokens, and wraps by prefixing "wrap:".
+type mockGSSAPI struct {
+	tokens [][]byte
+	round  int
+}
+
+func (m *mockGSSAPI) InitSecContext(token []byte) ([]byte, bool, error) {
+	if m.round > 0 && !bytes.Equal(token, m.tokens[m.round-1]) {
+		return nil, false, io.ErrUnexpectedEOF
+	}
+	if m.round == len(m.tokens) {
+		return nil, true, nil
+	}
+	m.round++
+	return []byte("client" + string(m.tokens[m.round-1])), false, nil
+}
+
+func (m *mockGSSAPI) Wrap(msg []byte) ([]byte, error) {
+	return append([]byte("wrap:"), msg...), nil
+}
+
+func (m *mockGSSAPI) Unwrap(token []byte) ([]byte, error) {
+	if !bytes.HasPrefix(token, []byte("wrap:")) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return token[len("wrap:"):], nil
+}
+
+// gssapiServer plays the server side of the GSSAPI authentication on conn,
+// answering each client token with the next of tokens and granting level.
+func gssapiServer(conn net.Conn, tokens [][]byte, level byte) error {
+	c := &SocksConn{conn, time.Second}
+	hello := make([]byte, 3)
+	if _, err := io.ReadFull(conn, hello); err != nil {
+		return err
+	}
+	if _, err := conn.Write([]byte{SocksVersion, SocksAuthMethodGSSAPI}); err != nil {
+		return err
+	}
+	for _, token := range tokens {
+		in, err := readGSSAPIMessage(c, conn, gssapiMsgAuth)
+		if err != nil {
+			return err
+		}
+		if string(in) != "client"+string(token) {
+			return writeGSSAPIMessage(c, gssapiMsgAbort, nil)
+		}
+		if err := writeGSSAPIMessage(c, gssapiMsgAuth, token); err != nil {
+			return err
+		}
+	}
+	if _, err := readGSSAPIMessage(c, conn, gssapiMsgProtection); err != nil {
+		return err
+	}
+	return writeGSSAPIMessage(c, gssapiMsgProtection, []byte{'w', 'r', 'a', 'p', ':', level})
+}
+
+func TestGSSAPIClientAuthenticate(t *testing.T) {
+	tokens := [][]byte{[]byte("one"), []byte("two")}
+	for _, tc := range []struct {
+		level byte
+		ok    bool
+	}{
+		{gssapiProtectionClear, true},
+		{0x02, false},
+	} {
+		client, server := net.Pipe()
+		done := make(chan error, 1)
+		go func() { done <- gssapiServer(server, tokens, tc.level) }()
+		a := &GSSAPIClientAuthenticator{Provider: &mockGSSAPI{tokens: tokens}}
+		err := a.ClientAuthenticate(&SocksConn{client, time.Second})
+		if tc.ok && err != nil {
+			t.Fatalf("level %d: %s", tc.level, err)
+		}
+		if !tc.ok && err == nil {
+			t.Fatalf("level %d: accepted", tc.level)
+		}
+		if err := <-done; err != nil {
+			t.Fatalf("server: %s", err)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestGSSAPIClientAuthenticateAbort(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go gssapiServer(server, [][]byte{[]byte("other")}, gssapiProtectionClear)
+	a := &GSSAPIClientAuthenticator{Provider: &mockGSSAPI{tokens: [][]byte{[]byte("one")}}}
+	err := a.ClientAuthenticate(&SocksConn{client, time.Second})
+	if err == nil || !strings.Contains(err.Error(), "aborted") {
+		t.Fatalf("got %v, want the abort", err)
+	}
+}
+
+func TestGSSAPIDemandedWithoutProvider(t *testing.T) {
+	a := &GSSAPIClientAuthenticator{}
+	if err := a.ClientAuthenticate(nil); err == nil {
+		t.Fatal("authenticated without a provider")
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go gssapiServer(server, nil, gssapiProtectionClear)
+	u := &UserNamePasswordClientAuthenticator{UserName: "user", Password: "pass"}
+	err := u.ClientAuthenticate(&SocksConn{client, time.Second})
+	if err == nil || !strings.Contains(err.Error(), "GSSAPI") {
+		t.Fatalf("got %v, want a GSSAPI error", err)
+	}
+}
@@ -33,7 +33,7 @@ type Server struct {
 }
 
 type UDPPacket struct {
-	Addr *net.UDPAddr
+	Addr net.Addr
 	Data []byte
 }
 
@@ -314,7 +314,8 @@ loop:
 			}
 			// validation
 			// 1) RFC1928 Section-7
-			if !LegalClientAddr(clientAssociate, pkt.Addr) {
+			from, ok := pkt.Addr.(*net.UDPAddr)
+			if !ok || !LegalClientAddr(clientAssociate, from) {
 				continue
 			}
 			// 2) format
@@ -329,8 +330,12 @@ loop:
 			}
 
 			// update clientAddr (not required)
-			clientAddr = pkt.Addr
-			forwardingAddr := SocksAddrToNetAddr("udp", udpReq.DstHost, udpReq.DstPort).(*net.UDPAddr)
+			clientAddr = from
+			forwardingAddr, ok := SocksAddrToNetAddr("udp", udpReq.DstHost, udpReq.DstPort).(*net.UDPAddr)
+			if !ok || forwardingAddr == nil {
+				log.Printf("error to resolve UDP destination %s", udpReq.DstHost)
+				continue
+			}
 			_, err = forwardingBind.WriteToUDP(udpReq.Data, forwardingAddr)
 			if err != nil {
 				log.Printf("error to send UDP packet to remote: %s", err)
@@ -384,12 +389,20 @@ func (h *BasicSocksHandler) HandleCmdUDPAssociate(req *SocksRequest, conn *Socks
 	log.Printf("UDP connection done")
 }
 
-func UDPReader(u *net.UDPConn, ch chan<- *UDPPacket, quit chan bool) {
-	u.SetDeadline(time.Time{})
-	var buf [largeBufSize]byte
+// UDPReader reads packets from u and delivers them to ch until a read fails,
+// as once u is closed or its read deadline passed, or quit is closed.
+func UDPReader(u net.PacketConn, ch chan<- *UDPPacket, quit chan bool) {
+	UDPReaderSize(u, ch, quit, largeBufSize)
+}
+
+// UDPReaderSize is UDPReader reading into a buffer of size bytes. Datagrams
+// larger than the buffer are clipped. u may be of any datagram network, e.g.
+// unixgram.
+func UDPReaderSize(u net.PacketConn, ch chan<- *UDPPacket, quit chan bool, size int) {
+	buf := make([]byte, size)
 loop:
 	for {
-		n, addr, err := u.ReadFromUDP(buf[:])
+		n, addr, err := u.ReadFrom(buf[:])
 		if err != nil {
 			break loop
 		}
@@ -0,0 +1,198 @@
+// Package ipfix exports flow records to an IPFIX (RFC 7011) collector.
+package ipfix
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/dkwiebe/gotun2socks/internal/packet"
+	"github.com/dkwiebe/gotun2socks/internal/tun2socks"
+)
+
+const (
+	VERSION = 10
+
+	// templates are sent again this often, as collectors listening on UDP
+	// may have missed them
+	TEMPLATE_REFRESH = 30 * time.Second
+
+	templateSetID = 2
+	templateIPv4  = 256
+	templateIPv6  = 257
+
+	headerLen = 16
+)
+
+// information elements (IANA IPFIX registry)
+const (
+	ieOctetDeltaCount          = 1
+	iePacketDeltaCount         = 2
+	ieProtocolIdentifier       = 4
+	ieSourceTransportPort      = 7
+	ieSourceIPv4Address        = 8
+	ieDestinationTransportPort = 11
+	ieDestinationIPv4Address   = 12
+	ieSourceIPv6Address        = 27
+	ieDestinationIPv6Address   = 28
+	ieFlowStartMilliseconds    = 152
+	ieFlowEndMilliseconds      = 153
+)
+
+// Record is a unidirectional flow.
+type Record struct {
+	SrcIP    net.IP
+	DstIP    net.IP
+	SrcPort  uint16
+	DstPort  uint16
+	Protocol uint8
+	Packets  uint64
+	Bytes    uint64
+	Start    time.Time
+	End      time.Time
+}
+
+type field struct {
+	id  uint16
+	len uint16
+}
+
+func template(addrLen uint16, src uint16, dst uint16) []field {
+	return []field{
+		{src, addrLen},
+		{dst, addrLen},
+		{ieSourceTransportPort, 2},
+		{ieDestinationTransportPort, 2},
+		{ieProtocolIdentifier, 1},
+		{iePacketDeltaCount, 8},
+		{ieOctetDeltaCount, 8},
+		{ieFlowStartMilliseconds, 8},
+		{ieFlowEndMilliseconds, 8},
+	}
+}
+
+var templates = map[uint16][]field{
+	templateIPv4: template(net.IPv4len, ieSourceIPv4Address, ieDestinationIPv4Address),
+	templateIPv6: template(net.IPv6len, ieSourceIPv6Address, ieDestinationIPv6Address),
+}
+
+// Exporter writes records as IPFIX messages to a collector.
+type Exporter struct {
+	mutex    sync.Mutex
+	w        io.Writer
+	domainID uint32
+	// data records sent so far
+	seq          uint32
+	templateSent time.Time
+}
+
+// NewExporter returns an exporter writing each message with a single Write
+// to w, typically a UDP socket connected to the collector, for observation
+// domain domainID.
+func NewExporter(w io.Writer, domainID uint32) *Exporter {
+	return &Exporter{w: w, domainID: domainID}
+}
+
+// Export sends records in one message, preceded by the templates when they
+// are due.
+func (e *Exporter) Export(records ...Record) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	now := time.Now()
+	due := now.Sub(e.templateSent) >= TEMPLATE_REFRESH
+	msg := make([]byte, headerLen, 512)
+	if due {
+		msg = appendTemplateSet(msg)
+	}
+	var v4, v6 []Record
+	for _, r := range records {
+		switch {
+		case r.SrcIP.To4() != nil && r.DstIP.To4() != nil:
+			v4 = append(v4, r)
+		case r.SrcIP.To16() != nil && r.DstIP.To16() != nil:
+			v6 = append(v6, r)
+		}
+	}
+	msg = appendDataSet(msg, templateIPv4, v4)
+	msg = appendDataSet(msg, templateIPv6, v6)
+
+	binary.BigEndian.PutUint16(msg[0:], VERSION)
+	binary.BigEndian.PutUint16(msg[2:], uint16(len(msg)))
+	binary.BigEndian.PutUint32(msg[4:], uint32(now.Unix()))
+	binary.BigEndian.PutUint32(msg[8:], e.seq)
+	binary.BigEndian.PutUint32(msg[12:], e.domainID)
+	if _, err := e.w.Write(msg); err != nil {
+		return err
+	}
+	if due {
+		e.templateSent = now
+	}
+	e.seq += uint32(len(v4) + len(v6))
+	return nil
+}
+
+// ExportFlow exports a closed flow of a Tun2Socks as a record for each
+// direction that carried packets, e.g. as its flow record handler.
+func (e *Exporter) ExportFlow(f tun2socks.FlowRecord) error {
+	proto := uint8(packet.IPProtocolUDP)
+	if f.Proto == "tcp" {
+		proto = uint8(packet.IPProtocolTCP)
+	}
+	var records []Record
+	if f.PacketsOut > 0 {
+		records = append(records, Record{f.SrcIP, f.DstIP, f.SrcPort, f.DstPort, proto, f.PacketsOut, f.BytesOut, f.Start, f.End})
+	}
+	if f.PacketsIn > 0 {
+		records = append(records, Record{f.DstIP, f.SrcIP, f.DstPort, f.SrcPort, proto, f.PacketsIn, f.BytesIn, f.Start, f.End})
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	return e.Export(records...)
+}
+
+func appendTemplateSet(msg []byte) []byte {
+	start := len(msg)
+	msg = append(msg, 0, 0, 0, 0)
+	for _, id := range []uint16{templateIPv4, templateIPv6} {
+		fields := templates[id]
+		msg = binary.BigEndian.AppendUint16(msg, id)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(len(fields)))
+		for _, f := range fields {
+			msg = binary.BigEndian.AppendUint16(msg, f.id)
+			msg = binary.BigEndian.AppendUint16(msg, f.len)
+		}
+	}
+	binary.BigEndian.PutUint16(msg[start:], templateSetID)
+	binary.BigEndian.PutUint16(msg[start+2:], uint16(len(msg)-start))
+	return msg
+}
+
+func appendDataSet(msg []byte, id uint16, records []Record) []byte {
+	if len(records) == 0 {
+		return msg
+	}
+	start := len(msg)
+	msg = append(msg, 0, 0, 0, 0)
+	for _, r := range records {
+		src, dst := r.SrcIP.To4(), r.DstIP.To4()
+		if id == templateIPv6 {
+			src, dst = r.SrcIP.To16(), r.DstIP.To16()
+		}
+		msg = append(msg, src...)
+		msg = append(msg, dst...)
+		msg = binary.BigEndian.AppendUint16(msg, r.SrcPort)
+		msg = binary.BigEndian.AppendUint16(msg, r.DstPort)
+		msg = append(msg, r.Protocol)
+		msg = binary.BigEndian.AppendUint64(msg, r.Packets)
+		msg = binary.BigEndian.AppendUint64(msg, r.Bytes)
+		msg = binary.BigEndian.AppendUint64(msg, uint64(r.Start.UnixMilli()))
+		msg = binary.BigEndian.AppendUint64(msg, uint64(r.End.UnixMilli()))
+	}
+	binary.BigEndian.PutUint16(msg[start:], id)
+	binary.BigEndian.PutUint16(msg[start+2:], uint16(len(msg)-start))
+	return msg
+}
@@ -0,0 +1,124 @@
+package ipfix
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dkwiebe/gotun2socks/internal/tun2socks"
+)
+
+// messages collects each Write as a message.
+type messages [][]byte
+
+func (m *messages) Write(b []byte) (int, error) {
+	*m = append(*m, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+// sets splits an IPFIX message into its sets by ID, after checking its
+// header.
+func sets(tb testing.TB, msg []byte, seq uint32) map[uint16][]byte {
+	tb.Helper()
+	if len(msg) < headerLen || binary.BigEndian.Uint16(msg) != VERSION || int(binary.BigEndian.Uint16(msg[2:])) != len(msg) {
+		tb.Fatalf("bad message header % x", msg[:headerLen])
+	}
+	if got := binary.BigEndian.Uint32(msg[8:]); got != seq {
+		tb.Fatalf("sequence %d, want %d", got, seq)
+	}
+	if got := binary.BigEndian.Uint32(msg[12:]); got != 7 {
+		tb.Fatalf("domain %d, want 7", got)
+	}
+	m := make(map[uint16][]byte)
+	for b := msg[headerLen:]; len(b) > 0; {
+		l := int(binary.BigEndian.Uint16(b[2:]))
+		if l < 4 || l > len(b) {
+			tb.Fatalf("bad set length %d", l)
+		}
+		m[binary.BigEndian.Uint16(b)] = b[4:l]
+		b = b[l:]
+	}
+	return m
+}
+
+func TestExportUDPFlow(t *testing.T) {
+	var w messages
+	e := NewExporter(&w, 7)
+	start := time.UnixMilli(1700000000000)
+	flow := tun2socks.FlowRecord{
+		Proto:      "udp",
+		SrcIP:      net.IP{10, 0, 0, 2},
+		SrcPort:    5000,
+		DstIP:      net.IP{192, 0, 2, 1},
+		DstPort:    53,
+		PacketsOut: 1,
+		BytesOut:   40,
+		PacketsIn:  2,
+		BytesIn:    300,
+		Start:      start,
+		End:        start.Add(1500 * time.Millisecond),
+	}
+	for i := 0; i < 2; i++ {
+		if err := e.ExportFlow(flow); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(w) != 2 {
+		t.Fatalf("%d messages, want one per flow", len(w))
+	}
+
+	first := sets(t, w[0], 0)
+	template := first[templateSetID]
+	if len(template) < 4 || binary.BigEndian.Uint16(template) != templateIPv4 || binary.BigEndian.Uint16(template[2:]) != 9 {
+		t.Fatalf("template set % x, want the IPv4 template of 9 fields first", template)
+	}
+	data := first[templateIPv4]
+	const recordLen = 4 + 4 + 2 + 2 + 1 + 8*4
+	if len(data) != 2*recordLen {
+		t.Fatalf("data set of %d bytes, want a record each way", len(data))
+	}
+	for i, want := range []struct {
+		src, dst        net.IP
+		sport, dport    uint16
+		packets, octets uint64
+	}{
+		{flow.SrcIP, flow.DstIP, 5000, 53, 1, 40},
+		{flow.DstIP, flow.SrcIP, 53, 5000, 2, 300},
+	} {
+		r := data[i*recordLen:]
+		if !bytes.Equal(r[0:4], want.src) || !bytes.Equal(r[4:8], want.dst) ||
+			binary.BigEndian.Uint16(r[8:]) != want.sport || binary.BigEndian.Uint16(r[10:]) != want.dport {
+			t.Errorf("record %d: % x", i, r[:12])
+		}
+		if r[12] != 17 || binary.BigEndian.Uint64(r[13:]) != want.packets || binary.BigEndian.Uint64(r[21:]) != want.octets {
+			t.Errorf("record %d: protocol %d, %d packets, %d octets", i, r[12], binary.BigEndian.Uint64(r[13:]), binary.BigEndian.Uint64(r[21:]))
+		}
+		if binary.BigEndian.Uint64(r[29:]) != uint64(start.UnixMilli()) || binary.BigEndian.Uint64(r[37:]) != uint64(flow.End.UnixMilli()) {
+			t.Errorf("record %d: flow times", i)
+		}
+	}
+
+	// templates aren't due again yet, the sequence counts records sent
+	second := sets(t, w[1], 2)
+	if _, ok := second[templateSetID]; ok || len(second[templateIPv4]) != 2*recordLen {
+		t.Fatalf("second message sets %v", second)
+	}
+}
+
+func TestExportSkipsEmptyDirections(t *testing.T) {
+	var w messages
+	e := NewExporter(&w, 7)
+	if err := e.ExportFlow(tun2socks.FlowRecord{Proto: "tcp", SrcIP: net.ParseIP("fd00::2"), DstIP: net.ParseIP("2001:db8::1")}); err != nil || len(w) != 0 {
+		t.Fatalf("exported %d messages of a flow carrying nothing, %v", len(w), err)
+	}
+	flow := tun2socks.FlowRecord{Proto: "tcp", SrcIP: net.ParseIP("fd00::2"), DstIP: net.ParseIP("2001:db8::1"), PacketsOut: 1, BytesOut: 10}
+	if err := e.ExportFlow(flow); err != nil {
+		t.Fatal(err)
+	}
+	data := sets(t, w[0], 0)[templateIPv6]
+	if len(data) != 16+16+2+2+1+8*4 || data[36] != 6 {
+		t.Fatalf("IPv6 data set % x, want a single TCP record", data)
+	}
+}
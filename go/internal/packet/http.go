@@ -19,6 +19,9 @@ func GetHostnamePlainHttp(data []byte) (string, error) {
 		return "", fmt.Errorf("Host not found")
 	}
 	end = findStringInData(data, "\r\n", start+len(hostString))
+	if end < 0 {
+		return "", fmt.Errorf("Host header not terminated")
+	}
 
 	return strings.TrimSpace(string(data[start+len(hostString) : end])), nil
 }
@@ -35,19 +38,19 @@ func (tcp *TCP) PatchHostForPlainHttp(proxyAuthHeader string) []byte {
 	var word string
 	var wordIndex int
 
-	if wordIndex := findStringInData(tcp.Payload, "GET ", 0); wordIndex >= 0 {
+	if wordIndex = findStringInData(tcp.Payload, "GET ", 0); wordIndex >= 0 {
 		word = "GET "
-	} else if wordIndex := findStringInData(tcp.Payload, "POST ", 0); wordIndex >= 0 {
+	} else if wordIndex = findStringInData(tcp.Payload, "POST ", 0); wordIndex >= 0 {
 		word = "POST "
-	} else if wordIndex := findStringInData(tcp.Payload, "PUT ", 0); wordIndex >= 0 {
+	} else if wordIndex = findStringInData(tcp.Payload, "PUT ", 0); wordIndex >= 0 {
 		word = "PUT "
-	} else if wordIndex := findStringInData(tcp.Payload, "DELETE ", 0); wordIndex >= 0 {
+	} else if wordIndex = findStringInData(tcp.Payload, "DELETE ", 0); wordIndex >= 0 {
 		word = "DELETE "
-	} else if wordIndex := findStringInData(tcp.Payload, "HEAD ", 0); wordIndex >= 0 {
+	} else if wordIndex = findStringInData(tcp.Payload, "HEAD ", 0); wordIndex >= 0 {
 		word = "HEAD "
-	} else if wordIndex := findStringInData(tcp.Payload, "OPTIONS ", 0); wordIndex >= 0 {
+	} else if wordIndex = findStringInData(tcp.Payload, "OPTIONS ", 0); wordIndex >= 0 {
 		word = "OPTIONS "
-	} else if wordIndex := findStringInData(tcp.Payload, "PATCH ", 0); wordIndex >= 0 {
+	} else if wordIndex = findStringInData(tcp.Payload, "PATCH ", 0); wordIndex >= 0 {
 		word = "PATCH "
 	}
 
@@ -57,6 +60,9 @@ func (tcp *TCP) PatchHostForPlainHttp(proxyAuthHeader string) []byte {
 
 	var wordLen = len(word)
 	var index1 = wordIndex + wordLen
+	if index1+5 > len(tcp.Payload) {
+		return tcp.Payload
+	}
 	if tcp.Payload[index1] == 'h' &&
 		tcp.Payload[index1+1] == 't' &&
 		tcp.Payload[index1+2] == 't' &&
@@ -75,7 +81,11 @@ func (tcp *TCP) PatchHostForPlainHttp(proxyAuthHeader string) []byte {
 	newPayloadLength := len(tcp.Payload) + httpHostLen + authHeaderLength
 	newPayLoad := make([]byte, newPayloadLength, newPayloadLength)
 
-	headerEndIndex := findStringInData(tcp.Payload, "\r\n", index1) + 2
+	headerEndIndex := findStringInData(tcp.Payload, "\r\n", index1)
+	if headerEndIndex < 0 {
+		return tcp.Payload
+	}
+	headerEndIndex += 2
 
 	//host
 	copy(newPayLoad[:index1], tcp.Payload[:index1])
@@ -92,7 +102,7 @@ func findStringInData(data []byte, stringToFind string, startIndex int) int {
 	stringLen := len(stringToFind)
 	dataLen := len(data)
 
-	for i := startIndex; i < dataLen-stringLen; i++ {
+	for i := startIndex; i <= dataLen-stringLen; i++ {
 		found := true
 		for j := 0; j < stringLen; j++ {
 			if data[i+j] != stringToFind[j] {
@@ -0,0 +1,53 @@
+package packet
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	ICMPv4TypeDestinationUnreachable uint8 = 3
+	ICMPv4TypeTimeExceeded           uint8 = 11
+
+	ICMPv4CodeNetUnreachable       uint8 = 0
+	ICMPv4CodeHostUnreachable      uint8 = 1
+	ICMPv4CodePortUnreachable      uint8 = 3
+	ICMPv4CodeFragmentationNeeded  uint8 = 4
+	ICMPv4CodeAdminProhibited      uint8 = 13
+	ICMPv4CodeTTLExceededInTransit uint8 = 0
+)
+
+type ICMPv4 struct {
+	Type     uint8
+	Code     uint8
+	Checksum uint16
+	Rest     uint32
+	Payload  []byte
+}
+
+func ParseICMPv4(pkt []byte, icmp *ICMPv4) error {
+	if len(pkt) < 8 {
+		return fmt.Errorf("payload too small for ICMP: %d bytes", len(pkt))
+	}
+
+	icmp.Type = pkt[0]
+	icmp.Code = pkt[1]
+	icmp.Checksum = binary.BigEndian.Uint16(pkt[2:4])
+	icmp.Rest = binary.BigEndian.Uint32(pkt[4:8])
+	icmp.Payload = pkt[8:]
+	return nil
+}
+
+func (icmp *ICMPv4) Serialize(hdr []byte, payload []byte) error {
+	if len(hdr) != 8 {
+		return fmt.Errorf("incorrect buffer size: %d buffer given, 8 needed", len(hdr))
+	}
+	hdr[0] = icmp.Type
+	hdr[1] = icmp.Code
+	hdr[2] = 0
+	hdr[3] = 0
+	binary.BigEndian.PutUint32(hdr[4:], icmp.Rest)
+	icmp.Checksum = Checksum(hdr, payload)
+	binary.BigEndian.PutUint16(hdr[2:], icmp.Checksum)
+	return nil
+}
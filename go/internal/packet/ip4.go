@@ -97,6 +97,9 @@ func IPID() uint16 {
 }
 
 func ParseIPv4(pkt []byte, ip4 *IPv4) error {
+	if len(pkt) < 20 {
+		return fmt.Errorf("packet too small for IPv4: %d bytes", len(pkt))
+	}
 	flagsfrags := binary.BigEndian.Uint16(pkt[6:8])
 
 	ip4.Version = uint8(pkt[0]) >> 4
@@ -127,6 +130,7 @@ func ParseIPv4(pkt []byte, ip4 *IPv4) error {
 	ip4.Payload = pkt[ip4.IHL*4:]
 	rest := pkt[20 : ip4.IHL*4]
 	// Pull out IP options
+options:
 	for len(rest) > 0 {
 		if ip4.Options == nil {
 			// Pre-allocate to avoid growing the slice too much.
@@ -138,18 +142,20 @@ func ParseIPv4(pkt []byte, ip4 *IPv4) error {
 			opt.OptionLength = 1
 			ip4.Options = append(ip4.Options, opt)
 			ip4.Padding = rest[1:]
-			break
+			break options
 		case 1: // 1 byte padding
 			opt.OptionLength = 1
 		default:
+			if len(rest) < 2 {
+				return fmt.Errorf("IP option type %v truncated", opt.OptionType)
+			}
 			opt.OptionLength = rest[1]
+			if opt.OptionLength < 2 || len(rest) < int(opt.OptionLength) {
+				return fmt.Errorf("Invalid IP option length, option type %v length %v", opt.OptionType, opt.OptionLength)
+			}
 			opt.OptionData = rest[2:opt.OptionLength]
 		}
-		if len(rest) >= int(opt.OptionLength) {
-			rest = rest[opt.OptionLength:]
-		} else {
-			return fmt.Errorf("IP option length exceeds remaining IP header size, option type %v length %v", opt.OptionType, opt.OptionLength)
-		}
+		rest = rest[opt.OptionLength:]
 		ip4.Options = append(ip4.Options, opt)
 	}
 	return nil
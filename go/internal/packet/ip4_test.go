@@ -0,0 +1,52 @@
+package packet
+
+import (
+	"bytes"
+	"testing"
+)
+
+func FuzzParseIPv4(f *testing.F) {
+	f.Add([]byte{
+		0x45, 0, 0, 28, 0, 1, 0x40, 0, 64, 17, 0, 0,
+		10, 0, 0, 2, 8, 8, 8, 8,
+		0x0f, 0xa0, 0, 53, 0, 8, 0, 0,
+	})
+	f.Fuzz(func(t *testing.T, pkt []byte) {
+		var ip IPv4
+		if ParseIPv4(pkt, &ip) != nil {
+			return
+		}
+		hl := int(ip.IHL) * 4
+		if len(ip.Payload) != len(pkt)-hl {
+			t.Fatalf("payload of %d bytes after a %d byte header in %d bytes", len(ip.Payload), hl, len(pkt))
+		}
+		// options shorter than the header leave padding, which isn't
+		// serialized back
+		if ip.HeaderLength() != hl {
+			return
+		}
+		hdr := make([]byte, hl)
+		if e := ip.Serialize(hdr, int(ip.Length)-hl); e != nil {
+			t.Fatal(e)
+		}
+		var again IPv4
+		if e := ParseIPv4(append(hdr, ip.Payload...), &again); e != nil {
+			t.Fatalf("serialized header doesn't parse: %s", e)
+		}
+		if again.Version != ip.Version || again.TOS != ip.TOS || again.Length != ip.Length ||
+			again.Id != ip.Id || again.Flags != ip.Flags || again.FragOffset != ip.FragOffset ||
+			again.TTL != ip.TTL || again.Protocol != ip.Protocol ||
+			!again.SrcIP.Equal(ip.SrcIP) || !again.DstIP.Equal(ip.DstIP) || len(again.Options) != len(ip.Options) {
+			t.Fatalf("header %+v serialized and parsed as %+v", ip, again)
+		}
+		for i, opt := range ip.Options {
+			o := again.Options[i]
+			if o.OptionType != opt.OptionType || o.OptionLength != opt.OptionLength || !bytes.Equal(o.OptionData, opt.OptionData) {
+				t.Fatalf("option %d %+v serialized and parsed as %+v", i, opt, o)
+			}
+		}
+		if Checksum(hdr) != 0 {
+			t.Fatal("serialized header checksum doesn't verify")
+		}
+	})
+}
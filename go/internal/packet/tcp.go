@@ -126,6 +126,9 @@ func ParseTCP(pkt []byte, tcp *TCP) error {
 		case 1: // 1 byte padding
 			opt.OptionLength = 1
 		default:
+			if len(rest) < 2 {
+				return fmt.Errorf("TCP option type %v truncated", opt.OptionType)
+			}
 			opt.OptionLength = rest[1]
 			if opt.OptionLength < 2 {
 				return fmt.Errorf("Invalid TCP option length %d < 2", opt.OptionLength)
@@ -44,8 +44,15 @@ func ParseUDP(pkt []byte, udp *UDP) error {
 	udp.DstPort = binary.BigEndian.Uint16(pkt[2:4])
 	udp.Length = binary.BigEndian.Uint16(pkt[4:6])
 	udp.Checksum = binary.BigEndian.Uint16(pkt[6:8])
-	if len(pkt) > 8 {
-		udp.Payload = pkt[8:]
+	if udp.Length < 8 {
+		return fmt.Errorf("Invalid (too small) UDP length (%d < 8)", udp.Length)
+	}
+	if int(udp.Length) > len(pkt) {
+		return fmt.Errorf("UDP length exceeds captured bytes (%d > %d)", udp.Length, len(pkt))
+	}
+	if udp.Length > 8 {
+		// anything past the claimed length is padding
+		udp.Payload = pkt[8:udp.Length]
 	} else {
 		udp.Payload = nil
 	}
@@ -53,6 +60,9 @@ func ParseUDP(pkt []byte, udp *UDP) error {
 	return nil
 }
 
+// Serialize writes the UDP header to hdr, with the checksum over ckFields,
+// the pseudo header, header and payload. Without ckFields the checksum is 0,
+// which over IPv4 means none.
 func (udp *UDP) Serialize(hdr []byte, ckFields ...[]byte) error {
 	if len(hdr) != 8 {
 		return fmt.Errorf("incorrect buffer size: %d buffer given, 8 needed", len(hdr))
@@ -63,6 +73,10 @@ func (udp *UDP) Serialize(hdr []byte, ckFields ...[]byte) error {
 	binary.BigEndian.PutUint16(hdr[4:], udp.Length)
 	hdr[6] = 0
 	hdr[7] = 0
+	if len(ckFields) == 0 {
+		udp.Checksum = 0
+		return nil
+	}
 	udp.Checksum = Checksum(ckFields...)
 	binary.BigEndian.PutUint16(hdr[6:], udp.Checksum)
 	return nil
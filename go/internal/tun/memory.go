@@ -0,0 +1,76 @@
+package tun
+
+import (
+	"io"
+	"sync"
+)
+
+// MemoryTun is an in-memory tun device, for exercising a tunnel in tests
+// without /dev/net/tun or root. Each injected packet is read as one, and
+// each packet written is emitted as one.
+type MemoryTun struct {
+	in     chan []byte
+	out    chan []byte
+	closed chan struct{}
+	once   sync.Once
+}
+
+// NewMemoryTun returns a MemoryTun buffering up to 1000 packets each way.
+func NewMemoryTun() *MemoryTun {
+	return &MemoryTun{
+		in:     make(chan []byte, 1000),
+		out:    make(chan []byte, 1000),
+		closed: make(chan struct{}),
+	}
+}
+
+// Inject queues a raw IP packet to be read from the device, as if an app had
+// sent it. pkt is not copied. It fails once the device is closed.
+func (m *MemoryTun) Inject(pkt []byte) error {
+	select {
+	case <-m.closed:
+		return io.ErrClosedPipe
+	default:
+	}
+	select {
+	case m.in <- pkt:
+		return nil
+	case <-m.closed:
+		return io.ErrClosedPipe
+	}
+}
+
+// Emitted returns the packets written to the device. It must be drained, as
+// writes block once it is full.
+func (m *MemoryTun) Emitted() <-chan []byte {
+	return m.out
+}
+
+func (m *MemoryTun) Read(b []byte) (int, error) {
+	select {
+	case pkt := <-m.in:
+		return copy(b, pkt), nil
+	case <-m.closed:
+		return 0, io.EOF
+	}
+}
+
+func (m *MemoryTun) Write(b []byte) (int, error) {
+	select {
+	case <-m.closed:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+	pkt := append([]byte(nil), b...)
+	select {
+	case m.out <- pkt:
+		return len(b), nil
+	case <-m.closed:
+		return 0, io.ErrClosedPipe
+	}
+}
+
+func (m *MemoryTun) Close() error {
+	m.once.Do(func() { close(m.closed) })
+	return nil
+}
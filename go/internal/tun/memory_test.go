@@ -0,0 +1,69 @@
+package tun
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestMemoryTunRoundTrip(t *testing.T) {
+	m := NewMemoryTun()
+	defer m.Close()
+
+	// injected packets are read one at a time, in order
+	for _, pkt := range [][]byte{[]byte("first"), []byte("second")} {
+		if e := m.Inject(pkt); e != nil {
+			t.Fatal(e)
+		}
+	}
+	b := make([]byte, 1500)
+	for _, want := range []string{"first", "second"} {
+		n, e := m.Read(b)
+		if e != nil || string(b[:n]) != want {
+			t.Fatalf("read %q, %v, want %q", b[:n], e, want)
+		}
+	}
+
+	// written packets are emitted as copies
+	out := []byte("reply")
+	if n, e := m.Write(out); n != len(out) || e != nil {
+		t.Fatalf("wrote %d, %v", n, e)
+	}
+	copy(out, "XXXXX")
+	select {
+	case pkt := <-m.Emitted():
+		if !bytes.Equal(pkt, []byte("reply")) {
+			t.Fatalf("emitted %q, want the packet as written", pkt)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("nothing emitted")
+	}
+}
+
+func TestMemoryTunClose(t *testing.T) {
+	m := NewMemoryTun()
+	read := make(chan error, 1)
+	go func() {
+		_, e := m.Read(make([]byte, 1500))
+		read <- e
+	}()
+	m.Close()
+	select {
+	case e := <-read:
+		if e != io.EOF {
+			t.Fatalf("pending read returned %v, want EOF", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("pending read not unblocked by Close")
+	}
+	if e := m.Inject([]byte("late")); e == nil {
+		t.Fatal("injected into a closed device")
+	}
+	if _, e := m.Write([]byte("late")); e == nil {
+		t.Fatal("wrote to a closed device")
+	}
+	if e := m.Close(); e != nil {
+		t.Fatalf("second close: %v", e)
+	}
+}
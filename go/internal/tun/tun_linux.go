@@ -1,6 +1,7 @@
 package tun
 
 import (
+	"fmt"
 	"io"
 	"log"
 	"net"
@@ -16,6 +17,15 @@ const (
 	IFF_NO_PI = 0x1000
 )
 
+const (
+	// LayerIP devices read and write raw IP packets, as Tun2Socks expects.
+	LayerIP = iota
+	// LayerEthernet devices read and write Ethernet frames. Tun2Socks only
+	// handles IP packets, so the caller has to put its own frame handler
+	// (ARP, framing) in front of it.
+	LayerEthernet
+)
+
 type ifReq struct {
 	Name  [0x10]byte
 	Flags uint16
@@ -23,16 +33,36 @@ type ifReq struct {
 }
 
 func OpenTunDevice(name, addr, gw, mask string, dns []string) (io.ReadWriteCloser, error) {
+	return OpenDevice(LayerIP, name, addr, gw, mask, dns)
+}
+
+func OpenTapDevice(name, addr, gw, mask string, dns []string) (io.ReadWriteCloser, error) {
+	return OpenDevice(LayerEthernet, name, addr, gw, mask, dns)
+}
+
+// OpenDevice opens a tun (LayerIP) or tap (LayerEthernet) device.
+func OpenDevice(layer int, name, addr, gw, mask string, dns []string) (io.ReadWriteCloser, error) {
+	var flags uint16
+	switch layer {
+	case LayerIP:
+		flags = IFF_TUN | IFF_NO_PI
+	case LayerEthernet:
+		flags = IFF_TAP | IFF_NO_PI
+	default:
+		return nil, fmt.Errorf("unknown device layer %d", layer)
+	}
+
 	file, err := os.OpenFile("/dev/net/tun", os.O_RDWR, 0)
 	if err != nil {
 		return nil, err
 	}
 	var req ifReq
 	copy(req.Name[:], name)
-	req.Flags = IFF_TUN | IFF_NO_PI
+	req.Flags = flags
 	log.Printf("openning tun device")
 	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), uintptr(syscall.TUNSETIFF), uintptr(unsafe.Pointer(&req)))
 	if errno != 0 {
+		file.Close()
 		err = errno
 		return nil, err
 	}
@@ -51,6 +81,7 @@ func OpenTunDevice(name, addr, gw, mask string, dns []string) (io.ReadWriteClose
 		f:      file,
 		addr:   addr,
 		addrIP: net.ParseIP(addr).To4(),
+		mask:   parseMask(mask),
 		gw:     gw,
 		gwIP:   net.ParseIP(gw).To4(),
 	}, nil
@@ -67,16 +98,64 @@ func NewTunDev(fd uintptr, name string, addr string, gw string) io.ReadWriteClos
 	}
 }
 
+// NewAndroidTun wraps the tun fd handed over by Android's VpnService. The fd
+// is duplicated, so the device stays usable after the ParcelFileDescriptor is
+// garbage collected or closed, and Close only closes the duplicate. mask and
+// dns describe the configuration made through VpnService.Builder, the device
+// itself is not reconfigured.
+func NewAndroidTun(fd int, addr, gw, mask string, dns []string) (io.ReadWriteCloser, error) {
+	dup, err := syscall.Dup(fd)
+	if err != nil {
+		return nil, err
+	}
+	syscall.CloseOnExec(dup)
+	err = syscall.SetNonblock(dup, true)
+	if err != nil {
+		syscall.Close(dup)
+		return nil, err
+	}
+	return &tunDev{
+		f:      os.NewFile(uintptr(dup), "tun"),
+		addr:   addr,
+		addrIP: net.ParseIP(addr).To4(),
+		mask:   parseMask(mask),
+		gw:     gw,
+		gwIP:   net.ParseIP(gw).To4(),
+	}, nil
+}
+
 type tunDev struct {
 	name   string
 	addr   string
 	addrIP net.IP
+	mask   net.IPMask
 	gw     string
 	gwIP   net.IP
 	marker []byte
 	f      *os.File
 }
 
+func parseMask(mask string) net.IPMask {
+	ip := net.ParseIP(mask).To4()
+	if ip == nil {
+		return nil
+	}
+	return net.IPMask(ip)
+}
+
+// Subnet returns the network of the device address. Without a known mask it
+// covers the device address only.
+func (dev *tunDev) Subnet() *net.IPNet {
+	if dev.addrIP == nil {
+		return nil
+	}
+	mask := dev.mask
+	if mask == nil {
+		mask = net.CIDRMask(32, 32)
+	}
+	return &net.IPNet{IP: dev.addrIP.Mask(mask), Mask: mask}
+}
+
 func (dev *tunDev) Read(data []byte) (int, error) {
 	n, e := dev.f.Read(data)
 
@@ -0,0 +1,85 @@
+package tun
+
+import (
+	"io/ioutil"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestOpenDeviceUnknownLayer(t *testing.T) {
+	if dev, err := OpenDevice(LayerEthernet+1, "t2stest0", "10.0.0.1", "10.0.0.2", "255.255.255.0", nil); err == nil {
+		dev.Close()
+		t.Fatal("opened a device of an unknown layer")
+	}
+}
+
+func TestOpenTapDevice(t *testing.T) {
+	for _, c := range []struct {
+		layer int
+		// ARPHRD_* link type the kernel reports for the device
+		linkType string
+	}{
+		{LayerIP, "65534"},
+		{LayerEthernet, "1"},
+	} {
+		name := "t2stest0"
+		dev, err := OpenDevice(c.layer, name, "10.254.254.1", "10.254.254.2", "255.255.255.0", nil)
+		if err != nil {
+			t.Skipf("cannot open a device here: %s", err)
+		}
+		b, err := ioutil.ReadFile("/sys/class/net/" + name + "/type")
+		dev.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.TrimSpace(string(b)); got != c.linkType {
+			t.Errorf("layer %d: link type %s, want %s", c.layer, got, c.linkType)
+		}
+	}
+}
+
+func TestNewAndroidTunDupsFd(t *testing.T) {
+	fds, e := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_DGRAM, 0)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer syscall.Close(fds[1])
+	dev, e := NewAndroidTun(fds[0], "10.0.0.2", "10.0.0.1", "255.255.255.0", nil)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	// the device outlives the fd handed over, as when the
+	// ParcelFileDescriptor is closed
+	syscall.Close(fds[0])
+	if _, e := dev.Write([]byte("packet")); e != nil {
+		t.Fatalf("write after the original fd closed: %s", e)
+	}
+	buf := make([]byte, 16)
+	n, e := syscall.Read(fds[1], buf)
+	if e != nil || string(buf[:n]) != "packet" {
+		t.Fatalf("read %q, %v from the peer", buf[:n], e)
+	}
+
+	// Close interrupts a pending read
+	done := make(chan error, 1)
+	go func() {
+		_, e := dev.Read(buf)
+		done <- e
+	}()
+	time.Sleep(50 * time.Millisecond)
+	dev.Close()
+	select {
+	case e := <-done:
+		if e == nil {
+			t.Fatal("read of an idle device succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("read not interrupted by Close")
+	}
+	if _, e := syscall.Write(fds[1], []byte("x")); e == nil {
+		t.Fatal("device still open after Close")
+	}
+}
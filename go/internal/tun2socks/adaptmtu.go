@@ -0,0 +1,170 @@
+package tun2socks
+
+import (
+	"hash/fnv"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// how long a lowered MTU holds for a destination
+	ADAPTIVE_MTU_TTL = 10 * time.Minute
+
+	// smallest datagram every IPv4 host must reassemble
+	minReassemblyMTU = 576
+	// destinations whose fragmented responses are tracked at most
+	adaptiveMTUMaxDests = 1024
+)
+
+type adaptiveMTU struct {
+	ceiling  int
+	floor    int
+	failures int
+
+	mutex sync.Mutex
+	dests map[string]*destMTU
+}
+
+// destMTU tracks how the fragmented responses from a destination fare.
+type destMTU struct {
+	// lowered MTU, 0 for MTU
+	mtu     int
+	lowered time.Time
+	// fragmented responses lost in a row
+	losses int
+	// set after a fragmented response until the client sends again, sum of
+	// the datagram it answered
+	awaiting bool
+	awaitSum uint64
+}
+
+// SetAdaptiveMTU lowers the MTU of UDP responses from a destination whose
+// fragmented responses the client seems to lose, for client stacks with
+// broken reassembly or a smaller tun MTU. A response counts as lost when the
+// client sends the datagram it answered again; after failures losses in a
+// row the MTU of the destination is lowered to ceiling, then halved on
+// further losses down to floor, which is at least 576. Lowered MTUs are kept
+// for ADAPTIVE_MTU_TTL. A ceiling of 0 disables it, the default.
+func (t2s *Tun2Socks) SetAdaptiveMTU(ceiling, floor, failures int) {
+	if ceiling <= 0 {
+		t2s.adaptMTU = nil
+		return
+	}
+	if floor < minReassemblyMTU {
+		floor = minReassemblyMTU
+	}
+	if ceiling > MTU {
+		ceiling = MTU
+	}
+	if ceiling < floor {
+		ceiling = floor
+	}
+	if failures < 1 {
+		failures = 1
+	}
+	t2s.adaptMTU = &adaptiveMTU{
+		ceiling:  ceiling,
+		floor:    floor,
+		failures: failures,
+		dests:    make(map[string]*destMTU),
+	}
+}
+
+// pathMTU returns the MTU of UDP responses from remote.
+func (t2s *Tun2Socks) pathMTU(remote net.IP) int {
+	a := t2s.adaptMTU
+	if a == nil {
+		return MTU
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	d := a.dests[string(remote.To16())]
+	if d == nil || d.mtu == 0 {
+		return MTU
+	}
+	if time.Since(d.lowered) > ADAPTIVE_MTU_TTL {
+		d.mtu = 0
+		d.losses = 0
+		return MTU
+	}
+	return d.mtu
+}
+
+// fragSent notes a fragmented response from remote to the datagram summed
+// as sum.
+func (t2s *Tun2Socks) fragSent(remote net.IP, sum uint64) {
+	a := t2s.adaptMTU
+	if a == nil {
+		return
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	key := string(remote.To16())
+	d := a.dests[key]
+	if d == nil {
+		if len(a.dests) >= adaptiveMTUMaxDests {
+			a.prune()
+			if len(a.dests) >= adaptiveMTUMaxDests {
+				return
+			}
+		}
+		d = &destMTU{}
+		a.dests[key] = d
+	}
+	d.awaiting = true
+	d.awaitSum = sum
+}
+
+// prune forgets destinations neither lowered nor awaiting an outcome.
+// a.mutex must be held.
+func (a *adaptiveMTU) prune() {
+	for key, d := range a.dests {
+		if !d.awaiting && (d.mtu == 0 || time.Since(d.lowered) > ADAPTIVE_MTU_TTL) {
+			delete(a.dests, key)
+		}
+	}
+}
+
+// fragProgress judges the last fragmented response from remote by the next
+// datagram the client sends it, and returns the sum of that datagram.
+func (t2s *Tun2Socks) fragProgress(remote net.IP, payload []byte) uint64 {
+	a := t2s.adaptMTU
+	if a == nil {
+		return 0
+	}
+	h := fnv.New64a()
+	h.Write(payload)
+	sum := h.Sum64()
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	d := a.dests[string(remote.To16())]
+	if d == nil || !d.awaiting {
+		return sum
+	}
+	d.awaiting = false
+	if sum != d.awaitSum {
+		d.losses = 0
+		return sum
+	}
+	d.losses++
+	if d.losses < a.failures {
+		return sum
+	}
+	d.losses = 0
+	next := a.ceiling
+	if d.mtu != 0 && d.mtu <= a.ceiling {
+		next = d.mtu / 2
+	}
+	if next < a.floor {
+		next = a.floor
+	}
+	if next != d.mtu {
+		log.Printf("lower MTU of UDP responses from %s to %d after lost fragments", remote, next)
+	}
+	d.mtu = next
+	d.lowered = time.Now()
+	return sum
+}
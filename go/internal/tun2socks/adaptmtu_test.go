@@ -0,0 +1,92 @@
+package tun2socks
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dkwiebe/gotun2socks/internal/gosocks"
+	"github.com/dkwiebe/gotun2socks/internal/packet"
+	"github.com/dkwiebe/gotun2socks/internal/tun"
+	"github.com/miekg/dns"
+)
+
+// nextDatagram returns the sizes of the fragments of the next datagram
+// emitted to p.
+func nextDatagram(tb testing.TB, p *tun.MemoryTun) []int {
+	tb.Helper()
+	var sizes []int
+	for {
+		raw := nextPacket(tb, p)
+		var ip packet.IPv4
+		if e := packet.ParseIPv4(raw, &ip); e != nil {
+			tb.Fatal(e)
+		}
+		sizes = append(sizes, len(raw))
+		if ip.Flags&0x1 == 0 {
+			return sizes
+		}
+	}
+}
+
+func TestAdaptiveMTULowersOnLostFragments(t *testing.T) {
+	s := newStubSocks(t, func(req *gosocks.UDPRequest) []byte {
+		return make([]byte, 20000)
+	})
+	t2s, p := NewTun2SocksWithPipe()
+	s.route(t2s)
+	t2s.SetAdaptiveMTU(1000, 600, 2)
+	t2s.SetMaxFragments(2)
+	serve(t, t2s)
+
+	// the client asks again for a response it didn't reassemble
+	dst := net.IP{192, 0, 2, 1}
+	for i := 0; i < 2; i++ {
+		p.Inject(udpIPv4(clientIP, 5000, dst, 9, []byte("get")))
+		if sizes := nextDatagram(t, p); len(sizes) != 2 || sizes[0] <= 1000 {
+			t.Fatalf("try %d: fragments of %v, want 2 at the tun MTU", i, sizes)
+		}
+	}
+	p.Inject(udpIPv4(clientIP, 5000, dst, 9, []byte("get")))
+	noPacket(t, p, 50*time.Millisecond)
+	if mtu := t2s.pathMTU(dst); mtu != 1000 {
+		t.Fatalf("MTU %d after 2 losses, want 1000", mtu)
+	}
+	// a score of fragments at the lowered MTU is over the cap, counted once
+	if n := t2s.Stats().UDPFragmentCapped; n != 1 {
+		t.Fatalf("%d responses capped, want 1", n)
+	}
+
+	// other destinations keep the MTU
+	p.Inject(udpIPv4(clientIP, 5001, net.IP{192, 0, 2, 2}, 9, []byte("get")))
+	if sizes := nextDatagram(t, p); len(sizes) != 2 || sizes[0] <= 1000 {
+		t.Fatalf("fragments of %v, want 2 at the tun MTU", sizes)
+	}
+}
+
+func TestFragmentCapAtPathMTUTruncatesDNS(t *testing.T) {
+	s := newStubSocks(t, stubResolver(func(q *dns.Msg) *dns.Msg {
+		resp := answerA(q)
+		// some 1.6KB, a single packet at MTU but three fragments at 600
+		for i := 0; i < 100; i++ {
+			resp.Answer = append(resp.Answer, resp.Answer[0])
+		}
+		return resp
+	}))
+	t2s, p := NewTun2SocksWithPipe()
+	s.route(t2s)
+	t2s.SetAdaptiveMTU(1000, 600, 1)
+	t2s.SetMaxFragments(2)
+	t2s.adaptMTU.dests[string(resolverIP.To16())] = &destMTU{mtu: 600, lowered: time.Now()}
+	serve(t, t2s)
+
+	p.Inject(udpIPv4(clientIP, 4000, resolverIP, 53, packQuery(t, 7, "big.example.", dns.TypeA)))
+	_, udp := nextUDP(t, p)
+	if resp := unpackDNS(t, udp); resp.Id != 7 || !resp.Truncated || len(resp.Answer) != 0 {
+		t.Fatalf("got %v, want an empty truncated response", resp)
+	}
+	if n := t2s.Stats().UDPFragmentCapped; n != 1 {
+		t.Fatalf("%d responses capped, want 1", n)
+	}
+	noPacket(t, p, 50*time.Millisecond)
+}
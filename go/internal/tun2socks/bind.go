@@ -0,0 +1,195 @@
+package tun2socks
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/dkwiebe/gotun2socks/internal/gosocks"
+)
+
+// InboundBind is an inbound connection accepted by the SOCKS proxy with the
+// BIND command, for apps that have a peer connect back to them, e.g. FTP in
+// active mode or P2P.
+type InboundBind struct {
+	// Addr is where the proxy accepts the connection, to be advertised to
+	// the peer, e.g. in an FTP PORT command.
+	Addr net.Addr
+	conn *gosocks.SocksConn
+}
+
+// Accept waits for the peer to connect and returns its address. The
+// connection of the peer is then read and written through conn, which the
+// caller wires to the app.
+func (b *InboundBind) Accept() (conn net.Conn, peer net.Addr, e error) {
+	reply, e := gosocks.ClientBindAccept(b.conn)
+	if e != nil {
+		b.conn.Close()
+		return nil, nil, e
+	}
+	peer = gosocks.SocksAddrToNetAddr("tcp", reply.BndHost, reply.BndPort)
+	return b.conn, peer, nil
+}
+
+// Close gives up waiting for the peer.
+func (b *InboundBind) Close() error {
+	return b.conn.Close()
+}
+
+// FTP_CONTROL_PORT is the port of FTP control connections, whose PORT
+// commands are bound through the SOCKS proxy if SetSocksBind is on.
+const FTP_CONTROL_PORT = 21
+
+// SetSocksBind enables BindInbound, and with it FTP in active mode through a
+// SOCKS proxy: the address of a PORT command an app sends on a proxied FTP
+// control connection is replaced with a BIND address of the proxy, and the
+// data connection the server opens there is handed to the app as if the
+// server connected it directly. Off by default, as few proxies support BIND.
+func (t2s *Tun2Socks) SetSocksBind(enabled bool) {
+	t2s.socksBind = enabled
+}
+
+// BindInbound asks the SOCKS proxy of app uid to accept a connection from
+// peer:port, where the app expects a connection back from. peer may be
+// unspecified if not known in advance.
+func (t2s *Tun2Socks) BindInbound(uid int, peer net.IP, port uint16) (*InboundBind, error) {
+	if !t2s.socksBind {
+		return nil, fmt.Errorf("SOCKS BIND is disabled")
+	}
+	proxy := t2s.proxyFor(uid)
+	if proxy == nil || proxy.ProxyType != PROXY_TYPE_SOCKS {
+		return nil, fmt.Errorf("no SOCKS proxy for uid %d", uid)
+	}
+	conn, e := t2s.retryDial(func() (*gosocks.SocksConn, error) {
+		return t2s.dialProxy(proxy)
+	})
+	if e != nil {
+		return nil, e
+	}
+	t2s.relayBound("tcp", conn.LocalAddr())
+
+	hostType := byte(gosocks.SocksIPv4Host)
+	if peer.To4() == nil {
+		hostType = gosocks.SocksIPv6Host
+	}
+	reply, e := gosocks.ClientBind(conn, &gosocks.SocksRequest{
+		HostType: hostType,
+		DstHost:  peer.String(),
+		DstPort:  port,
+	})
+	if e != nil {
+		conn.Close()
+		return nil, e
+	}
+	addr := gosocks.SocksAddrToNetAddr("tcp", reply.BndHost, reply.BndPort)
+	log.Printf("SOCKS BIND for %s:%d accepting on %s", peer, port, addr)
+	return &InboundBind{Addr: addr, conn: conn}, nil
+}
+
+// ftpControl reports whether tt is a proxied FTP control connection whose
+// PORT commands are to be bound.
+func (tt *tcpConnTrack) ftpControl() bool {
+	return tt.t2s.socksBind && tt.remotePort == FTP_CONTROL_PORT && !tt.bound &&
+		tt.proxied() && tt.proxyType() == PROXY_TYPE_SOCKS
+}
+
+// bindFTPPort replaces the address of an FTP PORT command the app sent on
+// the control connection tt with a BIND address of the proxy, and has the
+// data connection of the server, once accepted, opened toward the address
+// the app listens on. It returns data unchanged if it is no PORT command or
+// the BIND fails.
+func (tt *tcpConnTrack) bindFTPPort(data []byte) []byte {
+	ip, port, ok := parseFTPPort(data)
+	if !ok {
+		return data
+	}
+	bind, e := tt.t2s.BindInbound(tt.uid, tt.remoteIP, 0)
+	if e != nil {
+		log.Printf("fail to bind FTP data connection of %s: %s", tt.id, e)
+		return data
+	}
+	addr, ok := bind.Addr.(*net.TCPAddr)
+	if !ok || addr.IP.To4() == nil {
+		log.Printf("cannot advertise BIND address %s in an FTP PORT command", bind.Addr)
+		bind.Close()
+		return data
+	}
+	go tt.t2s.acceptBound(tt, bind, ip, port)
+	return formatFTPPort(addr.IP.To4(), uint16(addr.Port))
+}
+
+// parseFTPPort parses an FTP PORT command, "PORT h1,h2,h3,h4,p1,p2",
+// returning the address it advertises.
+func parseFTPPort(data []byte) (ip net.IP, port uint16, ok bool) {
+	line := bytes.TrimRight(data, "\r\n")
+	if len(line) < 5 || !bytes.EqualFold(line[:5], []byte("PORT ")) {
+		return nil, 0, false
+	}
+	fields := bytes.Split(bytes.TrimSpace(line[5:]), []byte(","))
+	if len(fields) != 6 {
+		return nil, 0, false
+	}
+	var b [6]byte
+	for i, f := range fields {
+		n, e := strconv.ParseUint(string(f), 10, 8)
+		if e != nil {
+			return nil, 0, false
+		}
+		b[i] = byte(n)
+	}
+	return net.IPv4(b[0], b[1], b[2], b[3]).To4(), uint16(b[4])<<8 | uint16(b[5]), true
+}
+
+func formatFTPPort(ip net.IP, port uint16) []byte {
+	return []byte(fmt.Sprintf("PORT %d,%d,%d,%d,%d,%d\r\n", ip[0], ip[1], ip[2], ip[3], port>>8, port&0xff))
+}
+
+// acceptBound waits for the peer of bind, for as long as the control
+// connection ctl lasts, and opens its connection toward the app at ip:port.
+func (t2s *Tun2Socks) acceptBound(ctl *tcpConnTrack, bind *InboundBind, ip net.IP, port uint16) {
+	accepted := make(chan bool)
+	go func() {
+		select {
+		case <-accepted:
+			return
+		case <-ctl.quitBySelf:
+		case <-ctl.quitByOther:
+		}
+		bind.Close()
+	}()
+	_, peer, e := bind.Accept()
+	close(accepted)
+	if e != nil {
+		log.Printf("fail to accept FTP data connection of %s: %s", ctl.id, e)
+		return
+	}
+	addr, ok := peer.(*net.TCPAddr)
+	if !ok || addr.IP.To4() == nil {
+		log.Printf("cannot open a connection from %s toward the app", peer)
+		bind.Close()
+		return
+	}
+
+	id := ctl.dev.flowID(connID(ip, port, addr.IP.To4(), uint16(addr.Port)))
+	t2s.tcpConnTrackLock.Lock()
+	defer t2s.tcpConnTrackLock.Unlock()
+	if t2s.tcpConnTrackMap[id] != nil {
+		bind.Close()
+		return
+	}
+	track := t2s.newTCPConnTrack(ctl.dev, id, ip, port, addr.IP.To4(), uint16(addr.Port))
+	track.uid, track.proxyServer = ctl.uid, ctl.proxyServer
+	track.routed, track.viaProxy, track.bound = true, true, true
+	// no timeout
+	bind.conn.SetDeadline(time.Time{})
+	track.socksConn = bind.conn
+	track.nxtSeq = 1
+	track.syn()
+	track.changeState(SYN_SENT)
+	t2s.tcpConnTrackMap[id] = track
+
+	go track.run()
+}
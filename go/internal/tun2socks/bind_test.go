@@ -0,0 +1,103 @@
+package tun2socks
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dkwiebe/gotun2socks/internal/packet"
+	"github.com/dkwiebe/gotun2socks/internal/tun"
+)
+
+// nextTCPTo returns the next segment emitted to the app at port, skipping
+// those of other connections and bare ACKs.
+func nextTCPTo(tb testing.TB, p *tun.MemoryTun, port uint16) (*packet.IPv4, *packet.TCP) {
+	tb.Helper()
+	for {
+		ip, tcp := nextTCP(tb, p)
+		if tcp.DstPort == port && (tcp.SYN || tcp.FIN || tcp.RST || len(tcp.Payload) > 0) {
+			return ip, tcp
+		}
+	}
+}
+
+func TestFTPPortBoundThroughSocks(t *testing.T) {
+	s := newStubSocks(t, echoUDP)
+	t2s, p := NewTun2SocksWithPipe()
+	t2s.SetDefaultProxy(&ProxyServer{ProxyType: PROXY_TYPE_SOCKS, IpAddress: s.addr})
+	t2s.SetRoutingRules(RoutingRules{Rules: []RoutingRule{{Decision: ROUTE_PROXY}}})
+	t2s.SetSocksBind(true)
+	serve(t, t2s)
+
+	// control connection, echoed by the stub
+	server := net.IP{192, 0, 2, 21}
+	p.Inject(tcpIPv4(clientIP, 5000, server, FTP_CONTROL_PORT, packet.TCP{SYN: true, Seq: 100}))
+	_, synAck := nextTCPTo(t, p, 5000)
+	if !synAck.SYN || !synAck.ACK {
+		t.Fatalf("got %s, want SYN/ACK", tcpflagsString(synAck))
+	}
+	port := []byte("PORT 10,0,0,2,19,137\r\n")
+	p.Inject(tcpIPv4(clientIP, 5000, server, FTP_CONTROL_PORT, packet.TCP{ACK: true, Seq: 101, Ack: synAck.Seq + 1}))
+	p.Inject(tcpIPv4(clientIP, 5000, server, FTP_CONTROL_PORT, packet.TCP{ACK: true, Seq: 101, Ack: synAck.Seq + 1, Payload: port}))
+
+	_, echoed := nextTCPTo(t, p, 5000)
+	ip, bindPort, ok := parseFTPPort(echoed.Payload)
+	if !ok || !ip.Equal(net.IP{127, 0, 0, 1}) || bindPort == 0 {
+		t.Fatalf("proxy got %q, want a PORT command of the BIND address", echoed.Payload)
+	}
+
+	// the server connects its data connection to the BIND address
+	peer, e := net.Dial("tcp4", fmt.Sprintf("127.0.0.1:%d", bindPort))
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer peer.Close()
+	ip4, syn := nextTCPTo(t, p, 19<<8|137)
+	if !syn.SYN || syn.ACK || !ip4.SrcIP.Equal(net.IP{127, 0, 0, 1}) || syn.SrcPort != uint16(peer.LocalAddr().(*net.TCPAddr).Port) || !ip4.DstIP.Equal(clientIP) {
+		t.Fatalf("got %s from %s:%d, want a SYN from the server", tcpflagsString(syn), ip4.SrcIP, syn.SrcPort)
+	}
+	p.Inject(tcpIPv4(clientIP, syn.DstPort, ip4.SrcIP, syn.SrcPort, packet.TCP{SYN: true, ACK: true, Seq: 500, Ack: syn.Seq + 1}))
+	for {
+		_, ack := nextTCP(t, p)
+		if ack.DstPort != syn.DstPort {
+			continue
+		}
+		if !ack.ACK || ack.Ack != 501 || ack.SYN {
+			t.Fatalf("got %s ack %d, want the ACK of the handshake", tcpflagsString(ack), ack.Ack)
+		}
+		break
+	}
+
+	if _, e := peer.Write([]byte("listing")); e != nil {
+		t.Fatal(e)
+	}
+	if _, data := nextTCPTo(t, p, syn.DstPort); string(data.Payload) != "listing" {
+		t.Fatalf("app got %q from the server", data.Payload)
+	}
+	p.Inject(tcpIPv4(clientIP, syn.DstPort, ip4.SrcIP, syn.SrcPort, packet.TCP{ACK: true, Seq: 501, Ack: syn.Seq + 1 + 7, Payload: []byte("stor")}))
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4)
+	if _, e := io.ReadFull(peer, buf); e != nil || !bytes.Equal(buf, []byte("stor")) {
+		t.Fatalf("server got %q, %v from the app", buf, e)
+	}
+}
+
+func TestFTPPortUntouchedWithoutBind(t *testing.T) {
+	s := newStubSocks(t, echoUDP)
+	t2s, p := NewTun2SocksWithPipe()
+	t2s.SetDefaultProxy(&ProxyServer{ProxyType: PROXY_TYPE_SOCKS, IpAddress: s.addr})
+	t2s.SetRoutingRules(RoutingRules{Rules: []RoutingRule{{Decision: ROUTE_PROXY}}})
+	serve(t, t2s)
+
+	server := net.IP{192, 0, 2, 21}
+	p.Inject(tcpIPv4(clientIP, 5000, server, FTP_CONTROL_PORT, packet.TCP{SYN: true, Seq: 100}))
+	_, synAck := nextTCPTo(t, p, 5000)
+	port := []byte("PORT 10,0,0,2,19,137\r\n")
+	p.Inject(tcpIPv4(clientIP, 5000, server, FTP_CONTROL_PORT, packet.TCP{ACK: true, Seq: 101, Ack: synAck.Seq + 1, Payload: port}))
+	if _, echoed := nextTCPTo(t, p, 5000); !bytes.Equal(echoed.Payload, port) {
+		t.Fatalf("proxy got %q, want the PORT command as sent", echoed.Payload)
+	}
+}
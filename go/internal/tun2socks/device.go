@@ -0,0 +1,74 @@
+package tun2socks
+
+import (
+	"fmt"
+	"io"
+	"net"
+)
+
+// tunDevice is a tun device attached to a Tun2Socks. Flows read from a device
+// are tracked separately and their packets written back to the same device.
+type tunDevice struct {
+	index   int
+	rwc     io.ReadWriteCloser
+	writeCh chan interface{}
+	// nil if the device doesn't know its subnet
+	subnet *net.IPNet
+	// pooled buffer the reader reads the next packet into
+	readBuf []byte
+}
+
+// AddDevice attaches another tun device, e.g. on a multi-homed host. All
+// devices share the DNS cache, proxies and options. Flows are told apart by
+// the device they are read from, even with equal addresses and ports, and
+// their replies are written to that device. Call it before Run.
+func (t2s *Tun2Socks) AddDevice(dev io.ReadWriteCloser) {
+	d := &tunDevice{
+		index:   len(t2s.devs),
+		rwc:     dev,
+		writeCh: make(chan interface{}, 10000),
+	}
+	if s, ok := dev.(interface {
+		Subnet() *net.IPNet
+	}); ok {
+		d.subnet = s.Subnet()
+	}
+	t2s.devs = append(t2s.devs, d)
+}
+
+func (t2s *Tun2Socks) attached(dev io.ReadWriteCloser) bool {
+	for _, d := range t2s.devs {
+		if d.rwc == dev {
+			return true
+		}
+	}
+	return false
+}
+
+// takeReadBuf hands the read buffer over to the caller if raw was read into
+// it, so the reader reads the next packet into a fresh one. It returns nil
+// otherwise, e.g. for reassembled fragments.
+func (d *tunDevice) takeReadBuf(raw []byte) []byte {
+	buf := d.readBuf
+	if len(raw) == 0 || buf == nil || &raw[0] != &buf[0] {
+		return nil
+	}
+	d.readBuf = nil
+	return buf
+}
+
+func (d *tunDevice) releaseReadBuf() {
+	if d.readBuf != nil {
+		releaseBuffer(d.readBuf)
+		d.readBuf = nil
+	}
+}
+
+// flowID tags the id of a flow read from the device, so equal flows on
+// different devices are tracked apart.
+func (d *tunDevice) flowID(id string) string {
+	if d.index == 0 {
+		return id
+	}
+	return fmt.Sprintf("%s|%d", id, d.index)
+}
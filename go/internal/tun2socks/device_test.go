@@ -0,0 +1,154 @@
+package tun2socks
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dkwiebe/gotun2socks/internal/gosocks"
+	"github.com/dkwiebe/gotun2socks/internal/packet"
+	"github.com/dkwiebe/gotun2socks/internal/tun"
+	"github.com/miekg/dns"
+)
+
+// subnetTun is a memory tun telling its subnet, as the devices of package tun
+// do.
+type subnetTun struct {
+	*tun.MemoryTun
+	subnet *net.IPNet
+}
+
+func (d subnetTun) Subnet() *net.IPNet { return d.subnet }
+
+func TestSourceValidationDropsSpoofedPackets(t *testing.T) {
+	s := newStubSocks(t, echoUDP)
+	p := tun.NewMemoryTun()
+	_, subnet, _ := net.ParseCIDR("10.0.0.0/24")
+	t2s := New(subnetTun{p, subnet}, false)
+	s.route(t2s)
+	t2s.SetSourceValidation(true)
+	serve(t, t2s)
+
+	dst := net.IP{192, 0, 2, 1}
+	p.Inject(udpIPv4(net.IP{10, 0, 1, 2}, 5000, dst, 9, []byte("spoofed")))
+	waitFor(t, "spoofed packet counted", func() bool { return t2s.Stats().SpoofedDropped == 1 })
+	noPacket(t, p, 50*time.Millisecond)
+
+	p.Inject(udpIPv4(clientIP, 5000, dst, 9, []byte("ping")))
+	if _, udp := nextUDP(t, p); string(udp.Payload) != "ping" {
+		t.Fatalf("echoed %q", udp.Payload)
+	}
+	if n := t2s.Stats().SpoofedDropped; n != 1 {
+		t.Fatalf("%d spoofed packets counted, want 1", n)
+	}
+
+	// passed once validation is off again
+	t2s.SetSourceValidation(false)
+	p.Inject(udpIPv4(net.IP{10, 0, 1, 2}, 5000, dst, 9, []byte("unchecked")))
+	if _, udp := nextUDP(t, p); string(udp.Payload) != "unchecked" {
+		t.Fatalf("echoed %q", udp.Payload)
+	}
+}
+
+func TestDevicesShareCacheAndGetOwnReplies(t *testing.T) {
+	resolver := stubResolver(answerA)
+	s := newStubSocks(t, func(req *gosocks.UDPRequest) []byte {
+		if req.DstPort == 53 {
+			return resolver(req)
+		}
+		return echoUDP(req)
+	})
+	p1, p2 := tun.NewMemoryTun(), tun.NewMemoryTun()
+	t2s := New(p1, true)
+	t2s.AddDevice(p2)
+	s.route(t2s)
+	serve(t, t2s)
+
+	// the same flow on each device is a flow of its own
+	dst := net.IP{192, 0, 2, 1}
+	p1.Inject(udpIPv4(clientIP, 5000, dst, 9, []byte("one")))
+	p2.Inject(udpIPv4(clientIP, 5000, dst, 9, []byte("two")))
+	for _, c := range []struct {
+		p    *tun.MemoryTun
+		want string
+	}{{p1, "one"}, {p2, "two"}} {
+		if _, udp := nextUDP(t, c.p); string(udp.Payload) != c.want {
+			t.Fatalf("echoed %q, want %q", udp.Payload, c.want)
+		}
+	}
+	noPacket(t, p1, 50*time.Millisecond)
+	noPacket(t, p2, 0)
+
+	// an answer cached for one device is served to the other
+	for len(s.requests) > 0 {
+		<-s.requests
+	}
+	if _, upstream := resolve(t, s, p1, 1, "a.example."); !upstream {
+		t.Fatal("first query answered from the cache")
+	}
+	waitFor(t, "answer cached", func() bool {
+		_, hit := t2s.PeekDNSCache("a.example.", dns.TypeA)
+		return hit
+	})
+	if resp, upstream := resolve(t, s, p2, 2, "a.example."); upstream || resp.Id != 2 {
+		t.Fatalf("second device: id %d, upstream %v, want a cache hit", resp.Id, upstream)
+	}
+	noPacket(t, p1, 50*time.Millisecond)
+}
+
+func TestUDPRepliesFollowTrackOrigin(t *testing.T) {
+	s := newStubSocks(t, func(req *gosocks.UDPRequest) []byte {
+		// the first datagram is answered last
+		if string(req.Data) == "slow" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		return req.Data
+	})
+	s.async = true
+	devs := []*tun.MemoryTun{tun.NewMemoryTun(), tun.NewMemoryTun(), tun.NewMemoryTun()}
+	t2s := New(devs[0], false)
+	t2s.AddDevice(devs[1])
+	t2s.AddDevice(devs[2])
+	s.route(t2s)
+	t2s.SetICMPOnClose(true, false)
+	serve(t, t2s)
+
+	// one flow on each device, with the same endpoints
+	dst := net.IP{192, 0, 2, 1}
+	payloads := []string{"slow", "fast", "fast"}
+	for i, p := range devs {
+		p.Inject(udpIPv4(clientIP, 5000, dst, 9, []byte(payloads[i])))
+	}
+	id := connID(clientIP, 5000, dst, 9)
+	waitFor(t, "tracks", func() bool {
+		t2s.udpConnTrackLock.Lock()
+		defer t2s.udpConnTrackLock.Unlock()
+		return len(t2s.udpConnTrackMap) == len(devs)
+	})
+	t2s.udpConnTrackLock.Lock()
+	for i, dev := range t2s.devs {
+		track := t2s.udpConnTrackMap[dev.flowID(id)]
+		if track == nil || track.toTunCh != chan<- interface{}(dev.writeCh) {
+			t.Errorf("device %d: track %v not writing to its device", i, track)
+		}
+	}
+	t2s.udpConnTrackLock.Unlock()
+
+	// replies, in whatever order they come, go back where their flow came from
+	for i, p := range devs {
+		if _, udp := nextUDP(t, p); string(udp.Payload) != payloads[i] {
+			t.Fatalf("device %d got %q, want %q", i, udp.Payload, payloads[i])
+		}
+	}
+
+	// so does the notice of a flow closed
+	if n := t2s.CloseFlows(func(info ConnInfo) bool { return info.ID == t2s.devs[1].flowID(id) }); n != 1 {
+		t.Fatalf("closed %d flows, want the one of device 1", n)
+	}
+	var ip packet.IPv4
+	if e := packet.ParseIPv4(nextPacket(t, devs[1]), &ip); e != nil || ip.Protocol != packet.IPProtocolICMPv4 {
+		t.Fatalf("device 1 got protocol %d, %v, want ICMP", ip.Protocol, e)
+	}
+	noPacket(t, devs[0], 50*time.Millisecond)
+	noPacket(t, devs[2], 0)
+}
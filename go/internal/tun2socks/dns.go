@@ -0,0 +1,775 @@
+package tun2socks
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// SetStripQTypes sets record types removed from relayed DNS answers, e.g.
+// dns.TypeAAAA to force clients onto IPv4. A response left without answers
+// reaches the client as NODATA.
+func (t2s *Tun2Socks) SetStripQTypes(qtypes []uint16) {
+	t2s.stripQTypes = qtypes
+}
+
+func (t2s *Tun2Socks) stripQType(qtype uint16) bool {
+	for _, t := range t2s.stripQTypes {
+		if t == qtype {
+			return true
+		}
+	}
+	return false
+}
+
+// SetMaxDNSAnswers limits relayed DNS responses to max answer records
+// against answer sets meant to amplify or exhaust memory. Larger responses
+// are dropped if drop is set, otherwise cut to max answers with TC set. 0
+// disables the limit.
+func (t2s *Tun2Socks) SetMaxDNSAnswers(max int, drop bool) {
+	t2s.maxDNSAnswers = max
+	t2s.dropDNSAnswers = drop
+}
+
+// filterDNSResponse removes answers of stripped types from a DNS response
+// payload and enforces the answer limit. It returns nil if the response is to
+// be dropped. The payload is returned unchanged if nothing was removed or it
+// cannot be parsed.
+func (t2s *Tun2Socks) filterDNSResponse(payload []byte) []byte {
+	if len(t2s.stripQTypes) == 0 && t2s.maxDNSAnswers == 0 {
+		return payload
+	}
+	resp := new(dns.Msg)
+	e := resp.Unpack(payload)
+	if e != nil {
+		return payload
+	}
+
+	changed := false
+	if len(t2s.stripQTypes) > 0 {
+		answer := resp.Answer[:0]
+		for _, rr := range resp.Answer {
+			if !t2s.stripQType(rr.Header().Rrtype) {
+				answer = append(answer, rr)
+			}
+		}
+		changed = len(answer) != len(resp.Answer)
+		resp.Answer = answer
+	}
+	if max := t2s.maxDNSAnswers; max > 0 && len(resp.Answer) > max {
+		log.Printf("DNS response with %d answers over limit", len(resp.Answer))
+		atomic.AddUint64(&t2s.stats.DNSAnswersClamped, 1)
+		if t2s.dropDNSAnswers {
+			return nil
+		}
+		resp.Answer = resp.Answer[:max]
+		resp.Truncated = true
+		changed = true
+	}
+	if !changed {
+		return payload
+	}
+
+	data, e := resp.Pack()
+	if e != nil {
+		return payload
+	}
+	return data
+}
+
+// truncateDNSResponse turns a DNS response into an empty one with TC set,
+// telling the client to retry over TCP. It returns nil if the payload cannot
+// be parsed.
+func truncateDNSResponse(payload []byte) []byte {
+	resp := new(dns.Msg)
+	if resp.Unpack(payload) != nil {
+		return nil
+	}
+	resp.Truncated = true
+	resp.Answer = nil
+	resp.Ns = nil
+	resp.Extra = nil
+	data, e := resp.Pack()
+	if e != nil {
+		return nil
+	}
+	return data
+}
+
+// SetDNSCompression sets whether answers served from the DNS cache use name
+// compression. On by default; some broken clients fail to parse compressed
+// names.
+func (t2s *Tun2Socks) SetDNSCompression(enabled bool) {
+	t2s.dnsCompress = enabled
+}
+
+// SetRejectBadDNS answers DNS queries that cannot be parsed or ask no
+// question with FORMERR instead of relaying them upstream. Payloads too short
+// to carry a DNS header are dropped.
+func (t2s *Tun2Socks) SetRejectBadDNS(enabled bool) {
+	t2s.rejectBadDNS = enabled
+}
+
+// formatError reports whether a DNS query is malformed, and if so returns
+// the FORMERR response to it, nil if it cannot be answered at all.
+func formatError(payload []byte) ([]byte, bool) {
+	const headerLen = 12
+	if len(payload) < headerLen {
+		return nil, true
+	}
+	request := new(dns.Msg)
+	resp := new(dns.Msg)
+	if e := request.Unpack(payload); e == nil {
+		if len(request.Question) > 0 {
+			return nil, false
+		}
+		resp.SetRcodeFormatError(request)
+	} else {
+		resp.Id = dnsID(payload)
+		resp.Response = true
+		resp.Rcode = dns.RcodeFormatError
+	}
+	data, e := resp.Pack()
+	if e != nil {
+		return nil, true
+	}
+	return data, true
+}
+
+// SetDNSPadding pads DNS responses handed to clients with the EDNS padding
+// option (RFC 7830) to a multiple of block bytes, so their sizes give less
+// away to traffic analysis; 128 is a common choice. Only responses to queries
+// using EDNS are padded. 0 disables padding, the default.
+func (t2s *Tun2Socks) SetDNSPadding(block int) {
+	t2s.dnsPadding = block
+}
+
+// padDNSResponse pads a DNS response payload from remote as set by
+// SetDNSPadding, to a client that advertised an EDNS UDP payload size of
+// udpSize. The payload is returned unchanged if it isn't to be padded, cannot
+// be parsed, or would no longer reach the client once padded.
+func (t2s *Tun2Socks) padDNSResponse(payload []byte, remote net.IP, udpSize int) []byte {
+	block := t2s.dnsPadding
+	// the response may carry an OPT record the query didn't, if cached
+	if block <= 0 || udpSize == 0 {
+		return payload
+	}
+	resp := new(dns.Msg)
+	if resp.Unpack(payload) != nil {
+		return payload
+	}
+	opt := resp.IsEdns0()
+	if opt == nil {
+		return payload
+	}
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if _, ok := o.(*dns.EDNS0_PADDING); !ok {
+			options = append(options, o)
+		}
+	}
+	opt.Option = options
+	resp.Compress = t2s.dnsCompress
+	data, e := resp.Pack()
+	if e != nil {
+		return payload
+	}
+	// the option itself takes a 4 byte header
+	pad := (block - (len(data)+4)%block) % block
+	if len(data)+4+pad > t2s.dnsResponseRoom(remote, udpSize) {
+		return payload
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, pad)})
+	data, e = resp.Pack()
+	if e != nil {
+		return payload
+	}
+	return data
+}
+
+// dnsResponseRoom is the size of the largest DNS response from remote that
+// reaches a client which advertised an EDNS UDP payload size of udpSize,
+// within the response size cap, the fragment cap and the MTU of destinations
+// not to fragment.
+func (t2s *Tun2Socks) dnsResponseRoom(remote net.IP, udpSize int) int {
+	room := udpSize
+	if room < dns.MinMsgSize {
+		room = dns.MinMsgSize
+	}
+	if t2s.maxUDPResponseSize > 0 && t2s.maxUDPResponseSize < room {
+		room = t2s.maxUDPResponseSize
+	}
+	mtu := t2s.pathMTU(remote)
+	fit := room
+	if t2s.noFragment(remote) {
+		fit = mtu - 28
+	} else if t2s.maxFragments > 0 {
+		fit = (t2s.maxFragments-1)*fragPayloadSize(mtu) + mtu - 28
+	}
+	if fit < room {
+		room = fit
+	}
+	return room
+}
+
+// dnsUDPSize returns the EDNS UDP payload size a DNS query advertises, 0 if
+// it doesn't use EDNS or cannot be parsed.
+func dnsUDPSize(query []byte) int {
+	msg := new(dns.Msg)
+	if msg.Unpack(query) != nil {
+		return 0
+	}
+	if opt := msg.IsEdns0(); opt != nil {
+		return int(opt.UDPSize())
+	}
+	return 0
+}
+
+// SetDNSKeepAlive keeps a DNS session open for window after its queries are
+// answered, serving follow-up queries a client sends from the same source
+// port. 0 closes the session as soon as every query is answered.
+func (t2s *Tun2Socks) SetDNSKeepAlive(window time.Duration) {
+	t2s.dnsKeepAlive = window
+}
+
+// dnsQuery is a query relayed in a DNS session and waiting for its response.
+type dnsQuery struct {
+	start time.Time
+	// responses still expected, more than one when resolvers are raced
+	pending int
+	// question asked, if the query could be parsed
+	question *dns.Question
+	// IP ID of the packet carrying the query
+	ipid uint16
+	// EDNS UDP payload size the query advertised, 0 without EDNS
+	udpSize int
+}
+
+func newDNSQuery(payload []byte, pending int) *dnsQuery {
+	query := &dnsQuery{start: time.Now(), pending: pending}
+	if query.pending == 0 {
+		query.pending = 1
+	}
+	msg := new(dns.Msg)
+	if msg.Unpack(payload) == nil && len(msg.Question) > 0 {
+		query.question = &msg.Question[0]
+		if opt := msg.IsEdns0(); opt != nil {
+			query.udpSize = int(opt.UDPSize())
+		}
+	}
+	return query
+}
+
+// answers reports whether a response with a matching ID echoes the question
+// of the query, as off-path spoofed responses are unlikely to.
+func (query *dnsQuery) answers(payload []byte) bool {
+	if query.question == nil {
+		return true
+	}
+	resp := new(dns.Msg)
+	if resp.Unpack(payload) != nil || len(resp.Question) == 0 {
+		return false
+	}
+	q := resp.Question[0]
+	return q.Qtype == query.question.Qtype && q.Qclass == query.question.Qclass &&
+		strings.EqualFold(q.Name, query.question.Name)
+}
+
+// dnsID returns the transaction ID of a DNS message.
+func dnsID(payload []byte) uint16 {
+	if len(payload) < 2 {
+		return 0
+	}
+	return uint16(payload[0])<<8 | uint16(payload[1])
+}
+
+type dnsCacheEntry struct {
+	// parsed response, read by concurrent queries and so never modified:
+	// each query is served a copy carrying its own ID and aged TTLs
+	msg *dns.Msg
+	// packed response, kept instead of msg by a compact cache
+	wire   []byte
+	stored time.Time
+	exp    time.Time
+	// last served or stored, for evicting the least recently used entry
+	used time.Time
+}
+
+type dnsCache struct {
+	servers []string
+	mutex   sync.Mutex
+	storage map[string]*dnsCacheEntry
+	// most entries kept, 0 for no bound; pinned entries don't count
+	maxEntries int
+
+	bypassFlags   int
+	bypassNoStore bool
+	compact       bool
+	ecsAware      bool
+	// keys of entries served even when expired, until refreshed
+	pinned       map[string]bool
+	ttlOverrides []DNSTTLOverride
+	// reverse names of addresses in cached answers, if PTR queries are
+	// answered from them or SOCKS relays sent names
+	reverse   map[string][]*reverseEntry
+	answerPTR bool
+	hostNames bool
+	// queries in flight by key, if answers are only kept for their
+	// duplicates rather than cached or expired entries are refreshed once
+	inflight  map[string]*dnsFlight
+	dedupOnly bool
+	// how long expired entries are kept for queries to wait for their
+	// refresh
+	refreshGrace time.Duration
+}
+
+const (
+	// bypass the cache for queries with checking disabled (CD) set
+	DNS_BYPASS_CD = 1 << iota
+	// bypass the cache for non-recursive queries (RD clear)
+	DNS_BYPASS_NORECURSE
+)
+
+// bypass reports whether msg carries one of the flags the cache is bypassed
+// for. Both flags are copied from queries into responses.
+func (c *dnsCache) bypass(msg *dns.Msg) bool {
+	if c.bypassFlags&DNS_BYPASS_CD != 0 && msg.CheckingDisabled {
+		return true
+	}
+	if c.bypassFlags&DNS_BYPASS_NORECURSE != 0 && !msg.RecursionDesired {
+		return true
+	}
+	return false
+}
+
+// SetDNSCacheBypass makes queries carrying any of flags (DNS_BYPASS_*) skip
+// the cache and go upstream. With noStore their answers aren't cached either.
+func (t2s *Tun2Socks) SetDNSCacheBypass(flags int, noStore bool) {
+	if t2s.cache == nil {
+		return
+	}
+	t2s.cache.mutex.Lock()
+	defer t2s.cache.mutex.Unlock()
+	t2s.cache.bypassFlags = flags
+	t2s.cache.bypassNoStore = noStore
+}
+
+// SetDNSCacheCompact makes the cache keep packed responses rather than
+// parsed messages, saving memory at the cost of unpacking on every hit. It
+// applies to answers cached from then on.
+func (t2s *Tun2Socks) SetDNSCacheCompact(enabled bool) {
+	if t2s.cache == nil {
+		return
+	}
+	t2s.cache.mutex.Lock()
+	defer t2s.cache.mutex.Unlock()
+	t2s.cache.compact = enabled
+}
+
+// ageTTL lowers the TTLs of msg by the time it spent in the cache.
+func ageTTL(msg *dns.Msg, age time.Duration) {
+	secs := uint32(age / time.Second)
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			hdr := rr.Header()
+			if hdr.Rrtype == dns.TypeOPT {
+				continue
+			}
+			if hdr.Ttl > secs {
+				hdr.Ttl -= secs
+			} else {
+				hdr.Ttl = 0
+			}
+		}
+	}
+}
+
+func packUint16(i uint16) []byte { return []byte{byte(i >> 8), byte(i)} }
+
+// Cache keys are the name, then the EDNS client subnet after a 0 byte, which
+// presentation format names never contain, if the cache is keyed by it, then
+// the packed qtype.
+func cacheKey(q dns.Question) string {
+	return string(append([]byte(q.Name), packUint16(q.Qtype)...))
+}
+
+// keyName and keyQtype split a cache key.
+func keyName(key string) string {
+	name := key[:len(key)-2]
+	if i := strings.IndexByte(name, 0); i >= 0 {
+		name = name[:i]
+	}
+	return name
+}
+
+func keyQtype(key string) uint16 {
+	return uint16(key[len(key)-2])<<8 | uint16(key[len(key)-1])
+}
+
+// key returns the cache key of msg, a query or its response, which carry the
+// same client subnet.
+func (c *dnsCache) key(msg *dns.Msg) string {
+	q := msg.Question[0]
+	if !c.ecsAware {
+		return cacheKey(q)
+	}
+	ecs := ""
+	if opt := msg.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if subnet, ok := o.(*dns.EDNS0_SUBNET); ok {
+				ecs = fmt.Sprintf("%s/%d", subnet.Address, subnet.SourceNetmask)
+				break
+			}
+		}
+	}
+	if ecs == "" {
+		return cacheKey(q)
+	}
+	key := append([]byte(q.Name), 0)
+	key = append(key, ecs...)
+	return string(append(key, packUint16(q.Qtype)...))
+}
+
+// SetECSAwareCache keys cached DNS answers by the EDNS client subnet (ECS) of
+// the query too, so upstreams' geo-targeted answers are only served to the
+// subnet they were meant for. It applies to answers cached from then on.
+func (t2s *Tun2Socks) SetECSAwareCache(enabled bool) {
+	if t2s.cache == nil {
+		return
+	}
+	t2s.cache.mutex.Lock()
+	defer t2s.cache.mutex.Unlock()
+	t2s.cache.ecsAware = enabled
+}
+
+// SetInterceptDNS switches the special handling of DNS (caching, forwarding,
+// filtering, short sessions) on or off. Off, port 53 is relayed like any
+// other UDP. On by default.
+func (t2s *Tun2Socks) SetInterceptDNS(enabled bool) {
+	t2s.interceptDNS = enabled
+}
+
+func (t2s *Tun2Socks) isDNS(remoteIP string, remotePort uint16) bool {
+	return t2s.interceptDNS && remotePort == 53
+}
+
+func (c *dnsCache) query(payload []byte) *dns.Msg {
+	request := new(dns.Msg)
+	e := request.Unpack(payload)
+	if e != nil {
+		return nil
+	}
+	if len(request.Question) == 0 {
+		return nil
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.bypass(request) {
+		return nil
+	}
+	if msg := c.queryReverse(request); msg != nil {
+		return msg
+	}
+	key := c.key(request)
+	entry := c.storage[key]
+	if entry == nil {
+		return nil
+	}
+	now := time.Now()
+	if now.After(entry.exp) && !c.pinned[key] {
+		if !now.Before(entry.exp.Add(c.refreshGrace)) {
+			delete(c.storage, key)
+		}
+		return nil
+	}
+	var msg *dns.Msg
+	if entry.msg != nil {
+		msg = entry.msg.Copy()
+	} else {
+		msg = new(dns.Msg)
+		if msg.Unpack(entry.wire) != nil {
+			delete(c.storage, key)
+			return nil
+		}
+	}
+	msg.Id = request.Id
+	ageTTL(msg, now.Sub(entry.stored))
+	entry.used = now
+	return msg
+}
+
+func (c *dnsCache) store(payload []byte) {
+	resp := new(dns.Msg)
+	e := resp.Unpack(payload)
+	if e != nil {
+		return
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return
+	}
+	if len(resp.Question) == 0 || len(resp.Answer) == 0 {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.dedupOnly || c.bypassNoStore && c.bypass(resp) {
+		return
+	}
+	// flows resolving the same name at once each store their answer; keep
+	// whichever lasts longest
+	ttl := c.ttl(resp)
+	if entry := c.storage[c.key(resp)]; entry != nil && !entry.exp.Before(time.Now().Add(ttl)) {
+		return
+	}
+	c.insert(resp, payload, ttl)
+}
+
+// DNSTTLOverride caches answers for Suffix and its subdomains for TTL,
+// whatever the TTLs of their records.
+type DNSTTLOverride struct {
+	Suffix string
+	TTL    time.Duration
+}
+
+// SetDNSTTLOverrides sets how long answers for matching names are cached,
+// e.g. to have them refreshed every few seconds in testing. The first
+// override whose suffix matches the query name applies. Record TTLs served
+// to clients are left as received. It applies to answers cached from then
+// on.
+func (t2s *Tun2Socks) SetDNSTTLOverrides(overrides []DNSTTLOverride) {
+	if t2s.cache == nil {
+		return
+	}
+	fqdn := make([]DNSTTLOverride, 0, len(overrides))
+	for _, o := range overrides {
+		fqdn = append(fqdn, DNSTTLOverride{dns.Fqdn(o.Suffix), o.TTL})
+	}
+	t2s.cache.mutex.Lock()
+	defer t2s.cache.mutex.Unlock()
+	t2s.cache.ttlOverrides = fqdn
+}
+
+// ttl is how long resp is cached for. c.mutex must be held.
+func (c *dnsCache) ttl(resp *dns.Msg) time.Duration {
+	name := resp.Question[0].Name
+	for _, o := range c.ttlOverrides {
+		if dns.IsSubDomain(o.Suffix, name) {
+			return o.TTL
+		}
+	}
+	return minTTL(resp)
+}
+
+// minTTL is the lowest TTL of the answer records of resp, after which the
+// answer as a whole is stale.
+func minTTL(resp *dns.Msg) time.Duration {
+	ttl := resp.Answer[0].Header().Ttl
+	for _, rr := range resp.Answer[1:] {
+		if rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+// insert caches resp, packed as payload, for ttl. c.mutex must be held.
+func (c *dnsCache) insert(resp *dns.Msg, payload []byte, ttl time.Duration) {
+	key := c.key(resp)
+	log.Printf("cache DNS response for %s", key)
+	now := time.Now()
+	entry := &dnsCacheEntry{
+		stored: now,
+		exp:    now.Add(ttl),
+		used:   now,
+	}
+	if c.compact {
+		entry.wire = append([]byte(nil), payload...)
+	} else {
+		entry.msg = resp
+	}
+	if c.storage[key] == nil && !c.pinned[key] {
+		c.evict(1)
+	}
+	c.storage[key] = entry
+	if c.reverse != nil {
+		c.mapReverse(resp, entry.exp)
+	}
+}
+
+// evict drops expired entries, then the least recently used ones, until there
+// is room for n more entries within the size bound. Pinned entries are never
+// dropped. c.mutex must be held.
+func (c *dnsCache) evict(n int) {
+	if c.maxEntries <= 0 {
+		return
+	}
+	unpinned := 0
+	for key := range c.storage {
+		if !c.pinned[key] {
+			unpinned++
+		}
+	}
+	now := time.Now()
+	for ; unpinned+n > c.maxEntries; unpinned-- {
+		victim := ""
+		var lru time.Time
+		for key, entry := range c.storage {
+			if c.pinned[key] {
+				continue
+			}
+			if now.After(entry.exp) {
+				victim = key
+				break
+			}
+			if victim == "" || entry.used.Before(lru) {
+				victim, lru = key, entry.used
+			}
+		}
+		if victim == "" {
+			return
+		}
+		delete(c.storage, victim)
+	}
+}
+
+// SetDNSCacheSize bounds the DNS cache to size entries, dropping expired
+// answers first, then the least recently used, to make room. Answers of
+// pinned names are kept on top of the bound. 0, the default, keeps every
+// answer until it expires.
+func (t2s *Tun2Socks) SetDNSCacheSize(size int) {
+	if t2s.cache == nil {
+		return
+	}
+	t2s.cache.mutex.Lock()
+	defer t2s.cache.mutex.Unlock()
+	t2s.cache.maxEntries = size
+	t2s.cache.evict(0)
+}
+
+// peek returns how long the cached answer for name and qtype stays valid,
+// without serving or evicting it.
+func (c *dnsCache) peek(name string, qtype uint16) (time.Duration, bool) {
+	key := cacheKey(dns.Question{Name: dns.Fqdn(name), Qtype: qtype})
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entry := c.storage[key]
+	if entry == nil {
+		return 0, false
+	}
+	remaining := time.Until(entry.exp)
+	if remaining <= 0 {
+		return 0, false
+	}
+	return remaining, true
+}
+
+func (c *dnsCache) pin(name string, qtype uint16, pinned bool) {
+	key := cacheKey(dns.Question{Name: dns.Fqdn(name), Qtype: qtype})
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !pinned {
+		delete(c.pinned, key)
+		return
+	}
+	if c.pinned == nil {
+		c.pinned = make(map[string]bool)
+	}
+	c.pinned[key] = true
+}
+
+// stalePinned returns the pinned names whose answer is missing or expired.
+func (c *dnsCache) stalePinned() []PreloadEntry {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var stale []PreloadEntry
+	now := time.Now()
+	for key := range c.pinned {
+		entry := c.storage[key]
+		if entry != nil && now.Before(entry.exp) {
+			continue
+		}
+		stale = append(stale, PreloadEntry{Name: keyName(key), Qtype: keyQtype(key)})
+	}
+	return stale
+}
+
+func (c *dnsCache) flush() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.storage = make(map[string]*dnsCacheEntry)
+	if c.reverse != nil {
+		c.reverse = make(map[string][]*reverseEntry)
+	}
+}
+
+func (c *dnsCache) flushName(name string) {
+	name = dns.Fqdn(name)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for key := range c.storage {
+		if strings.EqualFold(keyName(key), name) {
+			delete(c.storage, key)
+		}
+	}
+	for arpa := range c.reverse {
+		c.pruneReverse(arpa, func(entry *reverseEntry) bool {
+			return strings.EqualFold(entry.name, name)
+		})
+	}
+}
+
+// FlushDNSCache drops all cached DNS answers, e.g. after a network change.
+func (t2s *Tun2Socks) FlushDNSCache() {
+	if t2s.dnsStore != nil {
+		t2s.dnsStore.Flush()
+	}
+	if t2s.cache != nil && t2s.dnsStore != DNSCache(t2s.cache) {
+		t2s.cache.flush()
+	}
+}
+
+// PeekDNSCache returns how long the cached answer for name and qtype stays
+// valid, e.g. for a cache inspector. hit is false if nothing valid is cached.
+func (t2s *Tun2Socks) PeekDNSCache(name string, qtype uint16) (remaining time.Duration, hit bool) {
+	if t2s.cache == nil {
+		return 0, false
+	}
+	return t2s.cache.peek(name, qtype)
+}
+
+// PinDNSName keeps the answer for name and qtype, e.g. of a management
+// domain that must always resolve, served past its expiry and never evicted
+// to keep the cache within SetDNSCacheSize. Pinned names are
+// resolved again in the background once expired, and right away if nothing
+// valid is cached for them yet. Flushing still drops their answers until then.
+func (t2s *Tun2Socks) PinDNSName(name string, qtype uint16) {
+	if t2s.cache != nil {
+		t2s.cache.pin(name, qtype, true)
+		t2s.refreshPinnedDNS()
+	}
+}
+
+// UnpinDNSName lets the answer for name and qtype expire again.
+func (t2s *Tun2Socks) UnpinDNSName(name string, qtype uint16) {
+	if t2s.cache != nil {
+		t2s.cache.pin(name, qtype, false)
+	}
+}
+
+// FlushDNSName drops the cached DNS answers of every type for name.
+func (t2s *Tun2Socks) FlushDNSName(name string) {
+	if t2s.cache != nil {
+		t2s.cache.flushName(name)
+	}
+}
@@ -0,0 +1,978 @@
+package tun2socks
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dkwiebe/gotun2socks/internal/gosocks"
+	"github.com/dkwiebe/gotun2socks/internal/packet"
+	"github.com/dkwiebe/gotun2socks/internal/tun"
+	"github.com/miekg/dns"
+)
+
+// resolverIP is where apps send DNS queries in tests.
+var resolverIP = net.IP{8, 8, 8, 8}
+
+// answerA is a stubResolver answer resolving every name to 192.0.2.1 for
+// five minutes.
+func answerA(req *dns.Msg) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   net.IP{192, 0, 2, 1},
+	}}
+	return resp
+}
+
+// resolve has the app on d look name up and returns the answer, and whether
+// the query went upstream through s.
+func resolve(tb testing.TB, s *stubSocks, d *tun.MemoryTun, id uint16, name string) (*dns.Msg, bool) {
+	tb.Helper()
+	d.Inject(udpIPv4(clientIP, 4000, resolverIP, 53, packQuery(tb, id, name, dns.TypeA)))
+	_, udp := nextUDP(tb, d)
+	// the proxy sees the query before answering it
+	select {
+	case <-s.requests:
+		return unpackDNS(tb, udp), true
+	default:
+		return unpackDNS(tb, udp), false
+	}
+}
+
+func TestStripQTypesLeavesNODATA(t *testing.T) {
+	t2s := New(nil, false)
+	t2s.SetStripQTypes([]uint16{dns.TypeAAAA})
+	query := new(dns.Msg)
+	query.SetQuestion("v6.example.", dns.TypeAAAA)
+	query.Id = 7
+	resp := new(dns.Msg)
+	resp.SetReply(query)
+	resp.Answer = []dns.RR{&dns.AAAA{
+		Hdr:  dns.RR_Header{Name: "v6.example.", Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 60},
+		AAAA: net.ParseIP("2001:db8::1"),
+	}}
+	data, e := resp.Pack()
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	got := new(dns.Msg)
+	if e := got.Unpack(t2s.filterDNSResponse(data)); e != nil {
+		t.Fatal(e)
+	}
+	if got.Id != 7 || got.Rcode != dns.RcodeSuccess || len(got.Answer) != 0 || len(got.Question) != 1 {
+		t.Fatalf("got %v, want NODATA", got)
+	}
+}
+
+func TestFlushDNSCache(t *testing.T) {
+	t2s := New(nil, true)
+	names := []string{"a.example.", "b.example.", "c.example."}
+	for _, name := range names {
+		t2s.cache.store(packReply(t, packQuery(t, 1, name, dns.TypeA), 300, "192.0.2.1"))
+	}
+	cached := func(name string) bool {
+		return t2s.cache.query(packQuery(t, 2, name, dns.TypeA)) != nil
+	}
+
+	// names match whatever their case and trailing dot
+	t2s.FlushDNSName("A.Example")
+	for _, name := range names {
+		if cached(name) != (name != "a.example.") {
+			t.Errorf("%s cached: %v after flushing a.example.", name, cached(name))
+		}
+	}
+
+	t2s.FlushDNSCache()
+	for _, name := range names {
+		if cached(name) {
+			t.Errorf("%s still cached after a full flush", name)
+		}
+	}
+}
+
+func TestDNSCacheBypassForCD(t *testing.T) {
+	s := newStubSocks(t, stubResolver(answerA))
+	t2s, p := NewTun2SocksWithPipe()
+	s.route(t2s)
+	t2s.SetDNSCacheBypass(DNS_BYPASS_CD, true)
+	serve(t, t2s)
+
+	// queryCD has the app look name up with checking disabled, from a port
+	// of its own, and reports whether the query went upstream
+	queryCD := func(id uint16, name string) bool {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		msg.Id = id
+		msg.CheckingDisabled = true
+		query, e := msg.Pack()
+		if e != nil {
+			t.Fatal(e)
+		}
+		p.Inject(udpIPv4(clientIP, 4000+id, resolverIP, 53, query))
+		_, udp := nextUDP(t, p)
+		if resp := unpackDNS(t, udp); resp.Id != id || !resp.CheckingDisabled || len(resp.Answer) != 1 {
+			t.Fatalf("%s answered with %v", name, resp)
+		}
+		select {
+		case <-s.requests:
+			return true
+		default:
+			return false
+		}
+	}
+
+	resolve(t, s, p, 1, "a.example.")
+	waitFor(t, "a.example. cached", func() bool {
+		_, hit := t2s.PeekDNSCache("a.example.", dns.TypeA)
+		return hit
+	})
+	if !queryCD(2, "a.example.") {
+		t.Fatal("query with CD set answered from the cache")
+	}
+	if _, upstream := resolve(t, s, p, 3, "a.example."); upstream {
+		t.Fatal("query without CD not answered from the cache")
+	}
+
+	// with noStore, answers to CD queries stay out of the cache
+	for id := uint16(4); id < 6; id++ {
+		if !queryCD(id, "b.example.") {
+			t.Fatal("query with CD set answered from the cache")
+		}
+	}
+	if _, hit := t2s.PeekDNSCache("b.example.", dns.TypeA); hit {
+		t.Fatal("answer to a query with CD set cached")
+	}
+}
+
+func TestDNSKeepAliveServesFollowUps(t *testing.T) {
+	s := &stubSocks{async: true, handle: stubResolver(func(req *dns.Msg) *dns.Msg {
+		if req.Question[0].Name == "slow.example." {
+			time.Sleep(100 * time.Millisecond)
+		}
+		return answerA(req)
+	})}
+	s.listen(t)
+	t2s, p := NewTun2SocksWithPipe()
+	s.route(t2s)
+	t2s.SetDNSKeepAlive(500 * time.Millisecond)
+	serve(t, t2s)
+	track := func() *udpConnTrack {
+		t2s.udpConnTrackLock.Lock()
+		defer t2s.udpConnTrackLock.Unlock()
+		for _, ut := range t2s.udpConnTrackMap {
+			return ut
+		}
+		return nil
+	}
+
+	resolve(t, s, p, 1, "a.example.")
+	first := track()
+	if first == nil {
+		t.Fatal("session closed after its first answer")
+	}
+
+	// two follow-ups in flight at once, answered out of order
+	p.Inject(udpIPv4(clientIP, 4000, resolverIP, 53, packQuery(t, 2, "slow.example.", dns.TypeA)))
+	p.Inject(udpIPv4(clientIP, 4000, resolverIP, 53, packQuery(t, 3, "b.example.", dns.TypeA)))
+	for _, want := range []struct {
+		id   uint16
+		name string
+	}{{3, "b.example."}, {2, "slow.example."}} {
+		_, udp := nextUDP(t, p)
+		if resp := unpackDNS(t, udp); resp.Id != want.id || resp.Question[0].Name != want.name {
+			t.Fatalf("got %v, want the answer to %d %s", resp, want.id, want.name)
+		}
+	}
+	if ut := track(); ut != first {
+		t.Fatal("follow-ups not served by the first session")
+	}
+
+	waitFor(t, "session closed after the window", func() bool { return track() == nil })
+}
+
+func TestDNSCacheAgesTTLs(t *testing.T) {
+	for _, compact := range []bool{false, true} {
+		t2s := New(nil, true)
+		t2s.SetDNSCacheCompact(compact)
+		query := packQuery(t, 1, "aged.example.", dns.TypeA)
+		t2s.cache.store(packReply(t, query, 300, "192.0.2.1"))
+
+		// as if stored 100s ago
+		for _, entry := range t2s.cache.storage {
+			entry.stored = entry.stored.Add(-100 * time.Second)
+			entry.exp = entry.exp.Add(-100 * time.Second)
+		}
+		resp := t2s.cache.query(packQuery(t, 2, "aged.example.", dns.TypeA))
+		if resp == nil || resp.Id != 2 || len(resp.Answer) != 1 {
+			t.Fatalf("compact %v: got %v", compact, resp)
+		}
+		if ttl := resp.Answer[0].Header().Ttl; ttl != 200 {
+			t.Errorf("compact %v: served TTL %d, want 200", compact, ttl)
+		}
+	}
+}
+
+// BenchmarkDNSCacheEntries reports the memory held by 10k cached answers,
+// parsed and compact.
+func BenchmarkDNSCacheEntries(b *testing.B) {
+	const entries = 10000
+	responses := make([][]byte, entries)
+	for i := range responses {
+		query := packQuery(b, uint16(i), fmt.Sprintf("host%d.example.", i), dns.TypeA)
+		responses[i] = packReply(b, query, 300, "192.0.2.1", "192.0.2.2")
+	}
+	for _, compact := range []bool{false, true} {
+		name := "parsed"
+		if compact {
+			name = "compact"
+		}
+		b.Run(name, func(b *testing.B) {
+			var held uint64
+			for i := 0; i < b.N; i++ {
+				t2s := New(nil, true)
+				t2s.SetDNSCacheCompact(compact)
+				var before, after runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+				for _, resp := range responses {
+					t2s.cache.store(resp)
+				}
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				held += after.HeapAlloc - before.HeapAlloc
+				runtime.KeepAlive(t2s)
+			}
+			b.ReportMetric(float64(held)/float64(b.N)/entries, "B/entry")
+		})
+	}
+}
+
+func TestInterceptDNSOffRelaysPort53(t *testing.T) {
+	s := newStubSocks(t, stubResolver(answerA))
+	t2s, p := NewTun2SocksWithPipe()
+	s.route(t2s)
+	t2s.SetInterceptDNS(false)
+	serve(t, t2s)
+	flows := func() int {
+		t2s.udpConnTrackLock.Lock()
+		defer t2s.udpConnTrackLock.Unlock()
+		return len(t2s.udpConnTrackMap)
+	}
+
+	for id := uint16(1); id <= 2; id++ {
+		resp, upstream := resolve(t, s, p, id, "a.example.")
+		if !upstream {
+			t.Fatalf("query %d answered from the cache", id)
+		}
+		if resp.Id != id || len(resp.Answer) != 1 {
+			t.Fatalf("query %d: got %v", id, resp)
+		}
+	}
+	if _, hit := t2s.PeekDNSCache("a.example.", dns.TypeA); hit {
+		t.Fatal("answer cached")
+	}
+	// no DNS teardown: the flow lives on like any other UDP flow
+	time.Sleep(100 * time.Millisecond)
+	if n := flows(); n != 1 {
+		t.Fatalf("%d flows after the answers, want 1", n)
+	}
+}
+
+func TestLargeCachedAnswerPacked(t *testing.T) {
+	// far more than the 1024 bytes the cache packs into in place
+	s := newStubSocks(t, stubResolver(func(req *dns.Msg) *dns.Msg {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		for i := 0; i < 200; i++ {
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+				A:   net.IP{192, 0, 2 + byte(i>>8), byte(i)},
+			})
+		}
+		return resp
+	}))
+	t2s, p := NewTun2SocksWithPipe()
+	s.route(t2s)
+	serve(t, t2s)
+
+	first, upstream := resolve(t, s, p, 1, "big.example.")
+	if !upstream {
+		t.Fatal("first query answered from the cache")
+	}
+	waitFor(t, "answer cached", func() bool {
+		_, hit := t2s.PeekDNSCache("big.example.", dns.TypeA)
+		return hit
+	})
+	p.Inject(udpIPv4(clientIP, 4000, resolverIP, 53, packQuery(t, 2, "big.example.", dns.TypeA)))
+	_, udp := nextUDP(t, p)
+	select {
+	case <-s.requests:
+		t.Fatal("second query went upstream")
+	default:
+	}
+	if len(udp.Payload) <= 1024 {
+		t.Fatalf("cached answer of %d bytes, want more than 1024", len(udp.Payload))
+	}
+	cached := unpackDNS(t, udp)
+	if cached.Id != 2 || len(cached.Answer) != len(first.Answer) {
+		t.Fatalf("cached answer: id %d, %d records, want id 2, %d records", cached.Id, len(cached.Answer), len(first.Answer))
+	}
+	for i, rr := range cached.Answer {
+		if !rr.(*dns.A).A.Equal(first.Answer[i].(*dns.A).A) {
+			t.Fatalf("record %d: %s, want %s", i, rr, first.Answer[i])
+		}
+	}
+}
+
+func TestMismatchedDNSResponsesDropped(t *testing.T) {
+	s := newStubSocks(t, stubResolver(func(req *dns.Msg) *dns.Msg {
+		resp := answerA(req)
+		switch req.Question[0].Name {
+		case "wrong-id.example.":
+			resp.Id++
+		case "wrong-question.example.":
+			resp.Question[0].Name = "other.example."
+		}
+		return resp
+	}))
+	t2s, p := NewTun2SocksWithPipe()
+	s.route(t2s)
+	serve(t, t2s)
+
+	for i, name := range []string{"wrong-id.example.", "wrong-question.example."} {
+		p.Inject(udpIPv4(clientIP, uint16(4000+i), resolverIP, 53, packQuery(t, 7, name, dns.TypeA)))
+		waitFor(t, name+" dropped", func() bool { return t2s.Stats().DNSMismatched == uint64(i+1) })
+		if _, hit := t2s.PeekDNSCache(name, dns.TypeA); hit {
+			t.Fatalf("%s: mismatched response cached", name)
+		}
+	}
+	noPacket(t, p, 50*time.Millisecond)
+
+	resp, _ := resolve(t, s, p, 8, "right.example.")
+	if resp.Id != 8 || len(resp.Answer) != 1 {
+		t.Fatalf("got %v", resp)
+	}
+}
+
+func TestMaxDNSAnswers(t *testing.T) {
+	for _, drop := range []bool{false, true} {
+		s := newStubSocks(t, stubResolver(func(req *dns.Msg) *dns.Msg {
+			resp := new(dns.Msg)
+			resp.SetReply(req)
+			for i := 0; i < 20; i++ {
+				resp.Answer = append(resp.Answer, &dns.A{
+					Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+					A:   net.IP{192, 0, 2, byte(i)},
+				})
+			}
+			return resp
+		}))
+		t2s, p := NewTun2SocksWithPipe()
+		s.route(t2s)
+		t2s.SetMaxDNSAnswers(5, drop)
+		serve(t, t2s)
+
+		p.Inject(udpIPv4(clientIP, 4000, resolverIP, 53, packQuery(t, 1, "many.example.", dns.TypeA)))
+		if drop {
+			waitFor(t, "response dropped", func() bool { return t2s.Stats().DNSAnswersClamped == 1 })
+			noPacket(t, p, 50*time.Millisecond)
+			if _, hit := t2s.PeekDNSCache("many.example.", dns.TypeA); hit {
+				t.Fatal("dropped response cached")
+			}
+			continue
+		}
+		_, udp := nextUDP(t, p)
+		if resp := unpackDNS(t, udp); len(resp.Answer) != 5 || !resp.Truncated {
+			t.Fatalf("got %d answers, truncated %v, want 5 truncated", len(resp.Answer), resp.Truncated)
+		}
+		if n := t2s.Stats().DNSAnswersClamped; n != 1 {
+			t.Fatalf("%d responses clamped, want 1", n)
+		}
+	}
+}
+
+func TestPeekDNSCache(t *testing.T) {
+	t2s := New(nil, true)
+	if _, hit := t2s.PeekDNSCache("peek.example.", dns.TypeA); hit {
+		t.Fatal("hit on an empty cache")
+	}
+	query := new(dns.Msg)
+	query.SetQuestion("peek.example.", dns.TypeA)
+	resp := new(dns.Msg)
+	resp.SetReply(query)
+	for i, ttl := range []uint32{300, 60, 120} {
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: "peek.example.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+			A:   net.IP{192, 0, 2, byte(i)},
+		})
+	}
+	data, e := resp.Pack()
+	if e != nil {
+		t.Fatal(e)
+	}
+	t2s.cache.store(data)
+
+	remaining, hit := t2s.PeekDNSCache("peek.example", dns.TypeA)
+	entry := t2s.cache.storage[cacheKey(query.Question[0])]
+	if !hit || entry == nil {
+		t.Fatal("stored answer missed")
+	}
+	// expires at the lowest TTL of its records
+	if exp := time.Until(entry.exp); remaining < exp || remaining > exp+time.Second || remaining > time.Minute {
+		t.Fatalf("%s remaining, entry expires in %s", remaining, exp)
+	}
+	// peeking neither serves nor evicts
+	if again, hit := t2s.PeekDNSCache("peek.example.", dns.TypeA); !hit || again > remaining {
+		t.Fatalf("second peek: %s, %v", again, hit)
+	}
+	if _, hit := t2s.PeekDNSCache("peek.example.", dns.TypeAAAA); hit {
+		t.Fatal("hit for another qtype")
+	}
+
+	entry.exp = time.Now().Add(-time.Second)
+	if _, hit := t2s.PeekDNSCache("peek.example.", dns.TypeA); hit {
+		t.Fatal("hit on an expired answer")
+	}
+	if t2s.cache.storage[cacheKey(query.Question[0])] == nil {
+		t.Fatal("peek evicted the expired answer")
+	}
+}
+
+func TestConcurrentCacheHitsGetOwnIDs(t *testing.T) {
+	t2s := New(nil, true)
+	query := packQuery(t, 1, "shared.example.", dns.TypeA)
+	t2s.cache.store(packReply(t, query, 300, "192.0.2.1", "192.0.2.2"))
+
+	const queriers, rounds = 8, 200
+	errs := make(chan error, queriers)
+	for g := 0; g < queriers; g++ {
+		go func(g int) {
+			for i := 0; i < rounds; i++ {
+				id := uint16(g*rounds + i + 2)
+				resp := t2s.cache.query(packQuery(t, id, "shared.example.", dns.TypeA))
+				if resp == nil || resp.Id != id || len(resp.Answer) != 2 {
+					errs <- fmt.Errorf("query %d got %v", id, resp)
+					return
+				}
+			}
+			errs <- nil
+		}(g)
+	}
+	for g := 0; g < queriers; g++ {
+		if e := <-errs; e != nil {
+			t.Fatal(e)
+		}
+	}
+	// the stored message is never handed out
+	for _, entry := range t2s.cache.storage {
+		if entry.msg.Id != 1 {
+			t.Fatalf("stored message carries ID %d", entry.msg.Id)
+		}
+	}
+}
+
+func TestDNSCacheSizeEvictsLRUButNotPinned(t *testing.T) {
+	t2s := New(nil, true)
+	t2s.SetDNSCacheSize(2)
+	cache := func(name string) {
+		t2s.cache.store(packReply(t, packQuery(t, 1, name, dns.TypeA), 300, "192.0.2.1"))
+	}
+	cached := func(name string) bool {
+		_, hit := t2s.PeekDNSCache(name, dns.TypeA)
+		return hit
+	}
+
+	cache("pinned.example.")
+	t2s.PinDNSName("pinned.example.", dns.TypeA)
+	cache("a.example.")
+	cache("b.example.")
+	// serving a makes b the least recently used
+	time.Sleep(time.Millisecond)
+	if t2s.cache.query(packQuery(t, 2, "a.example.", dns.TypeA)) == nil {
+		t.Fatal("a.example. not served")
+	}
+	cache("c.example.")
+	if !cached("a.example.") || cached("b.example.") || !cached("c.example.") {
+		t.Fatal("least recently used entry not evicted for c.example.")
+	}
+
+	// pinned entries outlast any pressure and don't count toward the bound
+	for i := 0; i < 20; i++ {
+		cache(fmt.Sprintf("n%d.example.", i))
+	}
+	if !cached("pinned.example.") {
+		t.Fatal("pinned entry evicted")
+	}
+	if n := len(t2s.cache.storage); n != 3 {
+		t.Fatalf("%d entries cached, want 2 and the pinned one", n)
+	}
+
+	// shrinking the bound evicts right away
+	t2s.SetDNSCacheSize(1)
+	if n := len(t2s.cache.storage); n != 2 || !cached("pinned.example.") || !cached("n19.example.") {
+		t.Fatalf("%d entries cached after shrinking, want the newest and the pinned one", n)
+	}
+}
+
+func TestECSAwareCache(t *testing.T) {
+	ecsQuery := func(subnet string) []byte {
+		msg := new(dns.Msg)
+		msg.SetQuestion("geo.example.", dns.TypeA)
+		if subnet != "" {
+			_, n, _ := net.ParseCIDR(subnet)
+			ones, _ := n.Mask.Size()
+			opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+			opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+				Code:          dns.EDNS0SUBNET,
+				Family:        1,
+				SourceNetmask: uint8(ones),
+				Address:       n.IP,
+			})
+			msg.Extra = append(msg.Extra, opt)
+		}
+		data, e := msg.Pack()
+		if e != nil {
+			t.Fatal(e)
+		}
+		return data
+	}
+	// upstreams echo the ECS option of the query
+	ecsReply := func(subnet, ip string) []byte {
+		query := new(dns.Msg)
+		if e := query.Unpack(ecsQuery(subnet)); e != nil {
+			t.Fatal(e)
+		}
+		resp := new(dns.Msg)
+		resp.SetReply(query)
+		resp.Extra = query.Extra
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: "geo.example.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.ParseIP(ip),
+		})
+		data, e := resp.Pack()
+		if e != nil {
+			t.Fatal(e)
+		}
+		return data
+	}
+	answer := func(c *dnsCache, subnet string) string {
+		msg := c.query(ecsQuery(subnet))
+		if msg == nil || len(msg.Answer) == 0 {
+			return ""
+		}
+		return msg.Answer[0].(*dns.A).A.String()
+	}
+
+	for _, aware := range []bool{true, false} {
+		t2s := New(nil, true)
+		t2s.SetECSAwareCache(aware)
+		europe, asia := "192.0.2.0/24", "198.51.100.0/24"
+		t2s.cache.store(ecsReply(europe, "203.0.113.1"))
+		t2s.cache.store(ecsReply(asia, "203.0.113.2"))
+
+		got := []string{answer(t2s.cache, europe), answer(t2s.cache, asia), answer(t2s.cache, "")}
+		want := []string{"203.0.113.1", "203.0.113.2", ""}
+		if !aware {
+			// a single entry, whichever answer it kept, for every subnet
+			want = []string{got[0], got[0], got[0]}
+			if got[0] == "" {
+				t.Fatal("nothing cached without ECS awareness")
+			}
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("aware %v: answers %v, want %v", aware, got, want)
+				break
+			}
+		}
+	}
+}
+
+func TestDNSTTLOverrideExpiry(t *testing.T) {
+	t2s := New(nil, true)
+	const override = 200 * time.Millisecond
+	t2s.SetDNSTTLOverrides([]DNSTTLOverride{{Suffix: "example.com", TTL: override}})
+	for _, name := range []string{"www.example.com.", "example.com.", "example.org."} {
+		t2s.cache.store(packReply(t, packQuery(t, 1, name, dns.TypeA), 300, "192.0.2.1"))
+	}
+
+	for _, name := range []string{"www.example.com.", "example.com."} {
+		if remaining, hit := t2s.PeekDNSCache(name, dns.TypeA); !hit || remaining > override {
+			t.Fatalf("%s cached for %s, want at most %s", name, remaining, override)
+		}
+		// records are served with their own TTLs
+		msg := t2s.cache.query(packQuery(t, 2, name, dns.TypeA))
+		if msg == nil || msg.Answer[0].Header().Ttl != 300 {
+			t.Fatalf("%s served as %v", name, msg)
+		}
+	}
+	if remaining, _ := t2s.PeekDNSCache("example.org.", dns.TypeA); remaining < time.Minute {
+		t.Fatalf("example.org. cached for %s, want its record TTL", remaining)
+	}
+
+	time.Sleep(override + 50*time.Millisecond)
+	for _, name := range []string{"www.example.com.", "example.com."} {
+		if t2s.cache.query(packQuery(t, 3, name, dns.TypeA)) != nil {
+			t.Fatalf("%s served past its overridden TTL", name)
+		}
+	}
+	if t2s.cache.query(packQuery(t, 3, "example.org.", dns.TypeA)) == nil {
+		t.Fatal("example.org. expired with the override of another suffix")
+	}
+}
+
+func TestDNSCompressionToggle(t *testing.T) {
+	t2s, p := NewTun2SocksWithPipe()
+	serve(t, t2s)
+	query := packQuery(t, 1, "compress.example.", dns.TypeA)
+	if e := t2s.PreloadDNS([]PreloadEntry{{Response: packReply(t, query, 300, "192.0.2.1", "192.0.2.2", "192.0.2.3")}}); e != nil {
+		t.Fatal(e)
+	}
+
+	served := func(compress bool) []byte {
+		t2s.SetDNSCompression(compress)
+		p.Inject(udpIPv4(clientIP, 4000, resolverIP, 53, query))
+		_, udp := nextUDP(t, p)
+		if len(unpackDNS(t, udp).Answer) != 3 {
+			t.Fatalf("compress %v: answers missing", compress)
+		}
+		return udp.Payload
+	}
+	compressed, plain := served(true), served(false)
+	// each answer repeats the name of the question, in 2 bytes compressed
+	if want := len(compressed) + 3*(len("compress.example.")+1-2); len(plain) != want {
+		t.Fatalf("%d bytes uncompressed, %d compressed, want %d uncompressed", len(plain), len(compressed), want)
+	}
+}
+
+func TestEchoDNSIPID(t *testing.T) {
+	s := newStubSocks(t, stubResolver(answerA))
+	t2s, p := NewTun2SocksWithPipe()
+	s.route(t2s)
+	t2s.SetIPIDFunc(func() uint16 { return 7 })
+	serve(t, t2s)
+
+	query := func(ipid uint16, name string) uint16 {
+		raw := udpIPv4(clientIP, 4000, resolverIP, 53, packQuery(t, ipid, name, dns.TypeA))
+		binary.BigEndian.PutUint16(raw[4:], ipid)
+		binary.BigEndian.PutUint16(raw[10:], 0)
+		binary.BigEndian.PutUint16(raw[10:], packet.Checksum(raw[:20]))
+		p.Inject(raw)
+		ip, _ := nextUDP(t, p)
+		return ip.Id
+	}
+	if id := query(0x1234, "echo.example."); id != 7 {
+		t.Fatalf("response IP ID %#x, want a fresh one by default", id)
+	}
+	t2s.SetEchoDNSIPID(true)
+	// relayed, then served from the cache
+	if id := query(0x2345, "echo2.example."); id != 0x2345 {
+		t.Fatalf("relayed response IP ID %#x, want the query's", id)
+	}
+	waitFor(t, "answer cached", func() bool {
+		_, hit := t2s.PeekDNSCache("echo2.example.", dns.TypeA)
+		return hit
+	})
+	if id := query(0x3456, "echo2.example."); id != 0x3456 {
+		t.Fatalf("cached response IP ID %#x, want the query's", id)
+	}
+}
+
+func TestDNSConcurrentStoresKeepFreshest(t *testing.T) {
+	t2s := New(nil, true)
+	query := packQuery(t, 1, "burst.example.", dns.TypeA)
+	var wg sync.WaitGroup
+	for i := 1; i <= 50; i++ {
+		reply := packReply(t, query, uint32(i*10), fmt.Sprintf("192.0.2.%d", i))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			t2s.cache.store(reply)
+		}()
+	}
+	wg.Wait()
+	msg := t2s.cache.query(query)
+	if msg == nil || msg.Answer[0].(*dns.A).A.String() != "192.0.2.50" {
+		t.Fatalf("cached %v, want the answer of the longest TTL", msg)
+	}
+
+	// an answer lasting less doesn't replace it
+	t2s.cache.store(packReply(t, query, 10, "192.0.2.1"))
+	if msg := t2s.cache.query(query); msg.Answer[0].(*dns.A).A.String() != "192.0.2.50" {
+		t.Fatalf("cached %s, replaced by an older answer", msg.Answer[0])
+	}
+}
+
+func TestRejectBadDNS(t *testing.T) {
+	empty := new(dns.Msg)
+	empty.Id = 7
+	noQuestion, e := empty.Pack()
+	if e != nil {
+		t.Fatal(e)
+	}
+	// a header promising a question that isn't there
+	truncated := append([]byte(nil), noQuestion...)
+	truncated[0], truncated[1], truncated[5] = 0, 8, 1
+
+	for _, reject := range []bool{true, false} {
+		s := newStubSocks(t, echoUDP)
+		t2s, p := NewTun2SocksWithPipe()
+		s.route(t2s)
+		t2s.SetRejectBadDNS(reject)
+		serve(t, t2s)
+
+		for i, payload := range [][]byte{noQuestion, truncated} {
+			p.Inject(udpIPv4(clientIP, uint16(4000+i), resolverIP, 53, payload))
+			_, udp := nextUDP(t, p)
+			relayed := false
+			select {
+			case <-s.requests:
+				relayed = true
+			default:
+			}
+			if !reject {
+				if !relayed {
+					t.Fatalf("query %d not relayed with rejecting off", i)
+				}
+				continue
+			}
+			if relayed {
+				t.Fatalf("malformed query %d relayed upstream", i)
+			}
+			if len(udp.Payload) < 12 || binary.BigEndian.Uint16(udp.Payload) != dnsID(payload) ||
+				udp.Payload[2]&0x80 == 0 || udp.Payload[3]&0xf != dns.RcodeFormatError {
+				t.Fatalf("query %d answered % x, want FORMERR", i, udp.Payload)
+			}
+		}
+		if reject {
+			// too short to answer at all
+			p.Inject(udpIPv4(clientIP, 4002, resolverIP, 53, []byte{0, 1, 2}))
+			noPacket(t, p, 50*time.Millisecond)
+		}
+		t2s.Stop()
+	}
+}
+
+func TestDNSPaddingToBlock(t *testing.T) {
+	// answers of n records, echoing the OPT record of the query
+	answer := func(n int) func(req *dns.Msg) *dns.Msg {
+		return func(req *dns.Msg) *dns.Msg {
+			resp := answerA(req)
+			for i := 1; i < n; i++ {
+				resp.Answer = append(resp.Answer, &dns.A{Hdr: *resp.Answer[0].Header(), A: net.IP{192, 0, 2, byte(i)}})
+			}
+			if opt := req.IsEdns0(); opt != nil {
+				resp.SetEdns0(opt.UDPSize(), false)
+			}
+			resp.Compress = true
+			return resp
+		}
+	}
+	records := map[string]int{"big.example.": 70}
+	s := newStubSocks(t, stubResolver(func(req *dns.Msg) *dns.Msg {
+		n := records[req.Question[0].Name]
+		if n == 0 {
+			n = 1
+		}
+		return answer(n)(req)
+	}))
+	t2s, p := NewTun2SocksWithPipe()
+	s.route(t2s)
+	const block = 128
+	t2s.SetDNSPadding(block)
+	serve(t, t2s)
+
+	query := func(id uint16, name string, udpSize uint16) []byte {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		msg.Id = id
+		if udpSize > 0 {
+			msg.SetEdns0(udpSize, false)
+		}
+		data, e := msg.Pack()
+		if e != nil {
+			t.Fatal(e)
+		}
+		return data
+	}
+	padding := func(msg *dns.Msg) *dns.EDNS0_PADDING {
+		if opt := msg.IsEdns0(); opt != nil {
+			for _, o := range opt.Option {
+				if pad, ok := o.(*dns.EDNS0_PADDING); ok {
+					return pad
+				}
+			}
+		}
+		return nil
+	}
+
+	for i, tc := range []struct {
+		what    string
+		name    string
+		udpSize uint16
+		padded  bool
+	}{
+		{"relayed", "www.example.", 1232, true},
+		{"cached", "www.example.", 1232, true},
+		// the cache keeps the answer unpadded
+		{"cached without EDNS", "www.example.", 0, false},
+		{"without EDNS", "plain.example.", 0, false},
+		// some 1160 bytes, padded to 1280 it would be over what the client
+		// takes
+		{"over the client's size", "big.example.", 1232, false},
+	} {
+		p.Inject(udpIPv4(clientIP, uint16(4000+i), resolverIP, 53, query(uint16(i), tc.name, tc.udpSize)))
+		_, udp := nextUDP(t, p)
+		msg := unpackDNS(t, udp)
+		if msg.Truncated || len(msg.Answer) == 0 {
+			t.Fatalf("%s: got %v", tc.what, msg)
+		}
+		if !tc.padded {
+			if padding(msg) != nil || (tc.udpSize > 0 && len(udp.Payload) > int(tc.udpSize)) {
+				t.Fatalf("%s: padded to %d bytes", tc.what, len(udp.Payload))
+			}
+			continue
+		}
+		if padding(msg) == nil || len(udp.Payload)%block != 0 {
+			t.Fatalf("%s: %d bytes, want padding to a multiple of %d", tc.what, len(udp.Payload), block)
+		}
+	}
+
+	// the caps on responses leave less room
+	r := New(nil, true)
+	_, local, _ := net.ParseCIDR("192.0.2.0/24")
+	for _, tc := range []struct {
+		what string
+		set  func()
+		room int
+	}{
+		{"EDNS size", func() {}, 65535},
+		{"size cap", func() { r.SetMaxUDPResponseSize(1000) }, 1000},
+		{"fragment cap", func() { r.SetMaxUDPResponseSize(0); r.SetMaxFragments(1) }, MTU - 28},
+		{"no fragments", func() { r.SetMaxFragments(0); r.SetNoFragment([]*net.IPNet{local}) }, MTU - 28},
+	} {
+		tc.set()
+		if room := r.dnsResponseRoom(net.IP{192, 0, 2, 1}, 65535); room != tc.room {
+			t.Errorf("%s: room for %d bytes, want %d", tc.what, room, tc.room)
+		}
+	}
+	r.SetAdaptiveMTU(1000, 600, 1)
+	r.adaptMTU.dests[string(net.IP{192, 0, 2, 1}.To16())] = &destMTU{mtu: 600, lowered: time.Now()}
+	if room := r.dnsResponseRoom(net.IP{192, 0, 2, 1}, 65535); room != 600-28 {
+		t.Errorf("room for %d bytes unfragmented at a path MTU of 600", room)
+	}
+	if room := r.dnsResponseRoom(resolverIP, 0); room != dns.MinMsgSize {
+		t.Errorf("room for %d bytes without EDNS", room)
+	}
+}
+
+// answerBigA answers with more A records than fit in one packet at MTU.
+func answerBigA(req *dns.Msg) *dns.Msg {
+	resp := answerA(req)
+	for len(resp.Answer) < 1200 {
+		resp.Answer = append(resp.Answer, resp.Answer[0])
+	}
+	return resp
+}
+
+// nextDNSTo returns the next DNS response emitted to the app's port, skipping
+// the fragments of others.
+func nextDNSTo(tb testing.TB, p *tun.MemoryTun, port uint16) (*packet.IPv4, *dns.Msg) {
+	tb.Helper()
+	for {
+		var ip packet.IPv4
+		var udp packet.UDP
+		if e := packet.ParseIPv4(nextPacket(tb, p), &ip); e != nil {
+			tb.Fatal(e)
+		}
+		if ip.FragOffset != 0 || packet.ParseUDP(ip.Payload, &udp) != nil || udp.DstPort != port {
+			continue
+		}
+		return &ip, unpackDNS(tb, &udp)
+	}
+}
+
+func TestNoFragmentTruncatesEveryDNSPath(t *testing.T) {
+	noFrag := []*net.IPNet{{IP: resolverIP, Mask: net.CIDRMask(32, 32)}}
+	checkTC := func(t *testing.T, p *tun.MemoryTun, port, id uint16) {
+		t.Helper()
+		ip, resp := nextDNSTo(t, p, port)
+		if ip.Flags&0x1 != 0 {
+			t.Fatal("response fragmented")
+		}
+		if resp.Id != id || !resp.Truncated || len(resp.Answer) != 0 {
+			t.Fatalf("got %v, want an empty truncated response to %d", resp, id)
+		}
+	}
+
+	t.Run("relayed", func(t *testing.T) {
+		s := newStubSocks(t, stubResolver(answerBigA))
+		t2s, p := NewTun2SocksWithPipe()
+		s.route(t2s)
+		t2s.SetNoFragment(noFrag)
+		serve(t, t2s)
+		p.Inject(udpIPv4(clientIP, 4000, resolverIP, 53, packQuery(t, 1, "big.example.", dns.TypeA)))
+		checkTC(t, p, 4000, 1)
+	})
+
+	t.Run("cached", func(t *testing.T) {
+		t2s, p := NewTun2SocksWithPipe()
+		t2s.SetNoFragment(noFrag)
+		serve(t, t2s)
+		query := packQuery(t, 1, "big.example.", dns.TypeA)
+		ips := make([]string, 1200)
+		for i := range ips {
+			ips[i] = fmt.Sprintf("192.0.%d.%d", 2+i/250, i%250)
+		}
+		if e := t2s.PreloadDNS([]PreloadEntry{{Response: packReply(t, query, 300, ips...)}}); e != nil {
+			t.Fatal(e)
+		}
+		p.Inject(udpIPv4(clientIP, 4000, resolverIP, 53, packQuery(t, 2, "big.example.", dns.TypeA)))
+		checkTC(t, p, 4000, 2)
+	})
+
+	t.Run("waiting", func(t *testing.T) {
+		release := make(chan struct{})
+		answer := stubResolver(answerBigA)
+		s := newStubSocks(t, func(req *gosocks.UDPRequest) []byte {
+			<-release
+			return answer(req)
+		})
+		t2s, p := NewTun2SocksWithPipe()
+		s.route(t2s)
+		t2s.SetNoFragment(noFrag)
+		t2s.SetDNSDedupOnly(true)
+		serve(t, t2s)
+
+		// the query goes to a resolver fragments may come from, its
+		// duplicate to one they may not
+		other := net.IP{8, 8, 4, 4}
+		p.Inject(udpIPv4(clientIP, 4000, other, 53, packQuery(t, 1, "big.example.", dns.TypeA)))
+		select {
+		case <-s.requests:
+		case <-time.After(5 * time.Second):
+			t.Fatal("query not relayed")
+		}
+		p.Inject(udpIPv4(clientIP, 4001, resolverIP, 53, packQuery(t, 2, "big.example.", dns.TypeA)))
+		noPacket(t, p, 50*time.Millisecond)
+		close(release)
+		checkTC(t, p, 4001, 2)
+	})
+
+	t.Run("DoT", func(t *testing.T) {
+		s := newStubDoT(t, answerBigA)
+		t2s, p := NewTun2SocksWithPipe()
+		s.use(t, t2s, "")
+		t2s.SetNoFragment(noFrag)
+		serve(t, t2s)
+		p.Inject(udpIPv4(clientIP, 4000, resolverIP, 53, packQuery(t, 1, "big.example.", dns.TypeA)))
+		checkTC(t, p, 4000, 1)
+	})
+}
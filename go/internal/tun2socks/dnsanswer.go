@@ -0,0 +1,103 @@
+package tun2socks
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DNSAnswer maps a queried name to the addresses it resolved to, e.g. to
+// route or display connections by domain rather than bare IP.
+type DNSAnswer struct {
+	// Name is the queried name.
+	Name string
+	// CNAMEs are the aliases Name led to, in chain order.
+	CNAMEs []string
+	// IPs are the A and AAAA records of Name or its aliases.
+	IPs []net.IP
+	// TTL is the lowest TTL of the records involved.
+	TTL time.Duration
+	// Cached is true if the answer came from the DNS cache.
+	Cached bool
+}
+
+// SetDNSAnswerHandler sets a function receiving every DNS response handed to
+// a client that resolved to addresses, from the cache or upstream. Like the
+// log hook it is called on a separate goroutine, and answers are dropped if
+// it falls behind. The goroutine of a handler replaced, unset or stopped
+// with Stop ends once it has handled the answers queued for it.
+func (t2s *Tun2Socks) SetDNSAnswerHandler(handler func(DNSAnswer)) {
+	t2s.dnsHookLock.Lock()
+	defer t2s.dnsHookLock.Unlock()
+	if t2s.dnsAnswerCh != nil {
+		close(t2s.dnsAnswerCh)
+		t2s.dnsAnswerCh = nil
+	}
+	if handler == nil {
+		return
+	}
+	ch := make(chan *dnsLogEntry, dnsLogQueueSize)
+	go func() {
+		for entry := range ch {
+			resp := new(dns.Msg)
+			if resp.Unpack(entry.payload) != nil {
+				continue
+			}
+			answer, ok := parseDNSAnswer(resp)
+			if !ok {
+				continue
+			}
+			answer.Cached = entry.cached
+			handler(answer)
+		}
+	}()
+	t2s.dnsAnswerCh = ch
+}
+
+// parseDNSAnswer follows the CNAME chain from the question of resp and
+// collects the addresses of the names on it. ok is false if resp resolved to
+// no address.
+func parseDNSAnswer(resp *dns.Msg) (answer DNSAnswer, ok bool) {
+	if len(resp.Question) == 0 || len(resp.Answer) == 0 {
+		return
+	}
+	answer.Name = resp.Question[0].Name
+	chain := map[string]bool{strings.ToLower(answer.Name): true}
+
+	// each hop uses a CNAME record, which bounds a looping chain
+	name := answer.Name
+	for range resp.Answer {
+		next := ""
+		for _, rr := range resp.Answer {
+			if cname, isCNAME := rr.(*dns.CNAME); isCNAME && strings.EqualFold(cname.Hdr.Name, name) {
+				next = cname.Target
+				break
+			}
+		}
+		if next == "" || chain[strings.ToLower(next)] {
+			break
+		}
+		answer.CNAMEs = append(answer.CNAMEs, next)
+		chain[strings.ToLower(next)] = true
+		name = next
+	}
+
+	for _, rr := range resp.Answer {
+		if !chain[strings.ToLower(rr.Header().Name)] {
+			continue
+		}
+		switch rr := rr.(type) {
+		case *dns.A:
+			answer.IPs = append(answer.IPs, rr.A)
+		case *dns.AAAA:
+			answer.IPs = append(answer.IPs, rr.AAAA)
+		}
+	}
+	if len(answer.IPs) == 0 {
+		return
+	}
+	answer.TTL = minTTL(resp)
+	return answer, true
+}
@@ -0,0 +1,80 @@
+package tun2socks
+
+import (
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestDNSAnswerHandler(t *testing.T) {
+	s := newStubSocks(t, stubResolver(func(req *dns.Msg) *dns.Msg {
+		resp := answerA(req)
+		if req.Question[0].Name == "alias.example." {
+			resp.Answer = []dns.RR{
+				&dns.CNAME{
+					Hdr:    dns.RR_Header{Name: "alias.example.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60},
+					Target: "target.example.",
+				},
+				&dns.A{
+					Hdr: dns.RR_Header{Name: "target.example.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+					A:   net.IP{192, 0, 2, 7},
+				},
+			}
+		}
+		return resp
+	}))
+	t2s, p := NewTun2SocksWithPipe()
+	s.route(t2s)
+	answers := make(chan DNSAnswer, 10)
+	t2s.SetDNSAnswerHandler(func(a DNSAnswer) { answers <- a })
+	serve(t, t2s)
+	next := func() DNSAnswer {
+		t.Helper()
+		select {
+		case a := <-answers:
+			return a
+		case <-time.After(5 * time.Second):
+			t.Fatal("no answer handled")
+		}
+		return DNSAnswer{}
+	}
+
+	resolve(t, s, p, 1, "alias.example.")
+	a := next()
+	if a.Name != "alias.example." || len(a.CNAMEs) != 1 || a.CNAMEs[0] != "target.example." ||
+		len(a.IPs) != 1 || !a.IPs[0].Equal(net.IP{192, 0, 2, 7}) || a.TTL != time.Minute || a.Cached {
+		t.Fatalf("got %+v", a)
+	}
+
+	// replacing the handler ends the goroutine of the old one
+	before := runtime.NumGoroutine()
+	replaced := make(chan DNSAnswer, 10)
+	t2s.SetDNSAnswerHandler(func(a DNSAnswer) { replaced <- a })
+	waitGoroutines(t, before)
+	resolve(t, s, p, 2, "b.example.")
+	select {
+	case a := <-replaced:
+		if a.Name != "b.example." {
+			t.Fatalf("got %+v", a)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no answer handled by the new handler")
+	}
+	select {
+	case a := <-answers:
+		t.Fatalf("replaced handler got %+v", a)
+	default:
+	}
+
+	// so do unsetting it and stopping
+	t2s.SetDNSAnswerHandler(nil)
+	waitGoroutines(t, before-1)
+	t2s.SetDNSAnswerHandler(func(DNSAnswer) {})
+	t2s.Stop()
+	if t2s.dnsHooked() {
+		t.Fatal("handler set after Stop")
+	}
+}
@@ -0,0 +1,258 @@
+package tun2socks
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/dkwiebe/gotun2socks/internal/packet"
+	"github.com/miekg/dns"
+)
+
+// duplicates of a query in flight that wait for its answer, beyond which
+// more are dropped
+const dnsMaxWaiters = 64
+
+// dnsFlight is a query relayed upstream and the duplicates waiting for its
+// answer.
+type dnsFlight struct {
+	start   time.Time
+	waiters []*dnsWaiter
+}
+
+// dnsWaiter is a duplicate query to answer along with the query in flight.
+type dnsWaiter struct {
+	dev           *tunDevice
+	local, remote net.IP
+	lPort, rPort  uint16
+	// DNS transaction ID, IP ID and TOS of the duplicate
+	id, ipid uint16
+	tos      uint8
+	// EDNS UDP payload size the duplicate advertised
+	udpSize int
+}
+
+// SetDNSDedupOnly turns the DNS cache into an in-flight table for users who
+// want no stale answers: answers are no longer kept for their TTL, but a
+// query asking what a query still waiting for its answer asked gets that
+// answer too instead of going upstream, as during retransmit storms. The
+// answer is dropped once handed out. Preloaded answers are still served.
+func (t2s *Tun2Socks) SetDNSDedupOnly(enabled bool) {
+	if t2s.cache == nil {
+		return
+	}
+	t2s.cache.mutex.Lock()
+	defer t2s.cache.mutex.Unlock()
+	if enabled && !t2s.cache.dedupOnly {
+		t2s.cache.storage = make(map[string]*dnsCacheEntry)
+	}
+	t2s.cache.dedupOnly = enabled
+	t2s.cache.trackFlights()
+}
+
+// SetDNSRefreshGrace keeps expired DNS cache entries for grace so that the
+// queries for one arriving at once wait for a single refresh: the first goes
+// upstream, the others get its answer. Expired entries are never served.
+// 0, the default, drops entries as they expire.
+func (t2s *Tun2Socks) SetDNSRefreshGrace(grace time.Duration) {
+	if t2s.cache == nil {
+		return
+	}
+	t2s.cache.mutex.Lock()
+	defer t2s.cache.mutex.Unlock()
+	t2s.cache.refreshGrace = grace
+	t2s.cache.trackFlights()
+}
+
+// trackFlights sets up the in-flight table if a mode needs it, or drops it.
+// c.mutex must be held.
+func (c *dnsCache) trackFlights() {
+	if !c.dedupOnly && c.refreshGrace == 0 {
+		c.inflight = nil
+	} else if c.inflight == nil {
+		c.inflight = make(map[string]*dnsFlight)
+	}
+}
+
+// refreshing reports whether the entry for key expired within the refresh
+// grace period. c.mutex must be held.
+func (c *dnsCache) refreshing(key string) bool {
+	entry := c.storage[key]
+	if entry == nil || c.refreshGrace == 0 {
+		return false
+	}
+	now := time.Now()
+	return now.After(entry.exp) && now.Before(entry.exp.Add(c.refreshGrace))
+}
+
+// join parks a query read from dev behind the same query in flight, or marks
+// it as in flight if there is none, in dedup-only mode or for an entry being
+// refreshed. It reports whether the query was parked,
+// and so must not be relayed.
+func (c *dnsCache) join(dev *tunDevice, ip *packet.IPv4, udp *packet.UDP) bool {
+	c.mutex.Lock()
+	dedup := c.inflight != nil
+	c.mutex.Unlock()
+	if !dedup {
+		return false
+	}
+	request := new(dns.Msg)
+	if request.Unpack(udp.Payload) != nil || len(request.Question) == 0 {
+		return false
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.inflight == nil || c.bypass(request) {
+		return false
+	}
+	key := c.key(request)
+	if !c.dedupOnly && !c.refreshing(key) {
+		return false
+	}
+	flight := c.inflight[key]
+	if flight == nil || time.Since(flight.start) > DNS_IDLE_TIMEOUT {
+		c.inflight[key] = &dnsFlight{start: time.Now()}
+		return false
+	}
+	if len(flight.waiters) < dnsMaxWaiters {
+		flight.waiters = append(flight.waiters, &dnsWaiter{
+			dev:     dev,
+			local:   append(net.IP(nil), ip.SrcIP...),
+			remote:  append(net.IP(nil), ip.DstIP...),
+			lPort:   udp.SrcPort,
+			rPort:   udp.DstPort,
+			id:      dnsID(udp.Payload),
+			ipid:    ip.Id,
+			tos:     ip.TOS,
+			udpSize: dnsUDPSize(udp.Payload),
+		})
+	}
+	return true
+}
+
+// land ends the flight of the query payload answers and returns the
+// duplicates that waited for it.
+func (c *dnsCache) land(payload []byte) []*dnsWaiter {
+	resp := new(dns.Msg)
+	if len(payload) < 2 || resp.Unpack(payload) != nil || len(resp.Question) == 0 {
+		return nil
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	key := c.key(resp)
+	flight := c.inflight[key]
+	if flight == nil {
+		return nil
+	}
+	delete(c.inflight, key)
+	return flight.waiters
+}
+
+// expireFlights forgets queries that went unanswered, whose duplicates have
+// long been retried by then.
+func (c *dnsCache) expireFlights() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for key, flight := range c.inflight {
+		if time.Since(flight.start) > DNS_IDLE_TIMEOUT {
+			delete(c.inflight, key)
+		}
+	}
+}
+
+// SetDNSStoreQueue moves caching DNS responses off the relay path to a
+// worker, queueing up to depth responses, so that the next response of a
+// busy DNS session isn't held up by parsing the last one. Duplicates waiting
+// for a response are still answered right away. Responses are not cached if
+// the queue is full. 0, the default, caches responses as they are relayed.
+// The worker of a queue replaced, removed or stopped with Stop ends once it
+// has stored the responses queued for it.
+func (t2s *Tun2Socks) SetDNSStoreQueue(depth int) {
+	t2s.dnsStoreLock.Lock()
+	defer t2s.dnsStoreLock.Unlock()
+	if t2s.dnsStoreCh != nil {
+		close(t2s.dnsStoreCh)
+		t2s.dnsStoreCh = nil
+	}
+	if depth <= 0 {
+		return
+	}
+	ch := make(chan []byte, depth)
+	go func() {
+		for data := range ch {
+			t2s.storeDNS(data)
+		}
+	}()
+	t2s.dnsStoreCh = ch
+}
+
+// closeDNSStoreQueue ends the worker of the store queue once it has stored
+// the responses queued for it.
+func (t2s *Tun2Socks) closeDNSStoreQueue() {
+	t2s.dnsStoreLock.Lock()
+	defer t2s.dnsStoreLock.Unlock()
+	if t2s.dnsStoreCh != nil {
+		close(t2s.dnsStoreCh)
+	}
+	t2s.dnsStoreCh = nil
+}
+
+// cacheDNS caches a DNS response as the resolver sent it, on the worker if
+// there is a store queue, never blocking, and answers the duplicates of its
+// query that waited for it. data must not be modified afterwards.
+func (t2s *Tun2Socks) cacheDNS(data []byte) {
+	if !t2s.queueDNSStore(data) {
+		t2s.storeDNS(data)
+	}
+	t2s.answerWaiters(data)
+}
+
+// queueDNSStore hands data to the store worker, dropping it if the queue is
+// full. It reports false if there is no store queue.
+func (t2s *Tun2Socks) queueDNSStore(data []byte) bool {
+	// held while sending, so the queue isn't closed meanwhile
+	t2s.dnsStoreLock.RLock()
+	defer t2s.dnsStoreLock.RUnlock()
+	if t2s.dnsStoreCh == nil {
+		return false
+	}
+	select {
+	case t2s.dnsStoreCh <- data:
+	default:
+		atomic.AddUint64(&t2s.stats.DNSStoreDropped, 1)
+	}
+	return true
+}
+
+// storeDNS caches a DNS response.
+func (t2s *Tun2Socks) storeDNS(data []byte) {
+	if t2s.dnsStore != nil {
+		t2s.dnsStore.Store(data)
+	}
+}
+
+// answerWaiters answers the duplicates of the query of a DNS response that
+// waited for it, each with its own ID.
+func (t2s *Tun2Socks) answerWaiters(data []byte) {
+	if t2s.cache == nil {
+		return
+	}
+	for _, w := range t2s.cache.land(data) {
+		// the duplicate may have asked a resolver the response doesn't fit
+		answer := t2s.fitDNSResponse(w.remote, data, w.udpSize)
+		if answer == nil {
+			continue
+		}
+		answer = append([]byte(nil), answer...)
+		answer[0], answer[1] = byte(w.id>>8), byte(w.id)
+		resp, fragments := t2s.responsePacket(w.local, w.remote, w.lPort, w.rPort, answer, t2s.responseID(w.ipid), w.tos)
+		if resp == nil {
+			continue
+		}
+		w.dev.writeCh <- resp
+		for _, frag := range fragments {
+			w.dev.writeCh <- frag
+		}
+	}
+}
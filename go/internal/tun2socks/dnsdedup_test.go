@@ -0,0 +1,200 @@
+package tun2socks
+
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/dkwiebe/gotun2socks/internal/gosocks"
+	"github.com/miekg/dns"
+)
+
+func TestDNSDedupOnly(t *testing.T) {
+	release := make(chan struct{})
+	answer := stubResolver(answerA)
+	s := newStubSocks(t, func(req *gosocks.UDPRequest) []byte {
+		<-release
+		return answer(req)
+	})
+	t2s, p := NewTun2SocksWithPipe()
+	s.route(t2s)
+	t2s.SetDNSDedupOnly(true)
+	serve(t, t2s)
+
+	// a query and its retransmit from another socket while it is in flight
+	p.Inject(udpIPv4(clientIP, 4000, resolverIP, 53, packQuery(t, 1, "www.example.", dns.TypeA)))
+	select {
+	case <-s.requests:
+	case <-time.After(5 * time.Second):
+		t.Fatal("query not relayed")
+	}
+	p.Inject(udpIPv4(clientIP, 4001, resolverIP, 53, packQuery(t, 2, "www.example.", dns.TypeA)))
+	noPacket(t, p, 50*time.Millisecond)
+	close(release)
+
+	answered := map[uint16]uint16{}
+	for i := 0; i < 2; i++ {
+		_, udp := nextUDP(t, p)
+		msg := unpackDNS(t, udp)
+		if len(msg.Answer) != 1 {
+			t.Fatalf("answer %v", msg)
+		}
+		answered[udp.DstPort] = msg.Id
+	}
+	if answered[4000] != 1 || answered[4001] != 2 {
+		t.Fatalf("answered IDs by port %v, want each query its own", answered)
+	}
+	select {
+	case <-s.requests:
+		t.Fatal("retransmit relayed upstream")
+	default:
+	}
+
+	// nothing is kept once answered
+	if _, upstream := resolve(t, s, p, 3, "www.example."); !upstream {
+		t.Fatal("answered from the cache after the query landed")
+	}
+	t2s.cache.mutex.Lock()
+	defer t2s.cache.mutex.Unlock()
+	if len(t2s.cache.storage) != 0 || len(t2s.cache.inflight) != 0 {
+		t.Fatalf("%d answers cached, %d queries in flight", len(t2s.cache.storage), len(t2s.cache.inflight))
+	}
+}
+
+func TestDNSRefreshGraceCoalesces(t *testing.T) {
+	release := make(chan struct{}, 10)
+	answer := stubResolver(answerA)
+	s := newStubSocks(t, func(req *gosocks.UDPRequest) []byte {
+		<-release
+		return answer(req)
+	})
+	t2s, p := NewTun2SocksWithPipe()
+	s.route(t2s)
+	t2s.SetDNSRefreshGrace(time.Minute)
+	serve(t, t2s)
+
+	release <- struct{}{}
+	if _, upstream := resolve(t, s, p, 1, "www.example."); !upstream {
+		t.Fatal("first lookup answered from the cache")
+	}
+	t2s.cache.mutex.Lock()
+	for _, entry := range t2s.cache.storage {
+		entry.exp = time.Now().Add(-time.Second)
+	}
+	t2s.cache.mutex.Unlock()
+
+	// apps asking for the name just expired at once
+	for i := uint16(0); i < 3; i++ {
+		p.Inject(udpIPv4(clientIP, 4001+i, resolverIP, 53, packQuery(t, 2+i, "www.example.", dns.TypeA)))
+	}
+	select {
+	case <-s.requests:
+	case <-time.After(5 * time.Second):
+		t.Fatal("refresh not relayed")
+	}
+	// none is answered from the expired entry
+	noPacket(t, p, 50*time.Millisecond)
+	release <- struct{}{}
+
+	answered := map[uint16]uint16{}
+	for i := 0; i < 3; i++ {
+		_, udp := nextUDP(t, p)
+		if msg := unpackDNS(t, udp); len(msg.Answer) == 1 {
+			answered[udp.DstPort] = msg.Id
+		}
+	}
+	if answered[4001] != 2 || answered[4002] != 3 || answered[4003] != 4 {
+		t.Fatalf("answered IDs by port %v, want each query its own", answered)
+	}
+	select {
+	case <-s.requests:
+		t.Fatal("expired name refreshed more than once")
+	default:
+	}
+
+	// the refresh is cached again
+	if _, upstream := resolve(t, s, p, 5, "www.example."); upstream {
+		t.Fatal("refreshed name not cached")
+	}
+}
+
+// stalledCache is a mapCache whose stores wait for release, signalling
+// entered as each starts.
+type stalledCache struct {
+	mapCache
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (c *stalledCache) Store(payload []byte) {
+	c.entered <- struct{}{}
+	<-c.release
+	c.mapCache.Store(payload)
+}
+
+func TestDNSStoreQueueOffRelayPath(t *testing.T) {
+	hold := make(chan struct{})
+	answer := stubResolver(answerA)
+	s := newStubSocks(t, func(req *gosocks.UDPRequest) []byte {
+		if m := new(dns.Msg); m.Unpack(req.Data) == nil && m.Question[0].Name == "w.example." {
+			<-hold
+		}
+		return answer(req)
+	})
+	t2s, p := NewTun2SocksWithPipe()
+	s.route(t2s)
+	cache := &stalledCache{
+		mapCache: mapCache{answers: map[string]*dns.Msg{}},
+		entered:  make(chan struct{}, 10),
+		release:  make(chan struct{}),
+	}
+	t2s.SetDNSCache(cache)
+	t2s.SetDNSDedupOnly(true)
+	t2s.SetDNSStoreQueue(1)
+	serve(t, t2s)
+
+	// answered while the worker is stuck storing the answer
+	resolve(t, s, p, 1, "a.example.")
+	select {
+	case <-cache.entered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("answer not stored")
+	}
+	// queued, then dropped with the queue full
+	resolve(t, s, p, 2, "b.example.")
+	resolve(t, s, p, 3, "c.example.")
+	if n := t2s.Stats().DNSStoreDropped; n != 1 {
+		t.Fatalf("%d stores dropped, want 1", n)
+	}
+
+	// a duplicate waiting for an answer gets it right away too
+	p.Inject(udpIPv4(clientIP, 4001, resolverIP, 53, packQuery(t, 4, "w.example.", dns.TypeA)))
+	select {
+	case <-s.requests:
+	case <-time.After(5 * time.Second):
+		t.Fatal("query not relayed")
+	}
+	p.Inject(udpIPv4(clientIP, 4002, resolverIP, 53, packQuery(t, 5, "w.example.", dns.TypeA)))
+	noPacket(t, p, 50*time.Millisecond)
+	close(hold)
+	answered := map[uint16]uint16{}
+	for i := 0; i < 2; i++ {
+		_, udp := nextUDP(t, p)
+		answered[udp.DstPort] = unpackDNS(t, udp).Id
+	}
+	if answered[4001] != 4 || answered[4002] != 5 {
+		t.Fatalf("answered IDs by port %v, want each query its own", answered)
+	}
+
+	close(cache.release)
+	waitFor(t, "queued answers stored", func() bool {
+		cache.mutex.Lock()
+		defer cache.mutex.Unlock()
+		return cache.answers["a.example."] != nil && cache.answers["b.example."] != nil
+	})
+
+	// the worker ends with its queue
+	before := runtime.NumGoroutine()
+	t2s.SetDNSStoreQueue(0)
+	waitGoroutines(t, before-1)
+}
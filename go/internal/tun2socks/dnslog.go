@@ -0,0 +1,110 @@
+package tun2socks
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const dnsLogQueueSize = 256
+
+// DNSEvent describes one DNS response handed to a client.
+type DNSEvent struct {
+	// Name is the queried name, or a hash of it if redaction is on.
+	Name  string
+	Qtype uint16
+	Rcode int
+	// Cached is true if the answer came from the DNS cache rather than an
+	// upstream lookup.
+	Cached bool
+	// Negative is true for an NXDOMAIN or NODATA response, a negative cache
+	// hit if Cached is set too.
+	Negative bool
+	Latency  time.Duration
+}
+
+type dnsLogEntry struct {
+	payload []byte
+	cached  bool
+	latency time.Duration
+}
+
+// SetDNSLogHook sets a function receiving a DNSEvent for every DNS response.
+// Responses are parsed and the hook is called on a separate goroutine; events
+// are dropped if the hook falls behind. With redact set, names are replaced
+// by a hash. The goroutine of a hook replaced, unset or stopped with Stop
+// ends once it has handled the events queued for it.
+func (t2s *Tun2Socks) SetDNSLogHook(hook func(DNSEvent), redact bool) {
+	t2s.dnsHookLock.Lock()
+	defer t2s.dnsHookLock.Unlock()
+	if t2s.dnsLogCh != nil {
+		close(t2s.dnsLogCh)
+		t2s.dnsLogCh = nil
+	}
+	if hook == nil {
+		return
+	}
+	ch := make(chan *dnsLogEntry, dnsLogQueueSize)
+	go func() {
+		for entry := range ch {
+			resp := new(dns.Msg)
+			if resp.Unpack(entry.payload) != nil || len(resp.Question) == 0 {
+				continue
+			}
+			ev := DNSEvent{
+				Name:     resp.Question[0].Name,
+				Qtype:    resp.Question[0].Qtype,
+				Rcode:    resp.Rcode,
+				Cached:   entry.cached,
+				Negative: resp.Rcode == dns.RcodeNameError || resp.Rcode == dns.RcodeSuccess && len(resp.Answer) == 0,
+				Latency:  entry.latency,
+			}
+			if redact {
+				sum := sha256.Sum256([]byte(ev.Name))
+				ev.Name = hex.EncodeToString(sum[:8])
+			}
+			hook(ev)
+		}
+	}()
+	t2s.dnsLogCh = ch
+}
+
+// dnsHooked reports whether a log hook or an answer handler is set.
+func (t2s *Tun2Socks) dnsHooked() bool {
+	t2s.dnsHookLock.RLock()
+	defer t2s.dnsHookLock.RUnlock()
+	return t2s.dnsLogCh != nil || t2s.dnsAnswerCh != nil
+}
+
+// closeDNSHooks ends the goroutines of the log hook and the answer handler.
+func (t2s *Tun2Socks) closeDNSHooks() {
+	t2s.dnsHookLock.Lock()
+	defer t2s.dnsHookLock.Unlock()
+	if t2s.dnsLogCh != nil {
+		close(t2s.dnsLogCh)
+	}
+	if t2s.dnsAnswerCh != nil {
+		close(t2s.dnsAnswerCh)
+	}
+	t2s.dnsLogCh = nil
+	t2s.dnsAnswerCh = nil
+}
+
+// logDNS queues a DNS response for the log hook and the answer handler, never
+// blocking. payload must not be modified afterwards.
+func (t2s *Tun2Socks) logDNS(payload []byte, cached bool, latency time.Duration) {
+	// held while sending, so the channels aren't closed meanwhile
+	t2s.dnsHookLock.RLock()
+	defer t2s.dnsHookLock.RUnlock()
+	for _, ch := range []chan *dnsLogEntry{t2s.dnsLogCh, t2s.dnsAnswerCh} {
+		if ch == nil {
+			continue
+		}
+		select {
+		case ch <- &dnsLogEntry{payload, cached, latency}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package tun2socks
+
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestDNSLogHookEvents(t *testing.T) {
+	s := newStubSocks(t, stubResolver(func(req *dns.Msg) *dns.Msg {
+		resp := new(dns.Msg)
+		switch req.Question[0].Name {
+		case "empty.example.":
+			return resp.SetReply(req)
+		case "nx.example.":
+			return resp.SetRcode(req, dns.RcodeNameError)
+		}
+		return answerA(req)
+	}))
+	t2s, dev := NewTun2SocksWithPipe()
+	s.route(t2s)
+	events := make(chan DNSEvent, 10)
+	t2s.SetDNSLogHook(func(ev DNSEvent) { events <- ev }, false)
+	serve(t, t2s)
+
+	for i, c := range []struct {
+		name             string
+		cached, negative bool
+		rcode            int
+	}{
+		{"a.example.", false, false, dns.RcodeSuccess},
+		{"a.example.", true, false, dns.RcodeSuccess},
+		{"empty.example.", false, true, dns.RcodeSuccess},
+		{"nx.example.", false, true, dns.RcodeNameError},
+	} {
+		resolve(t, s, dev, uint16(i), c.name)
+		var ev DNSEvent
+		select {
+		case ev = <-events:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no event for %s", c.name)
+		}
+		if ev.Name != c.name || ev.Qtype != dns.TypeA || ev.Cached != c.cached || ev.Negative != c.negative || ev.Rcode != c.rcode {
+			t.Errorf("event %+v, want %s cached %v negative %v rcode %d", ev, c.name, c.cached, c.negative, c.rcode)
+		}
+		waitFor(t, c.name+" cached", func() bool {
+			return t2s.cache.query(packQuery(t, 1, c.name, dns.TypeA)) != nil || c.negative
+		})
+	}
+
+	// unsetting the hook ends its goroutine
+	before := runtime.NumGoroutine()
+	t2s.SetDNSLogHook(nil, false)
+	waitGoroutines(t, before-1)
+}
@@ -0,0 +1,126 @@
+package tun2socks
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// PreloadEntry is a DNS answer put into the cache by PreloadDNS.
+type PreloadEntry struct {
+	// Response is a packed DNS response to cache as is. If nil, Name is
+	// resolved for Qtype when preloading.
+	Response []byte
+	Name     string
+	Qtype    uint16
+	// TTL overrides the TTL of the response, and of its records, if not 0.
+	TTL time.Duration
+}
+
+// PreloadDNS fills the DNS cache, e.g. at startup so the first lookups are
+// answered even before upstream is reachable. Names to resolve are sent to
+// the resolver SetDNSForwarding picks for them. Preloaded answers expire
+// after their TTL like any other; the first entry that fails stops the
+// preload.
+func (t2s *Tun2Socks) PreloadDNS(entries []PreloadEntry) error {
+	if t2s.cache == nil {
+		return fmt.Errorf("DNS cache is disabled")
+	}
+	for _, entry := range entries {
+		payload := entry.Response
+		if payload == nil {
+			var e error
+			payload, e = t2s.resolve(entry.Name, entry.Qtype)
+			if e != nil {
+				return e
+			}
+		}
+		resp := new(dns.Msg)
+		e := resp.Unpack(payload)
+		if e != nil {
+			return e
+		}
+		if len(resp.Question) == 0 || len(resp.Answer) == 0 {
+			return fmt.Errorf("DNS response for %s has no answer", entry.Name)
+		}
+		if entry.TTL != 0 {
+			// served TTLs count down from the override, not from the
+			// record TTLs, which may run out first
+			setTTLs(resp, entry.TTL)
+			if payload, e = resp.Pack(); e != nil {
+				return e
+			}
+		}
+		t2s.cache.mutex.Lock()
+		ttl := entry.TTL
+		if ttl == 0 {
+			ttl = t2s.cache.ttl(resp)
+		}
+		t2s.cache.insert(resp, payload, ttl)
+		t2s.cache.mutex.Unlock()
+	}
+	return nil
+}
+
+// setTTLs sets the TTL of every record of resp but its OPT record to ttl.
+func setTTLs(resp *dns.Msg, ttl time.Duration) {
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range section {
+			hdr := rr.Header()
+			if hdr.Rrtype == dns.TypeOPT {
+				continue
+			}
+			hdr.Ttl = uint32(ttl / time.Second)
+		}
+	}
+}
+
+// resolve looks name up directly, outside of the tunnel.
+func (t2s *Tun2Socks) resolve(name string, qtype uint16) ([]byte, error) {
+	query := new(dns.Msg)
+	query.SetQuestion(dns.Fqdn(name), qtype)
+	data, e := query.Pack()
+	if e != nil {
+		return nil, e
+	}
+	upstreams := t2s.dnsUpstreams(data)
+	if len(upstreams) == 0 {
+		return nil, fmt.Errorf("no DNS server to resolve %s", name)
+	}
+	client := &dns.Client{
+		Timeout: 5 * time.Second,
+		Dialer:  &net.Dialer{Timeout: 5 * time.Second, Control: t2s.socketControl},
+	}
+	resp, _, e := client.Exchange(query, upstreams[0].String())
+	if e != nil {
+		return nil, e
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("DNS lookup of %s failed: %s", name, dns.RcodeToString[resp.Rcode])
+	}
+	return resp.Pack()
+}
+
+// refreshPinnedDNS resolves the pinned names whose answer is missing or
+// expired again, one refresh at a time.
+func (t2s *Tun2Socks) refreshPinnedDNS() {
+	if t2s.cache == nil {
+		return
+	}
+	stale := t2s.cache.stalePinned()
+	if len(stale) == 0 || !atomic.CompareAndSwapInt32(&t2s.pinRefreshing, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&t2s.pinRefreshing, 0)
+		for _, entry := range stale {
+			if e := t2s.PreloadDNS([]PreloadEntry{entry}); e != nil {
+				log.Printf("fail to refresh pinned DNS name %s: %s", entry.Name, e)
+			}
+		}
+	}()
+}
@@ -0,0 +1,36 @@
+package tun2socks
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestPreloadTTLOverridesRecordTTLs(t *testing.T) {
+	for _, compact := range []bool{false, true} {
+		t2s := New(nil, true)
+		t2s.SetDNSCacheCompact(compact)
+		query := packQuery(t, 1, "preloaded.example.", dns.TypeA)
+		e := t2s.PreloadDNS([]PreloadEntry{{
+			Response: packReply(t, query, 5, "192.0.2.1"),
+			TTL:      time.Hour,
+		}})
+		if e != nil {
+			t.Fatal(e)
+		}
+
+		// as if preloaded 100s ago, long after the record TTL ran out
+		for _, entry := range t2s.cache.storage {
+			entry.stored = entry.stored.Add(-100 * time.Second)
+			entry.exp = entry.exp.Add(-100 * time.Second)
+		}
+		resp := t2s.cache.query(packQuery(t, 2, "preloaded.example.", dns.TypeA))
+		if resp == nil || len(resp.Answer) != 1 {
+			t.Fatalf("compact %v: got %v", compact, resp)
+		}
+		if ttl := resp.Answer[0].Header().Ttl; ttl != 3500 {
+			t.Errorf("compact %v: served TTL %d, want 3500", compact, ttl)
+		}
+	}
+}
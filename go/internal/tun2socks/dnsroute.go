@@ -0,0 +1,120 @@
+package tun2socks
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/miekg/dns"
+)
+
+// DNSForwardRule sends queries for Suffix and its subdomains to Server, like
+// dnsmasq's server=/corp.example/10.0.0.1.
+type DNSForwardRule struct {
+	Suffix string
+	// Server is "ip" or "ip:port"; port defaults to 53.
+	Server string
+}
+
+type dnsForwardRoute struct {
+	suffix string
+	server *net.UDPAddr
+}
+
+func parseDNSServer(server string) (*net.UDPAddr, error) {
+	host, port, e := net.SplitHostPort(server)
+	if e != nil {
+		host, port = server, "53"
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid DNS server address %q", server)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	p, e := strconv.Atoi(port)
+	if e != nil || p <= 0 || p > 65535 {
+		return nil, fmt.Errorf("invalid DNS server port %q", server)
+	}
+	return &net.UDPAddr{IP: ip, Port: p}, nil
+}
+
+// SetDNSForwarding routes DNS queries by name: the first rule whose suffix
+// matches the query name picks the resolver, other queries go to
+// defaultServer. An empty defaultServer keeps the resolver the client asked.
+func (t2s *Tun2Socks) SetDNSForwarding(rules []DNSForwardRule, defaultServer string) error {
+	routes := make([]dnsForwardRoute, 0, len(rules))
+	for _, rule := range rules {
+		server, e := parseDNSServer(rule.Server)
+		if e != nil {
+			return e
+		}
+		routes = append(routes, dnsForwardRoute{dns.Fqdn(rule.Suffix), server})
+	}
+	var def *net.UDPAddr
+	if defaultServer != "" {
+		var e error
+		def, e = parseDNSServer(defaultServer)
+		if e != nil {
+			return e
+		}
+	}
+	t2s.dnsRoutes = routes
+	t2s.dnsDefaultServer = def
+	return nil
+}
+
+// SetDNSRaceAll sends each DNS query that no forwarding rule matches to all
+// of servers at once and answers with the first usable response, trading
+// bandwidth for latency. Disabling it restores the default server of
+// SetDNSForwarding.
+func (t2s *Tun2Socks) SetDNSRaceAll(enabled bool, servers []string) error {
+	if !enabled {
+		t2s.dnsRaceServers = nil
+		return nil
+	}
+	race := make([]*net.UDPAddr, 0, len(servers))
+	for _, server := range servers {
+		addr, e := parseDNSServer(server)
+		if e != nil {
+			return e
+		}
+		race = append(race, addr)
+	}
+	t2s.dnsRaceServers = race
+	return nil
+}
+
+// dnsUpstreams picks the resolvers a DNS query is forwarded to, or nil to
+// keep the original destination.
+func (t2s *Tun2Socks) dnsUpstreams(payload []byte) []*net.UDPAddr {
+	if len(t2s.dnsRoutes) > 0 {
+		request := new(dns.Msg)
+		if request.Unpack(payload) == nil && len(request.Question) > 0 {
+			name := request.Question[0].Name
+			for _, route := range t2s.dnsRoutes {
+				if dns.IsSubDomain(route.suffix, name) {
+					return []*net.UDPAddr{route.server}
+				}
+			}
+		}
+	}
+	if len(t2s.dnsRaceServers) > 0 {
+		return t2s.dnsRaceServers
+	}
+	if t2s.dnsDefaultServer != nil {
+		return []*net.UDPAddr{t2s.dnsDefaultServer}
+	}
+	return nil
+}
+
+// usableDNSResponse reports whether a raced response can be taken, or whether
+// the other resolvers are worth waiting for.
+func usableDNSResponse(payload []byte) bool {
+	resp := new(dns.Msg)
+	if resp.Unpack(payload) != nil || !resp.Response {
+		return false
+	}
+	return resp.Rcode != dns.RcodeServerFailure && resp.Rcode != dns.RcodeRefused
+}
@@ -0,0 +1,126 @@
+package tun2socks
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dkwiebe/gotun2socks/internal/gosocks"
+	"github.com/miekg/dns"
+)
+
+func TestDNSForwardingBySuffix(t *testing.T) {
+	s := newStubSocks(t, stubResolver(answerA))
+	t2s, p := NewTun2SocksWithPipe()
+	s.route(t2s)
+	e := t2s.SetDNSForwarding([]DNSForwardRule{
+		{Suffix: "lab.corp.example.", Server: "10.0.0.2:5353"},
+		{Suffix: "corp.example", Server: "10.0.0.1"},
+	}, "9.9.9.9")
+	if e != nil {
+		t.Fatal(e)
+	}
+	serve(t, t2s)
+
+	for i, c := range []struct {
+		name     string
+		resolver string
+		port     uint16
+	}{
+		{"corp.example.", "10.0.0.1", 53},
+		{"git.corp.example.", "10.0.0.1", 53},
+		// the first matching rule wins
+		{"ci.lab.corp.example.", "10.0.0.2", 5353},
+		{"www.example.", "9.9.9.9", 53},
+		// a suffix matches whole labels only
+		{"notcorp.example.", "9.9.9.9", 53},
+	} {
+		p.Inject(udpIPv4(clientIP, 4000+uint16(i), resolverIP, 53, packQuery(t, uint16(i), c.name, dns.TypeA)))
+		select {
+		case req := <-s.requests:
+			if req.DstHost != c.resolver || req.DstPort != c.port {
+				t.Errorf("%s forwarded to %s:%d, want %s:%d", c.name, req.DstHost, req.DstPort, c.resolver, c.port)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s not forwarded", c.name)
+		}
+		// answered as if by the resolver the app asked
+		ip, udp := nextUDP(t, p)
+		if !ip.SrcIP.Equal(resolverIP) || udp.SrcPort != 53 {
+			t.Errorf("%s answered from %s:%d", c.name, ip.SrcIP, udp.SrcPort)
+		}
+		if resp := unpackDNS(t, udp); resp.Id != uint16(i) || len(resp.Answer) != 1 {
+			t.Errorf("%s answered with %v", c.name, resp)
+		}
+	}
+
+	// answers of either resolver are cached as usual
+	waitFor(t, "answers cached", func() bool {
+		_, corp := t2s.PeekDNSCache("git.corp.example.", dns.TypeA)
+		_, public := t2s.PeekDNSCache("www.example.", dns.TypeA)
+		return corp && public
+	})
+	if e := t2s.SetDNSForwarding([]DNSForwardRule{{Suffix: "corp.example", Server: "not-an-ip"}}, ""); e == nil {
+		t.Error("resolver address without an IP accepted")
+	}
+}
+
+func TestDNSRaceAllTakesFastestAnswer(t *testing.T) {
+	fast := stubResolver(answerA)
+	slow := stubResolver(func(req *dns.Msg) *dns.Msg {
+		resp := answerA(req)
+		resp.Answer[0].(*dns.A).A = net.IP{192, 0, 2, 2}
+		return resp
+	})
+	s := &stubSocks{async: true, handle: func(req *gosocks.UDPRequest) []byte {
+		if req.DstHost == "10.0.0.1" {
+			time.Sleep(200 * time.Millisecond)
+			return slow(req)
+		}
+		return fast(req)
+	}}
+	s.listen(t)
+	t2s, p := NewTun2SocksWithPipe()
+	s.route(t2s)
+	// the slow resolver is asked first
+	if e := t2s.SetDNSRaceAll(true, []string{"10.0.0.1", "10.0.0.2"}); e != nil {
+		t.Fatal(e)
+	}
+	serve(t, t2s)
+
+	start := time.Now()
+	p.Inject(udpIPv4(clientIP, 4000, resolverIP, 53, packQuery(t, 7, "race.example.", dns.TypeA)))
+	_, udp := nextUDP(t, p)
+	if d := time.Since(start); d >= 200*time.Millisecond {
+		t.Errorf("answered after %s, as late as the slow resolver", d)
+	}
+	resp := unpackDNS(t, udp)
+	if resp.Id != 7 || len(resp.Answer) != 1 || !resp.Answer[0].(*dns.A).A.Equal(net.IP{192, 0, 2, 1}) {
+		t.Fatalf("got %v, want the fast answer", resp)
+	}
+	asked := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case req := <-s.requests:
+			asked[req.DstHost] = true
+		case <-time.After(5 * time.Second):
+			t.Fatal("query not sent to every resolver")
+		}
+	}
+	if !asked["10.0.0.1"] || !asked["10.0.0.2"] {
+		t.Fatalf("asked %v, want both resolvers", asked)
+	}
+
+	// the slow answer is neither relayed nor cached, and the relay is gone
+	// by the time it comes
+	noPacket(t, p, 300*time.Millisecond)
+	waitFor(t, "relay closed", func() bool {
+		t2s.udpConnTrackLock.Lock()
+		defer t2s.udpConnTrackLock.Unlock()
+		return len(t2s.udpConnTrackMap) == 0
+	})
+	resp, upstream := resolve(t, s, p, 8, "race.example.")
+	if upstream || !resp.Answer[0].(*dns.A).A.Equal(net.IP{192, 0, 2, 1}) {
+		t.Fatalf("got %v from upstream: %v, want the fast answer from the cache", resp, upstream)
+	}
+}
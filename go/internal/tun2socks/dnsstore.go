@@ -0,0 +1,40 @@
+package tun2socks
+
+import (
+	"log"
+
+	"github.com/miekg/dns"
+)
+
+// DNSCache answers DNS queries read from tun and keeps the responses relayed
+// for them. The built-in cache is used unless SetDNSCache plugs in another,
+// e.g. one shared by several instances or one that keeps nothing.
+type DNSCache interface {
+	// Query returns the answer to the query payload, with the ID of the
+	// query, or nil if none is cached.
+	Query(payload []byte) *dns.Msg
+	// Store keeps the response payload.
+	Store(payload []byte)
+	// Flush drops all answers.
+	Flush()
+}
+
+func (c *dnsCache) Query(payload []byte) *dns.Msg { return c.query(payload) }
+func (c *dnsCache) Store(payload []byte)          { c.store(payload) }
+func (c *dnsCache) Flush()                        { c.flush() }
+
+// SetDNSCache answers DNS queries from cache instead of the built-in cache,
+// and stores responses into it. Preloading, pinning, PTR answers and the
+// names SetSocksRemoteDNS sends rely on what the built-in cache stored, so
+// they stop working while another cache is plugged in. In-flight
+// deduplication still works if the built-in cache is enabled. nil restores
+// the built-in cache, if enabled.
+func (t2s *Tun2Socks) SetDNSCache(cache DNSCache) {
+	if cache == nil && t2s.cache != nil {
+		cache = t2s.cache
+	}
+	if t2s.cache != nil && cache != DNSCache(t2s.cache) {
+		log.Printf("DNS cache plugged in, no preloaded, pinned or PTR answers from the built-in cache")
+	}
+	t2s.dnsStore = cache
+}
@@ -0,0 +1,101 @@
+package tun2socks
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/dkwiebe/gotun2socks/internal/tun"
+	"github.com/miekg/dns"
+)
+
+// mapCache is a DNSCache keeping the last response by question name.
+type mapCache struct {
+	mutex   sync.Mutex
+	answers map[string]*dns.Msg
+	flushed int
+}
+
+func (c *mapCache) Query(payload []byte) *dns.Msg {
+	req := new(dns.Msg)
+	if req.Unpack(payload) != nil || len(req.Question) != 1 {
+		return nil
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	resp := c.answers[req.Question[0].Name]
+	if resp == nil {
+		return nil
+	}
+	resp = resp.Copy()
+	resp.Id = req.Id
+	return resp
+}
+
+func (c *mapCache) Store(payload []byte) {
+	resp := new(dns.Msg)
+	if resp.Unpack(payload) != nil || len(resp.Question) != 1 {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.answers[resp.Question[0].Name] = resp
+}
+
+func (c *mapCache) Flush() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.answers = map[string]*dns.Msg{}
+	c.flushed++
+}
+
+func TestPluggedDNSCache(t *testing.T) {
+	s := newStubSocks(t, stubResolver(answerA))
+	p := tun.NewMemoryTun()
+	// no built-in cache to fall back on
+	t2s := New(p, false)
+	s.route(t2s)
+	cache := &mapCache{answers: map[string]*dns.Msg{}}
+	t2s.SetDNSCache(cache)
+	serve(t, t2s)
+
+	if _, upstream := resolve(t, s, p, 1, "www.example."); !upstream {
+		t.Fatal("first lookup answered from the cache")
+	}
+	waitFor(t, "response stored", func() bool { return cache.Query(packQuery(t, 1, "www.example.", dns.TypeA)) != nil })
+	resp, upstream := resolve(t, s, p, 2, "www.example.")
+	if upstream {
+		t.Fatal("stored answer not served")
+	}
+	if resp.Id != 2 || len(resp.Answer) != 1 {
+		t.Fatalf("served %v", resp)
+	}
+
+	t2s.FlushDNSCache()
+	if cache.flushed != 1 {
+		t.Fatalf("flushed %d times, want once", cache.flushed)
+	}
+	if _, upstream := resolve(t, s, p, 3, "www.example."); !upstream {
+		t.Fatal("answered from a flushed cache")
+	}
+
+	// nil leaves no cache without the built-in one
+	other := New(nil, false)
+	other.SetDNSCache(cache)
+	other.SetDNSCache(nil)
+	if other.dnsStore != nil {
+		t.Fatal("cache kept after removal")
+	}
+
+	// plugged over the built-in cache, what only it serves is gone
+	logged := captureLog(t)
+	builtin := New(nil, true)
+	builtin.SetDNSCache(cache)
+	if !strings.Contains(logged.String(), "no preloaded, pinned or PTR answers") {
+		t.Fatal("no warning about the built-in cache")
+	}
+	builtin.SetDNSCache(nil)
+	if builtin.dnsStore != DNSCache(builtin.cache) {
+		t.Fatal("built-in cache not restored")
+	}
+}
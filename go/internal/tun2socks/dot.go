@@ -0,0 +1,192 @@
+package tun2socks
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dkwiebe/gotun2socks/internal/packet"
+)
+
+const (
+	DOT_TIMEOUT = 5 * time.Second
+	// queries waiting for the DoT resolver, beyond which more are dropped
+	DOT_MAX_PENDING = 64
+)
+
+// DNSOverTLS configures forwarding DNS queries over TLS (RFC 7858).
+type DNSOverTLS struct {
+	// Server is "ip" or "ip:port"; port defaults to 853.
+	Server string
+	// ServerName is verified against the server certificate.
+	ServerName string
+	// SPKIPin, if set, is the base64 SHA-256 of the SubjectPublicKeyInfo
+	// of a certificate the server must present.
+	SPKIPin string
+}
+
+// dotClient exchanges DNS messages with a DoT resolver over one connection,
+// reconnecting when it breaks. Queries are sent one at a time.
+type dotClient struct {
+	addr   string
+	config *tls.Config
+	dialer *net.Dialer
+
+	// a slot per query waiting for its answer
+	pending chan struct{}
+
+	mutex sync.Mutex
+	conn  *tls.Conn
+}
+
+// SetDNSOverTLS forwards DNS queries missing the cache to a DoT resolver
+// instead of relaying them as UDP. Forwarding rules don't apply then. nil
+// restores UDP forwarding.
+func (t2s *Tun2Socks) SetDNSOverTLS(cfg *DNSOverTLS) error {
+	if cfg == nil {
+		t2s.dot = nil
+		return nil
+	}
+	host, port, e := net.SplitHostPort(cfg.Server)
+	if e != nil {
+		host, port = cfg.Server, "853"
+	}
+	if net.ParseIP(host) == nil {
+		return fmt.Errorf("invalid DNS server address %q", cfg.Server)
+	}
+	if p, e := strconv.Atoi(port); e != nil || p <= 0 || p > 65535 {
+		return fmt.Errorf("invalid DNS server port %q", cfg.Server)
+	}
+	config := &tls.Config{ServerName: cfg.ServerName}
+	if cfg.SPKIPin != "" {
+		pin, e := base64.StdEncoding.DecodeString(cfg.SPKIPin)
+		if e != nil || len(pin) != sha256.Size {
+			return fmt.Errorf("invalid SPKI pin %q", cfg.SPKIPin)
+		}
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			for _, cert := range cs.PeerCertificates {
+				sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				if string(sum[:]) == string(pin) {
+					return nil
+				}
+			}
+			return fmt.Errorf("DoT server %s presented no pinned key", cfg.Server)
+		}
+	}
+	t2s.dot = &dotClient{
+		addr:    net.JoinHostPort(host, port),
+		config:  config,
+		dialer:  &net.Dialer{Timeout: DOT_TIMEOUT, Control: t2s.socketControl},
+		pending: make(chan struct{}, DOT_MAX_PENDING),
+	}
+	return nil
+}
+
+// exchange sends a packed query and returns the packed response. A broken
+// connection is replaced and the query retried once.
+func (c *dotClient) exchange(query []byte) ([]byte, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var e error
+	for i := 0; i < 2; i++ {
+		if c.conn == nil {
+			c.conn, e = tls.DialWithDialer(c.dialer, "tcp", c.addr, c.config)
+			if e != nil {
+				return nil, e
+			}
+		}
+		var resp []byte
+		resp, e = c.roundTrip(query)
+		if e == nil {
+			return resp, nil
+		}
+		c.conn.Close()
+		c.conn = nil
+	}
+	return nil, e
+}
+
+func (c *dotClient) roundTrip(query []byte) ([]byte, error) {
+	c.conn.SetDeadline(time.Now().Add(DOT_TIMEOUT))
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	_, e := c.conn.Write(msg)
+	if e != nil {
+		return nil, e
+	}
+	var l [2]byte
+	_, e = io.ReadFull(c.conn, l[:])
+	if e != nil {
+		return nil, e
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(l[:]))
+	_, e = io.ReadFull(c.conn, resp)
+	if e != nil {
+		return nil, e
+	}
+	return resp, nil
+}
+
+// forwardDoT answers a DNS query read from dev through the DoT resolver.
+// Queries are dropped while DOT_MAX_PENDING others wait for the resolver, as
+// when it is unreachable, for the client to retry.
+func (t2s *Tun2Socks) forwardDoT(dev *tunDevice, ip *packet.IPv4, udp *packet.UDP) {
+	dot := t2s.dot
+	select {
+	case dot.pending <- struct{}{}:
+	default:
+		atomic.AddUint64(&t2s.stats.DoTDropped, 1)
+		return
+	}
+	local := append(net.IP(nil), ip.SrcIP...)
+	remote := append(net.IP(nil), ip.DstIP...)
+	lPort, rPort := udp.SrcPort, udp.DstPort
+	ipid := t2s.responseID(ip.Id)
+	tos := ip.TOS
+	query := append([]byte(nil), udp.Payload...)
+	go func() {
+		defer func() { <-dot.pending }()
+		start := time.Now()
+		data, e := dot.exchange(query)
+		if e != nil {
+			log.Printf("DoT query failed: %s", e)
+			return
+		}
+		q := newDNSQuery(query, 1)
+		if dnsID(data) != dnsID(query) || !q.answers(data) {
+			log.Printf("drop DoT response not matching the query")
+			atomic.AddUint64(&t2s.stats.DNSMismatched, 1)
+			return
+		}
+		data = t2s.filterDNSResponse(data)
+		if data == nil {
+			return
+		}
+		// cached as the resolver sent it, each client gets it fit
+		t2s.cacheDNS(data)
+		answer := t2s.fitDNSResponse(remote, data, q.udpSize)
+		if answer == nil {
+			return
+		}
+		resp, fragments := t2s.responsePacket(local, remote, lPort, rPort, answer, ipid, tos)
+		if resp == nil {
+			return
+		}
+		dev.writeCh <- resp
+		for _, frag := range fragments {
+			dev.writeCh <- frag
+		}
+		t2s.logDNS(answer, false, time.Since(start))
+	}()
+}
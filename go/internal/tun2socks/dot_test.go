@@ -0,0 +1,168 @@
+package tun2socks
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// stubDoT is a DoT resolver for tests answering with answer, holding each
+// answer back until hold is closed if set.
+type stubDoT struct {
+	addr string
+	cert *x509.Certificate
+	hold chan struct{}
+	// connections accepted
+	conns int32
+}
+
+func newStubDoT(tb testing.TB, answer func(req *dns.Msg) *dns.Msg) *stubDoT {
+	tb.Helper()
+	key, e := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if e != nil {
+		tb.Fatal(e)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "dns.example"},
+		DNSNames:     []string{"dns.example"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, e := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if e != nil {
+		tb.Fatal(e)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	ln, e := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	})
+	if e != nil {
+		tb.Fatal(e)
+	}
+	tb.Cleanup(func() { ln.Close() })
+	s := &stubDoT{addr: ln.Addr().String(), cert: cert}
+	go func() {
+		for {
+			c, e := ln.Accept()
+			if e != nil {
+				return
+			}
+			atomic.AddInt32(&s.conns, 1)
+			go s.serve(c, answer)
+		}
+	}()
+	return s
+}
+
+func (s *stubDoT) serve(c net.Conn, answer func(req *dns.Msg) *dns.Msg) {
+	defer c.Close()
+	for {
+		var l [2]byte
+		if _, e := io.ReadFull(c, l[:]); e != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(l[:]))
+		if _, e := io.ReadFull(c, query); e != nil {
+			return
+		}
+		if s.hold != nil {
+			<-s.hold
+		}
+		req := new(dns.Msg)
+		if req.Unpack(query) != nil {
+			return
+		}
+		data, e := answer(req).Pack()
+		if e != nil {
+			return
+		}
+		binary.BigEndian.PutUint16(l[:], uint16(len(data)))
+		if _, e := c.Write(append(l[:], data...)); e != nil {
+			return
+		}
+	}
+}
+
+// use has t2s forward DNS to s, trusting its certificate.
+func (s *stubDoT) use(tb testing.TB, t2s *Tun2Socks, pin string) {
+	tb.Helper()
+	if e := t2s.SetDNSOverTLS(&DNSOverTLS{Server: s.addr, ServerName: "dns.example", SPKIPin: pin}); e != nil {
+		tb.Fatal(e)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(s.cert)
+	t2s.dot.config.RootCAs = roots
+}
+
+func TestDNSOverTLS(t *testing.T) {
+	s := newStubDoT(t, answerA)
+	sum := sha256.Sum256(s.cert.RawSubjectPublicKeyInfo)
+	t2s, p := NewTun2SocksWithPipe()
+	s.use(t, t2s, base64.StdEncoding.EncodeToString(sum[:]))
+	serve(t, t2s)
+
+	for i, name := range []string{"a.example.", "b.example."} {
+		p.Inject(udpIPv4(clientIP, 4000, resolverIP, 53, packQuery(t, uint16(i), name, dns.TypeA)))
+		_, udp := nextUDP(t, p)
+		if resp := unpackDNS(t, udp); resp.Id != uint16(i) || len(resp.Answer) != 1 {
+			t.Fatalf("%s: got %v", name, resp)
+		}
+	}
+	if n := atomic.LoadInt32(&s.conns); n != 1 {
+		t.Fatalf("%d connections for two queries, want 1", n)
+	}
+	waitFor(t, "answer cached", func() bool {
+		_, hit := t2s.PeekDNSCache("a.example.", dns.TypeA)
+		return hit
+	})
+}
+
+func TestDNSOverTLSWrongPin(t *testing.T) {
+	s := newStubDoT(t, answerA)
+	t2s, p := NewTun2SocksWithPipe()
+	s.use(t, t2s, base64.StdEncoding.EncodeToString(make([]byte, sha256.Size)))
+	serve(t, t2s)
+
+	p.Inject(udpIPv4(clientIP, 4000, resolverIP, 53, packQuery(t, 1, "a.example.", dns.TypeA)))
+	noPacket(t, p, 200*time.Millisecond)
+}
+
+func TestDNSOverTLSDropsBeyondPending(t *testing.T) {
+	s := newStubDoT(t, answerA)
+	s.hold = make(chan struct{})
+	t2s, p := NewTun2SocksWithPipe()
+	s.use(t, t2s, "")
+	serve(t, t2s)
+
+	const over = 5
+	for i := 0; i < DOT_MAX_PENDING+over; i++ {
+		name := fmt.Sprintf("host%d.example.", i)
+		p.Inject(udpIPv4(clientIP, uint16(4000+i), resolverIP, 53, packQuery(t, uint16(i), name, dns.TypeA)))
+	}
+	waitFor(t, "queries dropped", func() bool { return t2s.Stats().DoTDropped == over })
+
+	// the waiting queries are answered once the resolver catches up
+	close(s.hold)
+	for i := 0; i < DOT_MAX_PENDING; i++ {
+		nextUDP(t, p)
+	}
+	if n := t2s.Stats().DoTDropped; n != over {
+		t.Fatalf("%d queries dropped, want %d", n, over)
+	}
+}
@@ -0,0 +1,71 @@
+package tun2socks
+
+import (
+	"net"
+	"time"
+)
+
+// FlowRecord accounts for a closed flow, e.g. for NetFlow/IPFIX export.
+// Out counts what the app sent, In what it received.
+type FlowRecord struct {
+	// Proto is "tcp" or "udp".
+	Proto      string
+	SrcIP      net.IP
+	SrcPort    uint16
+	DstIP      net.IP
+	DstPort    uint16
+	PacketsOut uint64
+	BytesOut   uint64
+	PacketsIn  uint64
+	BytesIn    uint64
+	Start      time.Time
+	End        time.Time
+}
+
+// flowCounters counts the payload of a flow. They are only updated by the
+// goroutine running the flow.
+type flowCounters struct {
+	start      time.Time
+	packetsOut uint64
+	bytesOut   uint64
+	packetsIn  uint64
+	bytesIn    uint64
+}
+
+func (c *flowCounters) out(n int) {
+	c.packetsOut++
+	c.bytesOut += uint64(n)
+}
+
+func (c *flowCounters) in(n int) {
+	c.packetsIn++
+	c.bytesIn += uint64(n)
+}
+
+// SetFlowRecordHandler sets a function receiving a record of every TCP and
+// UDP flow as it closes, on the goroutine of the flow. Bytes are counted as
+// payload.
+func (t2s *Tun2Socks) SetFlowRecordHandler(handler func(FlowRecord)) {
+	t2s.flowRecordHandler = handler
+}
+
+// flowClosed hands the record of a closed flow to the handler.
+func (t2s *Tun2Socks) flowClosed(proto string, localIP net.IP, localPort uint16, remoteIP net.IP, remotePort uint16, c *flowCounters) {
+	handler := t2s.flowRecordHandler
+	if handler == nil {
+		return
+	}
+	handler(FlowRecord{
+		Proto:      proto,
+		SrcIP:      localIP,
+		SrcPort:    localPort,
+		DstIP:      remoteIP,
+		DstPort:    remotePort,
+		PacketsOut: c.packetsOut,
+		BytesOut:   c.bytesOut,
+		PacketsIn:  c.packetsIn,
+		BytesIn:    c.bytesIn,
+		Start:      c.start,
+		End:        time.Now(),
+	})
+}
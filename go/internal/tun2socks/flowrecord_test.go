@@ -0,0 +1,39 @@
+package tun2socks
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFlowRecordOfUDPFlow(t *testing.T) {
+	s := newStubSocks(t, echoUDP)
+	t2s, p := NewTun2SocksWithPipe()
+	s.route(t2s)
+	records := make(chan FlowRecord, 1)
+	t2s.SetFlowRecordHandler(func(r FlowRecord) { records <- r })
+	serve(t, t2s)
+
+	start := time.Now()
+	dst := net.IP{192, 0, 2, 1}
+	for _, data := range []string{"ping", "hello"} {
+		p.Inject(udpIPv4(clientIP, 5000, dst, 9, []byte(data)))
+		nextUDP(t, p)
+	}
+	t2s.CloseFlows(func(ConnInfo) bool { return true })
+
+	select {
+	case r := <-records:
+		if r.Proto != "udp" || !r.SrcIP.Equal(clientIP) || r.SrcPort != 5000 || !r.DstIP.Equal(dst) || r.DstPort != 9 {
+			t.Fatalf("record of %s %s:%d > %s:%d", r.Proto, r.SrcIP, r.SrcPort, r.DstIP, r.DstPort)
+		}
+		if r.PacketsOut != 2 || r.BytesOut != 9 || r.PacketsIn != 2 || r.BytesIn != 9 {
+			t.Fatalf("counted %d/%d out, %d/%d in, want 2 packets of 9 bytes each way", r.PacketsOut, r.BytesOut, r.PacketsIn, r.BytesIn)
+		}
+		if r.Start.Before(start) || r.End.Before(r.Start) || time.Since(r.End) > 5*time.Second {
+			t.Fatalf("flow from %s to %s", r.Start, r.End)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no record of the closed flow")
+	}
+}
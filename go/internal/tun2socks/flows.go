@@ -0,0 +1,110 @@
+package tun2socks
+
+import (
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// ConnInfo describes a tracked flow.
+type ConnInfo struct {
+	// Proto is "tcp" or "udp".
+	Proto      string
+	ID         string
+	LocalIP    net.IP
+	LocalPort  uint16
+	RemoteIP   net.IP
+	RemotePort uint16
+	// UID is the app of a TCP flow, -1 if unknown or for UDP.
+	UID int
+	// Idle is how long the flow has gone without traffic.
+	Idle time.Duration
+}
+
+// SetNewFlowHandler sets a function vetting every new TCP and UDP flow before
+// anything is set up for it, e.g. for admission control; proto is "tcp" or
+// "udp". A flow it returns false for is dropped as if by a routing rule. New
+// UDP flows wait for it with the tracks locked, so it must return quickly
+// and not call back into the Tun2Socks.
+func (t2s *Tun2Socks) SetNewFlowHandler(handler func(proto string, src, dst net.IP, sport, dport uint16) bool) {
+	t2s.newFlowHandler = handler
+}
+
+// admitted asks the new flow handler whether to set up a flow.
+func (t2s *Tun2Socks) admitted(proto string, src, dst net.IP, sport, dport uint16) bool {
+	handler := t2s.newFlowHandler
+	return handler == nil || handler(proto, src, dst, sport, dport)
+}
+
+// DebugFlow logs every packet of the new flows pred returns true for, e.g.
+// to debug one app without the noise of all others. Idle is 0 for new flows.
+// pred must return quickly and not call back into the Tun2Socks, as new UDP
+// flows wait for it with the tracks locked. nil stops debugging new flows.
+func (t2s *Tun2Socks) DebugFlow(pred func(ConnInfo) bool) {
+	t2s.debugFlow = pred
+}
+
+// debugged reports whether the flow of info is debugged.
+func (t2s *Tun2Socks) debugged(info ConnInfo) bool {
+	pred := t2s.debugFlow
+	return pred != nil && pred(info)
+}
+
+// CloseFlows closes the flows for which pred returns true, e.g. all flows to
+// an IP or all idle for long, and returns how many it closed. pred is called
+// with the tracks locked and must not call back into the Tun2Socks.
+func (t2s *Tun2Socks) CloseFlows(pred func(ConnInfo) bool) int {
+	if atomic.LoadInt32(&t2s.stopped) != 0 {
+		return 0
+	}
+	now := time.Now().UnixNano()
+	closed := 0
+
+	t2s.tcpConnTrackLock.Lock()
+	for id, tt := range t2s.tcpConnTrackMap {
+		info := ConnInfo{
+			Proto:      "tcp",
+			ID:         id,
+			LocalIP:    tt.localIP,
+			LocalPort:  tt.localPort,
+			RemoteIP:   tt.remoteIP,
+			RemotePort: tt.remotePort,
+			UID:        tt.uid,
+			Idle:       time.Duration(now - atomic.LoadInt64(&tt.activity)),
+		}
+		if !pred(info) {
+			continue
+		}
+		log.Printf("close tcp flow %s", id)
+		// whoever closes quitByOther clears the track, which marks itself
+		// destroyed
+		delete(t2s.tcpConnTrackMap, id)
+		close(tt.quitByOther)
+		closed++
+	}
+	t2s.tcpConnTrackLock.Unlock()
+
+	t2s.udpConnTrackLock.Lock()
+	for id, ut := range t2s.udpConnTrackMap {
+		info := ConnInfo{
+			Proto:      "udp",
+			ID:         id,
+			LocalIP:    ut.localIP,
+			LocalPort:  uint16(atomic.LoadUint32(&ut.replyPort)),
+			RemoteIP:   ut.remoteIP,
+			RemotePort: ut.remotePort,
+			UID:        -1,
+			Idle:       time.Duration(now - atomic.LoadInt64(&ut.activity)),
+		}
+		if !pred(info) {
+			continue
+		}
+		log.Printf("close udp flow %s", id)
+		delete(t2s.udpConnTrackMap, id)
+		ut.quit(CLOSE_POLICY)
+		closed++
+	}
+	t2s.udpConnTrackLock.Unlock()
+	return closed
+}
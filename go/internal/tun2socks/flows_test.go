@@ -0,0 +1,196 @@
+package tun2socks
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dkwiebe/gotun2socks/internal/packet"
+)
+
+func TestCloseFlowsByDestination(t *testing.T) {
+	s := newStubSocks(t, echoUDP)
+	t2s, p := NewTun2SocksWithPipe()
+	t2s.SetDefaultProxy(&ProxyServer{ProxyType: PROXY_TYPE_SOCKS, IpAddress: s.addr})
+	t2s.SetRoutingRules(RoutingRules{Rules: []RoutingRule{{Decision: ROUTE_PROXY}}})
+	serve(t, t2s)
+
+	closing, kept := net.IP{192, 0, 2, 1}, net.IP{192, 0, 2, 2}
+	for i, dst := range []net.IP{closing, kept} {
+		p.Inject(udpIPv4(clientIP, uint16(5000+i), dst, 9, []byte("ping")))
+		nextUDP(t, p)
+		p.Inject(tcpIPv4(clientIP, uint16(6000+i), dst, 80, packet.TCP{SYN: true, Seq: 100}))
+		nextTCP(t, p)
+	}
+
+	n := t2s.CloseFlows(func(info ConnInfo) bool { return info.RemoteIP.Equal(closing) })
+	if n != 2 {
+		t.Fatalf("closed %d flows, want the UDP and the TCP one to %s", n, closing)
+	}
+	remaining := 0
+	t2s.CloseFlows(func(info ConnInfo) bool {
+		if !info.RemoteIP.Equal(kept) {
+			t.Errorf("%s flow %s still tracked", info.Proto, info.ID)
+		}
+		remaining++
+		return false
+	})
+	if remaining != 2 {
+		t.Fatalf("%d flows left, want 2 to %s", remaining, kept)
+	}
+
+	// the flows left go on
+	p.Inject(udpIPv4(clientIP, 5001, kept, 9, []byte("again")))
+	if _, udp := nextUDP(t, p); string(udp.Payload) != "again" {
+		t.Fatalf("echoed %q", udp.Payload)
+	}
+}
+
+func TestClearTCPConnTrackKeepsReplacement(t *testing.T) {
+	t2s := New(nil, false)
+	track := func() *tcpConnTrack {
+		return &tcpConnTrack{
+			id:          "flow",
+			recvWndCond: &sync.Cond{L: &sync.Mutex{}},
+			sendWndCond: &sync.Cond{L: &sync.Mutex{}},
+		}
+	}
+	closed, replacement := track(), track()
+	t2s.tcpConnTrackMap["flow"] = replacement
+
+	t2s.clearTCPConnTrack(closed)
+	if t2s.tcpConnTrackMap["flow"] != replacement {
+		t.Fatal("clearing a closed track dropped the track replacing it")
+	}
+	if closed.destroyed == 0 || replacement.destroyed != 0 {
+		t.Fatal("clearing marked the wrong track destroyed")
+	}
+	t2s.clearTCPConnTrack(replacement)
+	if len(t2s.tcpConnTrackMap) != 0 {
+		t.Fatal("track not cleared")
+	}
+}
+
+func TestNewFlowHandlerVetoes(t *testing.T) {
+	s := newStubSocks(t, echoUDP)
+	t2s, p := NewTun2SocksWithPipe()
+	s.route(t2s)
+	vetoed := net.IP{192, 0, 2, 1}
+	type flow struct {
+		proto        string
+		src, dst     string
+		sport, dport uint16
+	}
+	asked := make(chan flow, 10)
+	t2s.SetNewFlowHandler(func(proto string, src, dst net.IP, sport, dport uint16) bool {
+		asked <- flow{proto, src.String(), dst.String(), sport, dport}
+		return !dst.Equal(vetoed)
+	})
+	serve(t, t2s)
+
+	p.Inject(udpIPv4(clientIP, 5000, vetoed, 9, []byte("ping")))
+	if f := <-asked; f != (flow{"udp", clientIP.String(), vetoed.String(), 5000, 9}) {
+		t.Fatalf("asked about %+v", f)
+	}
+	noPacket(t, p, 50*time.Millisecond)
+	p.Inject(tcpIPv4(clientIP, 6000, vetoed, 80, packet.TCP{SYN: true, Seq: 100}))
+	if f := <-asked; f != (flow{"tcp", clientIP.String(), vetoed.String(), 6000, 80}) {
+		t.Fatalf("asked about %+v", f)
+	}
+	if _, tcp := nextTCP(t, p); !tcp.RST {
+		t.Fatalf("got %s, want RST", tcpflagsString(tcp))
+	}
+	t2s.udpConnTrackLock.Lock()
+	udpTracks := len(t2s.udpConnTrackMap)
+	t2s.udpConnTrackLock.Unlock()
+	t2s.tcpConnTrackLock.Lock()
+	tcpTracks := len(t2s.tcpConnTrackMap)
+	t2s.tcpConnTrackLock.Unlock()
+	if udpTracks != 0 || tcpTracks != 0 {
+		t.Fatalf("%d UDP and %d TCP tracks for vetoed flows", udpTracks, tcpTracks)
+	}
+	select {
+	case <-s.requests:
+		t.Fatal("vetoed flow relayed")
+	default:
+	}
+
+	// other flows are let through, and asked about once
+	allowed := net.IP{192, 0, 2, 2}
+	for i := 0; i < 2; i++ {
+		p.Inject(udpIPv4(clientIP, 5000, allowed, 9, []byte("ping")))
+		nextUDP(t, p)
+	}
+	<-asked
+	select {
+	case f := <-asked:
+		t.Fatalf("asked again about %+v", f)
+	default:
+	}
+}
+
+// logBuffer collects what the log package writes while a test runs.
+type logBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.String()
+}
+
+// captureLog collects the log until the test ends.
+func captureLog(tb testing.TB) *logBuffer {
+	b := &logBuffer{}
+	w := log.Writer()
+	log.SetOutput(b)
+	tb.Cleanup(func() { log.SetOutput(w) })
+	return b
+}
+
+func TestDebugFlowLogsMatchingFlowsOnly(t *testing.T) {
+	s := newStubSocks(t, echoUDP)
+	t2s, p := NewTun2SocksWithPipe()
+	s.route(t2s)
+	t2s.DebugFlow(func(info ConnInfo) bool { return info.LocalPort == 5000 })
+	logged := captureLog(t)
+	serve(t, t2s)
+
+	dst := net.IP{192, 0, 2, 1}
+	for _, port := range []uint16{5000, 5001} {
+		p.Inject(udpIPv4(clientIP, port, dst, 9, []byte("ping")))
+		nextUDP(t, p)
+		p.Inject(tcpIPv4(clientIP, port, dst, 80, packet.TCP{SYN: true, Seq: 100}))
+		nextTCP(t, p)
+	}
+	t2s.Stop()
+
+	out := logged.String()
+	for _, line := range []string{
+		"--> [UDP][10.0.0.2|5000|192.0.2.1|9]",
+		"<-- [UDP][10.0.0.2|5000|192.0.2.1|9]",
+		"--> [TCP][10.0.0.2|5000|192.0.2.1|80]",
+		"<-- [TCP][10.0.0.2|5000|192.0.2.1|80][SYN,ACK]",
+	} {
+		if !strings.Contains(out, line) {
+			t.Errorf("no %q logged", line)
+		}
+	}
+	for _, l := range strings.Split(out, "\n") {
+		if strings.Contains(l, "P][10.0.0.2|5001|") {
+			t.Errorf("flow not matched logged %q", l)
+		}
+	}
+}
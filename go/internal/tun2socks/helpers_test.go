@@ -0,0 +1,215 @@
+package tun2socks
+
+import (
+	"flag"
+	"io"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/dkwiebe/gotun2socks/internal/packet"
+	"github.com/dkwiebe/gotun2socks/internal/tun"
+	"github.com/miekg/dns"
+)
+
+// address of the app in tests, on the tun
+var clientIP = net.IP{10, 0, 0, 2}
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	// the tunnel logs every flow; keep it for -v
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+// serve runs t2s until the test ends, from the moment it is ready.
+func serve(tb testing.TB, t2s *Tun2Socks) {
+	tb.Helper()
+	go t2s.Serve(nil)
+	select {
+	case <-t2s.Ready():
+	case <-time.After(5 * time.Second):
+		tb.Fatal("tunnel not ready")
+	}
+	tb.Cleanup(t2s.Stop)
+}
+
+// waitFor fails the test unless cond turns true within a few seconds.
+func waitFor(tb testing.TB, what string, cond func() bool) {
+	tb.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			tb.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitGoroutines fails the test unless the goroutines wind down to at most
+// n; torn down relays wind down on their own goroutines.
+func waitGoroutines(tb testing.TB, n int) {
+	tb.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > n {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			tb.Fatalf("%d goroutines left, want at most %d:\n%s", runtime.NumGoroutine(), n, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// udpIPv4 builds an IPv4 packet carrying a UDP datagram, checksum included.
+func udpIPv4(src net.IP, sport uint16, dst net.IP, dport uint16, payload []byte) []byte {
+	ip := packet.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: packet.IPProtocolUDP,
+		SrcIP:    src.To4(),
+		DstIP:    dst.To4(),
+	}
+	udp := packet.UDP{SrcPort: sport, DstPort: dport, Payload: payload}
+	raw := make([]byte, 20+8+len(payload))
+	copy(raw[28:], payload)
+	var pseudo [packet.IPv4_PSEUDO_LENGTH]byte
+	ip.PseudoHeader(pseudo[:], packet.IPProtocolUDP, 8+len(payload))
+	udp.Serialize(raw[20:28], pseudo[:], raw[20:28], payload)
+	ip.Serialize(raw[:20], 8+len(payload))
+	return raw
+}
+
+// tcpIPv4 builds an IPv4 packet carrying seg from src:sport to dst:dport,
+// checksum included.
+func tcpIPv4(src net.IP, sport uint16, dst net.IP, dport uint16, seg packet.TCP) []byte {
+	seg.SrcPort, seg.DstPort = sport, dport
+	if seg.Window == 0 {
+		seg.Window = 65535
+	}
+	ip := packet.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: packet.IPProtocolTCP,
+		SrcIP:    src.To4(),
+		DstIP:    dst.To4(),
+	}
+	hl := seg.HeaderLength()
+	l := hl + len(seg.Payload)
+	// pseudo header, then the segment the checksum covers
+	buf := make([]byte, packet.IPv4_PSEUDO_LENGTH+l)
+	copy(buf[packet.IPv4_PSEUDO_LENGTH+hl:], seg.Payload)
+	ip.PseudoHeader(buf[:packet.IPv4_PSEUDO_LENGTH], packet.IPProtocolTCP, l)
+	seg.Serialize(buf[packet.IPv4_PSEUDO_LENGTH:packet.IPv4_PSEUDO_LENGTH+hl], buf)
+	raw := make([]byte, 20+l)
+	ip.Serialize(raw[:20], l)
+	copy(raw[20:], buf[packet.IPv4_PSEUDO_LENGTH:])
+	return raw
+}
+
+// nextPacket returns the next packet emitted to p, failing the test if none
+// comes within a few seconds.
+func nextPacket(tb testing.TB, p *tun.MemoryTun) []byte {
+	tb.Helper()
+	select {
+	case pkt := <-p.Emitted():
+		return pkt
+	case <-time.After(5 * time.Second):
+		tb.Fatal("no packet emitted")
+	}
+	return nil
+}
+
+// nextUDP returns the next packet emitted to p, parsed as a UDP datagram.
+func nextUDP(tb testing.TB, p *tun.MemoryTun) (*packet.IPv4, *packet.UDP) {
+	tb.Helper()
+	raw := nextPacket(tb, p)
+	ip, udp := new(packet.IPv4), new(packet.UDP)
+	if e := packet.ParseIPv4(raw, ip); e != nil {
+		tb.Fatal(e)
+	}
+	if ip.Protocol != packet.IPProtocolUDP {
+		tb.Fatalf("emitted protocol %d, want UDP", ip.Protocol)
+	}
+	if e := packet.ParseUDP(ip.Payload, udp); e != nil {
+		tb.Fatal(e)
+	}
+	return ip, udp
+}
+
+// nextTCP returns the next packet emitted to p, parsed as a TCP segment.
+func nextTCP(tb testing.TB, p *tun.MemoryTun) (*packet.IPv4, *packet.TCP) {
+	tb.Helper()
+	raw := nextPacket(tb, p)
+	ip, tcp := new(packet.IPv4), new(packet.TCP)
+	if e := packet.ParseIPv4(raw, ip); e != nil {
+		tb.Fatal(e)
+	}
+	if ip.Protocol != packet.IPProtocolTCP {
+		tb.Fatalf("emitted protocol %d, want TCP", ip.Protocol)
+	}
+	if e := packet.ParseTCP(ip.Payload, tcp); e != nil {
+		tb.Fatal(e)
+	}
+	return ip, tcp
+}
+
+// noPacket fails the test if a packet is emitted to p within d.
+func noPacket(tb testing.TB, p *tun.MemoryTun, d time.Duration) {
+	tb.Helper()
+	select {
+	case pkt := <-p.Emitted():
+		tb.Fatalf("unexpected packet emitted: % x", pkt)
+	case <-time.After(d):
+	}
+}
+
+// packQuery packs a recursive query for name and qtype.
+func packQuery(tb testing.TB, id uint16, name string, qtype uint16) []byte {
+	tb.Helper()
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, qtype)
+	msg.Id = id
+	data, e := msg.Pack()
+	if e != nil {
+		tb.Fatal(e)
+	}
+	return data
+}
+
+// packReply packs the response to query answering with an A record of ttl
+// for each of ips.
+func packReply(tb testing.TB, query []byte, ttl uint32, ips ...string) []byte {
+	tb.Helper()
+	req := new(dns.Msg)
+	if e := req.Unpack(query); e != nil {
+		tb.Fatal(e)
+	}
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	for _, ip := range ips {
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+			A:   net.ParseIP(ip).To4(),
+		})
+	}
+	data, e := resp.Pack()
+	if e != nil {
+		tb.Fatal(e)
+	}
+	return data
+}
+
+// unpackDNS parses the DNS message carried by udp.
+func unpackDNS(tb testing.TB, udp *packet.UDP) *dns.Msg {
+	tb.Helper()
+	msg := new(dns.Msg)
+	if e := msg.Unpack(udp.Payload); e != nil {
+		tb.Fatal(e)
+	}
+	return msg
+}
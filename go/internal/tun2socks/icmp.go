@@ -0,0 +1,77 @@
+package tun2socks
+
+import (
+	"net"
+
+	"github.com/dkwiebe/gotun2socks/internal/packet"
+)
+
+// icmpError builds an ICMP error message of the given type and code in reply
+// to orig, a raw IPv4 packet read from tun. It returns nil if orig cannot be
+// parsed.
+func (t2s *Tun2Socks) icmpError(orig []byte, typ uint8, code uint8) *ipPacket {
+	return t2s.icmpErrorFrom(nil, orig, typ, code)
+}
+
+// icmpErrorFrom is icmpError sent from src, e.g. a router on the way, rather
+// than the destination of orig.
+func (t2s *Tun2Socks) icmpErrorFrom(src net.IP, orig []byte, typ uint8, code uint8) *ipPacket {
+	var origIP packet.IPv4
+	if packet.ParseIPv4(orig, &origIP) != nil {
+		return nil
+	}
+	if src == nil {
+		src = origIP.DstIP
+	}
+	// quote the original header and the first 8 bytes of its payload
+	quoteL := int(origIP.IHL)*4 + 8
+	if quoteL > len(orig) {
+		quoteL = len(orig)
+	}
+	quote := orig[:quoteL]
+
+	ip := packet.NewIPv4()
+	ip.Version = 4
+	ip.Id = t2s.ipID()
+	ip.SrcIP = make(net.IP, len(src))
+	copy(ip.SrcIP, src)
+	ip.DstIP = make(net.IP, len(origIP.SrcIP))
+	copy(ip.DstIP, origIP.SrcIP)
+	ip.TOS = t2s.tos
+	ip.TTL = 64
+	ip.Protocol = packet.IPProtocolICMPv4
+
+	icmp := &packet.ICMPv4{Type: typ, Code: code}
+
+	pkt := &ipPacket{ip: ip}
+	pkt.mtuBuf = newBuffer()
+	payloadStart := MTU - quoteL
+	copy(pkt.mtuBuf[payloadStart:], quote)
+	icmpStart := payloadStart - 8
+	icmp.Serialize(pkt.mtuBuf[icmpStart:payloadStart], pkt.mtuBuf[payloadStart:])
+	ipStart := icmpStart - ip.HeaderLength()
+	ip.Serialize(pkt.mtuBuf[ipStart:icmpStart], 8+quoteL)
+	pkt.wire = pkt.mtuBuf[ipStart:]
+	return pkt
+}
+
+// SetTracerouteHop makes packets from tun arriving with a TTL of 1, which
+// would expire at the next hop, get answered with an ICMP time exceeded from
+// hop instead of being relayed, so traceroute shows the tunnel as a hop. hop
+// must be an IPv4 address, nil disables it.
+func (t2s *Tun2Socks) SetTracerouteHop(hop net.IP) {
+	t2s.tracerouteHop = hop.To4()
+}
+
+// expired answers a packet whose TTL runs out at the tunnel hop with an ICMP
+// time exceeded. It reports whether the packet was answered.
+func (t2s *Tun2Socks) expired(dev *tunDevice, raw []byte, ip *packet.IPv4) bool {
+	hop := t2s.tracerouteHop
+	if hop == nil || ip.TTL > 1 {
+		return false
+	}
+	if resp := t2s.icmpErrorFrom(hop, raw, packet.ICMPv4TypeTimeExceeded, 0); resp != nil {
+		dev.writeCh <- resp
+	}
+	return true
+}
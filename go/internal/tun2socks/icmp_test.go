@@ -0,0 +1,112 @@
+package tun2socks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dkwiebe/gotun2socks/internal/packet"
+)
+
+func TestTracerouteHopAnswersTTL1(t *testing.T) {
+	s := newStubSocks(t, echoUDP)
+	t2s, p := NewTun2SocksWithPipe()
+	s.route(t2s)
+	hop := net.IP{10, 0, 0, 254}
+	t2s.SetTracerouteHop(hop)
+	serve(t, t2s)
+
+	dst := net.IP{192, 0, 2, 1}
+	probe := udpIPv4(clientIP, 33434, dst, 33434, []byte("probe"))
+	probe[8] = 1
+	binary.BigEndian.PutUint16(probe[10:], 0)
+	binary.BigEndian.PutUint16(probe[10:], packet.Checksum(probe[:20]))
+	p.Inject(probe)
+
+	raw := nextPacket(t, p)
+	var ip packet.IPv4
+	var icmp packet.ICMPv4
+	if e := packet.ParseIPv4(raw, &ip); e != nil {
+		t.Fatal(e)
+	}
+	if ip.Protocol != packet.IPProtocolICMPv4 || !ip.SrcIP.Equal(hop) || !ip.DstIP.Equal(clientIP) {
+		t.Fatalf("emitted protocol %d from %s to %s, want ICMP from %s", ip.Protocol, ip.SrcIP, ip.DstIP, hop)
+	}
+	if e := packet.ParseICMPv4(ip.Payload, &icmp); e != nil {
+		t.Fatal(e)
+	}
+	if icmp.Type != packet.ICMPv4TypeTimeExceeded || icmp.Code != packet.ICMPv4CodeTTLExceededInTransit {
+		t.Fatalf("ICMP type %d code %d, want time exceeded", icmp.Type, icmp.Code)
+	}
+	// quoting the IP header and the first 8 bytes of the probe
+	if !bytes.Equal(icmp.Payload, probe[:28]) {
+		t.Fatalf("quoted % x, want % x", icmp.Payload, probe[:28])
+	}
+	select {
+	case <-s.requests:
+		t.Fatal("expiring probe relayed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// one more hop and it goes through
+	p.Inject(udpIPv4(clientIP, 33435, dst, 33435, []byte("probe")))
+	if _, udp := nextUDP(t, p); string(udp.Payload) != "probe" {
+		t.Fatalf("echoed %q", udp.Payload)
+	}
+}
+
+func TestICMPOnPolicyCloseNotIdle(t *testing.T) {
+	s := newStubSocks(t, echoUDP)
+	t2s, p := NewTun2SocksWithPipe()
+	s.route(t2s)
+	t2s.SetICMPOnClose(true, false)
+	t2s.SetUDPIdleTimeout(100*time.Millisecond, 100*time.Millisecond)
+	closed := make(chan CloseReason, 2)
+	t2s.SetConnCloseHandler(func(id string, reason CloseReason) { closed <- reason })
+	serve(t, t2s)
+
+	dst := net.IP{192, 0, 2, 1}
+	last := udpIPv4(clientIP, 5000, dst, 9, []byte("ping"))
+	p.Inject(last)
+	nextUDP(t, p)
+	if n := t2s.CloseFlows(func(ConnInfo) bool { return true }); n != 1 {
+		t.Fatalf("closed %d flows", n)
+	}
+	if reason := <-closed; reason != CLOSE_POLICY {
+		t.Fatalf("closed for %s", reason)
+	}
+	raw := nextPacket(t, p)
+	var ip packet.IPv4
+	var icmp packet.ICMPv4
+	if e := packet.ParseIPv4(raw, &ip); e != nil {
+		t.Fatal(e)
+	}
+	if ip.Protocol != packet.IPProtocolICMPv4 || !ip.DstIP.Equal(clientIP) {
+		t.Fatalf("emitted protocol %d to %s, want ICMP to the app", ip.Protocol, ip.DstIP)
+	}
+	if e := packet.ParseICMPv4(ip.Payload, &icmp); e != nil {
+		t.Fatal(e)
+	}
+	if icmp.Type != packet.ICMPv4TypeDestinationUnreachable || icmp.Code != packet.ICMPv4CodePortUnreachable {
+		t.Fatalf("ICMP type %d code %d, want port unreachable", icmp.Type, icmp.Code)
+	}
+	// quoting the last packet of the app
+	if !bytes.Equal(icmp.Payload, last[:28]) {
+		t.Fatalf("quoted % x, want % x", icmp.Payload, last[:28])
+	}
+
+	// idle flows close silently by default
+	p.Inject(udpIPv4(clientIP, 5001, dst, 9, []byte("ping")))
+	nextUDP(t, p)
+	select {
+	case reason := <-closed:
+		if reason != CLOSE_IDLE_TIMEOUT {
+			t.Fatalf("closed for %s", reason)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle flow not closed")
+	}
+	noPacket(t, p, 50*time.Millisecond)
+}
@@ -3,6 +3,7 @@ package tun2socks
 import (
 	"log"
 	"net"
+	"sync"
 
 	"github.com/dkwiebe/gotun2socks/internal/packet"
 )
@@ -14,10 +15,36 @@ type ipPacket struct {
 }
 
 var (
-	frags = make(map[uint16]*ipPacket)
+	// fragments are reassembled across all devices
+	fragsLock sync.Mutex
+	frags     = make(map[uint16]*ipPacket)
 )
 
+// fragPayloadSize is the largest IP payload a non-last fragment of at most
+// mtu bytes may carry: fragment offsets count 8-byte units, so it must be a
+// multiple of 8.
+func fragPayloadSize(mtu int) int {
+	return (mtu - 20) &^ 7
+}
+
+// fragmentCount returns how many IP packets of at most mtu bytes a UDP
+// response with payloadL bytes of payload is sent as, the way responsePacket
+// and genFragments split it.
+func fragmentCount(payloadL int, mtu int) int {
+	if payloadL <= mtu-28 {
+		return 1
+	}
+	size := fragPayloadSize(mtu)
+	n := 2
+	for rest := payloadL + 8 - size; rest > mtu-20; rest -= size {
+		n++
+	}
+	return n
+}
+
 func procFragment(ip *packet.IPv4, raw []byte) (bool, *packet.IPv4, []byte) {
+	fragsLock.Lock()
+	defer fragsLock.Unlock()
 	exist, ok := frags[ip.Id]
 	if !ok {
 		if ip.Flags&0x1 == 0 {
@@ -50,7 +77,10 @@ func procFragment(ip *packet.IPv4, raw []byte) (bool, *packet.IPv4, []byte) {
 	}
 }
 
-func genFragments(first *packet.IPv4, offset uint16, data []byte) []*ipPacket {
+// genFragments splits data, the rest of the payload of first from offset on,
+// into fragments of at most mtu bytes.
+func genFragments(first *packet.IPv4, offset uint16, data []byte, mtu int) []*ipPacket {
+	size := fragPayloadSize(mtu)
 	var ret []*ipPacket
 	for {
 		frag := packet.NewIPv4()
@@ -61,16 +91,17 @@ func genFragments(first *packet.IPv4, offset uint16, data []byte) []*ipPacket {
 		copy(frag.SrcIP, first.SrcIP)
 		frag.DstIP = make(net.IP, len(first.DstIP))
 		copy(frag.DstIP, first.DstIP)
+		frag.TOS = first.TOS
 		frag.TTL = first.TTL
 		frag.Protocol = first.Protocol
 		frag.FragOffset = offset
-		if len(data) <= MTU-20 {
+		if len(data) <= mtu-20 {
 			frag.Payload = data
 		} else {
 			frag.Flags = 1
-			offset += (MTU - 20) / 8
-			frag.Payload = data[:MTU-20]
-			data = data[MTU-20:]
+			offset += uint16(size / 8)
+			frag.Payload = data[:size]
+			data = data[size:]
 		}
 
 		pkt := &ipPacket{ip: frag}
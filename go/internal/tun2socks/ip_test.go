@@ -0,0 +1,112 @@
+package tun2socks
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/dkwiebe/gotun2socks/internal/packet"
+)
+
+// reassemble checks that the UDP response first and its fragments are well
+// formed fragments of at most mtu bytes and returns the UDP datagram they
+// carry.
+func reassemble(t testing.TB, first *udpPacket, frags []*ipPacket, mtu int) []byte {
+	t.Helper()
+	wires := [][]byte{first.wire}
+	for _, f := range frags {
+		wires = append(wires, f.wire)
+	}
+	var datagram []byte
+	for i, w := range wires {
+		var ip packet.IPv4
+		if e := packet.ParseIPv4(w, &ip); e != nil {
+			t.Fatal(e)
+		}
+		last := i == len(wires)-1
+		switch {
+		case len(w) > mtu:
+			t.Fatalf("fragment %d of %d bytes over the MTU", i, len(w))
+		case int(ip.Length) != len(w):
+			t.Fatalf("fragment %d claims %d bytes, has %d", i, ip.Length, len(w))
+		case int(ip.FragOffset)*8 != len(datagram):
+			t.Fatalf("fragment %d at offset %d, want %d", i, int(ip.FragOffset)*8, len(datagram))
+		case ip.Flags&1 == 0 != last:
+			t.Fatalf("fragment %d has MF %d", i, ip.Flags&1)
+		case !last && len(ip.Payload)%8 != 0:
+			t.Fatalf("fragment %d carries %d bytes, not a multiple of 8", i, len(ip.Payload))
+		}
+		datagram = append(datagram, ip.Payload...)
+	}
+	return datagram
+}
+
+func TestFragmentRoundTrip(t *testing.T) {
+	t2s := New(nil, false)
+	for _, n := range []int{MTU - 28, MTU - 27, MTU - 21, MTU - 20, MTU - 19, MTU, MTU + 1, 2*MTU - 3, 2 * MTU, 3*MTU + 7, 4 * MTU, MAX_UDP_PAYLOAD} {
+		payload := make([]byte, n)
+		for i := range payload {
+			payload[i] = byte(i * 7)
+		}
+		first, frags := t2s.responsePacket(clientIP, net.IP{8, 8, 8, 8}, 1000, 53, payload, 1, 0)
+		if first == nil {
+			t.Fatalf("%d bytes: no response", n)
+		}
+		datagram := reassemble(t, first, frags, MTU)
+		var udp packet.UDP
+		if e := packet.ParseUDP(datagram, &udp); e != nil {
+			t.Fatalf("%d bytes: %s", n, e)
+		}
+		if !bytes.Equal(udp.Payload, payload) {
+			t.Fatalf("%d bytes: reassembled payload differs", n)
+		}
+	}
+}
+
+// FuzzUDPRoundTrip builds responses of payload followed by grow more bytes,
+// which lets the fuzzer reach fragmented sizes cheaply.
+func FuzzUDPRoundTrip(f *testing.F) {
+	t2s := New(nil, false)
+	f.Fuzz(func(t *testing.T, payload []byte, grow uint16) {
+		for i := 0; i < int(grow); i++ {
+			payload = append(payload, byte(i*7))
+		}
+		first, frags := t2s.responsePacket(clientIP, resolverIP, 1000, 53, payload, 1, 0)
+		if len(payload) > MAX_UDP_PAYLOAD {
+			if first != nil {
+				t.Fatalf("%d bytes: response over the UDP maximum built", len(payload))
+			}
+			return
+		}
+		if first == nil {
+			t.Fatalf("%d bytes: no response", len(payload))
+		}
+		datagram := reassemble(t, first, frags, MTU)
+		var udp packet.UDP
+		if e := packet.ParseUDP(datagram, &udp); e != nil {
+			t.Fatalf("%d bytes: %s", len(payload), e)
+		}
+		if udp.SrcPort != 53 || udp.DstPort != 1000 || !bytes.Equal(udp.Payload, payload) {
+			t.Fatalf("%d bytes: reassembled %d bytes from port %d to %d", len(payload), len(udp.Payload), udp.SrcPort, udp.DstPort)
+		}
+	})
+}
+
+func TestIPIDFuncStampsEveryFragment(t *testing.T) {
+	t2s := New(nil, false)
+	t2s.SetIPIDFunc(func() uint16 { return 0x1234 })
+	first, frags := t2s.responsePacket(clientIP, net.IP{8, 8, 8, 8}, 1000, 53, make([]byte, 2*MTU), t2s.ipID(), 0)
+	if len(frags) == 0 {
+		t.Fatal("response not fragmented")
+	}
+	if first.ip.Id != 0x1234 {
+		t.Fatalf("IP ID %#x, want 0x1234", first.ip.Id)
+	}
+	for i, f := range frags {
+		var ip packet.IPv4
+		packet.ParseIPv4(f.wire, &ip)
+		if ip.Id != 0x1234 {
+			t.Fatalf("fragment %d IP ID %#x, want 0x1234", i, ip.Id)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package tun2socks
+
+import (
+	"sync"
+)
+
+// number of emitted packets remembered for loop detection
+const loopHistorySize = 1024
+
+// packetSig identifies an IPv4 packet well enough to recognize our own output
+// coming back in.
+type packetSig struct {
+	src   [4]byte
+	dst   [4]byte
+	id    uint16
+	proto uint8
+}
+
+func wireSig(wire []byte) (packetSig, bool) {
+	var sig packetSig
+	if len(wire) < 20 {
+		return sig, false
+	}
+	copy(sig.src[:], wire[12:16])
+	copy(sig.dst[:], wire[16:20])
+	sig.id = uint16(wire[4])<<8 | uint16(wire[5])
+	sig.proto = wire[9]
+	return sig, true
+}
+
+// emittedPackets remembers signatures of the last loopHistorySize packets
+// written to tun.
+type emittedPackets struct {
+	mutex sync.Mutex
+	ring  [loopHistorySize]packetSig
+	next  int
+	count map[packetSig]int
+}
+
+func newEmittedPackets() *emittedPackets {
+	return &emittedPackets{count: make(map[packetSig]int)}
+}
+
+func (e *emittedPackets) add(wire []byte) {
+	sig, ok := wireSig(wire)
+	if !ok {
+		return
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	old := e.ring[e.next]
+	if n := e.count[old]; n > 1 {
+		e.count[old] = n - 1
+	} else {
+		delete(e.count, old)
+	}
+	e.ring[e.next] = sig
+	e.next = (e.next + 1) % loopHistorySize
+	e.count[sig]++
+}
+
+func (e *emittedPackets) contains(wire []byte) bool {
+	sig, ok := wireSig(wire)
+	if !ok {
+		return false
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.count[sig] > 0
+}
+
+// SetLoopDetection enables dropping packets read from tun that are copies of
+// packets we wrote to it, which happens when routes send relayed traffic back
+// into the tun. Drops are counted in Stats.LoopDetected.
+func (t2s *Tun2Socks) SetLoopDetection(enabled bool) {
+	if enabled {
+		t2s.emitted = newEmittedPackets()
+	} else {
+		t2s.emitted = nil
+	}
+}
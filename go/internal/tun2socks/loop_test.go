@@ -0,0 +1,38 @@
+package tun2socks
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLoopDetectionDropsOwnPackets(t *testing.T) {
+	s := newStubSocks(t, echoUDP)
+	t2s, p := NewTun2SocksWithPipe()
+	s.route(t2s)
+	t2s.SetLoopDetection(true)
+	serve(t, t2s)
+
+	p.Inject(udpIPv4(clientIP, 5000, net.IP{192, 0, 2, 1}, 9, []byte("ping")))
+	emitted := nextPacket(t, p)
+	<-s.requests
+
+	// as if routes sent it back into the tun
+	p.Inject(emitted)
+	waitFor(t, "loop counted", func() bool { return t2s.Stats().LoopDetected == 1 })
+	noPacket(t, p, 50*time.Millisecond)
+	select {
+	case req := <-s.requests:
+		t.Fatalf("looped packet relayed to %s:%d", req.DstHost, req.DstPort)
+	default:
+	}
+
+	// the app's own packets still pass
+	p.Inject(udpIPv4(clientIP, 5000, net.IP{192, 0, 2, 1}, 9, []byte("ping again")))
+	if _, udp := nextUDP(t, p); string(udp.Payload) != "ping again" {
+		t.Fatalf("echoed %q", udp.Payload)
+	}
+	if n := t2s.Stats().LoopDetected; n != 1 {
+		t.Fatalf("%d loops counted, want 1", n)
+	}
+}
@@ -2,20 +2,24 @@ package tun2socks
 
 import (
 	"sync"
+	"sync/atomic"
 )
 
 var (
 	bufPool *sync.Pool = &sync.Pool{
 		New: func() interface{} {
+			atomic.AddUint64(&poolStats.BufferMisses, 1)
 			return make([]byte, MTU)
 		},
 	}
 )
 
 func newBuffer() []byte {
+	atomic.AddUint64(&poolStats.BufferGets, 1)
 	return bufPool.Get().([]byte)
 }
 
 func releaseBuffer(buf []byte) {
+	atomic.AddUint64(&poolStats.BufferPuts, 1)
 	bufPool.Put(buf)
 }
@@ -0,0 +1,60 @@
+package tun2socks
+
+import (
+	"log"
+	"net"
+	"sync/atomic"
+)
+
+// SetDropMulticast enables dropping UDP to multicast and broadcast
+// destinations (SSDP, mDNS, DHCP, ...) read from tun, which could only make
+// pointless relay flows. Multicast groups in allow, e.g. 224.0.0.251 for
+// mDNS, are still relayed.
+func (t2s *Tun2Socks) SetDropMulticast(enabled bool, allow []net.IP) {
+	t2s.dropMulticast = enabled
+	t2s.multicastAllow = allow
+}
+
+// droppedMulticast reports whether the UDP datagram to dst read from dev is to
+// be dropped as multicast or broadcast, and counts it if so.
+func (t2s *Tun2Socks) droppedMulticast(dev *tunDevice, dst net.IP) bool {
+	if !t2s.dropMulticast {
+		return false
+	}
+	switch {
+	case dst.IsMulticast():
+		for _, group := range t2s.multicastAllow {
+			if group.Equal(dst) {
+				return false
+			}
+		}
+	case dst.Equal(net.IPv4bcast), isSubnetBroadcast(dev.subnet, dst):
+	default:
+		return false
+	}
+	log.Printf("drop UDP to multicast or broadcast %s", dst)
+	atomic.AddUint64(&t2s.stats.MulticastDropped, 1)
+	return true
+}
+
+// isSubnetBroadcast reports whether ip is the broadcast address of subnet.
+// Subnets without room for one (/31, /32) have none.
+func isSubnetBroadcast(subnet *net.IPNet, ip net.IP) bool {
+	if subnet == nil {
+		return false
+	}
+	ones, bits := subnet.Mask.Size()
+	if bits-ones < 2 || !subnet.Contains(ip) {
+		return false
+	}
+	ip4 := ip.To4()
+	if ip4 == nil || len(subnet.Mask) != net.IPv4len {
+		return false
+	}
+	for i := range ip4 {
+		if ip4[i]|subnet.Mask[i] != 0xff {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,70 @@
+package tun2socks
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dkwiebe/gotun2socks/internal/tun"
+)
+
+func TestDropMulticast(t *testing.T) {
+	s := newStubSocks(t, echoUDP)
+	p := tun.NewMemoryTun()
+	_, subnet, _ := net.ParseCIDR("10.0.0.0/24")
+	t2s := New(subnetTun{p, subnet}, false)
+	s.route(t2s)
+	mdns := net.IP{224, 0, 0, 251}
+	t2s.SetDropMulticast(true, []net.IP{mdns})
+	serve(t, t2s)
+
+	var dropped uint64
+	for _, tc := range []struct {
+		class   string
+		dst     net.IP
+		relayed bool
+	}{
+		{"multicast", net.IP{239, 255, 255, 250}, false},
+		{"allowed group", mdns, true},
+		{"broadcast", net.IPv4bcast.To4(), false},
+		{"subnet broadcast", net.IP{10, 0, 0, 255}, false},
+		{"unicast", net.IP{192, 0, 2, 1}, true},
+	} {
+		p.Inject(udpIPv4(clientIP, 5000, tc.dst, 1900, []byte(tc.class)))
+		if tc.relayed {
+			if _, udp := nextUDP(t, p); string(udp.Payload) != tc.class {
+				t.Fatalf("%s: echoed %q", tc.class, udp.Payload)
+			}
+			continue
+		}
+		dropped++
+		waitFor(t, tc.class+" counted", func() bool { return t2s.Stats().MulticastDropped == dropped })
+		noPacket(t, p, 50*time.Millisecond)
+	}
+
+	// relayed once dropping is off again
+	t2s.SetDropMulticast(false, nil)
+	p.Inject(udpIPv4(clientIP, 5000, net.IP{239, 255, 255, 250}, 1900, []byte("ssdp")))
+	if _, udp := nextUDP(t, p); string(udp.Payload) != "ssdp" {
+		t.Fatalf("echoed %q", udp.Payload)
+	}
+}
+
+func TestIsSubnetBroadcast(t *testing.T) {
+	for _, tc := range []struct {
+		subnet string
+		ip     net.IP
+		want   bool
+	}{
+		{"10.0.0.0/24", net.IP{10, 0, 0, 255}, true},
+		{"10.0.0.0/24", net.IP{10, 0, 0, 254}, false},
+		{"10.0.0.0/24", net.IP{10, 0, 1, 255}, false},
+		{"10.0.0.0/31", net.IP{10, 0, 0, 1}, false},
+		{"10.0.0.1/32", net.IP{10, 0, 0, 1}, false},
+	} {
+		_, subnet, _ := net.ParseCIDR(tc.subnet)
+		if got := isSubnetBroadcast(subnet, tc.ip); got != tc.want {
+			t.Errorf("%s in %s: broadcast %v, want %v", tc.ip, tc.subnet, got, tc.want)
+		}
+	}
+}
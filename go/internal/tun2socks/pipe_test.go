@@ -0,0 +1,109 @@
+package tun2socks
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/dkwiebe/gotun2socks/internal/gosocks"
+	"github.com/dkwiebe/gotun2socks/internal/packet"
+	"github.com/dkwiebe/gotun2socks/internal/tun"
+	"github.com/miekg/dns"
+)
+
+// NewTun2SocksWithPipe returns a Tun2Socks with the DNS cache enabled,
+// attached to a memory tun standing in for its tun device, to inject raw
+// packets into and capture those emitted. Run or Serve it as usual, and wait
+// for Ready before injecting packets.
+func NewTun2SocksWithPipe() (*Tun2Socks, *tun.MemoryTun) {
+	p := tun.NewMemoryTun()
+	return New(p, true), p
+}
+
+func TestPipeRoundTrip(t *testing.T) {
+	s := newStubSocks(t, echoUDP)
+	t2s, p := NewTun2SocksWithPipe()
+	t2s.SetDefaultProxy(&ProxyServer{ProxyType: PROXY_TYPE_SOCKS, IpAddress: s.addr})
+	t2s.SetRoutingRules(RoutingRules{Rules: []RoutingRule{{Decision: ROUTE_PROXY}}})
+	serve(t, t2s)
+	server := net.IP{192, 0, 2, 1}
+
+	// a datagram comes back from where it was sent
+	p.Inject(udpIPv4(clientIP, 5000, server, 9, []byte("ping")))
+	ip, udp := nextUDP(t, p)
+	if !ip.SrcIP.Equal(server) || udp.SrcPort != 9 || !ip.DstIP.Equal(clientIP) || udp.DstPort != 5000 ||
+		string(udp.Payload) != "ping" {
+		t.Fatalf("got %q from %s:%d to %s:%d", udp.Payload, ip.SrcIP, udp.SrcPort, ip.DstIP, udp.DstPort)
+	}
+
+	// a stream is accepted and its data echoed
+	p.Inject(tcpIPv4(clientIP, 6000, server, 7, packet.TCP{SYN: true, Seq: 100}))
+	_, synAck := nextTCPTo(t, p, 6000)
+	if !synAck.SYN || !synAck.ACK || synAck.Ack != 101 {
+		t.Fatalf("got %s ack %d, want SYN/ACK of 101", tcpflagsString(synAck), synAck.Ack)
+	}
+	p.Inject(tcpIPv4(clientIP, 6000, server, 7, packet.TCP{ACK: true, Seq: 101, Ack: synAck.Seq + 1}))
+	p.Inject(tcpIPv4(clientIP, 6000, server, 7, packet.TCP{ACK: true, Seq: 101, Ack: synAck.Seq + 1, Payload: []byte("hello")}))
+	if _, data := nextTCPTo(t, p, 6000); string(data.Payload) != "hello" || data.Seq != synAck.Seq+1 {
+		t.Fatalf("got %q at %d, want hello at %d", data.Payload, data.Seq, synAck.Seq+1)
+	}
+}
+
+func BenchmarkDNSCacheHit(b *testing.B) {
+	t2s, p := NewTun2SocksWithPipe()
+	serve(b, t2s)
+	query := packQuery(b, 1, "bench.example.", dns.TypeA)
+	if e := t2s.PreloadDNS([]PreloadEntry{{Response: packReply(b, query, 300, "192.0.2.1")}}); e != nil {
+		b.Fatal(e)
+	}
+	pkt := udpIPv4(clientIP, 4000, net.IP{8, 8, 8, 8}, 53, query)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if e := p.Inject(pkt); e != nil {
+			b.Fatal(e)
+		}
+		nextUDP(b, p)
+	}
+}
+
+// replayTun is a tun device reading pkt n times, then EOF, and discarding
+// whatever is written to it.
+type replayTun struct {
+	pkt []byte
+	n   int
+}
+
+func (d *replayTun) Read(b []byte) (int, error) {
+	if d.n == 0 {
+		return 0, io.EOF
+	}
+	d.n--
+	return copy(b, d.pkt), nil
+}
+
+func (d *replayTun) Write(b []byte) (int, error) { return len(b), nil }
+func (d *replayTun) Close() error                { return nil }
+
+// BenchmarkReadUDPPacket measures the read loop on its own: each packet is
+// read, parsed, copied for its flow and dropped from the flow's full queue,
+// as the flow's relay is still being dialed.
+func BenchmarkReadUDPPacket(b *testing.B) {
+	dev := &replayTun{pkt: udpIPv4(clientIP, 5000, net.IP{192, 0, 2, 1}, 9, make([]byte, 512)), n: b.N}
+	t2s := New(dev, false)
+	t2s.SetSocksRouter(func(net.IP, uint16, string) string { return "127.0.0.1:1080" })
+	t2s.SetUDPQueue(1, UDP_QUEUE_DROP_NEWEST)
+	release := make(chan struct{})
+	defer close(release)
+	t2s.SetRelayDialer(func(*ProxyServer) (*gosocks.SocksConn, error) {
+		<-release
+		return nil, io.EOF
+	})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	if e := t2s.Serve(nil); e != io.EOF {
+		b.Fatal(e)
+	}
+}
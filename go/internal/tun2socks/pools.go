@@ -0,0 +1,43 @@
+package tun2socks
+
+import (
+	"sync/atomic"
+)
+
+// PoolStats counts the use of the MTU buffer and UDP packet pools shared by
+// every Tun2Socks in the process. A miss is a get the pool had to allocate
+// for; the pools are emptied by garbage collection, so misses recurring in
+// bursts point at allocation spikes.
+type PoolStats struct {
+	BufferGets      uint64
+	BufferMisses    uint64
+	BufferPuts      uint64
+	UDPPacketGets   uint64
+	UDPPacketMisses uint64
+	UDPPacketPuts   uint64
+}
+
+var poolStats PoolStats
+
+// ReadPoolStats returns a snapshot of the pool counters.
+func ReadPoolStats() PoolStats {
+	return PoolStats{
+		BufferGets:      atomic.LoadUint64(&poolStats.BufferGets),
+		BufferMisses:    atomic.LoadUint64(&poolStats.BufferMisses),
+		BufferPuts:      atomic.LoadUint64(&poolStats.BufferPuts),
+		UDPPacketGets:   atomic.LoadUint64(&poolStats.UDPPacketGets),
+		UDPPacketMisses: atomic.LoadUint64(&poolStats.UDPPacketMisses),
+		UDPPacketPuts:   atomic.LoadUint64(&poolStats.UDPPacketPuts),
+	}
+}
+
+// PrewarmPools puts n MTU buffers and n UDP packets into the pools, e.g. at
+// startup so the first burst of traffic doesn't allocate. Garbage collection
+// may still drop them later, as it does any pooled object; prewarming doesn't
+// count as misses.
+func PrewarmPools(n int) {
+	for i := 0; i < n; i++ {
+		bufPool.Put(make([]byte, MTU))
+		udpPacketPool.Put(&udpPacket{})
+	}
+}
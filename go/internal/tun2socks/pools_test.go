@@ -0,0 +1,41 @@
+package tun2socks
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestPrewarmPoolsSavesMisses(t *testing.T) {
+	const n = 64
+	// misses getting n buffers and packets from pools just emptied, after
+	// prewarming them with prewarm
+	misses := func(prewarm int) (uint64, uint64) {
+		// objects survive a collection in the victim cache
+		runtime.GC()
+		runtime.GC()
+		PrewarmPools(prewarm)
+		before := ReadPoolStats()
+		bufs, pkts := make([][]byte, n), make([]*udpPacket, n)
+		for i := range bufs {
+			bufs[i], pkts[i] = newBuffer(), newUDPPacket()
+		}
+		after := ReadPoolStats()
+		for i := range bufs {
+			releaseBuffer(bufs[i])
+			// not a packet parsed off tun to release
+			udpPacketPool.Put(pkts[i])
+		}
+		if after.BufferGets-before.BufferGets < n || after.UDPPacketGets-before.UDPPacketGets < n {
+			t.Fatalf("gets not counted: %+v, then %+v", before, after)
+		}
+		return after.BufferMisses - before.BufferMisses, after.UDPPacketMisses - before.UDPPacketMisses
+	}
+
+	if buf, pkt := misses(0); buf < n/2 || pkt < n/2 {
+		t.Fatalf("%d buffer and %d packet misses of %d gets from empty pools", buf, pkt, n)
+	}
+	// under the race detector pools drop a quarter of what is put in them
+	if buf, pkt := misses(n); buf > n/2 || pkt > n/2 {
+		t.Fatalf("%d buffer and %d packet misses of %d gets from prewarmed pools", buf, pkt, n)
+	}
+}
@@ -0,0 +1,62 @@
+package tun2socks
+
+import (
+	"log"
+	"sync/atomic"
+
+	"github.com/dkwiebe/gotun2socks/internal/packet"
+)
+
+// ProtocolMode is which protocols are tunneled.
+type ProtocolMode int
+
+const (
+	PROTOCOL_BOTH ProtocolMode = iota
+	PROTOCOL_TCP_ONLY
+	PROTOCOL_UDP_ONLY
+)
+
+// SetProtocolMode tunnels only TCP or only UDP, e.g. only DNS for a captive
+// portal. Packets of the other protocol read from tun are dropped, and with
+// unreachable answered with an ICMP destination unreachable (administratively
+// prohibited) so apps fail fast. PROTOCOL_BOTH is the default.
+func (t2s *Tun2Socks) SetProtocolMode(mode ProtocolMode, unreachable bool) {
+	t2s.protocolMode = mode
+	t2s.protoUnreachable = unreachable
+}
+
+// disabledProto reports whether proto ("tcp" or "udp") is not tunneled.
+func (t2s *Tun2Socks) disabledProto(proto string) bool {
+	switch t2s.protocolMode {
+	case PROTOCOL_TCP_ONLY:
+		return proto == "udp"
+	case PROTOCOL_UDP_ONLY:
+		return proto == "tcp"
+	}
+	return false
+}
+
+// droppedProto reports whether the packet ip, read from dev as raw, is of a
+// protocol not tunneled, and drops it if so.
+func (t2s *Tun2Socks) droppedProto(dev *tunDevice, raw []byte, ip *packet.IPv4) bool {
+	var proto string
+	switch ip.Protocol {
+	case packet.IPProtocolTCP:
+		proto = "tcp"
+	case packet.IPProtocolUDP:
+		proto = "udp"
+	default:
+		return false
+	}
+	if !t2s.disabledProto(proto) {
+		return false
+	}
+	log.Printf("drop %s packet to %s, protocol disabled", proto, ip.DstIP)
+	atomic.AddUint64(&t2s.stats.ProtocolDropped, 1)
+	if t2s.protoUnreachable {
+		if resp := t2s.icmpError(raw, packet.ICMPv4TypeDestinationUnreachable, packet.ICMPv4CodeAdminProhibited); resp != nil {
+			dev.writeCh <- resp
+		}
+	}
+	return true
+}
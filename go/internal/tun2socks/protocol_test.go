@@ -0,0 +1,58 @@
+package tun2socks
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dkwiebe/gotun2socks/internal/packet"
+)
+
+func TestProtocolMode(t *testing.T) {
+	dst := net.IP{192, 0, 2, 1}
+	udp := udpIPv4(clientIP, 5000, dst, 9, []byte("ping"))
+	syn := tcpIPv4(clientIP, 5001, dst, 80, packet.TCP{SYN: true, Seq: 100})
+	for _, tc := range []struct {
+		mode        ProtocolMode
+		unreachable bool
+		// packet dropped and the one going through
+		dropped, passed []byte
+	}{
+		{PROTOCOL_TCP_ONLY, false, udp, syn},
+		{PROTOCOL_TCP_ONLY, true, udp, syn},
+		{PROTOCOL_UDP_ONLY, false, syn, udp},
+		{PROTOCOL_UDP_ONLY, true, syn, udp},
+	} {
+		s := newStubSocks(t, echoUDP)
+		t2s, p := NewTun2SocksWithPipe()
+		t2s.SetDefaultProxy(&ProxyServer{ProxyType: PROXY_TYPE_SOCKS, IpAddress: s.addr})
+		t2s.SetRoutingRules(RoutingRules{Rules: []RoutingRule{{Decision: ROUTE_PROXY}}})
+		t2s.SetProtocolMode(tc.mode, tc.unreachable)
+		serve(t, t2s)
+
+		p.Inject(tc.dropped)
+		if tc.unreachable {
+			var ip packet.IPv4
+			var icmp packet.ICMPv4
+			if e := packet.ParseIPv4(nextPacket(t, p), &ip); e != nil {
+				t.Fatal(e)
+			}
+			if e := packet.ParseICMPv4(ip.Payload, &icmp); e != nil || ip.Protocol != packet.IPProtocolICMPv4 ||
+				icmp.Type != packet.ICMPv4TypeDestinationUnreachable || icmp.Code != packet.ICMPv4CodeAdminProhibited {
+				t.Fatalf("mode %d: got protocol %d, want ICMP administratively prohibited", tc.mode, ip.Protocol)
+			}
+		} else {
+			noPacket(t, p, 50*time.Millisecond)
+		}
+		if n := t2s.Stats().ProtocolDropped; n != 1 {
+			t.Fatalf("mode %d: %d packets dropped, want 1", tc.mode, n)
+		}
+
+		p.Inject(tc.passed)
+		raw := nextPacket(t, p)
+		if proto := raw[9]; proto != tc.passed[9] {
+			t.Fatalf("mode %d: got protocol %d back, want %d", tc.mode, proto, tc.passed[9])
+		}
+		t2s.Stop()
+	}
+}
@@ -0,0 +1,62 @@
+package tun2socks
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// PROXY protocol v2 signature (haproxy proxy-protocol.txt, 2.2)
+var proxyProtoSig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	proxyProtoV2Proxy = 0x21
+	proxyProtoTCP4    = 0x11
+	proxyProtoTCP6    = 0x21
+)
+
+// ProxyProtocolFilter reports whether direct TCP connections to dst:port
+// start with a PROXY protocol header.
+type ProxyProtocolFilter func(dst net.IP, port uint16) bool
+
+// SetProxyProtocol makes direct TCP connections for which filter returns true
+// start with a PROXY protocol v2 header carrying the address and port of the
+// app and of the destination, for backends logging client addresses. Only
+// set for backends expecting the header, others take it for garbage. nil
+// disables it.
+func (t2s *Tun2Socks) SetProxyProtocol(filter ProxyProtocolFilter) {
+	t2s.proxyLock.Lock()
+	defer t2s.proxyLock.Unlock()
+	t2s.proxyProtocol = filter
+}
+
+// wantsProxyProtocol reports whether a direct connection to dst:port starts
+// with a PROXY protocol header.
+func (t2s *Tun2Socks) wantsProxyProtocol(dst net.IP, port uint16) bool {
+	t2s.proxyLock.RLock()
+	filter := t2s.proxyProtocol
+	t2s.proxyLock.RUnlock()
+	return filter != nil && filter(dst, port)
+}
+
+// proxyProtocolHeader encodes a PROXY protocol v2 header for a TCP connection
+// from src:srcPort to dst:dstPort. IPv4 addresses are mapped to IPv6 if the
+// other one is IPv6.
+func proxyProtocolHeader(src net.IP, srcPort uint16, dst net.IP, dstPort uint16) []byte {
+	family := byte(proxyProtoTCP4)
+	srcIP, dstIP := src.To4(), dst.To4()
+	if srcIP == nil || dstIP == nil {
+		family = proxyProtoTCP6
+		srcIP, dstIP = src.To16(), dst.To16()
+	}
+	addrL := 2*len(srcIP) + 4
+
+	hdr := make([]byte, 0, len(proxyProtoSig)+4+addrL)
+	hdr = append(hdr, proxyProtoSig...)
+	hdr = append(hdr, proxyProtoV2Proxy, family)
+	hdr = binary.BigEndian.AppendUint16(hdr, uint16(addrL))
+	hdr = append(hdr, srcIP...)
+	hdr = append(hdr, dstIP...)
+	hdr = binary.BigEndian.AppendUint16(hdr, srcPort)
+	hdr = binary.BigEndian.AppendUint16(hdr, dstPort)
+	return hdr
+}
@@ -0,0 +1,81 @@
+package tun2socks
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dkwiebe/gotun2socks/internal/gosocks"
+	"github.com/dkwiebe/gotun2socks/internal/packet"
+)
+
+func TestProxyProtocolHeader(t *testing.T) {
+	sig := "\r\n\r\n\x00\r\nQUIT\n"
+	for _, tc := range []struct {
+		name     string
+		src, dst net.IP
+		want     []byte
+	}{
+		{"v4", net.IP{10, 0, 0, 2}, net.IP{192, 0, 2, 1}, append([]byte(sig),
+			0x21, 0x11, 0, 12,
+			10, 0, 0, 2,
+			192, 0, 2, 1,
+			0x13, 0x88, 0, 80)},
+		{"v6", net.ParseIP("2001:db8::2"), net.ParseIP("2001:db8::1"), append([]byte(sig),
+			0x21, 0x21, 0, 36,
+			0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2,
+			0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+			0x13, 0x88, 0, 80)},
+		// an IPv4 address is mapped if the other one is IPv6
+		{"mixed", net.IP{10, 0, 0, 2}, net.ParseIP("2001:db8::1"), append([]byte(sig),
+			0x21, 0x21, 0, 36,
+			0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 10, 0, 0, 2,
+			0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+			0x13, 0x88, 0, 80)},
+	} {
+		if got := proxyProtocolHeader(tc.src, 5000, tc.dst, 80); !bytes.Equal(got, tc.want) {
+			t.Errorf("%s: header\n% x\nwant\n% x", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestProxyProtocolOnDirectConnections(t *testing.T) {
+	ln, e := net.Listen("tcp4", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer ln.Close()
+	t2s, p := NewTun2SocksWithPipe()
+	t2s.SetRoutingRules(RoutingRules{Rules: []RoutingRule{{Decision: ROUTE_DIRECT}}})
+	t2s.SetDirectDialer(func(string) (*gosocks.SocksConn, error) {
+		c, e := net.Dial("tcp4", ln.Addr().String())
+		if e != nil {
+			return nil, e
+		}
+		return &gosocks.SocksConn{Conn: c, Timeout: time.Second}, nil
+	})
+	backend := net.IP{192, 0, 2, 1}
+	t2s.SetProxyProtocol(func(dst net.IP, port uint16) bool { return dst.Equal(backend) })
+	serve(t, t2s)
+
+	for _, dst := range []net.IP{backend, {192, 0, 2, 2}} {
+		p.Inject(tcpIPv4(clientIP, 5000, dst, 80, packet.TCP{SYN: true, Seq: 100}))
+		nextTCP(t, p)
+		c, e := ln.Accept()
+		if e != nil {
+			t.Fatal(e)
+		}
+		want := proxyProtocolHeader(clientIP, 5000, dst, 80)
+		if !dst.Equal(backend) {
+			want = nil
+		}
+		c.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		got, _ := io.ReadAll(c)
+		c.Close()
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: backend read % x, want % x", dst, got, want)
+		}
+	}
+}
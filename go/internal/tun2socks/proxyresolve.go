@@ -0,0 +1,162 @@
+package tun2socks
+
+import (
+	"context"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dkwiebe/gotun2socks/internal/gosocks"
+)
+
+// proxyAddrs caches the addresses of proxy servers given by hostname.
+type proxyAddrs struct {
+	mutex    sync.Mutex
+	interval time.Duration
+	hosts    map[string]*proxyAddr
+	// set while a refresh runs
+	refreshing int32
+}
+
+type proxyAddr struct {
+	ip       net.IP
+	resolved time.Time
+}
+
+// SetProxyResolve makes proxy servers given by hostname get resolved once,
+// outside of the tunnel, and dialed by the cached address from then on,
+// rather than on every dial through the DNS the tunnel intercepts. Hosts are
+// resolved again every interval; a failed lookup keeps the last address. 0
+// disables the cache.
+func (t2s *Tun2Socks) SetProxyResolve(interval time.Duration) {
+	t2s.proxyAddrs.mutex.Lock()
+	defer t2s.proxyAddrs.mutex.Unlock()
+	t2s.proxyAddrs.interval = interval
+	if interval > 0 && t2s.proxyAddrs.hosts == nil {
+		t2s.proxyAddrs.hosts = make(map[string]*proxyAddr)
+	}
+	if interval == 0 {
+		t2s.proxyAddrs.hosts = nil
+	}
+}
+
+// dialProxy connects to proxy through the relay dialer, by its cached
+// address if it is given by hostname.
+func (t2s *Tun2Socks) dialProxy(proxy *ProxyServer) (*gosocks.SocksConn, error) {
+	return t2s.relayDial(t2s.resolvedProxy(proxy))
+}
+
+// resolvedProxy returns a copy of proxy addressed by the cached address of
+// its host, resolving it if not cached yet, or proxy itself if it is given
+// by IP or Unix socket path, the cache is disabled or the host fails to
+// resolve.
+func (t2s *Tun2Socks) resolvedProxy(proxy *ProxyServer) *ProxyServer {
+	// a socket path would split into host "unix" and the path
+	if strings.HasPrefix(proxy.IpAddress, gosocks.UnixAddrPrefix) {
+		return proxy
+	}
+	host, port, e := net.SplitHostPort(proxy.IpAddress)
+	if e != nil || net.ParseIP(host) != nil {
+		return proxy
+	}
+	c := &t2s.proxyAddrs
+	c.mutex.Lock()
+	if c.hosts == nil {
+		c.mutex.Unlock()
+		return proxy
+	}
+	addr := c.hosts[host]
+	c.mutex.Unlock()
+
+	if addr == nil {
+		ip, e := t2s.lookupProxy(host)
+		if e != nil {
+			log.Printf("fail to resolve proxy %s: %s", host, e)
+			return proxy
+		}
+		addr = &proxyAddr{ip: ip, resolved: time.Now()}
+		c.mutex.Lock()
+		if c.hosts != nil {
+			c.hosts[host] = addr
+		}
+		c.mutex.Unlock()
+	}
+	resolved := *proxy
+	resolved.IpAddress = net.JoinHostPort(addr.ip.String(), port)
+	return &resolved
+}
+
+// resolveProxies caches the addresses of the configured proxy servers given
+// by hostname, so the first flows don't wait for them.
+func (t2s *Tun2Socks) resolveProxies() {
+	t2s.proxyLock.RLock()
+	proxies := make([]*ProxyServer, 0, len(t2s.proxyServerMap)+1)
+	if t2s.defaultProxyServer != nil {
+		proxies = append(proxies, t2s.defaultProxyServer)
+	}
+	for _, proxy := range t2s.proxyServerMap {
+		proxies = append(proxies, proxy)
+	}
+	t2s.proxyLock.RUnlock()
+	for _, proxy := range proxies {
+		t2s.resolvedProxy(proxy)
+	}
+}
+
+// lookupProxy resolves host with the system resolver, over sockets kept out
+// of the tunnel like those of relays.
+func (t2s *Tun2Socks) lookupProxy(host string) (net.IP, error) {
+	dialer := &net.Dialer{Control: t2s.socketControl}
+	resolver := &net.Resolver{PreferGo: true, Dial: dialer.DialContext}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs, e := resolver.LookupIPAddr(ctx, host)
+	if e != nil {
+		return nil, e
+	}
+	// the relays are IPv4 first
+	for _, addr := range addrs {
+		if ip4 := addr.IP.To4(); ip4 != nil {
+			return ip4, nil
+		}
+	}
+	return addrs[0].IP, nil
+}
+
+// refreshProxyAddrs resolves cached proxy hosts again once their interval
+// has passed, one refresh at a time.
+func (t2s *Tun2Socks) refreshProxyAddrs() {
+	c := &t2s.proxyAddrs
+	c.mutex.Lock()
+	var stale []string
+	for host, addr := range c.hosts {
+		if time.Since(addr.resolved) >= c.interval {
+			stale = append(stale, host)
+		}
+	}
+	c.mutex.Unlock()
+	if len(stale) == 0 || !atomic.CompareAndSwapInt32(&c.refreshing, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&c.refreshing, 0)
+		for _, host := range stale {
+			ip, e := t2s.lookupProxy(host)
+			if e != nil {
+				log.Printf("fail to resolve proxy %s again: %s", host, e)
+			}
+			c.mutex.Lock()
+			if addr := c.hosts[host]; addr != nil {
+				if e != nil {
+					// keep the last address until the next interval
+					ip = addr.ip
+				}
+				c.hosts[host] = &proxyAddr{ip: ip, resolved: time.Now()}
+			}
+			c.mutex.Unlock()
+		}
+	}()
+}
@@ -0,0 +1,94 @@
+package tun2socks
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dkwiebe/gotun2socks/internal/gosocks"
+)
+
+func TestProxyAddressCachedAcrossDials(t *testing.T) {
+	s := newStubSocks(t, echoUDP)
+	_, port, _ := net.SplitHostPort(s.addr)
+	t2s, p := NewTun2SocksWithPipe()
+	t2s.SetDefaultProxy(&ProxyServer{ProxyType: PROXY_TYPE_SOCKS, IpAddress: net.JoinHostPort("localhost", port)})
+	t2s.SetRoutingRules(RoutingRules{Rules: []RoutingRule{{Decision: ROUTE_PROXY}}})
+	t2s.SetProxyResolve(time.Hour)
+	dialed := make(chan string, 2)
+	t2s.SetRelayDialer(func(proxy *ProxyServer) (*gosocks.SocksConn, error) {
+		dialed <- proxy.IpAddress
+		return dialStub(s)
+	})
+	serve(t, t2s)
+
+	var cached *proxyAddr
+	for i := 0; i < 2; i++ {
+		p.Inject(udpIPv4(clientIP, uint16(5000+i), net.IP{192, 0, 2, 1}, 9, []byte("ping")))
+		nextUDP(t, p)
+		if addr := <-dialed; addr != s.addr {
+			t.Fatalf("dial %d: dialed %s, want %s", i, addr, s.addr)
+		}
+		t2s.proxyAddrs.mutex.Lock()
+		addr := t2s.proxyAddrs.hosts["localhost"]
+		t2s.proxyAddrs.mutex.Unlock()
+		if addr == nil || (cached != nil && addr != cached) {
+			t.Fatalf("dial %d: localhost resolved again", i)
+		}
+		cached = addr
+	}
+}
+
+func TestProxyAddressKeptOnFailedRefresh(t *testing.T) {
+	t2s := New(nil, false)
+	t2s.SetProxyResolve(time.Millisecond)
+	ip := net.IP{127, 0, 0, 1}
+	t2s.proxyAddrs.hosts["proxy.invalid"] = &proxyAddr{ip: ip, resolved: time.Now().Add(-time.Hour)}
+
+	proxy := &ProxyServer{ProxyType: PROXY_TYPE_SOCKS, IpAddress: "proxy.invalid:1080"}
+	if got := t2s.resolvedProxy(proxy).IpAddress; got != "127.0.0.1:1080" {
+		t.Fatalf("dialing %s, want the cached address", got)
+	}
+	t2s.refreshProxyAddrs()
+	waitFor(t, "refresh", func() bool {
+		t2s.proxyAddrs.mutex.Lock()
+		defer t2s.proxyAddrs.mutex.Unlock()
+		return time.Since(t2s.proxyAddrs.hosts["proxy.invalid"].resolved) < time.Minute
+	})
+	if got := t2s.resolvedProxy(proxy).IpAddress; got != "127.0.0.1:1080" {
+		t.Fatalf("dialing %s after a failed lookup, want the last address", got)
+	}
+
+	t2s.SetProxyResolve(0)
+	if got := t2s.resolvedProxy(proxy); got != proxy {
+		t.Fatalf("dialing %s with the cache off, want the hostname", got.IpAddress)
+	}
+}
+
+func TestUnixSocketProxyNotResolved(t *testing.T) {
+	s := newUnixStubSocks(t, echoUDP)
+	t2s, p := NewTun2SocksWithPipe()
+	proxy := &ProxyServer{ProxyType: PROXY_TYPE_SOCKS, IpAddress: s.addr}
+	t2s.SetDefaultProxy(proxy)
+	t2s.SetRoutingRules(RoutingRules{Rules: []RoutingRule{{Decision: ROUTE_PROXY}}})
+	t2s.SetProxyResolve(time.Hour)
+	logged := captureLog(t)
+	serve(t, t2s)
+
+	if got := t2s.resolvedProxy(proxy); got != proxy {
+		t.Fatalf("dialing %s, want the socket path as given", got.IpAddress)
+	}
+	p.Inject(udpIPv4(clientIP, 5000, net.IP{192, 0, 2, 1}, 9, []byte("ping")))
+	if _, udp := nextUDP(t, p); string(udp.Payload) != "ping" {
+		t.Fatalf("echoed %q", udp.Payload)
+	}
+	if strings.Contains(logged.String(), "fail to resolve proxy") {
+		t.Fatal("socket path looked up as a hostname")
+	}
+	t2s.proxyAddrs.mutex.Lock()
+	defer t2s.proxyAddrs.mutex.Unlock()
+	if len(t2s.proxyAddrs.hosts) != 0 {
+		t.Fatalf("cached %v for a socket path", t2s.proxyAddrs.hosts)
+	}
+}
@@ -0,0 +1,170 @@
+package tun2socks
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// reverseEntry is a name an address was resolved from.
+type reverseEntry struct {
+	name string
+	exp  time.Time
+}
+
+// SetReverseDNS answers PTR queries for the addresses of cached answers with
+// the names they were resolved from, so apps looking up the peers of their
+// connections get the names they dialed. PTR queries for other addresses go
+// upstream as before. It applies to answers cached from then on.
+func (t2s *Tun2Socks) SetReverseDNS(enabled bool) {
+	if t2s.cache == nil {
+		return
+	}
+	t2s.cache.mutex.Lock()
+	defer t2s.cache.mutex.Unlock()
+	t2s.cache.answerPTR = enabled
+	t2s.cache.trackReverse()
+}
+
+// SetSocksRemoteDNS has the destinations of UDP flows relayed through a
+// SOCKS proxy addressed by the name they were resolved from, as cached,
+// rather than by IP, so that the proxy resolves them itself, e.g. for
+// geo-routing. Destinations not resolved through the cache, and DNS flows,
+// are still addressed by IP, as are those several live names resolve to,
+// e.g. CDN addresses shared by sites, which the proxy could resolve
+// elsewhere. It needs the DNS cache and applies to answers cached from then
+// on.
+func (t2s *Tun2Socks) SetSocksRemoteDNS(enabled bool) {
+	if t2s.cache == nil {
+		return
+	}
+	t2s.cache.mutex.Lock()
+	defer t2s.cache.mutex.Unlock()
+	t2s.cache.hostNames = enabled
+	t2s.cache.trackReverse()
+}
+
+// trackReverse sets up the reverse mapping if a mode needs it, or drops it.
+// c.mutex must be held.
+func (c *dnsCache) trackReverse() {
+	if !c.answerPTR && !c.hostNames {
+		c.reverse = nil
+	} else if c.reverse == nil {
+		c.reverse = make(map[string][]*reverseEntry)
+	}
+}
+
+// hostName returns the name ip was resolved from, without the trailing dot,
+// if SOCKS relays are sent names and it is the only live name ip is mapped
+// to, or "" otherwise.
+func (c *dnsCache) hostName(ip net.IP) string {
+	arpa, e := dns.ReverseAddr(ip.String())
+	if e != nil {
+		return ""
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.hostNames {
+		return ""
+	}
+	entries := c.liveReverse(strings.ToLower(arpa))
+	if len(entries) != 1 {
+		return ""
+	}
+	return strings.TrimSuffix(entries[0].name, ".")
+}
+
+// mapReverse maps the addresses resp resolved to back to its question name
+// until exp, alongside the other names they were resolved from. A later
+// answer for the same name and address extends the mapping. c.mutex must be
+// held.
+func (c *dnsCache) mapReverse(resp *dns.Msg, exp time.Time) {
+	answer, ok := parseDNSAnswer(resp)
+	if !ok {
+		return
+	}
+	for _, ip := range answer.IPs {
+		arpa, e := dns.ReverseAddr(ip.String())
+		if e != nil {
+			continue
+		}
+		arpa = strings.ToLower(arpa)
+		c.pruneReverse(arpa, func(entry *reverseEntry) bool {
+			return strings.EqualFold(entry.name, answer.Name)
+		})
+		c.reverse[arpa] = append(c.reverse[arpa], &reverseEntry{name: answer.Name, exp: exp})
+	}
+}
+
+// liveReverse returns the unexpired names arpa is mapped to, dropping the
+// expired ones. c.mutex must be held.
+func (c *dnsCache) liveReverse(arpa string) []*reverseEntry {
+	now := time.Now()
+	c.pruneReverse(arpa, func(entry *reverseEntry) bool {
+		return now.After(entry.exp)
+	})
+	return c.reverse[arpa]
+}
+
+// pruneReverse drops the names arpa is mapped to that drop reports, and arpa
+// itself once none is left. c.mutex must be held.
+func (c *dnsCache) pruneReverse(arpa string, drop func(*reverseEntry) bool) {
+	entries := c.reverse[arpa]
+	kept := entries[:0]
+	for _, entry := range entries {
+		if !drop(entry) {
+			kept = append(kept, entry)
+		}
+	}
+	if len(kept) == 0 {
+		delete(c.reverse, arpa)
+		return
+	}
+	for i := len(kept); i < len(entries); i++ {
+		entries[i] = nil
+	}
+	c.reverse[arpa] = kept
+}
+
+// queryReverse answers a PTR query from the reverse mapping, with every name
+// the address is mapped to, or returns nil if it isn't mapped. c.mutex must
+// be held.
+func (c *dnsCache) queryReverse(request *dns.Msg) *dns.Msg {
+	q := request.Question[0]
+	if !c.answerPTR || q.Qtype != dns.TypePTR || q.Qclass != dns.ClassINET {
+		return nil
+	}
+	entries := c.liveReverse(strings.ToLower(q.Name))
+	if len(entries) == 0 {
+		return nil
+	}
+
+	msg := new(dns.Msg)
+	msg.SetReply(request)
+	msg.RecursionAvailable = true
+	for _, entry := range entries {
+		msg.Answer = append(msg.Answer, &dns.PTR{
+			Hdr: dns.RR_Header{
+				Name:   q.Name,
+				Rrtype: dns.TypePTR,
+				Class:  dns.ClassINET,
+				Ttl:    uint32(time.Until(entry.exp) / time.Second),
+			},
+			Ptr: entry.name,
+		})
+	}
+	return msg
+}
+
+// expireReverse forgets the addresses of answers that have expired, which
+// PTR queries and hostName would otherwise only drop as they come across
+// them.
+func (c *dnsCache) expireReverse() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for arpa := range c.reverse {
+		c.liveReverse(arpa)
+	}
+}
@@ -0,0 +1,146 @@
+package tun2socks
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dkwiebe/gotun2socks/internal/gosocks"
+	"github.com/dkwiebe/gotun2socks/internal/tun"
+	"github.com/miekg/dns"
+)
+
+// lookupPTR has the app on p look the name of arpa up and returns the name
+// answered, and whether the query went upstream through s.
+func lookupPTR(tb testing.TB, s *stubSocks, p *tun.MemoryTun, id uint16, arpa string) (string, bool) {
+	tb.Helper()
+	p.Inject(udpIPv4(clientIP, 4001, resolverIP, 53, packQuery(tb, id, arpa, dns.TypePTR)))
+	_, udp := nextUDP(tb, p)
+	msg := unpackDNS(tb, udp)
+	if msg.Id != id || len(msg.Answer) != 1 {
+		tb.Fatalf("PTR answer %v", msg)
+	}
+	upstream := false
+	select {
+	case <-s.requests:
+		upstream = true
+	default:
+	}
+	return msg.Answer[0].(*dns.PTR).Ptr, upstream
+}
+
+func TestReverseDNSFromResolvedNames(t *testing.T) {
+	s := newStubSocks(t, stubResolver(func(req *dns.Msg) *dns.Msg {
+		if req.Question[0].Qtype != dns.TypePTR {
+			return answerA(req)
+		}
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		resp.Answer = []dns.RR{&dns.PTR{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 300},
+			Ptr: "upstream.example.",
+		}}
+		return resp
+	}))
+	t2s, p := NewTun2SocksWithPipe()
+	s.route(t2s)
+	t2s.SetReverseDNS(true)
+	serve(t, t2s)
+
+	// 192.0.2.1 isn't mapped until resolved
+	const arpa = "1.2.0.192.in-addr.arpa."
+	if name, upstream := lookupPTR(t, s, p, 1, arpa); !upstream || name != "upstream.example." {
+		t.Fatalf("unmapped address answered %s, upstream %v", name, upstream)
+	}
+	if _, upstream := resolve(t, s, p, 2, "www.example."); !upstream {
+		t.Fatal("name answered before it was resolved")
+	}
+	if name, upstream := lookupPTR(t, s, p, 3, arpa); upstream || name != "www.example." {
+		t.Fatalf("resolved address answered %s, upstream %v", name, upstream)
+	}
+}
+
+func TestReverseDNSExpires(t *testing.T) {
+	t2s := New(nil, true)
+	t2s.SetReverseDNS(true)
+	t2s.SetDNSTTLOverrides([]DNSTTLOverride{{Suffix: "short.example", TTL: 50 * time.Millisecond}})
+	t2s.cache.store(packReply(t, packQuery(t, 1, "short.example.", dns.TypeA), 300, "192.0.2.1"))
+	t2s.cache.store(packReply(t, packQuery(t, 2, "long.example.", dns.TypeA), 300, "192.0.2.2"))
+	if n := len(t2s.cache.reverse); n != 2 {
+		t.Fatalf("%d addresses mapped, want 2", n)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	t2s.cache.expireReverse()
+	if _, ok := t2s.cache.reverse["1.2.0.192.in-addr.arpa."]; ok || len(t2s.cache.reverse) != 1 {
+		t.Fatalf("mapping left %v, want only the unexpired address", t2s.cache.reverse)
+	}
+}
+
+func TestSocksRemoteDNSSendsDomain(t *testing.T) {
+	resolver := stubResolver(func(req *dns.Msg) *dns.Msg {
+		ip := "192.0.2.1"
+		if req.Question[0].Name != "www.example." {
+			// names sharing an address, as sites behind a CDN
+			ip = "192.0.2.2"
+		}
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		resp.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.ParseIP(ip).To4(),
+		}}
+		return resp
+	})
+	s := newStubSocks(t, func(req *gosocks.UDPRequest) []byte {
+		if req.DstPort == 53 {
+			return resolver(req)
+		}
+		return req.Data
+	})
+	t2s, p := NewTun2SocksWithPipe()
+	s.route(t2s)
+	t2s.SetSocksRemoteDNS(true)
+	t2s.SetReverseDNS(true)
+	serve(t, t2s)
+
+	// relays the datagram to dst and returns how the relay header addressed it
+	relayed := func(sport uint16, dst net.IP) *gosocks.UDPRequest {
+		t.Helper()
+		p.Inject(udpIPv4(clientIP, sport, dst, 9, []byte("ping")))
+		if _, udp := nextUDP(t, p); string(udp.Payload) != "ping" {
+			t.Fatalf("echoed %q", udp.Payload)
+		}
+		select {
+		case req := <-s.requests:
+			return req
+		case <-time.After(5 * time.Second):
+			t.Fatal("not relayed")
+		}
+		return nil
+	}
+
+	resolve(t, s, p, 1, "www.example.")
+	if req := relayed(5000, net.IP{192, 0, 2, 1}); req.HostType != gosocks.SocksDomainHost || req.DstHost != "www.example" {
+		t.Fatalf("relayed to type %d host %s, want the domain www.example", req.HostType, req.DstHost)
+	}
+
+	// an address two live names resolve to is ambiguous
+	resolve(t, s, p, 2, "a.example.")
+	resolve(t, s, p, 3, "b.example.")
+	if req := relayed(5001, net.IP{192, 0, 2, 2}); req.HostType != gosocks.SocksIPv4Host || req.DstHost != "192.0.2.2" {
+		t.Fatalf("relayed to type %d host %s, want the address", req.HostType, req.DstHost)
+	}
+	t2s.cache.mutex.Lock()
+	ptr := t2s.cache.queryReverse(new(dns.Msg).SetQuestion("2.2.0.192.in-addr.arpa.", dns.TypePTR))
+	t2s.cache.mutex.Unlock()
+	if ptr == nil || len(ptr.Answer) != 2 {
+		t.Fatalf("PTR answer %v, want both names", ptr)
+	}
+
+	// until one of them is flushed
+	t2s.FlushDNSName("b.example")
+	if name := t2s.cache.hostName(net.IP{192, 0, 2, 2}); name != "a.example" {
+		t.Fatalf("name %q left, want a.example", name)
+	}
+}
@@ -0,0 +1,102 @@
+package tun2socks
+
+import (
+	"bytes"
+	"log"
+	"sync/atomic"
+
+	"github.com/dkwiebe/gotun2socks/internal/packet"
+)
+
+const (
+	QUIC_PORT = 443
+
+	// longest QUIC connection ID (RFC 9000)
+	quicMaxCIDLen = 20
+	// connection IDs remembered per flow
+	quicMaxCIDs = 8
+)
+
+// SetQUICAware makes UDP flows to port 443 keep their relay association when
+// a QUIC client migrates to another source port: a datagram from a new port
+// addressing a connection ID the server handed out on an existing flow
+// continues that flow. Clients may switch connection IDs as they migrate, in
+// which case a new flow is made as without the option.
+func (t2s *Tun2Socks) SetQUICAware(enabled bool) {
+	t2s.udpConnTrackLock.Lock()
+	defer t2s.udpConnTrackLock.Unlock()
+	t2s.quicAware = enabled
+	if enabled && t2s.quicConns == nil {
+		t2s.quicConns = make(map[string]*udpConnTrack)
+	}
+}
+
+// learnQUIC remembers the connection ID the server of ut picks for itself in
+// a long header response, which the client addresses it by from then on.
+func (t2s *Tun2Socks) learnQUIC(ut *udpConnTrack, data []byte) {
+	if ut.remotePort != QUIC_PORT || len(data) < 7 || data[0]&0x80 == 0 {
+		return
+	}
+	// long header: flags, version, DCID length and DCID, SCID length and
+	// SCID
+	dcidL := int(data[5])
+	if dcidL > quicMaxCIDLen || len(data) < 7+dcidL {
+		return
+	}
+	scidL := int(data[6+dcidL])
+	if scidL == 0 || scidL > quicMaxCIDLen || len(data) < 7+dcidL+scidL {
+		return
+	}
+	cid := string(data[7+dcidL : 7+dcidL+scidL])
+
+	t2s.udpConnTrackLock.Lock()
+	defer t2s.udpConnTrackLock.Unlock()
+	if !t2s.quicAware || t2s.quicConns[cid] == ut || len(ut.quicCIDs) >= quicMaxCIDs {
+		return
+	}
+	t2s.quicConns[cid] = ut
+	ut.quicCIDs = append(ut.quicCIDs, cid)
+}
+
+// migratedQUICTrack returns the flow a QUIC short header datagram from a new
+// source port continues, re-keyed to connID, or nil if it starts a new flow.
+func (t2s *Tun2Socks) migratedQUICTrack(connID string, ip *packet.IPv4, udp *packet.UDP) *udpConnTrack {
+	data := udp.Payload
+	if udp.DstPort != QUIC_PORT || len(data) < 2 || data[0]&0xc0 != 0x40 {
+		return nil
+	}
+
+	t2s.udpConnTrackLock.Lock()
+	defer t2s.udpConnTrackLock.Unlock()
+	if !t2s.quicAware || t2s.udpConnTrackMap[connID] != nil {
+		return nil
+	}
+	for cid, ut := range t2s.quicConns {
+		if !bytes.HasPrefix(data[1:], []byte(cid)) || ut.remotePort != udp.DstPort ||
+			!ut.remoteIP.Equal(ip.DstIP) || !ut.localIP.Equal(ip.SrcIP) {
+			continue
+		}
+		if t2s.udpConnTrackMap[ut.key] != ut {
+			// closing
+			return nil
+		}
+		log.Printf("QUIC flow %s migrated to port %d", ut.id, udp.SrcPort)
+		delete(t2s.udpConnTrackMap, ut.key)
+		ut.key = connID
+		t2s.udpConnTrackMap[connID] = ut
+		atomic.StoreUint32(&ut.replyPort, uint32(udp.SrcPort))
+		return ut
+	}
+	return nil
+}
+
+// forgetQUIC drops the connection IDs learned on ut. udpConnTrackLock must be
+// held.
+func (t2s *Tun2Socks) forgetQUIC(ut *udpConnTrack) {
+	for _, cid := range ut.quicCIDs {
+		if t2s.quicConns[cid] == ut {
+			delete(t2s.quicConns, cid)
+		}
+	}
+	ut.quicCIDs = nil
+}
@@ -0,0 +1,50 @@
+package tun2socks
+
+import (
+	"net"
+	"testing"
+
+	"github.com/dkwiebe/gotun2socks/internal/gosocks"
+)
+
+func TestQUICSourcePortMigration(t *testing.T) {
+	serverCID := []byte("srvcid01")
+	// the server answers a long header packet with one picking its
+	// connection ID, and echoes short header packets
+	server := func(req *gosocks.UDPRequest) []byte {
+		if req.Data[0]&0x80 == 0 {
+			return req.Data
+		}
+		resp := []byte{0xc0, 0, 0, 0, 1, 0, byte(len(serverCID))}
+		return append(resp, serverCID...)
+	}
+	initial := []byte{0xc0, 0, 0, 0, 1, 4, 'd', 'c', 'i', 'd', 0}
+	short := append(append([]byte{0x40}, serverCID...), "migrated"...)
+
+	for _, aware := range []bool{true, false} {
+		s := newStubSocks(t, server)
+		t2s, p := NewTun2SocksWithPipe()
+		s.route(t2s)
+		t2s.SetQUICAware(aware)
+		serve(t, t2s)
+
+		dst := net.IP{192, 0, 2, 1}
+		p.Inject(udpIPv4(clientIP, 5000, dst, QUIC_PORT, initial))
+		nextUDP(t, p)
+		// the client moves to another source port
+		p.Inject(udpIPv4(clientIP, 5001, dst, QUIC_PORT, short))
+		if _, udp := nextUDP(t, p); udp.DstPort != 5001 || string(udp.Payload) != string(short) {
+			t.Fatalf("aware %v: got %q to port %d, want the echo to the new port", aware, udp.Payload, udp.DstPort)
+		}
+
+		flows := 0
+		t2s.CloseFlows(func(ConnInfo) bool {
+			flows++
+			return false
+		})
+		if want := map[bool]int{true: 1, false: 2}[aware]; flows != want {
+			t.Fatalf("aware %v: %d flows tracked, want %d", aware, flows, want)
+		}
+		t2s.Stop()
+	}
+}
@@ -0,0 +1,92 @@
+package tun2socks
+
+import (
+	"net"
+)
+
+// Decision is how a flow is routed.
+type Decision int
+
+const (
+	ROUTE_DIRECT Decision = iota
+	ROUTE_PROXY
+	ROUTE_DROP
+)
+
+// proxiedTCP reports whether TCP connections to ip:port go through the proxy
+// of their app; all others are connected directly.
+func proxiedTCP(ip net.IP, port uint16) bool {
+	return !isPrivate(ip) && (port == 80 || port == 443)
+}
+
+// SocksRouter picks the SOCKS proxy, as host:port, relaying a new flow of
+// proto ("tcp" or "udp") to dst:port. An empty address connects the flow
+// directly.
+type SocksRouter func(dst net.IP, port uint16, proto string) string
+
+// SetSocksRouter sets a router picking the SOCKS proxy of every new flow,
+// e.g. for geo-routing, in place of the proxy of its app. Credentials are
+// still taken from the proxy of the app. nil restores per-app routing.
+func (t2s *Tun2Socks) SetSocksRouter(router SocksRouter) {
+	t2s.proxyLock.Lock()
+	defer t2s.proxyLock.Unlock()
+	t2s.socksRouter = router
+}
+
+// routeSocks returns the SOCKS proxy the router picks for a flow, and whether
+// a router is set at all.
+func (t2s *Tun2Socks) routeSocks(proto string, dst net.IP, port uint16) (addr string, routed bool) {
+	t2s.proxyLock.RLock()
+	router := t2s.socksRouter
+	t2s.proxyLock.RUnlock()
+	if router == nil {
+		return "", false
+	}
+	return router(dst, port, proto), true
+}
+
+// routedProxy returns the proxy of app uid turned into the SOCKS proxy at
+// addr.
+func (t2s *Tun2Socks) routedProxy(uid int, addr string) *ProxyServer {
+	proxy := ProxyServer{}
+	if p := t2s.proxyFor(uid); p != nil {
+		proxy = *p
+	}
+	proxy.ProxyType = PROXY_TYPE_SOCKS
+	proxy.IpAddress = addr
+	return &proxy
+}
+
+// RouteDecision predicts how a flow of app uid to dst:port would be routed,
+// without sending anything. proto is "tcp" or "udp", flows of other
+// protocols are dropped.
+func (t2s *Tun2Socks) RouteDecision(proto string, uid int, dst net.IP, port uint16) Decision {
+	if t2s.disabledProto(proto) {
+		return ROUTE_DROP
+	}
+	if d, ok := t2s.ruleDecision(proto, dst, port); ok && (proto == "tcp" || proto == "udp") {
+		return d
+	}
+	if addr, routed := t2s.routeSocks(proto, dst, port); routed && (proto == "tcp" || proto == "udp") {
+		if addr == "" {
+			return ROUTE_DIRECT
+		}
+		return ROUTE_PROXY
+	}
+	switch proto {
+	case "tcp":
+		if !proxiedTCP(dst, port) {
+			return ROUTE_DIRECT
+		}
+		proxy := t2s.proxyFor(uid)
+		if proxy != nil && (proxy.ProxyType == PROXY_TYPE_SOCKS || proxy.ProxyType == PROXY_TYPE_HTTP) {
+			return ROUTE_PROXY
+		}
+		return ROUTE_DIRECT
+	case "udp":
+		// UDP bypasses the proxy unless routed
+		return ROUTE_DIRECT
+	default:
+		return ROUTE_DROP
+	}
+}
@@ -0,0 +1,407 @@
+package tun2socks
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/dkwiebe/gotun2socks/internal/gosocks"
+	"github.com/dkwiebe/gotun2socks/internal/packet"
+)
+
+type fixedUid int
+
+func (u fixedUid) GetUid(string, uint16, string, uint16) int { return int(u) }
+
+// dialStub dials s without authenticating, standing in for a proxy or a
+// destination.
+func dialStub(s *stubSocks) (*gosocks.SocksConn, error) {
+	d := &gosocks.SocksDialer{Auth: &gosocks.AnonymousClientAuthenticator{}, Timeout: time.Second}
+	return d.Dial(s.addr)
+}
+
+func TestRouteFlowsDirectOrThroughProxy(t *testing.T) {
+	for _, tc := range []struct {
+		decision Decision
+		proxied  bool
+	}{
+		{ROUTE_PROXY, true},
+		{ROUTE_DIRECT, false},
+	} {
+		for _, proto := range []string{"udp", "tcp"} {
+			s := newStubSocks(t, echoUDP)
+			t2s, p := NewTun2SocksWithPipe()
+			t2s.SetUidCallback(fixedUid(1000))
+			t2s.SetDefaultProxy(&ProxyServer{ProxyType: PROXY_TYPE_SOCKS, IpAddress: "proxy.example:1080"})
+			t2s.SetRoutingRules(RoutingRules{Rules: []RoutingRule{{Decision: tc.decision}}})
+			relayed, direct := make(chan string, 1), make(chan string, 1)
+			t2s.SetRelayDialer(func(proxy *ProxyServer) (*gosocks.SocksConn, error) {
+				relayed <- proxy.IpAddress
+				return dialStub(s)
+			})
+			t2s.SetDirectDialer(func(addr string) (*gosocks.SocksConn, error) {
+				direct <- addr
+				return dialStub(s)
+			})
+			serve(t, t2s)
+
+			dst, port := net.IP{192, 0, 2, 1}, uint16(9)
+			if proto == "udp" {
+				p.Inject(udpIPv4(clientIP, 5000, dst, port, []byte("ping")))
+				nextUDP(t, p)
+			} else {
+				port = 80
+				p.Inject(tcpIPv4(clientIP, 5000, dst, port, packet.TCP{SYN: true, Seq: 100}))
+				if _, tcp := nextTCP(t, p); !tcp.SYN || !tcp.ACK || tcp.Ack != 101 {
+					t.Fatalf("%s %v: got %s, want SYN/ACK", proto, tc.decision, tcpflagsString(tcp))
+				}
+			}
+
+			select {
+			case addr := <-relayed:
+				if !tc.proxied || addr != "proxy.example:1080" {
+					t.Errorf("%s %v: relayed through %s", proto, tc.decision, addr)
+				}
+			case addr := <-direct:
+				if tc.proxied || addr != net.JoinHostPort(dst.String(), fmt.Sprint(port)) {
+					t.Errorf("%s %v: connected directly to %s", proto, tc.decision, addr)
+				}
+			default:
+				t.Errorf("%s %v: nothing dialed", proto, tc.decision)
+			}
+			t2s.Stop()
+		}
+	}
+}
+
+func TestSocketControlPerInstance(t *testing.T) {
+	s := newStubSocks(t, echoUDP)
+	proxy := &ProxyServer{ProxyType: PROXY_TYPE_SOCKS, IpAddress: s.addr}
+	controlled := make(chan string, 10)
+	rules := RoutingRules{Rules: []RoutingRule{{Decision: ROUTE_PROXY}}}
+	a, pa := NewTun2SocksWithPipe()
+	a.SetDefaultProxy(proxy)
+	a.SetRoutingRules(rules)
+	a.SetSocketControl(func(network, address string, c syscall.RawConn) error {
+		controlled <- address
+		return nil
+	})
+	b, pb := NewTun2SocksWithPipe()
+	b.SetDefaultProxy(proxy)
+	b.SetRoutingRules(rules)
+	serve(t, a)
+	serve(t, b)
+
+	dst := net.IP{192, 0, 2, 1}
+	pb.Inject(udpIPv4(clientIP, 5000, dst, 9, []byte("ping")))
+	nextUDP(t, pb)
+	select {
+	case addr := <-controlled:
+		t.Fatalf("control of one tunnel called on a socket to %s of another", addr)
+	default:
+	}
+
+	pa.Inject(udpIPv4(clientIP, 5000, dst, 9, []byte("ping")))
+	nextUDP(t, pa)
+	select {
+	case addr := <-controlled:
+		if addr != s.addr {
+			t.Errorf("control called on a socket to %s, want the proxy %s", addr, s.addr)
+		}
+	default:
+		t.Fatal("control not called on the relay socket")
+	}
+	if localSocksDialer.Control != nil || directDialer.Control != nil {
+		t.Error("default dialers modified")
+	}
+}
+
+func TestRelayBindHandlerBeforeTraffic(t *testing.T) {
+	s := newStubSocks(t, echoUDP)
+	t2s, p := NewTun2SocksWithPipe()
+	t2s.SetDefaultProxy(&ProxyServer{ProxyType: PROXY_TYPE_SOCKS, IpAddress: s.addr})
+	t2s.SetRoutingRules(RoutingRules{Rules: []RoutingRule{{Decision: ROUTE_PROXY}}})
+	type bind struct {
+		proto string
+		local net.Addr
+		// datagrams the proxy had seen by then
+		relayed int
+	}
+	binds := make(chan bind, 10)
+	t2s.SetRelayBindHandler(func(proto string, local net.Addr) {
+		binds <- bind{proto, local, len(s.requests)}
+	})
+	serve(t, t2s)
+
+	dst := net.IP{192, 0, 2, 1}
+	p.Inject(udpIPv4(clientIP, 5000, dst, 9, []byte("ping")))
+	nextUDP(t, p)
+	b := <-binds
+	if a, ok := b.local.(*net.UDPAddr); b.proto != "udp" || !ok || a.Port == 0 {
+		t.Fatalf("bound %s %v, want the UDP relay socket", b.proto, b.local)
+	}
+	if b.relayed != 0 {
+		t.Fatal("UDP relay socket reported after traffic flowed")
+	}
+
+	p.Inject(tcpIPv4(clientIP, 5001, dst, 80, packet.TCP{SYN: true, Seq: 100}))
+	nextTCP(t, p)
+	b = <-binds
+	if a, ok := b.local.(*net.TCPAddr); b.proto != "tcp" || !ok || a.Port == 0 {
+		t.Fatalf("bound %s %v, want the TCP relay connection", b.proto, b.local)
+	}
+}
+
+func TestDialRetryHoldsFirstPacket(t *testing.T) {
+	s := newStubSocks(t, echoUDP)
+	t2s, p := NewTun2SocksWithPipe()
+	t2s.SetDefaultProxy(&ProxyServer{ProxyType: PROXY_TYPE_SOCKS, IpAddress: s.addr})
+	t2s.SetRoutingRules(RoutingRules{Rules: []RoutingRule{{Decision: ROUTE_PROXY}}})
+	t2s.SetDialRetry(3, 20*time.Millisecond)
+	var dials []time.Time
+	t2s.SetRelayDialer(func(proxy *ProxyServer) (*gosocks.SocksConn, error) {
+		dials = append(dials, time.Now())
+		if len(dials) < 3 {
+			return nil, fmt.Errorf("network unreachable")
+		}
+		return dialStub(s)
+	})
+	serve(t, t2s)
+
+	p.Inject(udpIPv4(clientIP, 5000, net.IP{192, 0, 2, 1}, 9, []byte("first")))
+	if _, udp := nextUDP(t, p); string(udp.Payload) != "first" {
+		t.Fatalf("echoed %q, want the packet held during retries", udp.Payload)
+	}
+	if len(dials) != 3 {
+		t.Fatalf("dialed %d times, want 3", len(dials))
+	}
+	// backoff doubles between attempts
+	if d := dials[1].Sub(dials[0]); d < 20*time.Millisecond {
+		t.Errorf("first retry after %s, want 20ms", d)
+	}
+	if d := dials[2].Sub(dials[1]); d < 40*time.Millisecond {
+		t.Errorf("second retry after %s, want 40ms", d)
+	}
+}
+
+func TestRouteDecision(t *testing.T) {
+	public, private := net.IPv4(93, 184, 216, 34), net.IPv4(10, 0, 0, 1)
+	socks := &ProxyServer{ProxyType: PROXY_TYPE_SOCKS, IpAddress: "proxy.example:1080"}
+	for _, tc := range []struct {
+		name   string
+		setup  func(t2s *Tun2Socks)
+		proto  string
+		uid    int
+		dst    net.IP
+		port   uint16
+		expect Decision
+	}{
+		{"tcp without proxy", nil, "tcp", 1000, public, 443, ROUTE_DIRECT},
+		{"tcp through default proxy", func(t2s *Tun2Socks) {
+			t2s.SetDefaultProxy(socks)
+		}, "tcp", 1000, public, 443, ROUTE_PROXY},
+		{"tcp to private address", func(t2s *Tun2Socks) {
+			t2s.SetDefaultProxy(socks)
+		}, "tcp", 1000, private, 443, ROUTE_DIRECT},
+		{"tcp to unproxied port", func(t2s *Tun2Socks) {
+			t2s.SetDefaultProxy(socks)
+		}, "tcp", 1000, public, 22, ROUTE_DIRECT},
+		{"tcp through app proxy", func(t2s *Tun2Socks) {
+			t2s.SetProxyServers(map[int]*ProxyServer{1000: socks})
+		}, "tcp", 1000, public, 80, ROUTE_PROXY},
+		{"tcp of app without proxy", func(t2s *Tun2Socks) {
+			t2s.SetProxyServers(map[int]*ProxyServer{1000: socks})
+		}, "tcp", 1001, public, 80, ROUTE_DIRECT},
+		{"udp by default", func(t2s *Tun2Socks) {
+			t2s.SetDefaultProxy(socks)
+		}, "udp", 1000, public, 53, ROUTE_DIRECT},
+		{"other protocol", nil, "icmp", 1000, public, 0, ROUTE_DROP},
+		{"udp disabled", func(t2s *Tun2Socks) {
+			t2s.SetProtocolMode(PROTOCOL_TCP_ONLY, false)
+			t2s.SetRoutingRules(RoutingRules{Rules: []RoutingRule{{Decision: ROUTE_PROXY}}})
+		}, "udp", 1000, public, 53, ROUTE_DROP},
+		{"tcp disabled", func(t2s *Tun2Socks) {
+			t2s.SetProtocolMode(PROTOCOL_UDP_ONLY, false)
+			t2s.SetDefaultProxy(socks)
+		}, "tcp", 1000, public, 443, ROUTE_DROP},
+		{"rule proxies udp", func(t2s *Tun2Socks) {
+			t2s.SetRoutingRules(RoutingRules{Rules: []RoutingRule{{Proto: "udp", Decision: ROUTE_PROXY}}})
+		}, "udp", 1000, public, 53, ROUTE_PROXY},
+		{"rule of other proto", func(t2s *Tun2Socks) {
+			t2s.SetRoutingRules(RoutingRules{Rules: []RoutingRule{{Proto: "tcp", Decision: ROUTE_PROXY}}})
+		}, "udp", 1000, public, 53, ROUTE_DIRECT},
+		{"rule drops port", func(t2s *Tun2Socks) {
+			t2s.SetDefaultProxy(socks)
+			t2s.SetRoutingRules(RoutingRules{Rules: []RoutingRule{{Port: 443, Decision: ROUTE_DROP}}})
+		}, "tcp", 1000, public, 443, ROUTE_DROP},
+		{"rule directs net", func(t2s *Tun2Socks) {
+			t2s.SetDefaultProxy(socks)
+			t2s.SetRoutingRules(RoutingRules{Rules: []RoutingRule{
+				{Net: &net.IPNet{IP: public.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}, Decision: ROUTE_DIRECT},
+			}})
+		}, "tcp", 1000, public, 443, ROUTE_DIRECT},
+		{"first rule wins", func(t2s *Tun2Socks) {
+			t2s.SetRoutingRules(RoutingRules{Rules: []RoutingRule{
+				{Port: 53, Decision: ROUTE_DROP},
+				{Decision: ROUTE_PROXY},
+			}})
+		}, "udp", 1000, public, 53, ROUTE_DROP},
+		{"rule does not route other protocols", func(t2s *Tun2Socks) {
+			t2s.SetRoutingRules(RoutingRules{Rules: []RoutingRule{{Decision: ROUTE_PROXY}}})
+		}, "icmp", 1000, public, 0, ROUTE_DROP},
+		{"router picks proxy", func(t2s *Tun2Socks) {
+			t2s.SetSocksRouter(func(net.IP, uint16, string) string { return "proxy.example:1080" })
+		}, "udp", 1000, public, 53, ROUTE_PROXY},
+		{"router connects directly", func(t2s *Tun2Socks) {
+			t2s.SetDefaultProxy(socks)
+			t2s.SetSocksRouter(func(net.IP, uint16, string) string { return "" })
+		}, "tcp", 1000, public, 443, ROUTE_DIRECT},
+		{"rule before router", func(t2s *Tun2Socks) {
+			t2s.SetSocksRouter(func(net.IP, uint16, string) string { return "proxy.example:1080" })
+			t2s.SetRoutingRules(RoutingRules{Rules: []RoutingRule{{Proto: "tcp", Decision: ROUTE_DROP}}})
+		}, "tcp", 1000, public, 443, ROUTE_DROP},
+		{"router after unmatched rule", func(t2s *Tun2Socks) {
+			t2s.SetSocksRouter(func(net.IP, uint16, string) string { return "proxy.example:1080" })
+			t2s.SetRoutingRules(RoutingRules{Rules: []RoutingRule{{Proto: "tcp", Decision: ROUTE_DROP}}})
+		}, "udp", 1000, public, 53, ROUTE_PROXY},
+	} {
+		t2s := New(nil, false)
+		if tc.setup != nil {
+			tc.setup(t2s)
+		}
+		if d := t2s.RouteDecision(tc.proto, tc.uid, tc.dst, tc.port); d != tc.expect {
+			t.Errorf("%s: decision %d, want %d", tc.name, d, tc.expect)
+		}
+	}
+}
+
+func TestMaxConcurrentDials(t *testing.T) {
+	s := newStubSocks(t, echoUDP)
+	t2s, p := NewTun2SocksWithPipe()
+	t2s.SetDefaultProxy(&ProxyServer{ProxyType: PROXY_TYPE_SOCKS, IpAddress: s.addr})
+	t2s.SetRoutingRules(RoutingRules{Rules: []RoutingRule{{Decision: ROUTE_PROXY}}})
+	t2s.SetMaxConcurrentDials(2, 5*time.Second)
+	release := make(chan struct{})
+	var inflight, most, dials int32
+	t2s.SetRelayDialer(func(proxy *ProxyServer) (*gosocks.SocksConn, error) {
+		atomic.AddInt32(&dials, 1)
+		n := atomic.AddInt32(&inflight, 1)
+		for {
+			m := atomic.LoadInt32(&most)
+			if n <= m || atomic.CompareAndSwapInt32(&most, m, n) {
+				break
+			}
+		}
+		<-release
+		atomic.AddInt32(&inflight, -1)
+		return dialStub(s)
+	})
+	serve(t, t2s)
+
+	const flows = 5
+	for i := 0; i < flows; i++ {
+		p.Inject(udpIPv4(clientIP, uint16(5000+i), net.IP{192, 0, 2, 1}, 9, []byte("ping")))
+	}
+	waitFor(t, "dials under way", func() bool { return atomic.LoadInt32(&inflight) == 2 })
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&dials); n != 2 {
+		t.Fatalf("%d dials started, want 2 queued behind the limit", n)
+	}
+
+	// the queued dials go ahead as the first ones finish
+	close(release)
+	for i := 0; i < flows; i++ {
+		nextUDP(t, p)
+	}
+	if n := atomic.LoadInt32(&most); n != 2 {
+		t.Fatalf("%d dials at once, want 2", n)
+	}
+	if n := atomic.LoadInt32(&dials); n != flows {
+		t.Fatalf("%d dials, want %d", n, flows)
+	}
+}
+
+func TestSocksRouterPicksProxyPerFlow(t *testing.T) {
+	s1 := newStubSocks(t, echoUDP)
+	s2 := newStubSocks(t, echoUDP)
+	t2s, p := NewTun2SocksWithPipe()
+	protos := make(chan string, 10)
+	t2s.SetSocksRouter(func(dst net.IP, port uint16, proto string) string {
+		protos <- proto
+		if dst.Equal(net.IP{192, 0, 2, 2}) {
+			return s2.addr
+		}
+		return s1.addr
+	})
+	serve(t, t2s)
+
+	for _, c := range []struct {
+		dst        net.IP
+		via, other *stubSocks
+	}{
+		{net.IP{192, 0, 2, 1}, s1, s2},
+		{net.IP{192, 0, 2, 2}, s2, s1},
+	} {
+		p.Inject(udpIPv4(clientIP, 5000, c.dst, 9, []byte("ping")))
+		if ip, udp := nextUDP(t, p); !ip.SrcIP.Equal(c.dst) || string(udp.Payload) != "ping" {
+			t.Fatalf("got %q from %s", udp.Payload, ip.SrcIP)
+		}
+		if req := <-c.via.requests; req.DstHost != c.dst.String() {
+			t.Fatalf("relayed to %s, want %s", req.DstHost, c.dst)
+		}
+		select {
+		case req := <-c.other.requests:
+			t.Fatalf("flow to %s also relayed through the other proxy, to %s", c.dst, req.DstHost)
+		default:
+		}
+		if proto := <-protos; proto != "udp" {
+			t.Fatalf("router asked for %s, want udp", proto)
+		}
+	}
+}
+
+func TestSocksCredentialsRotation(t *testing.T) {
+	s := newStubSocks(t, echoUDP)
+	t2s, p := NewTun2SocksWithPipe()
+	t2s.SetDefaultProxy(&ProxyServer{ProxyType: PROXY_TYPE_SOCKS, IpAddress: s.addr, Login: "old", Password: "secret"})
+	t2s.SetRoutingRules(RoutingRules{Rules: []RoutingRule{{Decision: ROUTE_PROXY}}})
+	serve(t, t2s)
+	user := func() string {
+		t.Helper()
+		select {
+		case u := <-s.users:
+			return u
+		case <-time.After(5 * time.Second):
+			t.Fatal("no authentication")
+		}
+		return ""
+	}
+
+	dst := net.IP{192, 0, 2, 1}
+	p.Inject(udpIPv4(clientIP, 5000, dst, 9, []byte("one")))
+	nextUDP(t, p)
+	if u := user(); u != "old" {
+		t.Fatalf("authenticated as %q, want old", u)
+	}
+
+	t2s.SetSocksCredentials("new", "rotated")
+	// the established flow keeps its association
+	p.Inject(udpIPv4(clientIP, 5000, dst, 9, []byte("two")))
+	if _, udp := nextUDP(t, p); string(udp.Payload) != "two" {
+		t.Fatalf("echoed %q", udp.Payload)
+	}
+	select {
+	case u := <-s.users:
+		t.Fatalf("established flow authenticated again as %q", u)
+	default:
+	}
+	// new flows authenticate with the new credentials
+	p.Inject(udpIPv4(clientIP, 5001, dst, 9, []byte("three")))
+	nextUDP(t, p)
+	if u := user(); u != "new" {
+		t.Fatalf("authenticated as %q, want new", u)
+	}
+}
@@ -0,0 +1,63 @@
+package tun2socks
+
+import (
+	"net"
+)
+
+// RoutingRule routes new flows to matching destinations. Zero fields match
+// any flow.
+type RoutingRule struct {
+	// Proto is "tcp" or "udp".
+	Proto string
+	Net   *net.IPNet
+	Port  uint16
+	// Decision is ROUTE_DIRECT, ROUTE_PROXY through the proxy of the app
+	// (the default proxy for UDP), or ROUTE_DROP.
+	Decision Decision
+	// RateLimit overrides the rate limit of matching UDP flows, in bytes
+	// per second; -1 removes it, 0 keeps SetUDPRateLimit's.
+	RateLimit int
+}
+
+// RoutingRules route each new flow by the first rule it matches. Flows
+// matching none are routed by the SOCKS router, if set, or as by default.
+type RoutingRules struct {
+	Rules []RoutingRule
+}
+
+// SetRoutingRules replaces the routing rules, e.g. on a configuration
+// reload, without a restart. Flows dispatched from then on see the new rules
+// as a whole; existing flows keep their route. The rules must not be
+// modified once set.
+func (t2s *Tun2Socks) SetRoutingRules(rules RoutingRules) {
+	t2s.routingRules.Store(&RoutingRules{
+		Rules: append([]RoutingRule(nil), rules.Rules...),
+	})
+}
+
+// matchRule returns the first routing rule matching a new flow of proto to
+// dst:port, or nil.
+func (t2s *Tun2Socks) matchRule(proto string, dst net.IP, port uint16) *RoutingRule {
+	rules, _ := t2s.routingRules.Load().(*RoutingRules)
+	if rules == nil {
+		return nil
+	}
+	for i := range rules.Rules {
+		rule := &rules.Rules[i]
+		if (rule.Proto == "" || rule.Proto == proto) &&
+			(rule.Net == nil || rule.Net.Contains(dst)) &&
+			(rule.Port == 0 || rule.Port == port) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// ruleDecision returns the decision of the routing rule matching a new flow
+// of proto to dst:port, and whether any matches.
+func (t2s *Tun2Socks) ruleDecision(proto string, dst net.IP, port uint16) (Decision, bool) {
+	if rule := t2s.matchRule(proto, dst, port); rule != nil {
+		return rule.Decision, true
+	}
+	return ROUTE_DIRECT, false
+}
@@ -0,0 +1,110 @@
+package tun2socks
+
+import (
+	"net"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRoutingRulesSwappedWhole(t *testing.T) {
+	t2s := New(nil, false)
+	// each set has its rules tagged by RateLimit and routes by its tag, so a
+	// rule of one set seen with the decision of the other is a torn read
+	sets := []RoutingRules{
+		{Rules: []RoutingRule{
+			{Proto: "tcp", Decision: ROUTE_DROP, RateLimit: 1},
+			{Port: 53, Decision: ROUTE_DROP, RateLimit: 1},
+			{Decision: ROUTE_PROXY, RateLimit: 1},
+		}},
+		{Rules: []RoutingRule{
+			{Port: 53, Decision: ROUTE_PROXY, RateLimit: 2},
+			{Decision: ROUTE_DIRECT, RateLimit: 2},
+		}},
+	}
+	want := map[int]Decision{1: ROUTE_PROXY, 2: ROUTE_DIRECT}
+	t2s.SetRoutingRules(sets[0])
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				rule := t2s.matchRule("udp", net.IP{192, 0, 2, 1}, 9)
+				if rule == nil || rule.Decision != want[rule.RateLimit] {
+					t.Errorf("matched %+v", rule)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 100000; i++ {
+		t2s.SetRoutingRules(sets[i%2])
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestRoutingRulesReloadKeepsFlows(t *testing.T) {
+	s := newStubSocks(t, echoUDP)
+	t2s, p := NewTun2SocksWithPipe()
+	t2s.SetDefaultProxy(&ProxyServer{ProxyType: PROXY_TYPE_SOCKS, IpAddress: s.addr})
+	proxyAll := RoutingRules{Rules: []RoutingRule{{Decision: ROUTE_PROXY}}}
+	dropAll := RoutingRules{Rules: []RoutingRule{{Decision: ROUTE_DROP}}}
+	t2s.SetRoutingRules(proxyAll)
+	serve(t, t2s)
+
+	dst := net.IP{192, 0, 2, 1}
+	p.Inject(udpIPv4(clientIP, 5000, dst, 9, []byte("ping")))
+	nextUDP(t, p)
+
+	// reload over and over while the flow goes on
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if i%2 == 0 {
+				t2s.SetRoutingRules(dropAll)
+			} else {
+				t2s.SetRoutingRules(proxyAll)
+			}
+			runtime.Gosched()
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		p.Inject(udpIPv4(clientIP, 5000, dst, 9, []byte("again")))
+		if _, udp := nextUDP(t, p); string(udp.Payload) != "again" {
+			t.Fatalf("echoed %q", udp.Payload)
+		}
+	}
+	close(stop)
+	<-done
+
+	// new flows follow the rules last set
+	t2s.SetRoutingRules(dropAll)
+	p.Inject(udpIPv4(clientIP, 5001, dst, 9, []byte("dropped")))
+	noPacket(t, p, 50*time.Millisecond)
+	p.Inject(udpIPv4(clientIP, 5000, dst, 9, []byte("kept")))
+	if _, udp := nextUDP(t, p); string(udp.Payload) != "kept" {
+		t.Fatalf("echoed %q", udp.Payload)
+	}
+	t2s.SetRoutingRules(proxyAll)
+	p.Inject(udpIPv4(clientIP, 5001, dst, 9, []byte("relayed")))
+	if _, udp := nextUDP(t, p); string(udp.Payload) != "relayed" {
+		t.Fatalf("echoed %q", udp.Payload)
+	}
+}
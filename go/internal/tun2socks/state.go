@@ -0,0 +1,92 @@
+package tun2socks
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync/atomic"
+
+	"github.com/dkwiebe/gotun2socks/internal/packet"
+)
+
+// version of the format ExportState writes
+const STATE_VERSION = 1
+
+// State is the flow table as exported by ExportState.
+type State struct {
+	Version int            `json:"version"`
+	UDP     []UDPFlowState `json:"udp"`
+}
+
+// UDPFlowState is a UDP flow in an exported State.
+type UDPFlowState struct {
+	// Device is the index of the device the flow came in on, in the order
+	// devices were added.
+	Device     int    `json:"device"`
+	LocalIP    net.IP `json:"local_ip"`
+	LocalPort  uint16 `json:"local_port"`
+	RemoteIP   net.IP `json:"remote_ip"`
+	RemotePort uint16 `json:"remote_port"`
+}
+
+// ExportState writes the table of UDP flows as JSON, e.g. before a restart
+// for ImportState to take them up again. DNS sessions are left out as too
+// short-lived to carry over, and TCP flows as they cannot be resumed.
+func (t2s *Tun2Socks) ExportState(w io.Writer) error {
+	state := State{Version: STATE_VERSION, UDP: []UDPFlowState{}}
+
+	t2s.udpConnTrackLock.Lock()
+	for _, ut := range t2s.udpConnTrackMap {
+		if t2s.isDNS(ut.remoteIP.String(), ut.remotePort) {
+			continue
+		}
+		dev := 0
+		for i, d := range t2s.devs {
+			if d.writeCh == ut.toTunCh {
+				dev = i
+				break
+			}
+		}
+		state.UDP = append(state.UDP, UDPFlowState{
+			Device:     dev,
+			LocalIP:    ut.localIP,
+			LocalPort:  uint16(atomic.LoadUint32(&ut.replyPort)),
+			RemoteIP:   ut.remoteIP,
+			RemotePort: ut.remotePort,
+		})
+	}
+	t2s.udpConnTrackLock.Unlock()
+
+	return json.NewEncoder(w).Encode(&state)
+}
+
+// ImportState sets up the UDP flows of a State written by ExportState, with
+// their relays but no traffic yet, so the datagrams apps go on sending
+// continue them. Flows are routed, and go through the routing rules and new
+// flow handler, as if new; those on a device not attached are skipped, and
+// those already tracked left as they are.
+func (t2s *Tun2Socks) ImportState(r io.Reader) error {
+	var state State
+	if e := json.NewDecoder(r).Decode(&state); e != nil {
+		return e
+	}
+	if state.Version != STATE_VERSION {
+		return fmt.Errorf("unsupported state version %d", state.Version)
+	}
+	imported := 0
+	for _, flow := range state.UDP {
+		if flow.Device < 0 || flow.Device >= len(t2s.devs) || flow.LocalIP.To4() == nil || flow.RemoteIP.To4() == nil {
+			continue
+		}
+		dev := t2s.devs[flow.Device]
+		ip := &packet.IPv4{SrcIP: flow.LocalIP.To4(), DstIP: flow.RemoteIP.To4()}
+		udp := &packet.UDP{SrcPort: flow.LocalPort, DstPort: flow.RemotePort}
+		if t2s.getUDPConnTrack(dev, dev.flowID(udpConnID(ip, udp)), ip, udp) != nil {
+			imported++
+		}
+	}
+	log.Printf("imported %d of %d UDP flows", imported, len(state.UDP))
+	return nil
+}
@@ -0,0 +1,111 @@
+package tun2socks
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dkwiebe/gotun2socks/internal/gosocks"
+	"github.com/dkwiebe/gotun2socks/internal/tun"
+	"github.com/miekg/dns"
+)
+
+func TestExportImportStateRoundTrip(t *testing.T) {
+	resolver := stubResolver(answerA)
+	s := newStubSocks(t, func(req *gosocks.UDPRequest) []byte {
+		if req.DstPort == 53 {
+			return resolver(req)
+		}
+		return echoUDP(req)
+	})
+	a, pa := NewTun2SocksWithPipe()
+	qa := tun.NewMemoryTun()
+	a.AddDevice(qa)
+	s.route(a)
+	a.SetDNSKeepAlive(time.Minute)
+	serve(t, a)
+
+	dst := net.IP{192, 0, 2, 1}
+	want := []UDPFlowState{
+		{Device: 0, LocalIP: clientIP, LocalPort: 5000, RemoteIP: dst, RemotePort: 9},
+		{Device: 1, LocalIP: clientIP, LocalPort: 5001, RemoteIP: dst, RemotePort: 443},
+	}
+	for i, dev := range []*tun.MemoryTun{pa, qa} {
+		dev.Inject(udpIPv4(clientIP, want[i].LocalPort, dst, want[i].RemotePort, []byte("ping")))
+		nextUDP(t, dev)
+	}
+	// a DNS session, left out
+	pa.Inject(udpIPv4(clientIP, 4000, resolverIP, 53, packQuery(t, 1, "www.example.", dns.TypeA)))
+	nextUDP(t, pa)
+
+	var buf bytes.Buffer
+	if e := a.ExportState(&buf); e != nil {
+		t.Fatal(e)
+	}
+	var state State
+	if e := json.Unmarshal(buf.Bytes(), &state); e != nil {
+		t.Fatal(e)
+	}
+	sort.Slice(state.UDP, func(i, j int) bool { return state.UDP[i].LocalPort < state.UDP[j].LocalPort })
+	if state.Version != STATE_VERSION || len(state.UDP) != len(want) {
+		t.Fatalf("exported %s", buf.Bytes())
+	}
+	for i := range want {
+		got := state.UDP[i]
+		if got.Device != want[i].Device || !got.LocalIP.Equal(want[i].LocalIP) || got.LocalPort != want[i].LocalPort ||
+			!got.RemoteIP.Equal(want[i].RemoteIP) || got.RemotePort != want[i].RemotePort {
+			t.Errorf("exported %+v, want %+v", got, want[i])
+		}
+	}
+
+	// a restarted tunnel takes the flows up, and the app goes on with them
+	b, pb := NewTun2SocksWithPipe()
+	qb := tun.NewMemoryTun()
+	b.AddDevice(qb)
+	s.route(b)
+	serve(t, b)
+	if e := b.ImportState(bytes.NewReader(buf.Bytes())); e != nil {
+		t.Fatal(e)
+	}
+	b.udpConnTrackLock.Lock()
+	tracked := len(b.udpConnTrackMap)
+	b.udpConnTrackLock.Unlock()
+	if tracked != len(want) {
+		t.Fatalf("%d flows imported, want %d", tracked, len(want))
+	}
+	var again bytes.Buffer
+	if e := b.ExportState(&again); e != nil {
+		t.Fatal(e)
+	}
+	var imported State
+	if e := json.Unmarshal(again.Bytes(), &imported); e != nil {
+		t.Fatal(e)
+	}
+	sort.Slice(imported.UDP, func(i, j int) bool { return imported.UDP[i].LocalPort < imported.UDP[j].LocalPort })
+	for i, dev := range []*tun.MemoryTun{pb, qb} {
+		if imported.UDP[i].Device != want[i].Device || imported.UDP[i].LocalPort != want[i].LocalPort {
+			t.Errorf("imported %+v, want %+v", imported.UDP[i], want[i])
+		}
+		dev.Inject(udpIPv4(clientIP, want[i].LocalPort, dst, want[i].RemotePort, []byte("again")))
+		if _, udp := nextUDP(t, dev); string(udp.Payload) != "again" {
+			t.Fatalf("echoed %q", udp.Payload)
+		}
+	}
+	b.udpConnTrackLock.Lock()
+	defer b.udpConnTrackLock.Unlock()
+	if len(b.udpConnTrackMap) != len(want) {
+		t.Fatalf("%d flows after traffic, want the %d imported", len(b.udpConnTrackMap), len(want))
+	}
+}
+
+func TestImportStateVersion(t *testing.T) {
+	t2s := New(nil, false)
+	e := t2s.ImportState(strings.NewReader(`{"version": 2, "udp": []}`))
+	if e == nil {
+		t.Fatal("imported a state of an unknown version")
+	}
+}
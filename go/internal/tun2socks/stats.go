@@ -0,0 +1,83 @@
+package tun2socks
+
+import (
+	"sync/atomic"
+)
+
+// Stats holds counters of notable events. Counters are updated atomically,
+// use Tun2Socks.Stats to read them.
+type Stats struct {
+	// UDP datagrams from tun dropped for an inconsistent length field
+	UDPMalformed uint64
+	// UDP responses dropped for exceeding the maximum UDP payload
+	UDPOversized uint64
+	// packets read from tun that we had written to it ourselves
+	LoopDetected uint64
+	// UDP responses over the configured size cap, dropped or truncated
+	UDPResponseCapped uint64
+	// packets from tun dropped for a source outside the tun subnet
+	SpoofedDropped uint64
+	// relayed DNS responses dropped for an ID or question matching no query
+	DNSMismatched uint64
+	// DNS queries dropped as too many were waiting for the DoT resolver
+	DoTDropped uint64
+	// UDP tracks reaped by the watchdog for making no progress
+	StuckReaped uint64
+	// DNS responses over the answer limit, dropped or cut
+	DNSAnswersClamped uint64
+	// packets from tun dropped from full UDP flow queues
+	UDPQueueDropped uint64
+	// deepest a UDP flow queue has been
+	UDPQueueHighWater uint64
+	// packets queued in UDP flows at the time of the snapshot
+	UDPQueued uint64
+	// UDP responses over the fragment cap, dropped or truncated
+	UDPFragmentCapped uint64
+	// UDP responses from SetNoFragment destinations that would have been
+	// fragmented, dropped or truncated
+	UDPNoFragment uint64
+	// UDP datagrams from tun to multicast or broadcast destinations dropped
+	MulticastDropped uint64
+	// IPv6 packets read from tun, which aren't handled
+	IPv6Dropped uint64
+	// packets read from tun of neither IP version
+	BadIPVersion uint64
+	// TCP or UDP packets from tun dropped by the protocol mode
+	ProtocolDropped uint64
+	// UDP datagrams dropped as over the backlog of their flow's rate limit
+	UDPRateDropped uint64
+	// DNS responses left uncached as the store queue was full
+	DNSStoreDropped uint64
+	// latencies of tun writes, if SetTunLatency enabled them
+	TunWrite LatencyHistogram
+}
+
+// Stats returns a snapshot of the counters.
+func (t2s *Tun2Socks) Stats() Stats {
+	stats := Stats{
+		UDPMalformed:      atomic.LoadUint64(&t2s.stats.UDPMalformed),
+		UDPOversized:      atomic.LoadUint64(&t2s.stats.UDPOversized),
+		LoopDetected:      atomic.LoadUint64(&t2s.stats.LoopDetected),
+		UDPResponseCapped: atomic.LoadUint64(&t2s.stats.UDPResponseCapped),
+		SpoofedDropped:    atomic.LoadUint64(&t2s.stats.SpoofedDropped),
+		DNSMismatched:     atomic.LoadUint64(&t2s.stats.DNSMismatched),
+		DoTDropped:        atomic.LoadUint64(&t2s.stats.DoTDropped),
+		StuckReaped:       atomic.LoadUint64(&t2s.stats.StuckReaped),
+		DNSAnswersClamped: atomic.LoadUint64(&t2s.stats.DNSAnswersClamped),
+		UDPQueueDropped:   atomic.LoadUint64(&t2s.stats.UDPQueueDropped),
+		UDPQueueHighWater: atomic.LoadUint64(&t2s.stats.UDPQueueHighWater),
+		UDPQueued:         t2s.udpQueued(),
+		UDPFragmentCapped: atomic.LoadUint64(&t2s.stats.UDPFragmentCapped),
+		UDPNoFragment:     atomic.LoadUint64(&t2s.stats.UDPNoFragment),
+		MulticastDropped:  atomic.LoadUint64(&t2s.stats.MulticastDropped),
+		IPv6Dropped:       atomic.LoadUint64(&t2s.stats.IPv6Dropped),
+		BadIPVersion:      atomic.LoadUint64(&t2s.stats.BadIPVersion),
+		ProtocolDropped:   atomic.LoadUint64(&t2s.stats.ProtocolDropped),
+		UDPRateDropped:    atomic.LoadUint64(&t2s.stats.UDPRateDropped),
+		DNSStoreDropped:   atomic.LoadUint64(&t2s.stats.DNSStoreDropped),
+	}
+	if lat := t2s.tunLatency.Load(); lat != nil {
+		stats.TunWrite = lat.snapshot()
+	}
+	return stats
+}
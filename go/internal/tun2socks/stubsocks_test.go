@@ -0,0 +1,301 @@
+package tun2socks
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/dkwiebe/gotun2socks/internal/gosocks"
+	"github.com/miekg/dns"
+)
+
+// stubSocks is a SOCKS5 proxy for tests. Datagrams sent through its UDP
+// associations are handed to handle rather than to their destination, and
+// whatever handle returns is relayed back as if from the destination.
+// CONNECTed streams are echoed, BIND accepts a single peer on loopback.
+type stubSocks struct {
+	// address to dial, host:port or a unix: path
+	addr   string
+	handle func(*gosocks.UDPRequest) []byte
+	// set for a proxy listening on a Unix domain socket, whose relays are
+	// Unix datagram sockets in dir
+	dir string
+	seq int32
+	// set to fail every request after authentication
+	refuse bool
+	// set to listen, and relay, on the IPv6 loopback
+	ipv6 bool
+	// set to call handle on a goroutine of its own for each datagram, so a
+	// slow answer doesn't hold up the next ones
+	async bool
+
+	// datagrams relayed and user names authenticated with, as they come
+	requests chan *gosocks.UDPRequest
+	users    chan string
+}
+
+// echoUDP is a handle for stubSocks relaying each datagram back as is.
+func echoUDP(req *gosocks.UDPRequest) []byte {
+	return req.Data
+}
+
+// newStubSocks starts a stubSocks on loopback until the test ends.
+func newStubSocks(tb testing.TB, handle func(*gosocks.UDPRequest) []byte) *stubSocks {
+	tb.Helper()
+	s := &stubSocks{handle: handle}
+	s.listen(tb)
+	return s
+}
+
+// listen starts s on loopback until the test ends.
+func (s *stubSocks) listen(tb testing.TB) {
+	tb.Helper()
+	loopback := "127.0.0.1:0"
+	if s.ipv6 {
+		loopback = "[::1]:0"
+	}
+	ln, e := net.Listen("tcp", loopback)
+	if e != nil {
+		tb.Fatal(e)
+	}
+	s.addr = ln.Addr().String()
+	s.start(tb, ln)
+}
+
+// newUnixStubSocks starts a stubSocks on a Unix domain socket until the test
+// ends.
+func newUnixStubSocks(tb testing.TB, handle func(*gosocks.UDPRequest) []byte) *stubSocks {
+	tb.Helper()
+	dir := tb.TempDir()
+	path := filepath.Join(dir, "socks.sock")
+	ln, e := net.Listen("unix", path)
+	if e != nil {
+		tb.Fatal(e)
+	}
+	s := &stubSocks{addr: gosocks.UnixAddrPrefix + path, handle: handle, dir: dir}
+	s.start(tb, ln)
+	return s
+}
+
+func (s *stubSocks) start(tb testing.TB, ln net.Listener) {
+	s.requests = make(chan *gosocks.UDPRequest, 100)
+	s.users = make(chan string, 100)
+	tb.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, e := ln.Accept()
+			if e != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+}
+
+func (s *stubSocks) serve(c net.Conn) {
+	defer c.Close()
+	if !s.authenticate(c) {
+		return
+	}
+	req, e := gosocks.ReadSocksRequest(c)
+	if e != nil {
+		return
+	}
+	if s.refuse {
+		gosocks.ReplyGeneralFailure(c, req)
+		return
+	}
+	switch req.Cmd {
+	case gosocks.SocksCmdUDPAssociate:
+		s.associate(c)
+	case gosocks.SocksCmdConnect:
+		gosocks.WriteSocksReply(c, &gosocks.SocksReply{
+			Rep:      gosocks.SocksSucceeded,
+			HostType: gosocks.SocksIPv4Host,
+			BndHost:  "127.0.0.1",
+		})
+		io.Copy(c, c)
+	case gosocks.SocksCmdBind:
+		s.bind(c)
+	default:
+		gosocks.ReplyGeneralFailure(c, req)
+	}
+}
+
+// authenticate takes the client through username/password authentication
+// (RFC 1929) if it offers it, accepting any credentials, or none otherwise.
+func (s *stubSocks) authenticate(c net.Conn) bool {
+	var hdr [2]byte
+	if _, e := io.ReadFull(c, hdr[:]); e != nil || hdr[0] != gosocks.SocksVersion {
+		return false
+	}
+	methods := make([]byte, hdr[1])
+	if _, e := io.ReadFull(c, methods); e != nil {
+		return false
+	}
+	if bytes.IndexByte(methods, gosocks.SocksAuthMethodUsernamePassword) < 0 {
+		_, e := c.Write([]byte{gosocks.SocksVersion, gosocks.SocksNoAuthentication})
+		return e == nil
+	}
+	if _, e := c.Write([]byte{gosocks.SocksVersion, gosocks.SocksAuthMethodUsernamePassword}); e != nil {
+		return false
+	}
+	var l [2]byte
+	if _, e := io.ReadFull(c, l[:]); e != nil {
+		return false
+	}
+	user := make([]byte, l[1])
+	if _, e := io.ReadFull(c, user); e != nil {
+		return false
+	}
+	if _, e := io.ReadFull(c, l[:1]); e != nil {
+		return false
+	}
+	if _, e := io.ReadFull(c, make([]byte, l[0])); e != nil {
+		return false
+	}
+	select {
+	case s.users <- string(user):
+	default:
+	}
+	_, e := c.Write([]byte{1, gosocks.SocksSucceeded})
+	return e == nil
+}
+
+// bind accepts a peer on loopback and relays between it and c.
+func (s *stubSocks) bind(c net.Conn) {
+	ln, e := net.Listen("tcp4", "127.0.0.1:0")
+	if e != nil {
+		gosocks.ReplyGeneralFailure(c, &gosocks.SocksRequest{})
+		return
+	}
+	defer ln.Close()
+	reply := &gosocks.SocksReply{
+		Rep:      gosocks.SocksSucceeded,
+		HostType: gosocks.SocksIPv4Host,
+		BndHost:  "127.0.0.1",
+		BndPort:  uint16(ln.Addr().(*net.TCPAddr).Port),
+	}
+	if _, e := gosocks.WriteSocksReply(c, reply); e != nil {
+		return
+	}
+	// reads c all along to stop accepting once the client gives up
+	pr, pw := io.Pipe()
+	go func() {
+		io.Copy(pw, c)
+		ln.Close()
+		pw.Close()
+	}()
+	peer, e := ln.Accept()
+	if e != nil {
+		return
+	}
+	defer peer.Close()
+	reply.BndPort = uint16(peer.RemoteAddr().(*net.TCPAddr).Port)
+	if _, e := gosocks.WriteSocksReply(c, reply); e != nil {
+		return
+	}
+	go io.Copy(c, peer)
+	io.Copy(peer, pr)
+}
+
+// associate relays datagrams to handle until the client closes c.
+func (s *stubSocks) associate(c net.Conn) {
+	var relay net.PacketConn
+	var e error
+	reply := &gosocks.SocksReply{Rep: gosocks.SocksSucceeded}
+	if s.dir != "" {
+		path := filepath.Join(s.dir, fmt.Sprintf("relay%d.sock", atomic.AddInt32(&s.seq, 1)))
+		relay, e = net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+		reply.HostType, reply.BndHost = gosocks.SocksDomainHost, path
+	} else if s.ipv6 {
+		relay, e = net.ListenPacket("udp6", "[::1]:0")
+		if e == nil {
+			reply.HostType, reply.BndHost = gosocks.SocksIPv6Host, "::1"
+			reply.BndPort = uint16(relay.LocalAddr().(*net.UDPAddr).Port)
+		}
+	} else {
+		relay, e = net.ListenPacket("udp4", "127.0.0.1:0")
+		if e == nil {
+			reply.HostType, reply.BndHost = gosocks.SocksIPv4Host, "127.0.0.1"
+			reply.BndPort = uint16(relay.LocalAddr().(*net.UDPAddr).Port)
+		}
+	}
+	if e != nil {
+		gosocks.ReplyGeneralFailure(c, &gosocks.SocksRequest{})
+		return
+	}
+	defer relay.Close()
+	if _, e := gosocks.WriteSocksReply(c, reply); e != nil {
+		return
+	}
+	go func() {
+		io.Copy(io.Discard, c)
+		relay.Close()
+	}()
+
+	buf := make([]byte, MAX_RELAY_READ_BUF)
+	for {
+		n, from, e := relay.ReadFrom(buf)
+		if e != nil {
+			return
+		}
+		req, e := gosocks.ParseUDPRequest(append([]byte(nil), buf[:n]...))
+		if e != nil {
+			continue
+		}
+		select {
+		case s.requests <- req:
+		default:
+		}
+		if s.handle == nil {
+			continue
+		}
+		if s.async {
+			go s.reply(relay, from, req)
+		} else {
+			s.reply(relay, from, req)
+		}
+	}
+}
+
+// reply relays the answer of handle to req back to the client at from.
+func (s *stubSocks) reply(relay net.PacketConn, from net.Addr, req *gosocks.UDPRequest) {
+	if data := s.handle(req); data != nil {
+		relay.WriteTo(gosocks.PackUDPRequest(&gosocks.UDPRequest{
+			HostType: req.HostType,
+			DstHost:  req.DstHost,
+			DstPort:  req.DstPort,
+			Data:     data,
+		}), from)
+	}
+}
+
+// route has t2s relay all its UDP flows through s.
+func (s *stubSocks) route(t2s *Tun2Socks) {
+	t2s.SetSocksRouter(func(net.IP, uint16, string) string { return s.addr })
+}
+
+// stubResolver is a handle for stubSocks answering DNS queries with answer,
+// dropping them if it returns nil.
+func stubResolver(answer func(req *dns.Msg) *dns.Msg) func(*gosocks.UDPRequest) []byte {
+	return func(req *gosocks.UDPRequest) []byte {
+		query := new(dns.Msg)
+		if query.Unpack(req.Data) != nil {
+			return nil
+		}
+		resp := answer(query)
+		if resp == nil {
+			return nil
+		}
+		data, e := resp.Pack()
+		if e != nil {
+			return nil
+		}
+		return data
+	}
+}
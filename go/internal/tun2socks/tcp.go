@@ -32,6 +32,8 @@ const (
 	CLOSING     tcpState = 0x5
 	LAST_ACK    tcpState = 0x6
 	TIME_WAIT   tcpState = 0x7
+	// client-side state of a connection opened toward the app
+	SYN_SENT tcpState = 0x8
 
 	MAX_RECV_WINDOW int = 65535
 	MAX_SEND_WINDOW int = 65535
@@ -45,7 +47,12 @@ const (
 )
 
 type tcpConnTrack struct {
+	// UnixNano of lastPacketTime for other goroutines, first for 64-bit
+	// alignment
+	activity int64
+
 	t2s *Tun2Socks
+	dev *tunDevice
 	id  string
 
 	input        chan *tcpPacket
@@ -77,7 +84,7 @@ type tcpConnTrack struct {
 	sendWindow  int32
 	sendWndCond *sync.Cond
 	recvWndCond *sync.Cond
-	destroyed   bool
+	destroyed   int32
 	localIP     net.IP
 	remoteIP    net.IP
 	localPort   uint16
@@ -85,6 +92,18 @@ type tcpConnTrack struct {
 	uid         int
 
 	proxyServer *ProxyServer
+	// set if a routing rule or the SOCKS router routed the flow, viaProxy
+	// is their pick and socksAddr the SOCKS proxy the router picked
+	routed    bool
+	viaProxy  bool
+	socksAddr string
+	// set for a connection of a peer the proxy accepted with BIND, whose
+	// socksConn carries it already
+	bound bool
+
+	counters flowCounters
+	// set if DebugFlow matched the flow
+	debug bool
 }
 
 var (
@@ -142,6 +161,8 @@ func tcpstateString(state tcpState) string {
 		return "LAST_ACK"
 	case TIME_WAIT:
 		return "TIME_WAIT"
+	case SYN_SENT:
+		return "SYN_SENT"
 	}
 	return ""
 }
@@ -161,20 +182,29 @@ func releaseTCPPacket(pkt *tcpPacket) {
 	tcpPacketPool.Put(pkt)
 }
 
-func copyTCPPacket(raw []byte, ip *packet.IPv4, tcp *packet.TCP) *tcpPacket {
+// copyTCPPacket copies the packet raw, parsed into ip and tcp. readBuf, if not
+// nil, is the pooled buffer raw was read into, which the copy takes over.
+func copyTCPPacket(raw []byte, readBuf []byte, ip *packet.IPv4, tcp *packet.TCP) *tcpPacket {
 	iphdr := packet.NewIPv4()
 	tcphdr := packet.NewTCP()
 	pkt := newTCPPacket()
 
-	// make a deep copy
+	// take over the read buffer or make a deep copy
 	var buf []byte
-	if len(raw) <= MTU {
-		buf = newBuffer()
+	var n int
+	if readBuf != nil {
+		buf = readBuf
 		pkt.mtuBuf = buf
+		n = len(raw)
 	} else {
-		buf = make([]byte, len(raw))
+		if len(raw) <= MTU {
+			buf = newBuffer()
+			pkt.mtuBuf = buf
+		} else {
+			buf = make([]byte, len(raw))
+		}
+		n = copy(buf, raw)
 	}
-	n := copy(buf, raw)
 	pkt.wire = buf[:n]
 	packet.ParseIPv4(pkt.wire, iphdr)
 	packet.ParseTCP(iphdr.Payload, tcphdr)
@@ -186,12 +216,7 @@ func copyTCPPacket(raw []byte, ip *packet.IPv4, tcp *packet.TCP) *tcpPacket {
 
 func tcpConnID(ip *packet.IPv4, tcp *packet.TCP) string {
 	//	uid := FindAppUid(ip.SrcIP.String(), tcp.SrcPort, ip.DstIP.String(), tcp.DstPort)
-	return strings.Join([]string{
-		ip.SrcIP.String(),
-		fmt.Sprintf("%d", tcp.SrcPort),
-		ip.DstIP.String(),
-		fmt.Sprintf("%d", tcp.DstPort),
-	}, "|")
+	return connID(ip.SrcIP, tcp.SrcPort, ip.DstIP, tcp.DstPort)
 }
 
 func packTCP(ip *packet.IPv4, tcp *packet.TCP) *tcpPacket {
@@ -258,14 +283,18 @@ func rstByPacket(pkt *tcpPacket) *tcpPacket {
 }
 
 func (tt *tcpConnTrack) changeState(nxt tcpState) {
-	// log.Printf("### [%s -> %s]", tcpstateString(tt.state), tcpstateString(nxt))
+	if tt.debug {
+		log.Printf("### [%s][%s -> %s]", tt.id, tcpstateString(tt.state), tcpstateString(nxt))
+	}
 	tt.state = nxt
 }
 
 func (tt *tcpConnTrack) validAck(pkt *tcpPacket) bool {
 	ret := (pkt.tcp.Ack == tt.nxtSeq)
 	if !ret {
-		// log.Printf("WARNING: invalid ack: recvd: %d, expecting: %d", pkt.tcp.Ack, tt.nxtSeq)
+		if tt.debug {
+			log.Printf("[TCP][%s] invalid ack: recvd: %d, expecting: %d", tt.id, pkt.tcp.Ack, tt.nxtSeq)
+		}
 	}
 	return ret
 }
@@ -273,8 +302,9 @@ func (tt *tcpConnTrack) validAck(pkt *tcpPacket) bool {
 func (tt *tcpConnTrack) validSeq(pkt *tcpPacket) bool {
 	ret := (pkt.tcp.Seq == tt.rcvNxtSeq)
 	if !ret {
-		// log.Printf("WARNING: invalid seq: recvd: %d, expecting: %d", pkt.tcp.Seq, tt.rcvNxtSeq)
-
+		if tt.debug {
+			log.Printf("[TCP][%s] invalid seq: recvd: %d, expecting: %d", tt.id, pkt.tcp.Seq, tt.rcvNxtSeq)
+		}
 	}
 	return ret
 }
@@ -284,6 +314,7 @@ func (tt *tcpConnTrack) relayPayload(pkt *tcpPacket) bool {
 	select {
 	case tt.toSocksCh <- pkt:
 		tt.rcvNxtSeq += payloadLen
+		tt.counters.out(int(payloadLen))
 
 		// reduce window when recved
 		wnd := atomic.LoadInt32(&tt.recvWindow)
@@ -300,7 +331,9 @@ func (tt *tcpConnTrack) relayPayload(pkt *tcpPacket) bool {
 }
 
 func (tt *tcpConnTrack) send(pkt *tcpPacket) {
-	// log.Printf("<-- [TCP][%s][%s][seq:%d][ack:%d][payload:%d]", tt.id, tcpflagsString(pkt.tcp), pkt.tcp.Seq, pkt.tcp.Ack, len(pkt.tcp.Payload))
+	if tt.debug {
+		log.Printf("<-- [TCP][%s][%s][seq:%d][ack:%d][payload:%d]", tt.id, tcpflagsString(pkt.tcp), pkt.tcp.Seq, pkt.tcp.Ack, len(pkt.tcp.Payload))
+	}
 	if pkt.tcp.ACK {
 		tt.lastAck = pkt.tcp.Ack
 	}
@@ -315,6 +348,7 @@ func (tt *tcpConnTrack) synAck(syn *tcpPacket) {
 	iphdr.Id = packet.IPID()
 	iphdr.SrcIP = tt.remoteIP
 	iphdr.DstIP = tt.localIP
+	iphdr.TOS = tt.t2s.tos
 	iphdr.TTL = 64
 	iphdr.Protocol = packet.IPProtocolTCP
 
@@ -334,6 +368,34 @@ func (tt *tcpConnTrack) synAck(syn *tcpPacket) {
 	tt.nxtSeq += 1
 }
 
+// syn opens a connection toward the app.
+func (tt *tcpConnTrack) syn() {
+	iphdr := packet.NewIPv4()
+	tcphdr := packet.NewTCP()
+
+	iphdr.Version = 4
+	iphdr.Id = packet.IPID()
+	iphdr.SrcIP = tt.remoteIP
+	iphdr.DstIP = tt.localIP
+	iphdr.TOS = tt.t2s.tos
+	iphdr.TTL = 64
+	iphdr.Protocol = packet.IPProtocolTCP
+
+	tcphdr.SrcPort = tt.remotePort
+	tcphdr.DstPort = tt.localPort
+	tcphdr.Window = uint16(atomic.LoadInt32(&tt.recvWindow))
+	tcphdr.SYN = true
+	tcphdr.Seq = tt.nxtSeq
+
+	// MSS 1460
+	tcphdr.Options = []packet.TCPOption{{OptionType: 2, OptionLength: 4, OptionData: []byte{0x5, 0xb4}}}
+
+	syn := packTCP(iphdr, tcphdr)
+	tt.send(syn)
+	// SYN counts 1 seq
+	tt.nxtSeq += 1
+}
+
 func (tt *tcpConnTrack) finAck() {
 	iphdr := packet.NewIPv4()
 	tcphdr := packet.NewTCP()
@@ -342,6 +404,7 @@ func (tt *tcpConnTrack) finAck() {
 	iphdr.Id = packet.IPID()
 	iphdr.SrcIP = tt.remoteIP
 	iphdr.DstIP = tt.localIP
+	iphdr.TOS = tt.t2s.tos
 	iphdr.TTL = 64
 	iphdr.Protocol = packet.IPProtocolTCP
 
@@ -367,6 +430,7 @@ func (tt *tcpConnTrack) ack() {
 	iphdr.Id = packet.IPID()
 	iphdr.SrcIP = tt.remoteIP
 	iphdr.DstIP = tt.localIP
+	iphdr.TOS = tt.t2s.tos
 	iphdr.TTL = 64
 	iphdr.Protocol = packet.IPProtocolTCP
 
@@ -382,6 +446,7 @@ func (tt *tcpConnTrack) ack() {
 }
 
 func (tt *tcpConnTrack) payload(data []byte) {
+	tt.counters.in(len(data))
 	iphdr := packet.NewIPv4()
 	tcphdr := packet.NewTCP()
 
@@ -389,6 +454,7 @@ func (tt *tcpConnTrack) payload(data []byte) {
 	iphdr.Id = packet.IPID()
 	iphdr.SrcIP = tt.remoteIP
 	iphdr.DstIP = tt.localIP
+	iphdr.TOS = tt.t2s.tos
 	iphdr.TTL = 64
 	iphdr.Protocol = packet.IPProtocolTCP
 
@@ -412,7 +478,7 @@ func (tt *tcpConnTrack) payload(data []byte) {
 func (tt *tcpConnTrack) stateClosed(syn *tcpPacket) (continu bool, release bool) {
 	var e error
 
-	if !isPrivate(tt.remoteIP) && (tt.remotePort == 80 || tt.remotePort == 443) {
+	if tt.proxied() {
 		if tt.uid == -1 {
 			log.Printf("initiating connection, loading uid and proxy")
 			uid := tt.t2s.FindAppUid(tt.localIP.String(), tt.localPort, tt.remoteIP.String(), tt.remotePort)
@@ -420,35 +486,41 @@ func (tt *tcpConnTrack) stateClosed(syn *tcpPacket) (continu bool, release bool)
 			tt.loadProxyConfig()
 		}
 
-		if tt.proxyServer.ProxyType == PROXY_TYPE_SOCKS {
-			tt.socksConn, e = dialLocalSocks(tt.proxyServer) //only 80 and 443 goes to proxy
-		} else if tt.proxyServer.ProxyType == PROXY_TYPE_HTTP {
-			tt.socksConn, e = dialTransaprent(tt.proxyServer.IpAddress)
-			if len(syn.tcp.Hostname) > 0 && tt.proxyServer.ProxyType == PROXY_TYPE_HTTP && tt.remotePort == 443 {
+		if tt.proxyType() == PROXY_TYPE_SOCKS {
+			tt.socksConn, e = tt.t2s.retryDial(func() (*gosocks.SocksConn, error) { //only 80 and 443 goes to proxy
+				return tt.t2s.dialProxy(tt.proxyServer)
+			})
+		} else if tt.proxyType() == PROXY_TYPE_HTTP {
+			tt.socksConn, e = tt.t2s.retryDial(func() (*gosocks.SocksConn, error) {
+				return tt.t2s.dialProxy(tt.proxyServer)
+			})
+			if e == nil && len(syn.tcp.Hostname) > 0 && tt.remotePort == 443 {
 				log.Print("Connect using state closed")
 				tt.callHttpProxyConnect(tt.socksConn, tt.remoteIP, syn.tcp)
 			}
 		} else {
-			remoteIpPort := fmt.Sprintf("%s:%d", tt.remoteIP.String(), tt.remotePort)
-			tt.socksConn, e = dialTransaprent(remoteIpPort)
+			e = tt.dialDirect()
 		}
 	} else {
-		remoteIpPort := fmt.Sprintf("%s:%d", tt.remoteIP.String(), tt.remotePort)
-		tt.socksConn, e = dialTransaprent(remoteIpPort)
+		e = tt.dialDirect()
 	}
 
 	if e != nil {
 		log.Printf("fail to connect SOCKS proxy: %s", e)
+		tt.t2s.flowError("tcp", tt.localIP, tt.localPort, tt.remoteIP, tt.remotePort, e)
 		return
 	} else {
 		// no timeout
 		tt.socksConn.SetDeadline(time.Time{})
+		tt.t2s.relayBound("tcp", tt.socksConn.LocalAddr())
 	}
 
 	if tt.socksConn == nil || tt.connectState != CONNECT_NOT_SENT {
 		resp := rstByPacket(syn)
 		tt.toTunCh <- resp.wire
-		// log.Printf("<-- [TCP][%s][RST]", tt.id)
+		if tt.debug {
+			log.Printf("<-- [TCP][%s][RST]", tt.id)
+		}
 		return false, true
 	}
 
@@ -461,6 +533,24 @@ func (tt *tcpConnTrack) stateClosed(syn *tcpPacket) (continu bool, release bool)
 	return true, true
 }
 
+// dialDirect connects the destination without a proxy, starting with a PROXY
+// protocol header if configured.
+func (tt *tcpConnTrack) dialDirect() (e error) {
+	remoteIpPort := fmt.Sprintf("%s:%d", tt.remoteIP.String(), tt.remotePort)
+	tt.socksConn, e = tt.t2s.retryDial(func() (*gosocks.SocksConn, error) {
+		return tt.t2s.directDial(remoteIpPort)
+	})
+	if e != nil || !tt.t2s.wantsProxyProtocol(tt.remoteIP, tt.remotePort) {
+		return
+	}
+	hdr := proxyProtocolHeader(tt.localIP, tt.localPort, tt.remoteIP, tt.remotePort)
+	if _, e = tt.socksConn.Write(hdr); e != nil {
+		tt.socksConn.Close()
+		tt.socksConn = nil
+	}
+	return
+}
+
 func (tt *tcpConnTrack) callSocks(dstIP net.IP, dstPort uint16, conn net.Conn, closeCh chan bool) error {
 	_, e := gosocks.WriteSocksRequest(conn, &gosocks.SocksRequest{
 		Cmd:      gosocks.SocksCmdConnect,
@@ -508,19 +598,40 @@ func (tt *tcpConnTrack) callHttpProxyConnect(conn net.Conn, dstIp net.IP, tcp *p
 	return nil
 }
 
+// proxied reports whether the connection goes through a proxy, as picked by
+// the SOCKS router if one is set.
+func (tt *tcpConnTrack) proxied() bool {
+	if tt.routed {
+		return tt.viaProxy
+	}
+	return proxiedTCP(tt.remoteIP, tt.remotePort)
+}
+
 func (tt *tcpConnTrack) loadProxyConfig() {
 	log.Printf("loadProxyConfig for uid %d", tt.uid)
 
-	proxyServer, ok := tt.t2s.proxyServerMap[tt.uid]
-	if !ok {
-		tt.proxyServer = tt.t2s.defaultProxyServer
+	if tt.socksAddr != "" {
+		tt.proxyServer = tt.t2s.routedProxy(tt.uid, tt.socksAddr)
 	} else {
-		tt.proxyServer = proxyServer
+		tt.proxyServer = tt.t2s.proxyFor(tt.uid)
 	}
 
+	if tt.proxyServer == nil {
+		log.Printf("No proxy for uid %d", tt.uid)
+		return
+	}
 	log.Printf("Proxy selected: address %s, type: %d", tt.proxyServer.IpAddress, tt.proxyServer.ProxyType)
 }
 
+// proxyType is the type of the proxy of the connection, PROXY_TYPE_NONE if
+// there is none, as without a default proxy.
+func (tt *tcpConnTrack) proxyType() int {
+	if tt.proxyServer == nil {
+		return PROXY_TYPE_NONE
+	}
+	return tt.proxyServer.ProxyType
+}
+
 func (tt *tcpConnTrack) tcpSocks2Tun(dstIP net.IP, dstPort uint16, conn net.Conn, readCh chan<- []byte, writeCh <-chan *tcpPacket, closeCh chan bool) {
 	if tt.uid == -1 {
 		uid := tt.t2s.FindAppUid(tt.localIP.String(), tt.localPort, dstIP.String(), dstPort)
@@ -529,17 +640,17 @@ func (tt *tcpConnTrack) tcpSocks2Tun(dstIP net.IP, dstPort uint16, conn net.Conn
 		tt.loadProxyConfig()
 	}
 
-	if !isPrivate(dstIP) && (dstPort == 443 || dstPort == 80) {
-		if tt.proxyServer.ProxyType == PROXY_TYPE_SOCKS {
+	if tt.proxied() && !tt.bound {
+		if tt.proxyType() == PROXY_TYPE_SOCKS {
 			e := tt.callSocks(dstIP, dstPort, conn, closeCh)
 			if e != nil {
-				tt.destroyed = true
+				atomic.StoreInt32(&tt.destroyed, 1)
 				return
 			}
 		}
 	}
 
-	if tt.proxyServer.ProxyType != PROXY_TYPE_HTTP || dstPort != 443 || isPrivate(dstIP) {
+	if tt.proxyType() != PROXY_TYPE_HTTP || dstPort != 443 || isPrivate(dstIP) {
 		tt.connectState = CONNECT_ESTABLISHED
 	}
 
@@ -560,7 +671,7 @@ func (tt *tcpConnTrack) tcpSocks2Tun(dstIP net.IP, dstPort uint16, conn net.Conn
 					tt.connectState = CONNECT_SENT
 				}
 
-				if tt.proxyServer.ProxyType == PROXY_TYPE_HTTP {
+				if tt.proxyType() == PROXY_TYPE_HTTP {
 					if tt.connectState != CONNECT_ESTABLISHED {
 						tt.recvWndCond.L.Lock()
 						log.Print("Waiting https connect")
@@ -574,6 +685,8 @@ func (tt *tcpConnTrack) tcpSocks2Tun(dstIP net.IP, dstPort uint16, conn net.Conn
 						conn.Write(pkt.tcp.PatchHostForPlainHttp(tt.proxyServer.AuthHeader))
 					}
 
+				} else if tt.ftpControl() {
+					conn.Write(tt.bindFTPPort(pkt.tcp.Payload))
 				} else {
 					conn.Write(pkt.tcp.Payload)
 				}
@@ -588,7 +701,7 @@ func (tt *tcpConnTrack) tcpSocks2Tun(dstIP net.IP, dstPort uint16, conn net.Conn
 
 				releaseTCPPacket(pkt)
 			default:
-				if tt.t2s.stopped || tt.destroyed {
+				if atomic.LoadInt32(&tt.t2s.stopped) != 0 || atomic.LoadInt32(&tt.destroyed) != 0 {
 					break loop
 				}
 				time.Sleep(10 * time.Millisecond)
@@ -600,7 +713,7 @@ func (tt *tcpConnTrack) tcpSocks2Tun(dstIP net.IP, dstPort uint16, conn net.Conn
 
 	// reader
 	for {
-		if tt.t2s.stopped || tt.destroyed {
+		if atomic.LoadInt32(&tt.t2s.stopped) != 0 || atomic.LoadInt32(&tt.destroyed) != 0 {
 			break
 		}
 
@@ -658,7 +771,7 @@ func (tt *tcpConnTrack) tcpSocks2Tun(dstIP net.IP, dstPort uint16, conn net.Conn
 	}
 
 	tt.recvWndCond.Broadcast()
-	if !tt.destroyed {
+	if atomic.LoadInt32(&tt.destroyed) == 0 {
 		closeCh <- true
 		close(closeCh)
 	}
@@ -673,13 +786,15 @@ func (tt *tcpConnTrack) stateSynRcvd(pkt *tcpPacket) (continu bool, release bool
 		if !pkt.tcp.RST {
 			resp := rstByPacket(pkt)
 			tt.toTunCh <- resp
-			// log.Printf("<-- [TCP][%s][RST] continue", tt.id)
+			if tt.debug {
+				log.Printf("<-- [TCP][%s][RST] continue", tt.id)
+			}
 		}
 		return true, true
 	}
 	// connection ends by valid RST
 	if pkt.tcp.RST {
-		tt.destroyed = true
+		atomic.StoreInt32(&tt.destroyed, 1)
 		return false, true
 	}
 	// ignore non-ACK packets
@@ -699,6 +814,24 @@ func (tt *tcpConnTrack) stateSynRcvd(pkt *tcpPacket) (continu bool, release bool
 	return
 }
 
+// stateSynSent expects the SYN/ACK of the app to a connection opened toward
+// it, acks it and starts relaying.
+func (tt *tcpConnTrack) stateSynSent(pkt *tcpPacket) (continu bool, release bool) {
+	// connection refused by the app
+	if pkt.tcp.RST {
+		return false, true
+	}
+	// ignore anything but a SYN/ACK of our SYN
+	if !pkt.tcp.SYN || !pkt.tcp.ACK || !tt.validAck(pkt) {
+		return true, true
+	}
+	tt.rcvNxtSeq = pkt.tcp.Seq + 1
+	tt.ack()
+	tt.changeState(ESTABLISHED)
+	go tt.tcpSocks2Tun(tt.remoteIP, tt.remotePort, tt.socksConn, tt.fromSocksCh, tt.toSocksCh, tt.socksCloseCh)
+	return true, true
+}
+
 func (tt *tcpConnTrack) stateEstablished(pkt *tcpPacket) (continu bool, release bool) {
 	// ack if sequence is not expected
 	if !tt.validSeq(pkt) {
@@ -827,6 +960,11 @@ func (tt *tcpConnTrack) newPacket(pkt *tcpPacket) {
 	}
 }
 
+func (tt *tcpConnTrack) touch() {
+	tt.lastPacketTime = time.Now()
+	atomic.StoreInt64(&tt.activity, tt.lastPacketTime.UnixNano())
+}
+
 func (tt *tcpConnTrack) updateSendWindow(pkt *tcpPacket) {
 	//log.Print("updateSendWindow")
 	// tt.sendWndCond.L.Lock()
@@ -841,6 +979,7 @@ func (tt *tcpConnTrack) run() {
 	var fromSocksCh chan []byte
 	var ackTimer *time.Timer
 	var timeout *time.Timer = time.NewTimer(30 * time.Second)
+	defer tt.t2s.flowClosed("tcp", tt.localIP, tt.localPort, tt.remoteIP, tt.remotePort, &tt.counters)
 
 	for {
 		timeout.Reset(30 * time.Second)
@@ -856,25 +995,27 @@ func (tt *tcpConnTrack) run() {
 			}
 			ackTimeout = ackTimer.C
 			if time.Now().Sub(tt.lastPacketTime) > TIMEOUT {
-				tt.destroyed = true
+				atomic.StoreInt32(&tt.destroyed, 1)
 			}
 		}
 
-		if tt.destroyed {
+		if atomic.LoadInt32(&tt.destroyed) != 0 {
 			if tt.socksConn != nil {
 				tt.socksConn.Close()
 			}
 			close(tt.quitBySelf)
-			tt.t2s.clearTCPConnTrack(tt.id)
+			tt.t2s.clearTCPConnTrack(tt)
 			return
 		}
 
 		select {
 		case pkt := <-tt.input:
-			// log.Printf("--> [TCP][%s][%s][%s][seq:%d][ack:%d][payload:%d]", tt.id, tcpstateString(tt.state), tcpflagsString(pkt.tcp), pkt.tcp.Seq, pkt.tcp.Ack, len(pkt.tcp.Payload))
+			if tt.debug {
+				log.Printf("--> [TCP][%s][%s][%s][seq:%d][ack:%d][payload:%d]", tt.id, tcpstateString(tt.state), tcpflagsString(pkt.tcp), pkt.tcp.Seq, pkt.tcp.Ack, len(pkt.tcp.Payload))
+			}
 			var continu, release bool
 
-			tt.lastPacketTime = time.Now()
+			tt.touch()
 
 			tt.updateSendWindow(pkt)
 			switch tt.state {
@@ -882,6 +1023,8 @@ func (tt *tcpConnTrack) run() {
 				continu, release = tt.stateClosed(pkt)
 			case SYN_RCVD:
 				continu, release = tt.stateSynRcvd(pkt)
+			case SYN_SENT:
+				continu, release = tt.stateSynSent(pkt)
 			case ESTABLISHED:
 				continu, release = tt.stateEstablished(pkt)
 			case FIN_WAIT_1:
@@ -897,12 +1040,12 @@ func (tt *tcpConnTrack) run() {
 				releaseTCPPacket(pkt)
 			}
 			if !continu {
-				tt.destroyed = true
+				atomic.StoreInt32(&tt.destroyed, 1)
 				if tt.socksConn != nil {
 					tt.socksConn.Close()
 				}
 				close(tt.quitBySelf)
-				tt.t2s.clearTCPConnTrack(tt.id)
+				tt.t2s.clearTCPConnTrack(tt)
 
 				return
 			}
@@ -914,7 +1057,7 @@ func (tt *tcpConnTrack) run() {
 			}
 
 		case data := <-fromSocksCh:
-			tt.lastPacketTime = time.Now()
+			tt.touch()
 			tt.payload(data)
 
 		case <-socksCloseCh:
@@ -926,11 +1069,14 @@ func (tt *tcpConnTrack) run() {
 				tt.socksConn.Close()
 			}
 			close(tt.quitBySelf)
-			tt.t2s.clearTCPConnTrack(tt.id)
+			tt.t2s.clearTCPConnTrack(tt)
 			return
 
 		case <-tt.quitByOther:
 			// who closes this channel should be responsible to clear track map
+			atomic.StoreInt32(&tt.destroyed, 1)
+			tt.recvWndCond.Broadcast()
+			tt.sendWndCond.Broadcast()
 			if tt.socksConn != nil {
 				tt.socksConn.Close()
 			}
@@ -943,14 +1089,45 @@ func (tt *tcpConnTrack) run() {
 	}
 }
 
-func (t2s *Tun2Socks) createTCPConnTrack(id string, ip *packet.IPv4, tcp *packet.TCP) *tcpConnTrack {
+// createTCPConnTrack starts tracking a new flow, or returns nil if a routing
+// rule or the new flow handler drops it.
+func (t2s *Tun2Socks) createTCPConnTrack(dev *tunDevice, id string, ip *packet.IPv4, tcp *packet.TCP) *tcpConnTrack {
+	decision, ruled := t2s.ruleDecision("tcp", ip.DstIP, tcp.DstPort)
+	if ruled && decision == ROUTE_DROP {
+		log.Printf("drop tcp flow %s by rule", id)
+		return nil
+	}
+	if !t2s.admitted("tcp", ip.SrcIP, ip.DstIP, tcp.SrcPort, tcp.DstPort) {
+		log.Printf("drop tcp flow %s by new flow handler", id)
+		return nil
+	}
+
 	t2s.tcpConnTrackLock.Lock()
 	defer t2s.tcpConnTrackLock.Unlock()
 
+	track := t2s.newTCPConnTrack(dev, id, ip.SrcIP, tcp.SrcPort, ip.DstIP, tcp.DstPort)
+	if ruled {
+		track.routed, track.viaProxy = true, decision == ROUTE_PROXY
+	} else {
+		track.socksAddr, track.routed = t2s.routeSocks("tcp", track.remoteIP, track.remotePort)
+		track.viaProxy = track.socksAddr != ""
+	}
+	track.loadProxyConfig()
+
+	t2s.tcpConnTrackMap[id] = track
+
+	go track.run()
+	return track
+}
+
+// newTCPConnTrack returns a track, in state CLOSED, of a flow read from dev
+// between the app at localIP:localPort and remoteIP:remotePort.
+func (t2s *Tun2Socks) newTCPConnTrack(dev *tunDevice, id string, localIP net.IP, localPort uint16, remoteIP net.IP, remotePort uint16) *tcpConnTrack {
 	track := &tcpConnTrack{
 		t2s:          t2s,
+		dev:          dev,
 		id:           id,
-		toTunCh:      t2s.writeCh,
+		toTunCh:      dev.writeCh,
 		input:        make(chan *tcpPacket),
 		fromSocksCh:  make(chan []byte, 1500),
 		toSocksCh:    make(chan *tcpPacket, 1500),
@@ -958,7 +1135,6 @@ func (t2s *Tun2Socks) createTCPConnTrack(id string, ip *packet.IPv4, tcp *packet
 		quitBySelf:   make(chan bool),
 		quitByOther:  make(chan bool),
 		connectState: CONNECT_NOT_SENT,
-		destroyed:    false,
 
 		lastPacketTime: time.Now(),
 
@@ -967,24 +1143,29 @@ func (t2s *Tun2Socks) createTCPConnTrack(id string, ip *packet.IPv4, tcp *packet
 		sendWndCond: &sync.Cond{L: &sync.Mutex{}},
 		recvWndCond: &sync.Cond{L: &sync.Mutex{}},
 
-		localPort:  tcp.SrcPort,
-		remotePort: tcp.DstPort,
+		localPort:  localPort,
+		remotePort: remotePort,
 		state:      CLOSED,
 
-		uid:         t2s.FindAppUid(ip.SrcIP.String(), tcp.SrcPort, ip.DstIP.String(), tcp.DstPort),
-		proxyServer: t2s.defaultProxyServer,
+		uid: t2s.FindAppUid(localIP.String(), localPort, remoteIP.String(), remotePort),
 	}
 
-	track.localIP = make(net.IP, len(ip.SrcIP))
-	copy(track.localIP, ip.SrcIP)
-	track.remoteIP = make(net.IP, len(ip.DstIP))
-	copy(track.remoteIP, ip.DstIP)
-
-	track.loadProxyConfig()
-
-	t2s.tcpConnTrackMap[id] = track
+	track.localIP = make(net.IP, len(localIP))
+	copy(track.localIP, localIP)
+	track.remoteIP = make(net.IP, len(remoteIP))
+	copy(track.remoteIP, remoteIP)
+	track.debug = t2s.debugged(ConnInfo{
+		Proto:      "tcp",
+		ID:         id,
+		LocalIP:    track.localIP,
+		LocalPort:  track.localPort,
+		RemoteIP:   track.remoteIP,
+		RemotePort: track.remotePort,
+		UID:        track.uid,
+	})
 
-	go track.run()
+	track.activity = track.lastPacketTime.UnixNano()
+	track.counters.start = track.lastPacketTime
 	return track
 }
 
@@ -995,30 +1176,30 @@ func (t2s *Tun2Socks) getTCPConnTrack(id string) *tcpConnTrack {
 	return t2s.tcpConnTrackMap[id]
 }
 
-func (t2s *Tun2Socks) clearTCPConnTrack(id string) {
+func (t2s *Tun2Socks) clearTCPConnTrack(tt *tcpConnTrack) {
 	t2s.tcpConnTrackLock.Lock()
 	defer t2s.tcpConnTrackLock.Unlock()
-	track, ok := t2s.tcpConnTrackMap[id]
-	if ok {
-		track.destroyed = true
-		track.recvWndCond.Broadcast()
-		track.sendWndCond.Broadcast()
-	}
+	atomic.StoreInt32(&tt.destroyed, 1)
+	tt.recvWndCond.Broadcast()
+	tt.sendWndCond.Broadcast()
 
-	delete(t2s.tcpConnTrackMap, id)
+	// a closed track may already be replaced
+	if t2s.tcpConnTrackMap[tt.id] == tt {
+		delete(t2s.tcpConnTrackMap, tt.id)
+	}
 }
 
-func (t2s *Tun2Socks) tcp(raw []byte, ip *packet.IPv4, tcp *packet.TCP) {
-	connID := tcpConnID(ip, tcp)
+func (t2s *Tun2Socks) tcp(dev *tunDevice, raw []byte, ip *packet.IPv4, tcp *packet.TCP) {
+	connID := dev.flowID(tcpConnID(ip, tcp))
 
 	track := t2s.getTCPConnTrack(connID)
 
-	if track != nil && track.destroyed {
+	if track != nil && atomic.LoadInt32(&track.destroyed) != 0 {
 		log.Print("Use of destroyed track! routine")
 		track = nil
 	}
 	if track != nil {
-		pkt := copyTCPPacket(raw, ip, tcp)
+		pkt := copyTCPPacket(raw, dev.takeReadBuf(raw), ip, tcp)
 		track.newPacket(pkt)
 	} else {
 		// ignore RST, if there is no track of this connection
@@ -1030,13 +1211,17 @@ func (t2s *Tun2Socks) tcp(raw []byte, ip *packet.IPv4, tcp *packet.TCP) {
 		if !tcp.SYN {
 			// log.Printf("--> [TCP][%s][%s]", connID, tcpflagsString(tcp))
 			resp := rst(ip.SrcIP, ip.DstIP, tcp.SrcPort, tcp.DstPort, tcp.Seq, tcp.Ack, uint32(len(tcp.Payload)))
-			t2s.writeCh <- resp
+			dev.writeCh <- resp
 			// log.Printf("<-- [TCP][%s][RST]", connID)
 			return
 		}
 
-		pkt := copyTCPPacket(raw, ip, tcp)
-		track := t2s.createTCPConnTrack(connID, ip, tcp)
+		track := t2s.createTCPConnTrack(dev, connID, ip, tcp)
+		if track == nil {
+			dev.writeCh <- rst(ip.SrcIP, ip.DstIP, tcp.SrcPort, tcp.DstPort, tcp.Seq, tcp.Ack, uint32(len(tcp.Payload)))
+			return
+		}
+		pkt := copyTCPPacket(raw, dev.takeReadBuf(raw), ip, tcp)
 		track.newPacket(pkt)
 	}
 }
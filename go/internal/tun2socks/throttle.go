@@ -0,0 +1,105 @@
+package tun2socks
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// tokenBucket paces a direction of a flow to a rate, bursting up to a
+// second's worth. It schedules each datagram at the time the bytes before it
+// have drained at the rate.
+type tokenBucket struct {
+	rate float64
+	// longest a datagram may be delayed before it is dropped instead
+	bound time.Duration
+	next  time.Time
+}
+
+func newTokenBucket(rate int, buffer int) *tokenBucket {
+	return &tokenBucket{
+		rate:  float64(rate),
+		bound: time.Duration(float64(buffer) / float64(rate) * float64(time.Second)),
+	}
+}
+
+// schedule returns when n bytes arriving now may be sent to keep to the
+// rate. ok is false if they are to be dropped, as the backlog before them
+// exceeds the buffer.
+func (b *tokenBucket) schedule(n int, now time.Time) (at time.Time, ok bool) {
+	if earliest := now.Add(-time.Second); b.next.Before(earliest) {
+		b.next = earliest
+	}
+	at = b.next
+	if at.Sub(now) > b.bound {
+		return time.Time{}, false
+	}
+	b.next = b.next.Add(time.Duration(float64(n) / b.rate * float64(time.Second)))
+	if at.Before(now) {
+		at = now
+	}
+	return at, true
+}
+
+// SetUDPRateLimit limits each UDP flow to bytesPerSec in either direction,
+// for fair use. Datagrams from tun over the rate are delayed while the
+// backlog stays within buffer bytes (a second's worth if 0) and dropped
+// beyond it; responses over the rate back up into the relay socket, see
+// SetRelayBuffers. Routing rules may override the rate per flow. 0
+// removes the limit. It applies to flows created from then on.
+func (t2s *Tun2Socks) SetUDPRateLimit(bytesPerSec int, buffer int) {
+	t2s.udpRateLimit = bytesPerSec
+	t2s.udpRateBuffer = buffer
+}
+
+// throttle sets up the rate limit of a new flow, rate being the override
+// of a routing rule or 0.
+func (ut *udpConnTrack) throttle(rate int) {
+	if rate == 0 {
+		rate = ut.t2s.udpRateLimit
+	}
+	if rate <= 0 {
+		return
+	}
+	buffer := ut.t2s.udpRateBuffer
+	if buffer <= 0 {
+		buffer = rate
+	}
+	ut.sendLimit = newTokenBucket(rate, buffer)
+	ut.recvLimit = newTokenBucket(rate, buffer)
+}
+
+// scheduled reports whether b lets n bytes through, delayed or not, and
+// counts them as dropped if not. A nil b lets everything through at once.
+func (t2s *Tun2Socks) scheduled(b *tokenBucket, n int) (at time.Time, ok bool) {
+	if b == nil {
+		return time.Time{}, true
+	}
+	at, ok = b.schedule(n, time.Now())
+	if !ok {
+		atomic.AddUint64(&t2s.stats.UDPRateDropped, 1)
+	}
+	return at, ok
+}
+
+// waitUntil waits until at, or returns false if the flow quits first.
+func (ut *udpConnTrack) waitUntil(at time.Time) bool {
+	delay := time.Until(at)
+	if delay <= 0 {
+		return true
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ut.quitByOther:
+		return false
+	}
+}
+
+// pace delays n bytes of a response to keep to the rate towards tun. It
+// returns false if they are to be dropped.
+func (ut *udpConnTrack) pace(n int) bool {
+	at, ok := ut.t2s.scheduled(ut.recvLimit, n)
+	return ok && ut.waitUntil(at)
+}
@@ -0,0 +1,55 @@
+package tun2socks
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUDPRateLimit(t *testing.T) {
+	const rate, size, n = 10000, 1000, 20
+	s := newStubSocks(t, echoUDP)
+	t2s, p := NewTun2SocksWithPipe()
+	t2s.SetDefaultProxy(&ProxyServer{ProxyType: PROXY_TYPE_SOCKS, IpAddress: s.addr})
+	t2s.SetRoutingRules(RoutingRules{Rules: []RoutingRule{{Decision: ROUTE_PROXY}}})
+	t2s.SetUDPRateLimit(rate, n*size)
+	serve(t, t2s)
+
+	start := time.Now()
+	dst := net.IP{192, 0, 2, 1}
+	for i := 0; i < n; i++ {
+		p.Inject(udpIPv4(clientIP, 5000, dst, 9, make([]byte, size)))
+	}
+	for i := 0; i < n; i++ {
+		nextUDP(t, p)
+	}
+	elapsed := time.Since(start)
+
+	// a second's worth goes at once, the rest at the rate
+	want := time.Duration(float64(n*size-rate) / rate * float64(time.Second))
+	if elapsed < want*8/10 || elapsed > 3*want {
+		t.Fatalf("echoed %d bytes in %s, want about %s", n*size, elapsed, want)
+	}
+	if dropped := t2s.Stats().UDPRateDropped; dropped != 0 {
+		t.Fatalf("%d datagrams dropped within the buffer", dropped)
+	}
+}
+
+func TestUDPRateLimitOfRuleDropsBacklog(t *testing.T) {
+	s := newStubSocks(t, echoUDP)
+	t2s, p := NewTun2SocksWithPipe()
+	t2s.SetDefaultProxy(&ProxyServer{ProxyType: PROXY_TYPE_SOCKS, IpAddress: s.addr})
+	t2s.SetRoutingRules(RoutingRules{Rules: []RoutingRule{{Decision: ROUTE_PROXY, RateLimit: 1000}}})
+	serve(t, t2s)
+
+	// two go at once, one is delayed within the buffer of a second's worth
+	// and the rest is dropped
+	dst := net.IP{192, 0, 2, 1}
+	for i := 0; i < 5; i++ {
+		p.Inject(udpIPv4(clientIP, 5000, dst, 9, make([]byte, 1000)))
+	}
+	waitFor(t, "drops", func() bool { return t2s.Stats().UDPRateDropped == 2 })
+	for i := 0; i < 3; i++ {
+		nextUDP(t, p)
+	}
+}
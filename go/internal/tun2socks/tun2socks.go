@@ -1,11 +1,16 @@
 package tun2socks
 
 import (
+	"context"
+	"fmt"
 	"io"
 	"log"
 	"net"
 	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/dkwiebe/gotun2socks/internal/gosocks"
@@ -18,6 +23,22 @@ const (
 	PROXY_TYPE_NONE  = 0
 	PROXY_TYPE_SOCKS = 1
 	PROXY_TYPE_HTTP  = 2
+
+	// room for the largest UDP payload, SOCKS UDP request header included
+	MAX_RELAY_READ_BUF = 65535
+
+	// longest wait after a tun read that returned nothing, by default
+	ZERO_READ_BACKOFF = 10 * time.Millisecond
+
+	// time to connect to a relay and take each step of its handshake, by
+	// default
+	SOCKS_CONNECT_TIMEOUT = 5 * time.Second
+
+	// ECN field of the TOS byte and its codepoints (RFC 3168)
+	ECN_MASK = 0x03
+	ECN_ECT1 = 0x01
+	ECN_ECT0 = 0x02
+	ECN_CE   = 0x03
 )
 
 var (
@@ -26,12 +47,12 @@ var (
 			UserName: "cloudveilsocks",
 			Password: "cloudveilsocks",
 		},
-		Timeout: time.Second,
+		Timeout: SOCKS_CONNECT_TIMEOUT,
 	}
 
 	directDialer *gosocks.SocksDialer = &gosocks.SocksDialer{
 		Auth:    &gosocks.HttpAuthenticator{},
-		Timeout: time.Second,
+		Timeout: SOCKS_CONNECT_TIMEOUT,
 	}
 
 	_, ip1, _ = net.ParseCIDR("10.0.0.0/24")
@@ -45,6 +66,29 @@ type ProxyServer struct {
 	AuthHeader string
 	Login      string
 	Password   string
+	// SocksGSSAPI, if set, authenticates to a SOCKS proxy with GSSAPI
+	// instead of Login and Password.
+	SocksGSSAPI gosocks.GSSAPIProvider
+}
+
+// RelayDialFunc connects to the proxy server that relays a flow.
+type RelayDialFunc func(proxy *ProxyServer) (*gosocks.SocksConn, error)
+
+// DirectDialFunc connects straight to the destination addr of a flow.
+type DirectDialFunc func(addr string) (*gosocks.SocksConn, error)
+
+// FlowError reports a flow that could not be relayed.
+type FlowError struct {
+	Proto   string
+	SrcIP   net.IP
+	SrcPort uint16
+	DstIP   net.IP
+	DstPort uint16
+	Err     error
+}
+
+func (e *FlowError) Error() string {
+	return fmt.Sprintf("%s %s:%d -> %s:%d: %s", e.Proto, e.SrcIP, e.SrcPort, e.DstIP, e.DstPort, e.Err)
 }
 
 type UidCallback interface {
@@ -52,12 +96,20 @@ type UidCallback interface {
 }
 
 type Tun2Socks struct {
-	dev io.ReadWriteCloser
+	// first, to keep the 64-bit counters aligned on 32-bit platforms
+	stats Stats
+	// write latencies of the tun devices, if recorded
+	tunLatency atomic.Pointer[tunLatency]
+
+	devs []*tunDevice
 
 	writerStopCh chan bool
-	writeCh      chan interface{}
 
 	tcpConnTrackMap    map[string]*tcpConnTrack
+	proxyLock          sync.RWMutex
+	socksRouter        SocksRouter
+	proxyProtocol      ProxyProtocolFilter
+	socksBind          bool
 	proxyServerMap     map[int]*ProxyServer
 	defaultProxyServer *ProxyServer
 	uidCallback        UidCallback
@@ -66,8 +118,81 @@ type Tun2Socks struct {
 
 	udpConnTrackLock sync.Mutex
 	udpConnTrackMap  map[string]*udpConnTrack
-	cache            *dnsCache
-	stopped          bool
+	// guarded by udpConnTrackLock
+	quicAware          bool
+	quicConns          map[string]*udpConnTrack
+	cache              *dnsCache
+	dnsStore           DNSCache // cache itself unless SetDNSCache replaced it
+	stripQTypes        []uint16
+	echoDNSIPID        bool
+	ipidFunc           func() uint16
+	relayDial          RelayDialFunc
+	directDial         DirectDialFunc
+	dialAttempts       int
+	dialBackoff        time.Duration
+	connectTimeout     time.Duration
+	dialSem            chan struct{}
+	dialWait           time.Duration
+	flowErrorHandler   func(*FlowError)
+	relayBindHandler   func(proto string, local net.Addr)
+	connCloseHandler   func(id string, reason CloseReason)
+	flowRecordHandler  func(FlowRecord)
+	newFlowHandler     func(string, net.IP, net.IP, uint16, uint16) bool
+	debugFlow          func(ConnInfo) bool
+	icmpUnreachable    bool
+	icmpOnPolicyClose  bool
+	icmpOnIdleClose    bool
+	protocolMode       ProtocolMode
+	protoUnreachable   bool
+	tracerouteHop      net.IP
+	udpIdleMin         time.Duration
+	udpIdleMax         time.Duration
+	udpMaxLifetime     time.Duration
+	dnsHookLock        sync.RWMutex
+	dnsLogCh           chan *dnsLogEntry // guarded by dnsHookLock
+	dnsAnswerCh        chan *dnsLogEntry // guarded by dnsHookLock
+	dnsStoreLock       sync.RWMutex
+	dnsStoreCh         chan []byte // guarded by dnsStoreLock
+	dnsRoutes          []dnsForwardRoute
+	dnsDefaultServer   *net.UDPAddr
+	dnsRaceServers     []*net.UDPAddr
+	dnsKeepAlive       time.Duration
+	pinRefreshing      int32
+	interceptDNS       bool
+	dnsCompress        bool
+	rejectBadDNS       bool
+	udpQueueDepth      int
+	udpQueuePolicy     int
+	dot                *dotClient
+	stuckThreshold     time.Duration
+	maxDNSAnswers      int
+	dropDNSAnswers     bool
+	socketControl      func(network, address string, c syscall.RawConn) error
+	userControl        func(network, address string, c syscall.RawConn) error
+	tos                uint8
+	noUDPChecksum      bool
+	ecnPassthrough     bool
+	dnsPadding         int
+	adaptMTU           *adaptiveMTU
+	emitted            *emittedPackets
+	maxUDPResponseSize int
+	maxFragments       int
+	noFragNets         []*net.IPNet
+	relayRcvBuf        int
+	relaySndBuf        int
+	relayReadBuf       int
+	relayEgressIP      net.IP
+	srcValidation      bool
+	dropMulticast      bool
+	multicastAllow     []net.IP
+	proxyAddrs         proxyAddrs
+	udpRateLimit       int
+	udpRateBuffer      int
+	zeroReadBackoff    time.Duration
+	routingRules       atomic.Value // *RoutingRules
+	stopped            int32
+	ready              chan struct{}
+	loopsDown          int32 // reader and writer loops yet to start
 
 	wg sync.WaitGroup
 }
@@ -76,37 +201,68 @@ func isPrivate(ip net.IP) bool {
 	return ip1.Contains(ip) || ip2.Contains(ip) || ip3.Contains(ip)
 }
 
-func dialLocalSocks(proxyServer *ProxyServer) (*gosocks.SocksConn, error) {
+func (t2s *Tun2Socks) dialLocalSocks(proxyServer *ProxyServer) (*gosocks.SocksConn, error) {
 	log.Print("dialLocalSocks")
-	localSocksDialer.Auth = &gosocks.UserNamePasswordClientAuthenticator{
-		UserName: proxyServer.Login,
-		Password: proxyServer.Password,
+	// concurrent dials may use different credentials
+	dialer := *localSocksDialer
+	dialer.Timeout = t2s.connectTimeout
+	dialer.Control = t2s.socketControl
+	if proxyServer.SocksGSSAPI != nil {
+		dialer.Auth = &gosocks.GSSAPIClientAuthenticator{
+			Provider: proxyServer.SocksGSSAPI,
+		}
+	} else {
+		dialer.Auth = &gosocks.UserNamePasswordClientAuthenticator{
+			UserName: proxyServer.Login,
+			Password: proxyServer.Password,
+		}
 	}
 
-	return localSocksDialer.Dial(proxyServer.IpAddress)
+	return dialer.Dial(proxyServer.IpAddress)
 }
 
-func dialTransaprent(localAddr string) (*gosocks.SocksConn, error) {
+func (t2s *Tun2Socks) dialTransaprent(localAddr string) (*gosocks.SocksConn, error) {
 	log.Print("dialTransaprent")
-	return directDialer.Dial(localAddr)
+	dialer := *directDialer
+	dialer.Timeout = t2s.connectTimeout
+	dialer.Control = t2s.socketControl
+	return dialer.Dial(localAddr)
+}
+
+func (t2s *Tun2Socks) dialRelay(proxyServer *ProxyServer) (*gosocks.SocksConn, error) {
+	if proxyServer.ProxyType == PROXY_TYPE_SOCKS {
+		return t2s.dialLocalSocks(proxyServer)
+	}
+	return t2s.dialTransaprent(proxyServer.IpAddress)
 }
 
 func New(dev io.ReadWriteCloser, enableDnsCache bool) *Tun2Socks {
 	t2s := &Tun2Socks{
-		dev:                dev,
 		writerStopCh:       make(chan bool, 10),
-		writeCh:            make(chan interface{}, 10000),
+		ready:              make(chan struct{}),
 		tcpConnTrackMap:    make(map[string]*tcpConnTrack),
 		udpConnTrackMap:    make(map[string]*udpConnTrack),
 		proxyServerMap:     make(map[int]*ProxyServer),
 		uidCallback:        nil,
 		defaultProxyServer: nil,
-		stopped:            false,
+		udpIdleMin:         UDP_IDLE_TIMEOUT,
+		udpIdleMax:         UDP_IDLE_TIMEOUT,
+		dialAttempts:       2,
+		connectTimeout:     SOCKS_CONNECT_TIMEOUT,
+		interceptDNS:       true,
+		dnsCompress:        true,
+		udpQueueDepth:      100,
+		relayReadBuf:       MAX_RELAY_READ_BUF,
+		zeroReadBackoff:    ZERO_READ_BACKOFF,
 	}
+	t2s.relayDial = t2s.dialRelay
+	t2s.directDial = t2s.dialTransaprent
+	t2s.AddDevice(dev)
 	if enableDnsCache {
 		t2s.cache = &dnsCache{
 			storage: make(map[string]*dnsCacheEntry),
 		}
+		t2s.dnsStore = t2s.cache
 	}
 	return t2s
 }
@@ -116,111 +272,682 @@ func (t2s *Tun2Socks) SetUidCallback(uidCallback UidCallback) {
 }
 
 func (t2s *Tun2Socks) SetDefaultProxy(proxy *ProxyServer) {
+	t2s.proxyLock.Lock()
+	defer t2s.proxyLock.Unlock()
 	t2s.defaultProxyServer = proxy
 }
 
 func (t2s *Tun2Socks) SetProxyServers(proxyServerMap map[int]*ProxyServer) {
+	t2s.proxyLock.Lock()
+	defer t2s.proxyLock.Unlock()
 	t2s.proxyServerMap = proxyServerMap
 }
 
+// SetSocksCredentials rotates the credentials of the SOCKS proxies, the
+// default one and those of apps. Flows connected from then on authenticate
+// with them, established ones are kept.
+func (t2s *Tun2Socks) SetSocksCredentials(user, pass string) {
+	t2s.proxyLock.Lock()
+	defer t2s.proxyLock.Unlock()
+	// proxies in use by flows are replaced rather than modified
+	rotate := func(proxy *ProxyServer) *ProxyServer {
+		if proxy == nil || proxy.ProxyType != PROXY_TYPE_SOCKS {
+			return proxy
+		}
+		rotated := *proxy
+		rotated.Login = user
+		rotated.Password = pass
+		return &rotated
+	}
+	t2s.defaultProxyServer = rotate(t2s.defaultProxyServer)
+	proxyServerMap := make(map[int]*ProxyServer, len(t2s.proxyServerMap))
+	for uid, proxy := range t2s.proxyServerMap {
+		proxyServerMap[uid] = rotate(proxy)
+	}
+	t2s.proxyServerMap = proxyServerMap
+}
+
+// proxyFor returns the proxy server configured for the app uid.
+func (t2s *Tun2Socks) proxyFor(uid int) *ProxyServer {
+	t2s.proxyLock.RLock()
+	defer t2s.proxyLock.RUnlock()
+	proxyServer, ok := t2s.proxyServerMap[uid]
+	if !ok {
+		return t2s.defaultProxyServer
+	}
+	return proxyServer
+}
+
+// SetIPIDFunc overrides the generator of IP identification values used for
+// UDP responses and their fragments. nil restores packet.IPID.
+func (t2s *Tun2Socks) SetIPIDFunc(f func() uint16) {
+	t2s.ipidFunc = f
+}
+
+func (t2s *Tun2Socks) ipID() uint16 {
+	if t2s.ipidFunc != nil {
+		return t2s.ipidFunc()
+	}
+	return packet.IPID()
+}
+
+// SetEchoDNSIPID makes DNS responses carry the IP ID of the packet of their
+// query rather than a fresh one, so captures can pair them up. Only single
+// response flows can be paired up this way, so other UDP is left alone.
+func (t2s *Tun2Socks) SetEchoDNSIPID(enabled bool) {
+	t2s.echoDNSIPID = enabled
+}
+
+// responseID returns the IP ID of the response to a DNS query carried in a
+// packet of IP ID reqID.
+func (t2s *Tun2Socks) responseID(reqID uint16) uint16 {
+	if t2s.echoDNSIPID {
+		return reqID
+	}
+	return t2s.ipID()
+}
+
+// SetRelayDialer replaces the dialer used for flows relayed through a proxy
+// server. nil restores the default.
+func (t2s *Tun2Socks) SetRelayDialer(dial RelayDialFunc) {
+	if dial == nil {
+		dial = t2s.dialRelay
+	}
+	t2s.relayDial = dial
+}
+
+// SetDirectDialer replaces the dialer used for flows that bypass the proxy.
+// nil restores the default.
+func (t2s *Tun2Socks) SetDirectDialer(dial DirectDialFunc) {
+	if dial == nil {
+		dial = t2s.dialTransaprent
+	}
+	t2s.directDial = dial
+}
+
+// SetSocksConnectTimeout sets how long connecting to a relay, and each step
+// of the SOCKS handshake, may take before the dial fails, e.g. longer for
+// slow proxies over high-latency links. It applies to the default dialers of
+// TCP and UDP flows, direct or through a proxy. 0 or less restores
+// SOCKS_CONNECT_TIMEOUT. Idle flows are timed out separately.
+func (t2s *Tun2Socks) SetSocksConnectTimeout(timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = SOCKS_CONNECT_TIMEOUT
+	}
+	t2s.connectTimeout = timeout
+}
+
+// SetDialRetry sets how many times connecting a flow to its relay is
+// attempted before the flow fails, waiting backoff, then twice as long, and
+// so on between attempts. Packets of the flow are held meanwhile. Defaults to
+// 2 attempts without waiting.
+func (t2s *Tun2Socks) SetDialRetry(attempts int, backoff time.Duration) {
+	if attempts < 1 {
+		attempts = 1
+	}
+	t2s.dialAttempts = attempts
+	t2s.dialBackoff = backoff
+}
+
+// retryDial calls dial until it succeeds or the attempts are used up.
+func (t2s *Tun2Socks) retryDial(dial func() (*gosocks.SocksConn, error)) (conn *gosocks.SocksConn, e error) {
+	delay := t2s.dialBackoff
+	for i := 0; i < t2s.dialAttempts; i++ {
+		if i > 0 && delay > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+		conn, e = t2s.limitedDial(dial)
+		if e == nil {
+			return conn, nil
+		}
+		log.Printf("dial attempt %d failed: %s", i+1, e)
+	}
+	return nil, e
+}
+
+// SetMaxConcurrentDials limits how many relay dials may be in flight at once,
+// smoothing bursts of new flows. A dial over the limit waits up to wait for
+// another to finish before it fails. 0 removes the limit; set it before Run.
+func (t2s *Tun2Socks) SetMaxConcurrentDials(max int, wait time.Duration) {
+	if max <= 0 {
+		t2s.dialSem = nil
+		return
+	}
+	t2s.dialSem = make(chan struct{}, max)
+	t2s.dialWait = wait
+}
+
+// limitedDial calls dial once the concurrent dial limit allows it.
+func (t2s *Tun2Socks) limitedDial(dial func() (*gosocks.SocksConn, error)) (*gosocks.SocksConn, error) {
+	sem := t2s.dialSem
+	if sem == nil {
+		return dial()
+	}
+	t := time.NewTimer(t2s.dialWait)
+	defer t.Stop()
+	select {
+	case sem <- struct{}{}:
+	case <-t.C:
+		return nil, fmt.Errorf("too many concurrent dials")
+	}
+	defer func() { <-sem }()
+	return dial()
+}
+
+// SetUDPIdleTimeout bounds the idle timeout of UDP flows. Within the bounds
+// the timeout adapts to the flow: bursty request/response flows are closed
+// soon after they go quiet, steady streams are given longer. Both default to
+// UDP_IDLE_TIMEOUT, i.e. a fixed timeout.
+func (t2s *Tun2Socks) SetUDPIdleTimeout(min, max time.Duration) {
+	if min > max {
+		min = max
+	}
+	t2s.udpIdleMin = min
+	t2s.udpIdleMax = max
+}
+
+// SetMaxFlowLifetime closes UDP flows lifetime after they were opened, however
+// active, e.g. to have them re-established through a rotated key or a
+// rebalanced relay. Clients open a new flow with their next datagram. 0, the
+// default, lets flows live until idle.
+func (t2s *Tun2Socks) SetMaxFlowLifetime(lifetime time.Duration) {
+	t2s.udpMaxLifetime = lifetime
+}
+
+// SetSocketControl sets a function called on every relay socket before it is
+// used, e.g. to protect() it on Android or to set SO_MARK so that relayed
+// traffic isn't routed back into the tun.
+func (t2s *Tun2Socks) SetSocketControl(control func(network, address string, c syscall.RawConn) error) {
+	t2s.userControl = control
+	t2s.updateSocketControl()
+}
+
+// SetTOS marks tunnel traffic with tos (DSCP << 2 | ECN), both the packets
+// written to the tun and the relay sockets (IP_TOS, IPV6_TCLASS), e.g. for
+// QoS on the uplink. 0 leaves traffic unmarked.
+func (t2s *Tun2Socks) SetTOS(tos uint8) {
+	t2s.tos = tos
+	t2s.updateSocketControl()
+}
+
+// SetECNPassthrough makes UDP responses written to the tun carry the ECN
+// field of the packet they answer, for congestion-aware apps, instead of that
+// of SetTOS; the DSCP of SetTOS is kept. A request marked as congested (CE)
+// is answered as ECN-capable (ECT(0)), as the response didn't meet the
+// congestion.
+func (t2s *Tun2Socks) SetECNPassthrough(enabled bool) {
+	t2s.ecnPassthrough = enabled
+}
+
+// responseTOS is the TOS of a UDP response to a packet of TOS tos.
+func (t2s *Tun2Socks) responseTOS(tos uint8) uint8 {
+	if !t2s.ecnPassthrough {
+		return t2s.tos
+	}
+	ecn := tos & ECN_MASK
+	if ecn == ECN_CE {
+		ecn = ECN_ECT0
+	}
+	return t2s.tos&^ECN_MASK | ecn
+}
+
+// updateSocketControl installs the socket control function combining the one
+// set by SetSocketControl with the TOS marking.
+func (t2s *Tun2Socks) updateSocketControl() {
+	control := t2s.userControl
+	if tos := t2s.tos; tos != 0 {
+		user := control
+		control = func(network, address string, c syscall.RawConn) error {
+			if user != nil {
+				if e := user(network, address, c); e != nil {
+					return e
+				}
+			}
+			var se error
+			e := c.Control(func(fd uintptr) {
+				se = setSockTOS(int(fd), network, tos)
+			})
+			if e != nil {
+				return e
+			}
+			return se
+		}
+	}
+	t2s.socketControl = control
+}
+
+func setSockTOS(fd int, network string, tos uint8) error {
+	if strings.HasSuffix(network, "6") {
+		return syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, int(tos))
+	}
+	return syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_TOS, int(tos))
+}
+
+// SetRelayBuffers sets the receive and send buffer sizes of the UDP relay
+// sockets, for high-throughput flows overflowing the defaults. 0 keeps the
+// OS default.
+func (t2s *Tun2Socks) SetRelayBuffers(rcvBuf, sndBuf int) {
+	t2s.relayRcvBuf = rcvBuf
+	t2s.relaySndBuf = sndBuf
+}
+
+// SetRelayReadBuffer sets the buffer each UDP flow reads relayed datagrams
+// into, capped at MAX_RELAY_READ_BUF (the default). Datagrams larger than the
+// buffer are clipped, so a smaller one only saves memory on flows known to
+// carry small datagrams. 0 restores the default.
+func (t2s *Tun2Socks) SetRelayReadBuffer(size int) {
+	if size <= 0 || size > MAX_RELAY_READ_BUF {
+		size = MAX_RELAY_READ_BUF
+	}
+	t2s.relayReadBuf = size
+}
+
+// SetRelayEgressIP binds the UDP relay sockets to ip, e.g. on a multi-homed
+// host to egress from a chosen address, instead of the local address of the
+// SOCKS connection. It only applies to flows whose SOCKS endpoint is of the
+// family of ip. nil restores the default.
+func (t2s *Tun2Socks) SetRelayEgressIP(ip net.IP) {
+	t2s.relayEgressIP = ip
+}
+
+// relayBindIP returns the address to bind a UDP relay socket to, given the
+// local address of its SOCKS connection.
+func (t2s *Tun2Socks) relayBindIP(socksIP net.IP) net.IP {
+	egress := t2s.relayEgressIP
+	if egress == nil {
+		return socksIP
+	}
+	if (egress.To4() == nil) != (socksIP.To4() == nil) {
+		log.Printf("relay egress IP %s not of the family of %s", egress, socksIP)
+		return socksIP
+	}
+	return egress
+}
+
+func (t2s *Tun2Socks) listenUDP(laddr *net.UDPAddr) (*net.UDPConn, error) {
+	var conn *net.UDPConn
+	if t2s.socketControl == nil {
+		var e error
+		conn, e = net.ListenUDP("udp", laddr)
+		if e != nil {
+			return nil, e
+		}
+	} else {
+		lc := &net.ListenConfig{Control: t2s.socketControl}
+		c, e := lc.ListenPacket(context.Background(), "udp", laddr.String())
+		if e != nil {
+			return nil, e
+		}
+		conn = c.(*net.UDPConn)
+	}
+	if t2s.relayRcvBuf > 0 {
+		if e := conn.SetReadBuffer(t2s.relayRcvBuf); e != nil {
+			log.Printf("fail to set relay receive buffer: %s", e)
+		}
+		checkSockBuf(conn, syscall.SO_RCVBUF, t2s.relayRcvBuf)
+	}
+	if t2s.relaySndBuf > 0 {
+		if e := conn.SetWriteBuffer(t2s.relaySndBuf); e != nil {
+			log.Printf("fail to set relay send buffer: %s", e)
+		}
+		checkSockBuf(conn, syscall.SO_SNDBUF, t2s.relaySndBuf)
+	}
+	return conn, nil
+}
+
+// checkSockBuf logs if the kernel granted less than size for the buffer opt,
+// e.g. because of net.core.rmem_max.
+func checkSockBuf(conn *net.UDPConn, opt int, size int) {
+	raw, e := conn.SyscallConn()
+	if e != nil {
+		return
+	}
+	var got int
+	raw.Control(func(fd uintptr) {
+		got, e = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, opt)
+	})
+	// Linux reports twice the size set, to account for bookkeeping
+	if e == nil && got/2 < size {
+		log.Printf("socket buffer clamped by the kernel: %d requested, %d granted", size, got/2)
+	}
+}
+
+// SetMaxUDPResponseSize caps the size of relayed UDP responses against
+// amplification. Larger responses are dropped, DNS responses are replaced by
+// an empty truncated (TC) one instead. 0 disables the cap.
+func (t2s *Tun2Socks) SetMaxUDPResponseSize(size int) {
+	t2s.maxUDPResponseSize = size
+}
+
+// SetMaxFragments caps the number of IP packets a UDP response is sent as
+// to the tun, fragments included. Responses needing more are dropped, DNS
+// responses are replaced by an empty truncated (TC) one instead. 0 disables
+// the cap.
+func (t2s *Tun2Socks) SetMaxFragments(max int) {
+	t2s.maxFragments = max
+}
+
+// SetNoFragment sets the destinations, e.g. peers known to be broken by
+// fragments, whose UDP responses are never fragmented: DNS responses too
+// large for one packet are replaced by an empty truncated (TC) one, others
+// are dropped and the client sent an ICMP fragmentation needed. nil restores
+// fragmenting to all destinations.
+func (t2s *Tun2Socks) SetNoFragment(nets []*net.IPNet) {
+	t2s.noFragNets = append([]*net.IPNet(nil), nets...)
+}
+
+// SetSourceValidation enables dropping packets read from tun whose source
+// address is outside the device subnet. Devices provide their subnet through
+// a Subnet() *net.IPNet method, as the devices of package tun do; packets of
+// other devices aren't validated.
+func (t2s *Tun2Socks) SetSourceValidation(enabled bool) {
+	t2s.srcValidation = enabled
+}
+
+// SetFlowErrorHandler sets a function called whenever a flow fails to be
+// relayed, e.g. because the dial failed.
+func (t2s *Tun2Socks) SetFlowErrorHandler(handler func(*FlowError)) {
+	t2s.flowErrorHandler = handler
+}
+
+// SetRelayBindHandler sets a function called with the local address of each
+// relay socket before any traffic flows through it, e.g. to open firewall
+// pinholes. proto is "tcp" for relayed TCP connections and "udp" for the UDP
+// sockets of relayed UDP flows.
+func (t2s *Tun2Socks) SetRelayBindHandler(handler func(proto string, local net.Addr)) {
+	t2s.relayBindHandler = handler
+}
+
+func (t2s *Tun2Socks) relayBound(proto string, local net.Addr) {
+	if t2s.relayBindHandler != nil {
+		t2s.relayBindHandler(proto, local)
+	}
+}
+
+// SetConnCloseHandler sets a function called whenever a UDP flow is closed,
+// with the flow id and why it was closed.
+func (t2s *Tun2Socks) SetConnCloseHandler(handler func(id string, reason CloseReason)) {
+	t2s.connCloseHandler = handler
+}
+
+// SetICMPUnreachable enables answering UDP flows that fail to be relayed with
+// an ICMP destination unreachable, so the app fails fast instead of timing out.
+func (t2s *Tun2Socks) SetICMPUnreachable(enabled bool) {
+	t2s.icmpUnreachable = enabled
+}
+
+// SetICMPOnClose makes established UDP flows closed by CloseFlows (policy),
+// or by their idle timeout (idle), answer the last packet of the app with an
+// ICMP port unreachable, so apps retransmitting into a dropped flow give up.
+// Both are off by default; unlike TCP's RST, the app may not expect it after
+// a long silence.
+func (t2s *Tun2Socks) SetICMPOnClose(policy bool, idle bool) {
+	t2s.icmpOnPolicyClose = policy
+	t2s.icmpOnIdleClose = idle
+}
+
+func (t2s *Tun2Socks) flowError(proto string, srcIP net.IP, srcPort uint16, dstIP net.IP, dstPort uint16, e error) {
+	fe := &FlowError{
+		Proto:   proto,
+		SrcIP:   srcIP,
+		SrcPort: srcPort,
+		DstIP:   dstIP,
+		DstPort: dstPort,
+		Err:     e,
+	}
+	log.Printf("flow error: %s", fe)
+	if t2s.flowErrorHandler != nil {
+		t2s.flowErrorHandler(fe)
+	}
+}
+
 func (t2s *Tun2Socks) Stop() {
-	t2s.writerStopCh <- true
-	t2s.dev.Close()
+	// set first, so readers take their closed device for a stop
+	if !atomic.CompareAndSwapInt32(&t2s.stopped, 0, 1) {
+		return
+	}
+	for _, dev := range t2s.devs {
+		t2s.writerStopCh <- true
+		dev.rwc.Close()
+	}
+	t2s.closeDNSHooks()
+	t2s.closeDNSStoreQueue()
 
 	t2s.tcpConnTrackLock.Lock()
-	defer t2s.tcpConnTrackLock.Unlock()
 	for _, tcpTrack := range t2s.tcpConnTrackMap {
-		tcpTrack.destroyed = true
+		atomic.StoreInt32(&tcpTrack.destroyed, 1)
 		if tcpTrack.socksConn != nil {
 			tcpTrack.socksConn.Close()
 		}
 		close(tcpTrack.quitByOther)
 	}
+	t2s.tcpConnTrackLock.Unlock()
 
 	t2s.udpConnTrackLock.Lock()
-	defer t2s.udpConnTrackLock.Unlock()
 	for _, udpTrack := range t2s.udpConnTrackMap {
-		close(udpTrack.quitByOther)
+		udpTrack.quit(CLOSE_EXTERNAL_QUIT)
 	}
-	t2s.stopped = true
+	t2s.udpConnTrackLock.Unlock()
 	t2s.wg.Wait()
 	log.Print("Stop")
 }
 
 func (t2s *Tun2Socks) Run() {
-	// writer
-	go func() {
-		t2s.wg.Add(1)
-		defer t2s.wg.Done()
-		for {
-			select {
-			case pkt := <-t2s.writeCh:
-				switch pkt.(type) {
-				case *tcpPacket:
-					tcp := pkt.(*tcpPacket)
-					t2s.dev.Write(tcp.wire)
-					releaseTCPPacket(tcp)
-				case *udpPacket:
-					udp := pkt.(*udpPacket)
-					t2s.dev.Write(udp.wire)
-					releaseUDPPacket(udp)
-				case *ipPacket:
-					ip := pkt.(*ipPacket)
-					t2s.dev.Write(ip.wire)
-					releaseIPPacket(ip)
-				}
-			case <-t2s.writerStopCh:
-				log.Printf("quit tun2socks writer")
-				return
-			}
-		}
-	}()
+	t2s.start()
+	for _, dev := range t2s.devs[1:] {
+		go t2s.reader(dev)
+	}
+	t2s.reader(t2s.devs[0])
+}
 
-	// reader
-	var buf [MTU]byte
-	var ip packet.IPv4
-	var tcp packet.TCP
-	var udp packet.UDP
+// Serve attaches dev, unless it is nil or already attached, and relays the
+// traffic of all devices in the foreground, e.g. under errgroup supervision.
+// It returns nil once Stop is called, or the error of the first device that
+// fails to be read (io.EOF once it's closed from the other end), stopping
+// the Tun2Socks.
+func (t2s *Tun2Socks) Serve(dev io.ReadWriteCloser) error {
+	if dev != nil && !t2s.attached(dev) {
+		t2s.AddDevice(dev)
+	}
+	t2s.start()
+	errCh := make(chan error, len(t2s.devs))
+	for _, d := range t2s.devs {
+		go func(d *tunDevice) {
+			errCh <- t2s.reader(d)
+		}(d)
+	}
+	e := <-errCh
+	if e != nil {
+		t2s.Stop()
+	}
+	return e
+}
+
+// Ready returns a channel closed once the reader and writer of every device
+// run, e.g. for tests and setups to start sending traffic only then.
+// Configuring the tun device itself is up to the caller.
+func (t2s *Tun2Socks) Ready() <-chan struct{} {
+	return t2s.ready
+}
+
+// loopUp counts a reader or writer loop as started.
+func (t2s *Tun2Socks) loopUp() {
+	if atomic.AddInt32(&t2s.loopsDown, -1) == 0 {
+		close(t2s.ready)
+	}
+}
+
+// start starts the writers of all devices and the housekeeping worker.
+func (t2s *Tun2Socks) start() {
+	atomic.StoreInt32(&t2s.loopsDown, int32(2*len(t2s.devs)))
+	for _, dev := range t2s.devs {
+		go t2s.writer(dev)
+	}
+	go t2s.resolveProxies()
 
 	//worker
 	go func() {
 		for {
-			if t2s.stopped {
+			if atomic.LoadInt32(&t2s.stopped) != 0 {
 				break
 			}
 
 			time.Sleep(5000 * time.Millisecond)
+			t2s.reapStuckUDPTracks()
+			t2s.refreshPinnedDNS()
+			t2s.refreshProxyAddrs()
+			if t2s.cache != nil {
+				t2s.cache.expireFlights()
+				t2s.cache.expireReverse()
+			}
 			log.Printf("Conn size tcp %d udp %d, routines %d", len(t2s.tcpConnTrackMap), len(t2s.udpConnTrackMap), runtime.NumGoroutine())
 		}
 		log.Printf("Worker exit")
 	}()
+}
+
+func (t2s *Tun2Socks) writer(dev *tunDevice) {
+	t2s.wg.Add(1)
+	defer t2s.wg.Done()
+	t2s.loopUp()
+	for {
+		select {
+		case pkt := <-dev.writeCh:
+			emitted := t2s.emitted
+			switch pkt.(type) {
+			case *tcpPacket:
+				tcp := pkt.(*tcpPacket)
+				if emitted != nil {
+					emitted.add(tcp.wire)
+				}
+				t2s.writeTun(dev, tcp.wire)
+				releaseTCPPacket(tcp)
+			case *udpPacket:
+				udp := pkt.(*udpPacket)
+				if emitted != nil {
+					emitted.add(udp.wire)
+				}
+				t2s.writeTun(dev, udp.wire)
+				releaseUDPPacket(udp)
+			case *ipPacket:
+				ip := pkt.(*ipPacket)
+				if emitted != nil {
+					emitted.add(ip.wire)
+				}
+				t2s.writeTun(dev, ip.wire)
+				releaseIPPacket(ip)
+			}
+		case <-t2s.writerStopCh:
+			log.Printf("quit tun2socks writer")
+			return
+		}
+	}
+}
+
+// dispatchable reports by the version nibble whether the packet read from
+// tun can be handled, counting it as dropped otherwise, rather than have
+// anything not IPv4 misparsed as IPv4.
+func (t2s *Tun2Socks) dispatchable(data []byte) bool {
+	switch data[0] >> 4 {
+	case 4:
+		return true
+	case 6:
+		// IPv6 isn't handled yet
+		atomic.AddUint64(&t2s.stats.IPv6Dropped, 1)
+	default:
+		log.Printf("drop packet of unknown IP version %d", data[0]>>4)
+		atomic.AddUint64(&t2s.stats.BadIPVersion, 1)
+	}
+	return false
+}
+
+// SetZeroReadBackoff sets the longest the reader of a device waits before
+// reading again after a read returned nothing without an error. Waits start
+// at a millisecond and double on every empty read in a row. Any read once
+// Stop is called, e.g. of a stop marker, quits the reader at once instead.
+func (t2s *Tun2Socks) SetZeroReadBackoff(max time.Duration) {
+	if max <= 0 {
+		max = ZERO_READ_BACKOFF
+	}
+	t2s.zeroReadBackoff = max
+}
+
+// zeroReadDelay returns the wait after an empty read following one of
+// last.
+func (t2s *Tun2Socks) zeroReadDelay(last time.Duration) time.Duration {
+	d := 2 * last
+	if d < time.Millisecond {
+		d = time.Millisecond
+	}
+	if d > t2s.zeroReadBackoff {
+		d = t2s.zeroReadBackoff
+	}
+	return d
+}
+
+// reader dispatches the packets read from dev until the Tun2Socks is stopped,
+// returning nil, or dev fails to be read, returning the error.
+func (t2s *Tun2Socks) reader(dev *tunDevice) error {
+	var ip packet.IPv4
+	var tcp packet.TCP
+	var udp packet.UDP
 
 	t2s.wg.Add(1)
 	defer t2s.wg.Done()
+	defer dev.releaseReadBuf()
+	t2s.loopUp()
+	var backoff time.Duration
 	for {
-		n, e := t2s.dev.Read(buf[:])
+		// packets are read into pooled buffers, which the packets copied
+		// for tracks take over rather than copy
+		if dev.readBuf == nil {
+			dev.readBuf = newBuffer()
+		}
+		n, e := dev.rwc.Read(dev.readBuf)
 
-		if t2s.stopped {
+		if atomic.LoadInt32(&t2s.stopped) != 0 {
 			log.Printf("quit tun2socks reader")
-			return
+			return nil
 		}
 
-		if n == 0 {
-			time.Sleep(10 * time.Millisecond)
+		if e == io.EOF {
+			log.Printf("tun device closed")
+			return e
+		}
+		if n == 0 && e == nil {
+			// nothing read, but not closed either: back off rather than
+			// spin until the device delivers again
+			backoff = t2s.zeroReadDelay(backoff)
+			time.Sleep(backoff)
 			continue
 		}
+		backoff = 0
 		if e != nil {
 			// TODO: stop at critical error
 			log.Printf("read packet error: %s", e)
-			return
+			return e
 		}
 
-		data := buf[:n]
+		data := dev.readBuf[:n]
+		if emitted := t2s.emitted; emitted != nil && emitted.contains(data) {
+			log.Printf("drop packet looped back into tun")
+			atomic.AddUint64(&t2s.stats.LoopDetected, 1)
+			continue
+		}
+		if !t2s.dispatchable(data) {
+			continue
+		}
 		e = packet.ParseIPv4(data, &ip)
 		if e != nil {
 			log.Printf("error to parse IPv4: %s", e)
 			continue
 		}
+		if t2s.srcValidation && dev.subnet != nil && !dev.subnet.Contains(ip.SrcIP) {
+			log.Printf("drop packet with spoofed source %s", ip.SrcIP)
+			atomic.AddUint64(&t2s.stats.SpoofedDropped, 1)
+			continue
+		}
 
 		if ip.Flags&0x1 != 0 || ip.FragOffset != 0 {
 			last, pkt, raw := procFragment(&ip, data)
@@ -231,6 +958,9 @@ func (t2s *Tun2Socks) Run() {
 				continue
 			}
 		}
+		if t2s.expired(dev, data, &ip) || t2s.droppedProto(dev, data, &ip) {
+			continue
+		}
 
 		switch ip.Protocol {
 		case packet.IPProtocolTCP:
@@ -239,15 +969,22 @@ func (t2s *Tun2Socks) Run() {
 				log.Printf("error to parse TCP: %s", e)
 				continue
 			}
-			t2s.tcp(data, &ip, &tcp)
+			t2s.tcp(dev, data, &ip, &tcp)
 
 		case packet.IPProtocolUDP:
-			e = packet.ParseUDP(ip.Payload, &udp)
+			segment, ok := udpSegment(&ip, data)
+			if !ok {
+				log.Printf("drop truncated UDP packet: %d of %d bytes", len(data), ip.Length)
+				atomic.AddUint64(&t2s.stats.UDPMalformed, 1)
+				continue
+			}
+			e = packet.ParseUDP(segment, &udp)
 			if e != nil {
 				log.Printf("error to parse UDP: %s", e)
+				atomic.AddUint64(&t2s.stats.UDPMalformed, 1)
 				continue
 			}
-			t2s.udp(data, &ip, &udp)
+			t2s.udp(dev, data, &ip, &udp)
 
 		default:
 			// Unsupported packets
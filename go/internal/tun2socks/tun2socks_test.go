@@ -0,0 +1,212 @@
+package tun2socks
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dkwiebe/gotun2socks/internal/tun"
+)
+
+func TestServeReturns(t *testing.T) {
+	for _, eof := range []bool{true, false} {
+		t2s, p := NewTun2SocksWithPipe()
+		done := make(chan error, 1)
+		go func() { done <- t2s.Serve(nil) }()
+		select {
+		case <-t2s.Ready():
+		case <-time.After(5 * time.Second):
+			t.Fatal("tunnel not ready")
+		}
+
+		want := error(nil)
+		if eof {
+			// the device reports EOF, as when closed from the other end
+			p.Close()
+			want = io.EOF
+		} else {
+			t2s.Stop()
+		}
+		select {
+		case e := <-done:
+			if e != want {
+				t.Fatalf("Serve returned %v, want %v", e, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Serve still running")
+		}
+		if atomic.LoadInt32(&t2s.stopped) == 0 {
+			t.Fatal("Serve returned without stopping")
+		}
+		// a second Stop does nothing
+		t2s.Stop()
+	}
+}
+
+func TestDropNonIPv4Packets(t *testing.T) {
+	s := newStubSocks(t, echoUDP)
+	t2s, p := NewTun2SocksWithPipe()
+	s.route(t2s)
+	serve(t, t2s)
+
+	// an IPv6 UDP datagram, fe80::1 -> fe80::2, would misparse as IPv4
+	v6 := make([]byte, 48)
+	v6[0] = 0x60
+	v6[5], v6[6], v6[7] = 8, 17, 64
+	v6[8], v6[9], v6[23] = 0xfe, 0x80, 1
+	v6[24], v6[25], v6[39] = 0xfe, 0x80, 2
+	p.Inject(v6)
+	waitFor(t, "IPv6 packet counted", func() bool { return t2s.Stats().IPv6Dropped == 1 })
+
+	garbage := []byte{0x50, 0, 0, 28, 0, 0, 0, 0, 64, 17, 0, 0, 10, 0, 0, 2, 192, 0, 2, 1, 0, 1, 0, 9, 0, 8, 0, 0}
+	p.Inject(garbage)
+	waitFor(t, "bad version counted", func() bool { return t2s.Stats().BadIPVersion == 1 })
+	noPacket(t, p, 50*time.Millisecond)
+
+	// IPv4 goes on being handled
+	p.Inject(udpIPv4(clientIP, 5000, net.IP{192, 0, 2, 1}, 9, []byte("v4")))
+	if _, udp := nextUDP(t, p); string(udp.Payload) != "v4" {
+		t.Fatalf("echoed %q", udp.Payload)
+	}
+	if st := t2s.Stats(); st.IPv6Dropped != 1 || st.BadIPVersion != 1 {
+		t.Fatalf("counted %d IPv6, %d bad version packets, want 1 each", st.IPv6Dropped, st.BadIPVersion)
+	}
+}
+
+// emptyTun is a memory tun whose reads return nothing, without an error,
+// while empty is set.
+type emptyTun struct {
+	*tun.MemoryTun
+	empty int32
+	reads int32
+}
+
+func (d *emptyTun) Read(b []byte) (int, error) {
+	atomic.AddInt32(&d.reads, 1)
+	if atomic.LoadInt32(&d.empty) != 0 {
+		return 0, nil
+	}
+	return d.MemoryTun.Read(b)
+}
+
+func TestZeroReadsBackOff(t *testing.T) {
+	s := newStubSocks(t, echoUDP)
+	p := &emptyTun{MemoryTun: tun.NewMemoryTun(), empty: 1}
+	t2s := New(p, false)
+	s.route(t2s)
+	t2s.SetZeroReadBackoff(10 * time.Millisecond)
+	serve(t, t2s)
+
+	// waits of 1, 2, 4, 8ms and then 10ms make for about 25 reads in 200ms,
+	// where spinning would make millions
+	time.Sleep(200 * time.Millisecond)
+	if n := atomic.LoadInt32(&p.reads); n > 50 {
+		t.Fatalf("%d empty reads in 200ms", n)
+	}
+
+	atomic.StoreInt32(&p.empty, 0)
+	p.Inject(udpIPv4(clientIP, 5000, net.IP{192, 0, 2, 1}, 9, []byte("ping")))
+	if _, udp := nextUDP(t, p.MemoryTun); string(udp.Payload) != "ping" {
+		t.Fatalf("echoed %q", udp.Payload)
+	}
+}
+
+func TestReadyOnceLoopsRun(t *testing.T) {
+	s := newStubSocks(t, echoUDP)
+	t2s, p := NewTun2SocksWithPipe()
+	second := tun.NewMemoryTun()
+	t2s.AddDevice(second)
+	s.route(t2s)
+	select {
+	case <-t2s.Ready():
+		t.Fatal("ready before serving")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	serve(t, t2s)
+	// traffic right away, on every device
+	for _, dev := range []*tun.MemoryTun{p, second} {
+		dev.Inject(udpIPv4(clientIP, 5000, net.IP{192, 0, 2, 1}, 9, []byte("ping")))
+		if _, udp := nextUDP(t, dev); string(udp.Payload) != "ping" {
+			t.Fatalf("echoed %q", udp.Payload)
+		}
+	}
+}
+
+// slowSocks accepts connections on loopback but never answers, stalling the
+// SOCKS handshake until the dialer gives up.
+func slowSocks(tb testing.TB) string {
+	ln, e := net.Listen("tcp4", "127.0.0.1:0")
+	if e != nil {
+		tb.Fatal(e)
+	}
+	tb.Cleanup(func() { ln.Close() })
+	go func() {
+		var conns []net.Conn
+		for {
+			c, e := ln.Accept()
+			if e != nil {
+				break
+			}
+			conns = append(conns, c)
+		}
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestSocksConnectTimeoutPerInstance(t *testing.T) {
+	addr := slowSocks(t)
+	fast, slow := New(nil, false), New(nil, false)
+	fast.SetSocksConnectTimeout(100 * time.Millisecond)
+	slow.SetSocksConnectTimeout(time.Second)
+	proxy := &ProxyServer{ProxyType: PROXY_TYPE_SOCKS, IpAddress: addr}
+
+	dial := func(t2s *Tun2Socks) chan time.Duration {
+		done := make(chan time.Duration, 1)
+		start := time.Now()
+		go func() {
+			if c, e := t2s.dialLocalSocks(proxy); e == nil {
+				c.Close()
+				t.Error("handshake with a silent proxy succeeded")
+			}
+			done <- time.Since(start)
+		}()
+		return done
+	}
+	fastDone, slowDone := dial(fast), dial(slow)
+	select {
+	case d := <-fastDone:
+		if d < 100*time.Millisecond {
+			t.Fatalf("dial gave up after %s, before its timeout", d)
+		}
+	case <-time.After(900 * time.Millisecond):
+		t.Fatal("dial outlasted its 100ms timeout")
+	}
+	select {
+	case d := <-slowDone:
+		if d < time.Second {
+			t.Fatalf("dial of the other instance gave up after %s, before its timeout", d)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("dial outlasted its 1s timeout")
+	}
+
+	// bypassing dials are given the timeout too
+	c, e := fast.dialTransaprent(addr)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer c.Close()
+	if c.Timeout != 100*time.Millisecond {
+		t.Fatalf("direct dial timeout %s, want 100ms", c.Timeout)
+	}
+	fast.SetSocksConnectTimeout(0)
+	if fast.connectTimeout != SOCKS_CONNECT_TIMEOUT {
+		t.Fatalf("timeout %s after reset, want %s", fast.connectTimeout, SOCKS_CONNECT_TIMEOUT)
+	}
+}
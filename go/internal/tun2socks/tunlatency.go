@@ -0,0 +1,75 @@
+package tun2socks
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// upper bounds of the buckets of tun write latencies
+var tunLatencyBounds = []time.Duration{
+	10 * time.Microsecond,
+	100 * time.Microsecond,
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+}
+
+// LatencyHistogram counts calls by duration: Counts[i] are those that took up
+// to Bounds[i] and above the bound before, the last count those above all
+// bounds. Sum is their total duration.
+type LatencyHistogram struct {
+	Bounds []time.Duration
+	Counts []uint64
+	Sum    time.Duration
+}
+
+// tunLatency holds the latencies of the tun writes of all devices.
+type tunLatency struct {
+	counts [6]uint64 // len(tunLatencyBounds)+1
+	sum    int64
+}
+
+func (h *tunLatency) observe(d time.Duration) {
+	i := 0
+	for i < len(tunLatencyBounds) && d > tunLatencyBounds[i] {
+		i++
+	}
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddInt64(&h.sum, int64(d))
+}
+
+func (h *tunLatency) snapshot() LatencyHistogram {
+	counts := make([]uint64, len(h.counts))
+	for i := range h.counts {
+		counts[i] = atomic.LoadUint64(&h.counts[i])
+	}
+	return LatencyHistogram{
+		Bounds: tunLatencyBounds,
+		Counts: counts,
+		Sum:    time.Duration(atomic.LoadInt64(&h.sum)),
+	}
+}
+
+// SetTunLatency sets whether the duration of every write of the tun devices
+// is recorded, into the TunWrite histogram of Stats, e.g. to tell a slow tun
+// device from a slow relay. Reads aren't, as they mostly wait for the next
+// packet. Off by default, which costs nothing.
+func (t2s *Tun2Socks) SetTunLatency(enabled bool) {
+	if !enabled {
+		t2s.tunLatency.Store(nil)
+		return
+	}
+	t2s.tunLatency.CompareAndSwap(nil, &tunLatency{})
+}
+
+// writeTun writes the packet wire to dev.
+func (t2s *Tun2Socks) writeTun(dev *tunDevice, wire []byte) {
+	lat := t2s.tunLatency.Load()
+	if lat == nil {
+		dev.rwc.Write(wire)
+		return
+	}
+	start := time.Now()
+	dev.rwc.Write(wire)
+	lat.observe(time.Since(start))
+}
@@ -0,0 +1,55 @@
+package tun2socks
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dkwiebe/gotun2socks/internal/tun"
+)
+
+// slowTun is a memory tun taking delay over every write.
+type slowTun struct {
+	*tun.MemoryTun
+	delay time.Duration
+}
+
+func (d *slowTun) Write(b []byte) (int, error) {
+	time.Sleep(d.delay)
+	return d.MemoryTun.Write(b)
+}
+
+func TestTunLatencyRecordsSlowWrites(t *testing.T) {
+	s := newStubSocks(t, echoUDP)
+	p := tun.NewMemoryTun()
+	t2s := New(&slowTun{p, 20 * time.Millisecond}, false)
+	s.route(t2s)
+	t2s.SetTunLatency(true)
+	serve(t, t2s)
+
+	for i := 0; i < 3; i++ {
+		p.Inject(udpIPv4(clientIP, 5000, net.IP{192, 0, 2, 1}, 9, []byte("ping")))
+		nextUDP(t, p)
+	}
+	// the last write is recorded once it returns
+	waitFor(t, "writes recorded", func() bool {
+		var n uint64
+		for _, c := range t2s.Stats().TunWrite.Counts {
+			n += c
+		}
+		return n == 3
+	})
+	w := t2s.Stats().TunWrite
+	// none under the 10ms bound
+	if w.Counts[0]+w.Counts[1]+w.Counts[2]+w.Counts[3] != 0 || w.Sum < 60*time.Millisecond {
+		t.Fatalf("write latencies %v summing to %s, want 3 over 10ms", w.Counts, w.Sum)
+	}
+	if len(w.Bounds) != len(w.Counts)-1 {
+		t.Fatalf("%d bounds for %d counts", len(w.Bounds), len(w.Counts))
+	}
+
+	t2s.SetTunLatency(false)
+	if stats := t2s.Stats(); stats.TunWrite.Counts != nil {
+		t.Fatal("latencies reported while off")
+	}
+}
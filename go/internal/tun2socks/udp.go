@@ -4,12 +4,12 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/miekg/dns"
-
 	"github.com/dkwiebe/gotun2socks/internal/gosocks"
 	"github.com/dkwiebe/gotun2socks/internal/packet"
 )
@@ -19,36 +19,137 @@ type udpPacket struct {
 	udp    *packet.UDP
 	mtuBuf []byte
 	wire   []byte
+	// when the rate limit lets it be relayed
+	sendAt time.Time
 }
 
 type udpConnTrack struct {
+	// UnixNano of the last relay loop iteration, first for 64-bit alignment
+	activity int64
+
 	t2s *Tun2Socks
 	id  string
+	// key in udpConnTrackMap, differs from id once a QUIC flow migrated;
+	// guarded by udpConnTrackLock like quicCIDs
+	key      string
+	quicCIDs []string
+	// source port of the client, responses are sent to
+	replyPort uint32
 
 	toTunCh     chan<- interface{}
 	quitBySelf  chan bool
 	quitByOther chan bool
+	// CloseReason quitByOther is closed for, stored by quit
+	quitBy int32
+	// held while a packet from tun is queued; closing, set under it, is
+	// set once a DNS session ended, which takes no more packets from tun
+	sendLock sync.Mutex
+	closing  int32
 
 	fromTunCh   chan *udpPacket
 	socksClosed chan bool
 
 	socksConn *gosocks.SocksConn
+	// SOCKS proxy picked by the router, empty to bypass
+	socksAddr string
+	// name the relay is sent for remoteIP, if SetSocksRemoteDNS found one
+	remoteName string
 
 	localIP    net.IP
 	remoteIP   net.IP
 	localPort  uint16
 	remotePort uint16
+
+	// smoothed packet inter-arrival time, drives the idle timeout
+	lastPacketTime time.Time
+	interval       time.Duration
+
+	// IP and UDP header of the last packet from tun, quoted by the ICMP sent
+	// on close or for a response that must not be fragmented
+	quote []byte
+	// sum of the last datagram from tun, if the MTU is adaptive
+	lastSum uint64
+	// TOS of the last datagram from tun, whose ECN field responses echo
+	ecn uint8
+	// set if DebugFlow matched the flow
+	debug bool
+
+	// rate limits towards the relay and towards tun, nil if unlimited
+	sendLimit *tokenBucket
+	recvLimit *tokenBucket
+
+	counters flowCounters
+}
+
+const (
+	// largest payload a UDP datagram over IPv4 can carry
+	MAX_UDP_PAYLOAD = 65535 - 20 - 8
+
+	UDP_IDLE_TIMEOUT = 2 * time.Minute
+	DNS_IDLE_TIMEOUT = 10 * time.Second
+
+	// idle timeout is this many smoothed inter-arrival times
+	udpIdleFactor = 8
+)
+
+// CloseReason tells why a UDP flow was closed.
+type CloseReason int
+
+const (
+	// a DNS session got the responses to all its queries
+	CLOSE_DNS_SINGLE_RESPONSE CloseReason = iota
+	CLOSE_IDLE_TIMEOUT
+	// the relay closed the SOCKS connection or its UDP socket
+	CLOSE_RELAY_CLOSED
+	CLOSE_RELAY_WRITE_ERROR
+	// Tun2Socks was stopped, or the track was quit from outside for no
+	// other reason
+	CLOSE_EXTERNAL_QUIT
+	// the relay could not be connected or set up
+	CLOSE_DIAL_FAILED
+	// closed by CloseFlows
+	CLOSE_POLICY
+	// reaped by the watchdog set by SetStuckTrackWatchdog
+	CLOSE_STUCK
+	// open for longer than SetMaxFlowLifetime allows
+	CLOSE_MAX_LIFETIME
+)
+
+func (r CloseReason) String() string {
+	switch r {
+	case CLOSE_DNS_SINGLE_RESPONSE:
+		return "DNS response"
+	case CLOSE_IDLE_TIMEOUT:
+		return "idle timeout"
+	case CLOSE_RELAY_CLOSED:
+		return "relay closed"
+	case CLOSE_RELAY_WRITE_ERROR:
+		return "relay write error"
+	case CLOSE_EXTERNAL_QUIT:
+		return "stopped"
+	case CLOSE_DIAL_FAILED:
+		return "dial failed"
+	case CLOSE_POLICY:
+		return "closed by policy"
+	case CLOSE_STUCK:
+		return "stuck"
+	case CLOSE_MAX_LIFETIME:
+		return "max lifetime"
+	}
+	return fmt.Sprintf("CloseReason(%d)", int(r))
 }
 
 var (
 	udpPacketPool = &sync.Pool{
 		New: func() interface{} {
+			atomic.AddUint64(&poolStats.UDPPacketMisses, 1)
 			return &udpPacket{}
 		},
 	}
 )
 
 func newUDPPacket() *udpPacket {
+	atomic.AddUint64(&poolStats.UDPPacketGets, 1)
 	return udpPacketPool.Get().(*udpPacket)
 }
 
@@ -60,44 +161,107 @@ func releaseUDPPacket(pkt *udpPacket) {
 	}
 	pkt.mtuBuf = nil
 	pkt.wire = nil
+	pkt.sendAt = time.Time{}
+	atomic.AddUint64(&poolStats.UDPPacketPuts, 1)
 	udpPacketPool.Put(pkt)
 }
 
 func udpConnID(ip *packet.IPv4, udp *packet.UDP) string {
+	return connID(ip.SrcIP, udp.SrcPort, ip.DstIP, udp.DstPort)
+}
+
+// connID keys a flow by its endpoints. net.IP.String prints an IPv4 address
+// the same whether held in 4 or 16 bytes, so a flow maps to one key however
+// its addresses are encoded.
+func connID(src net.IP, sport uint16, dst net.IP, dport uint16) string {
 	return strings.Join([]string{
-		ip.SrcIP.String(),
-		fmt.Sprintf("%d", udp.SrcPort),
-		ip.DstIP.String(),
-		fmt.Sprintf("%d", udp.DstPort),
+		src.String(),
+		strconv.Itoa(int(sport)),
+		dst.String(),
+		strconv.Itoa(int(dport)),
 	}, "|")
 }
 
-func copyUDPPacket(raw []byte, ip *packet.IPv4, udp *packet.UDP) *udpPacket {
+// udpSegment returns the UDP datagram carried by ip, read as raw: its IP
+// payload up to the total length the IP header claims, so that the UDP
+// length is checked against the bytes of the datagram rather than whatever
+// trails it. It reports false if fewer bytes than claimed were read.
+// Reassembled datagrams are taken whole, their header being the first
+// fragment's.
+func udpSegment(ip *packet.IPv4, raw []byte) ([]byte, bool) {
+	if ip.Flags&0x1 != 0 || ip.FragOffset != 0 {
+		return ip.Payload, true
+	}
+	if int(ip.Length) > len(raw) {
+		return nil, false
+	}
+	return ip.Payload[:int(ip.Length)-int(ip.IHL)*4], true
+}
+
+// copyUDPPacket copies the packet raw, parsed into ip and udp. readBuf, if not
+// nil, is the pooled buffer raw was read into, which the copy takes over.
+func copyUDPPacket(raw []byte, readBuf []byte, ip *packet.IPv4, udp *packet.UDP) *udpPacket {
 	iphdr := packet.NewIPv4()
 	udphdr := packet.NewUDP()
 	pkt := newUDPPacket()
 
-	// make a deep copy
+	// take over the read buffer or make a deep copy
 	var buf []byte
-	if len(raw) <= MTU {
-		buf = newBuffer()
+	var n int
+	if readBuf != nil {
+		buf = readBuf
 		pkt.mtuBuf = buf
+		n = len(raw)
 	} else {
-		buf = make([]byte, len(raw))
+		if len(raw) <= MTU {
+			buf = newBuffer()
+			pkt.mtuBuf = buf
+		} else {
+			buf = make([]byte, len(raw))
+		}
+		n = copy(buf, raw)
 	}
-	n := copy(buf, raw)
 	pkt.wire = buf[:n]
-	packet.ParseIPv4(pkt.wire, iphdr)
-	packet.ParseUDP(iphdr.Payload, udphdr)
 	pkt.ip = iphdr
 	pkt.udp = udphdr
 
+	// ip and udp were parsed from raw, take them over and point their slices
+	// into the copy instead of parsing again
+	ihl := int(ip.IHL) * 4
+	if n < ihl+int(udp.Length) || udp.Length < 8 {
+		releaseUDPPacket(pkt)
+		return nil
+	}
+	*iphdr = *ip
+	iphdr.SrcIP = pkt.wire[12:16]
+	iphdr.DstIP = pkt.wire[16:20]
+	// options are not used past this point
+	iphdr.Options = nil
+	iphdr.Padding = nil
+	iphdr.Payload = pkt.wire[ihl:]
+	*udphdr = *udp
+	udphdr.Payload = nil
+	if udp.Length > 8 {
+		udphdr.Payload = iphdr.Payload[8:udp.Length]
+	}
+
 	return pkt
 }
 
-func responsePacket(local net.IP, remote net.IP, lPort uint16, rPort uint16, respPayload []byte) (*udpPacket, []*ipPacket) {
-	ipid := packet.IPID()
-
+// responsePacket builds a UDP response to the client, split into fragments if
+// need be. ecn is the ECN field of the packet it answers.
+func (t2s *Tun2Socks) responsePacket(local net.IP, remote net.IP, lPort uint16, rPort uint16, respPayload []byte, ipid uint16, ecn uint8) (*udpPacket, []*ipPacket) {
+	if len(respPayload) > MAX_UDP_PAYLOAD {
+		log.Printf("drop oversized UDP response: %d bytes", len(respPayload))
+		atomic.AddUint64(&t2s.stats.UDPOversized, 1)
+		return nil, nil
+	}
+	mtu := t2s.pathMTU(remote)
+	if t2s.overFragmentCap(remote, len(respPayload)) {
+		log.Printf("drop UDP response over fragment cap: %d bytes", len(respPayload))
+		atomic.AddUint64(&t2s.stats.UDPFragmentCapped, 1)
+		return nil, nil
+	}
 	ip := packet.NewIPv4()
 	udp := packet.NewUDP()
 
@@ -107,6 +271,7 @@ func responsePacket(local net.IP, remote net.IP, lPort uint16, rPort uint16, res
 	copy(ip.SrcIP, remote)
 	ip.DstIP = make(net.IP, len(local))
 	copy(ip.DstIP, local)
+	ip.TOS = t2s.responseTOS(ecn)
 	ip.TTL = 64
 	ip.Protocol = packet.IPProtocolUDP
 
@@ -121,17 +286,23 @@ func responsePacket(local net.IP, remote net.IP, lPort uint16, rPort uint16, res
 	pkt.mtuBuf = newBuffer()
 	payloadL := len(udp.Payload)
 	payloadStart := MTU - payloadL
-	// if payload too long, need fragment, only part of payload put to mtubuf[28:]
-	if payloadL > MTU-28 {
+	// if payload too long, need fragment, only the part of payload that fills
+	// the first fragment (udp header included) is put to mtubuf
+	fragSize := fragPayloadSize(mtu)
+	if payloadL > mtu-28 {
 		ip.Flags = 1
-		payloadStart = 28
+		payloadStart = MTU - (fragSize - 8)
 	}
 	udpHL := 8
 	udpStart := payloadStart - udpHL
-	pseduoStart := udpStart - packet.IPv4_PSEUDO_LENGTH
-	ip.PseudoHeader(pkt.mtuBuf[pseduoStart:udpStart], packet.IPProtocolUDP, udpHL+payloadL)
-	// udp length and checksum count on full payload
-	udp.Serialize(pkt.mtuBuf[udpStart:payloadStart], pkt.mtuBuf[pseduoStart:payloadStart], udp.Payload)
+	if t2s.noUDPChecksum {
+		udp.Serialize(pkt.mtuBuf[udpStart:payloadStart])
+	} else {
+		pseduoStart := udpStart - packet.IPv4_PSEUDO_LENGTH
+		ip.PseudoHeader(pkt.mtuBuf[pseduoStart:udpStart], packet.IPProtocolUDP, udpHL+payloadL)
+		// udp length and checksum count on full payload
+		udp.Serialize(pkt.mtuBuf[udpStart:payloadStart], pkt.mtuBuf[pseduoStart:payloadStart], udp.Payload)
+	}
 	if payloadL != 0 {
 		copy(pkt.mtuBuf[payloadStart:], udp.Payload)
 	}
@@ -145,90 +316,212 @@ func responsePacket(local net.IP, remote net.IP, lPort uint16, rPort uint16, res
 		return pkt, nil
 	}
 	// generate fragments
-	frags := genFragments(ip, (MTU-20)/8, respPayload[MTU-28:])
+	frags := genFragments(ip, uint16(fragSize/8), respPayload[fragSize-8:], mtu)
 	return pkt, frags
 }
 
-func (ut *udpConnTrack) send(data []byte) {
-	pkt, fragments := responsePacket(ut.localIP, ut.remoteIP, ut.localPort, ut.remotePort, data)
+func (ut *udpConnTrack) send(data []byte, ipid uint16) {
+	replyPort := uint16(atomic.LoadUint32(&ut.replyPort))
+	pkt, fragments := ut.t2s.responsePacket(ut.localIP, ut.remoteIP, replyPort, ut.remotePort, data, ipid, ut.ecn)
+	if pkt == nil {
+		return
+	}
+	ut.counters.in(len(data))
+	if ut.debug {
+		log.Printf("<-- [UDP][%s][payload:%d]", ut.id, len(data))
+	}
 	ut.toTunCh <- pkt
 	if fragments != nil {
+		ut.t2s.fragSent(ut.remoteIP, ut.lastSum)
 		for _, frag := range fragments {
 			ut.toTunCh <- frag
 		}
 	}
 }
 
-func (ut *udpConnTrack) run() {
-	// connect to socks
-	var e error
-	for i := 0; i < 2; i++ {
-		var remoteIpPort string
-		remoteIpPort = fmt.Sprintf("%s:%d", ut.remoteIP.String(), ut.remotePort)
-		ut.socksConn, e = dialTransaprent(remoteIpPort) //bypass udp
+// relayUDPRequest sends req through the relay, once to each of upstreams if
+// given, otherwise to its own destination.
+func relayUDPRequest(udpBind net.PacketConn, relayAddr net.Addr, req *gosocks.UDPRequest, upstreams []*net.UDPAddr) error {
+	if len(upstreams) == 0 {
+		_, e := udpBind.WriteTo(gosocks.PackUDPRequest(req), relayAddr)
+		return e
+	}
+	for _, upstream := range upstreams {
+		req.HostType, req.DstHost, req.DstPort = gosocks.NetAddrToSocksAddr(upstream)
+		_, e := udpBind.WriteTo(gosocks.PackUDPRequest(req), relayAddr)
 		if e != nil {
-			log.Printf("fail to connect remote ip: %s", e)
-		} else {
-			// need to finish handshake in 1 mins
-			ut.socksConn.SetDeadline(time.Now().Add(time.Minute * 1))
-			break
+			return e
+		}
+	}
+	return nil
+}
+
+// overResponseCap reports whether the response data from remote is over the
+// size cap or would be sent as more fragments than allowed, and counts it if
+// so.
+func (t2s *Tun2Socks) overResponseCap(remote net.IP, data []byte) bool {
+	if t2s.maxUDPResponseSize > 0 && len(data) > t2s.maxUDPResponseSize {
+		atomic.AddUint64(&t2s.stats.UDPResponseCapped, 1)
+		return true
+	}
+	if t2s.overFragmentCap(remote, len(data)) {
+		atomic.AddUint64(&t2s.stats.UDPFragmentCapped, 1)
+		return true
+	}
+	if t2s.noFragment(remote) && fragmentCount(len(data), t2s.pathMTU(remote)) > 1 {
+		atomic.AddUint64(&t2s.stats.UDPNoFragment, 1)
+		return true
+	}
+	return false
+}
+
+// noFragment reports whether responses from remote must not be fragmented.
+func (t2s *Tun2Socks) noFragment(remote net.IP) bool {
+	for _, n := range t2s.noFragNets {
+		if n.Contains(remote) {
+			return true
 		}
 	}
-	if ut.socksConn == nil {
-		close(ut.socksClosed)
-		close(ut.quitBySelf)
-		ut.t2s.clearUDPConnTrack(ut.id)
+	return false
+}
+
+// fitDNSResponse returns the DNS response data from remote as it is handed
+// to a client that advertised an EDNS UDP payload size of udpSize: padded as
+// set by SetDNSPadding, or emptied with TC set if it is over the response cap
+// or would be fragmented against SetNoFragment, to have the client retry over
+// TCP rather than amplify. It returns nil, the response being counted
+// already, if it can't be truncated.
+func (t2s *Tun2Socks) fitDNSResponse(remote net.IP, data []byte, udpSize int) []byte {
+	if !t2s.overResponseCap(remote, data) {
+		return t2s.padDNSResponse(data, remote, udpSize)
+	}
+	return truncateDNSResponse(data)
+}
+
+// overFragmentCap reports whether a response of payloadL bytes from remote
+// would be sent as more fragments than allowed at its path MTU.
+func (t2s *Tun2Socks) overFragmentCap(remote net.IP, payloadL int) bool {
+	return t2s.maxFragments > 0 && fragmentCount(payloadL, t2s.pathMTU(remote)) > t2s.maxFragments
+}
+
+// unreachable answers the first packet of the flow with an ICMP destination
+// unreachable of the given code.
+func (ut *udpConnTrack) unreachable(code uint8) {
+	select {
+	case pkt := <-ut.fromTunCh:
+		resp := ut.t2s.icmpError(pkt.wire, packet.ICMPv4TypeDestinationUnreachable, code)
+		releaseUDPPacket(pkt)
+		if resp != nil {
+			ut.toTunCh <- resp
+		}
+	case <-ut.quitByOther:
+	}
+}
+
+// dialFailed ends a flow whose relay could not be dialed or set up: the
+// error is reported, the client told if configured, and nothing is left to
+// close.
+func (ut *udpConnTrack) dialFailed(e error) CloseReason {
+	log.Printf("fail to set up relay: %s", e)
+	ut.t2s.flowError("udp", ut.localIP, ut.localPort, ut.remoteIP, ut.remotePort, e)
+	if ut.t2s.icmpUnreachable {
+		ut.unreachable(packet.ICMPv4CodeHostUnreachable)
+	}
+	close(ut.socksClosed)
+	return CLOSE_DIAL_FAILED
+}
+
+// closeNotice answers the last packet of the flow closed for reason with an
+// ICMP port unreachable if configured.
+func (ut *udpConnTrack) closeNotice(reason CloseReason) {
+	switch {
+	case ut.quote == nil:
 		return
+	case reason == CLOSE_POLICY && ut.t2s.icmpOnPolicyClose:
+	case reason == CLOSE_IDLE_TIMEOUT && ut.t2s.icmpOnIdleClose:
+	default:
+		return
+	}
+	resp := ut.t2s.icmpError(ut.quote, packet.ICMPv4TypeDestinationUnreachable, packet.ICMPv4CodePortUnreachable)
+	if resp != nil {
+		ut.toTunCh <- resp
 	}
+}
 
-	// create one UDP to recv/send packets
-	socksAddr := ut.socksConn.LocalAddr().(*net.TCPAddr)
-	udpBind, err := net.ListenUDP("udp", &net.UDPAddr{
-		IP:   socksAddr.IP,
-		Port: 0,
-		Zone: socksAddr.Zone,
+func (ut *udpConnTrack) run() {
+	reason := ut.relay()
+	log.Printf("udp flow %s closed: %s", ut.id, reason)
+	ut.closeNotice(reason)
+	replyPort := uint16(atomic.LoadUint32(&ut.replyPort))
+	ut.t2s.flowClosed("udp", ut.localIP, replyPort, ut.remoteIP, ut.remotePort, &ut.counters)
+	close(ut.quitBySelf)
+	ut.t2s.clearUDPConnTrack(ut)
+	if ut.t2s.connCloseHandler != nil {
+		ut.t2s.connCloseHandler(ut.id, reason)
+	}
+}
+
+// relay relays the flow until it ends and returns why it ended.
+func (ut *udpConnTrack) relay() CloseReason {
+	// connect to socks
+	remoteIpPort := fmt.Sprintf("%s:%d", ut.remoteIP.String(), ut.remotePort)
+	conn, e := ut.t2s.retryDial(func() (*gosocks.SocksConn, error) {
+		if ut.socksAddr != "" {
+			return ut.t2s.dialProxy(ut.t2s.routedProxy(-1, ut.socksAddr))
+		}
+		return ut.t2s.directDial(remoteIpPort) //bypass udp
 	})
-	if err != nil {
-		log.Printf("error in binding local UDP: %s", err)
+	if e == nil && conn == nil {
+		e = fmt.Errorf("no dial attempted")
+	}
+	if e != nil {
+		return ut.dialFailed(e)
+	}
+	ut.socksConn = conn
+	// need to finish handshake in 1 mins
+	ut.socksConn.SetDeadline(time.Now().Add(time.Minute * 1))
+	// the relay could not be set up
+	setupFailed := func(e error) CloseReason {
 		ut.socksConn.Close()
-		close(ut.socksClosed)
-		close(ut.quitBySelf)
-		ut.t2s.clearUDPConnTrack(ut.id)
-		return
+		return ut.dialFailed(e)
+	}
+
+	// create one socket to recv/send packets through the relay
+	udpBind, err := ut.t2s.relayBind(ut.socksConn)
+	if err != nil {
+		return setupFailed(fmt.Errorf("error in binding local UDP: %s", err))
 	}
+	ut.t2s.relayBound("udp", udpBind.LocalAddr())
 
 	// socks request/reply
+	hostType, host := byte(gosocks.SocksIPv4Host), "0.0.0.0"
+	if socksAddr, ok := ut.socksConn.LocalAddr().(*net.TCPAddr); ok && socksAddr.IP.To4() == nil {
+		hostType, host = gosocks.SocksIPv6Host, "::"
+	}
 	_, e = gosocks.WriteSocksRequest(ut.socksConn, &gosocks.SocksRequest{
 		Cmd:      gosocks.SocksCmdUDPAssociate,
-		HostType: gosocks.SocksIPv4Host,
-		DstHost:  "0.0.0.0",
+		HostType: hostType,
+		DstHost:  host,
 		DstPort:  0,
 	})
 	if e != nil {
-		log.Printf("error to send socks request: %s", e)
-		ut.socksConn.Close()
-		close(ut.socksClosed)
-		close(ut.quitBySelf)
-		ut.t2s.clearUDPConnTrack(ut.id)
-		return
+		closeRelayBind(udpBind)
+		return setupFailed(fmt.Errorf("error to send socks request: %s", e))
 	}
 	reply, e := gosocks.ReadSocksReply(ut.socksConn)
 	if e != nil {
-		ut.socksConn.Close()
-		close(ut.socksClosed)
-		close(ut.quitBySelf)
-		ut.t2s.clearUDPConnTrack(ut.id)
-		return
+		closeRelayBind(udpBind)
+		return setupFailed(fmt.Errorf("error to read socks reply: %s", e))
 	}
 	if reply.Rep != gosocks.SocksSucceeded {
-		log.Printf("socks connect request fail, retcode: %d", reply.Rep)
-		ut.socksConn.Close()
-		close(ut.socksClosed)
-		close(ut.quitBySelf)
-		ut.t2s.clearUDPConnTrack(ut.id)
-		return
+		closeRelayBind(udpBind)
+		return setupFailed(fmt.Errorf("socks UDP associate request fail, retcode: %d", reply.Rep))
+	}
+	relayAddr, e := relayAddress(ut.socksConn, reply)
+	if e != nil {
+		closeRelayBind(udpBind)
+		return setupFailed(e)
 	}
-	relayAddr := gosocks.SocksAddrToNetAddr("udp", reply.BndHost, reply.BndPort).(*net.UDPAddr)
 
 	ut.socksConn.SetDeadline(time.Time{})
 	// monitor socks TCP connection
@@ -236,27 +529,52 @@ func (ut *udpConnTrack) run() {
 	// read UDP packets from relay
 	quitUDP := make(chan bool)
 	chRelayUDP := make(chan *gosocks.UDPPacket)
-	go gosocks.UDPReader(udpBind, chRelayUDP, quitUDP)
+	go gosocks.UDPReaderSize(udpBind, chRelayUDP, quitUDP, ut.t2s.relayReadBuf)
+
+	// whichever way the loop ends, the relay is torn down. The pending
+	// read of the reader is expired and udpBind closed before the reader is
+	// told to quit, so it neither lingers nor blocks handing over a packet.
+	defer func() {
+		ut.socksConn.Close()
+		udpBind.SetReadDeadline(time.Now())
+		closeRelayBind(udpBind)
+		close(quitUDP)
+	}()
+
+	// the flow ends at its max lifetime even while active
+	var expired <-chan time.Time
+	if max := ut.t2s.udpMaxLifetime; max > 0 {
+		lifetime := time.NewTimer(time.Until(ut.counters.start.Add(max)))
+		defer lifetime.Stop()
+		expired = lifetime.C
+	}
+
+	// let the proxy resolve the destination if its name is known
+	if ut.socksAddr != "" && ut.t2s.cache != nil && !ut.t2s.isDNS(ut.remoteIP.String(), ut.remotePort) {
+		ut.remoteName = ut.t2s.cache.hostName(ut.remoteIP)
+	}
 
-	start := time.Now()
+	// outstanding DNS queries by transaction ID
+	queries := make(map[uint16]*dnsQuery)
 	for {
+		atomic.StoreInt64(&ut.activity, time.Now().UnixNano())
 		var t *time.Timer
 		if ut.t2s.isDNS(ut.remoteIP.String(), ut.remotePort) {
-			t = time.NewTimer(10 * time.Second)
+			if len(queries) == 0 && ut.t2s.dnsKeepAlive > 0 {
+				t = time.NewTimer(ut.t2s.dnsKeepAlive)
+			} else {
+				t = time.NewTimer(DNS_IDLE_TIMEOUT)
+			}
 		} else {
-			t = time.NewTimer(2 * time.Minute)
+			t = time.NewTimer(ut.idleTimeout())
 		}
 		select {
 		// pkt from relay
 		case pkt, ok := <-chRelayUDP:
 			if !ok {
-				ut.socksConn.Close()
-				udpBind.Close()
-				close(ut.quitBySelf)
-				ut.t2s.clearUDPConnTrack(ut.id)
-				close(quitUDP)
-				return
+				return CLOSE_RELAY_CLOSED
 			}
+			ut.observe(time.Now())
 			if pkt.Addr.String() != relayAddr.String() {
 				log.Printf("response relayed from %s, expect %s", pkt.Addr.String(), relayAddr.String())
 				continue
@@ -269,25 +587,71 @@ func (ut *udpConnTrack) run() {
 			if udpReq.Frag != gosocks.SocksNoFragment {
 				continue
 			}
-			ut.send(udpReq.Data)
 			if ut.t2s.isDNS(ut.remoteIP.String(), ut.remotePort) {
-				// DNS-without-fragment only has one request-response
-				end := time.Now()
-				ms := end.Sub(start).Nanoseconds() / 1000000
-				log.Printf("DNS session response received: %d ms", ms)
-				if ut.t2s.cache != nil {
-					ut.t2s.cache.store(udpReq.Data)
+				query := queries[dnsID(udpReq.Data)]
+				if query == nil || !query.answers(udpReq.Data) {
+					log.Printf("drop DNS response not matching any query")
+					atomic.AddUint64(&ut.t2s.stats.DNSMismatched, 1)
+					continue
 				}
-				ut.socksConn.Close()
-				udpBind.Close()
-				close(ut.quitBySelf)
-				ut.t2s.clearUDPConnTrack(ut.id)
-				close(quitUDP)
-				return
+				if query.pending > 1 && !usableDNSResponse(udpReq.Data) {
+					query.pending--
+					continue
+				}
+				delete(queries, dnsID(udpReq.Data))
+				data := ut.t2s.filterDNSResponse(udpReq.Data)
+				if data == nil {
+					continue
+				}
+				if answer := ut.t2s.fitDNSResponse(ut.remoteIP, data, query.udpSize); answer != nil {
+					if ut.pace(len(answer)) {
+						ut.send(answer, ut.t2s.responseID(query.ipid))
+					}
+					latency := time.Since(query.start)
+					log.Printf("DNS session response received: %d ms", latency.Nanoseconds()/1000000)
+					ut.t2s.logDNS(answer, false, latency)
+				}
+				// cached as the resolver sent it, each client gets it fit
+				ut.t2s.cacheDNS(data)
+				// without keep-alive the session ends once every query is
+				// answered, unless the next one came in meanwhile
+				if len(queries) == 0 && ut.t2s.dnsKeepAlive == 0 && ut.drained() {
+					return CLOSE_DNS_SINGLE_RESPONSE
+				}
+				continue
 			}
+			if ut.t2s.overResponseCap(ut.remoteIP, udpReq.Data) {
+				log.Printf("drop UDP response over cap: %d bytes", len(udpReq.Data))
+				if ut.quote != nil && ut.t2s.noFragment(ut.remoteIP) {
+					resp := ut.t2s.icmpError(ut.quote, packet.ICMPv4TypeDestinationUnreachable, packet.ICMPv4CodeFragmentationNeeded)
+					if resp != nil {
+						ut.toTunCh <- resp
+					}
+				}
+				continue
+			}
+			ut.t2s.learnQUIC(ut, udpReq.Data)
+			if !ut.pace(len(udpReq.Data)) {
+				continue
+			}
+			ut.send(udpReq.Data, ut.t2s.ipID())
 
 		// pkt from tun
 		case pkt := <-ut.fromTunCh:
+			ut.observe(time.Now())
+			ut.lastSum = ut.t2s.fragProgress(ut.remoteIP, pkt.udp.Payload)
+			ut.ecn = pkt.ip.TOS
+			if ut.t2s.icmpOnPolicyClose || ut.t2s.icmpOnIdleClose || ut.t2s.noFragNets != nil {
+				quoteL := int(pkt.ip.IHL)*4 + 8
+				if quoteL > len(pkt.wire) {
+					quoteL = len(pkt.wire)
+				}
+				ut.quote = append(ut.quote[:0], pkt.wire[:quoteL]...)
+			}
+			if !ut.waitUntil(pkt.sendAt) {
+				releaseUDPPacket(pkt)
+				return ut.quitReason()
+			}
 			req := &gosocks.UDPRequest{
 				Frag:     0,
 				HostType: gosocks.SocksIPv4Host,
@@ -295,78 +659,280 @@ func (ut *udpConnTrack) run() {
 				DstPort:  uint16(pkt.udp.DstPort),
 				Data:     pkt.udp.Payload,
 			}
-			datagram := gosocks.PackUDPRequest(req)
-			_, err := udpBind.WriteToUDP(datagram, relayAddr)
+			if ut.remoteName != "" {
+				req.HostType, req.DstHost = gosocks.SocksDomainHost, ut.remoteName
+			}
+			var upstreams []*net.UDPAddr
+			if ut.t2s.isDNS(ut.remoteIP.String(), ut.remotePort) {
+				upstreams = ut.t2s.dnsUpstreams(pkt.udp.Payload)
+				query := newDNSQuery(pkt.udp.Payload, len(upstreams))
+				query.ipid = pkt.ip.Id
+				queries[dnsID(pkt.udp.Payload)] = query
+			}
+			err := relayUDPRequest(udpBind, relayAddr, req, upstreams)
+			ut.counters.out(len(req.Data))
 			releaseUDPPacket(pkt)
 			if err != nil {
 				log.Printf("error to send UDP packet to relay: %s", err)
-				ut.socksConn.Close()
-				udpBind.Close()
-				close(ut.quitBySelf)
-				ut.t2s.clearUDPConnTrack(ut.id)
-				close(quitUDP)
-				return
+				return CLOSE_RELAY_WRITE_ERROR
 			}
 
 		case <-ut.socksClosed:
-			ut.socksConn.Close()
-			udpBind.Close()
-			close(ut.quitBySelf)
-			ut.t2s.clearUDPConnTrack(ut.id)
-			close(quitUDP)
-			return
+			return CLOSE_RELAY_CLOSED
 
 		case <-t.C:
-			ut.socksConn.Close()
-			udpBind.Close()
-			close(ut.quitBySelf)
-			ut.t2s.clearUDPConnTrack(ut.id)
-			close(quitUDP)
-			return
+			return CLOSE_IDLE_TIMEOUT
+
+		case <-expired:
+			return CLOSE_MAX_LIFETIME
 
 		case <-ut.quitByOther:
-			log.Printf("udpConnTrack quitByOther")
-			ut.socksConn.Close()
-			udpBind.Close()
-			close(quitUDP)
-			return
+			return ut.quitReason()
 		}
 		t.Stop()
 	}
 }
 
-func (ut *udpConnTrack) newPacket(pkt *udpPacket) {
+// drained reports whether the flow can end, marking it closing: no packet
+// from tun is queued, or being queued, and none will be. Otherwise the flow
+// goes on with the queued packets.
+func (ut *udpConnTrack) drained() bool {
+	// a full queue may block the sender holding sendLock
+	if len(ut.fromTunCh) > 0 {
+		return false
+	}
+	// waits for a packet being queued
+	ut.sendLock.Lock()
+	defer ut.sendLock.Unlock()
+	if len(ut.fromTunCh) > 0 {
+		return false
+	}
+	atomic.StoreInt32(&ut.closing, 1)
+	return true
+}
+
+// quit asks the track to quit for reason. udpConnTrackLock must be held, so
+// that quitByOther is closed once.
+func (ut *udpConnTrack) quit(reason CloseReason) {
+	atomic.StoreInt32(&ut.quitBy, int32(reason))
+	close(ut.quitByOther)
+}
+
+// quitReason tells why quitByOther was closed.
+func (ut *udpConnTrack) quitReason() CloseReason {
+	return CloseReason(atomic.LoadInt32(&ut.quitBy))
+}
+
+// observe updates the smoothed inter-arrival time with a packet seen now.
+func (ut *udpConnTrack) observe(now time.Time) {
+	if !ut.lastPacketTime.IsZero() {
+		d := now.Sub(ut.lastPacketTime)
+		if ut.interval == 0 {
+			ut.interval = d
+		} else {
+			// same gain as TCP's smoothed RTT
+			ut.interval += (d - ut.interval) / 8
+		}
+	}
+	ut.lastPacketTime = now
+}
+
+// idleTimeout is how long the flow may stay silent before it is torn down:
+// a multiple of the smoothed inter-arrival time, bounded by the configured
+// minimum and maximum.
+func (ut *udpConnTrack) idleTimeout() time.Duration {
+	min, max := ut.t2s.udpIdleMin, ut.t2s.udpIdleMax
+	if ut.interval == 0 {
+		return max
+	}
+	t := ut.interval * udpIdleFactor
+	if t < min {
+		t = min
+	}
+	if t > max {
+		t = max
+	}
+	return t
+}
+
+const (
+	// block the dispatcher until the flow takes the packet
+	UDP_QUEUE_BLOCK = iota
+	// drop the oldest queued packet to make room
+	UDP_QUEUE_DROP_OLDEST
+	// drop the packet that doesn't fit
+	UDP_QUEUE_DROP_NEWEST
+)
+
+// SetUDPQueue sets how many packets from tun each UDP flow queues for its
+// relay (100 by default) and what happens when a slow relay lets the queue
+// fill up (UDP_QUEUE_*). UDP_QUEUE_DROP_OLDEST is recommended, as a blocked
+// queue stalls every flow behind the dispatcher; the default is
+// UDP_QUEUE_BLOCK. It applies to flows created from then on.
+func (t2s *Tun2Socks) SetUDPQueue(depth int, policy int) {
+	if depth <= 0 {
+		depth = 100
+	}
+	t2s.udpQueueDepth = depth
+	t2s.udpQueuePolicy = policy
+}
+
+// newPacket queues pkt for the relay, or reports false if the flow is
+// closing, for pkt to go to a new flow.
+func (ut *udpConnTrack) newPacket(pkt *udpPacket) bool {
+	ut.sendLock.Lock()
+	defer ut.sendLock.Unlock()
+	if atomic.LoadInt32(&ut.closing) != 0 {
+		return false
+	}
+	at, ok := ut.t2s.scheduled(ut.sendLimit, len(pkt.udp.Payload))
+	if !ok {
+		releaseUDPPacket(pkt)
+		return true
+	}
+	pkt.sendAt = at
+	if ut.t2s.udpQueuePolicy != UDP_QUEUE_BLOCK {
+		ut.enqueue(pkt)
+		return true
+	}
 	select {
 	case <-ut.quitByOther:
+		releaseUDPPacket(pkt)
 	case <-ut.quitBySelf:
+		releaseUDPPacket(pkt)
 	case ut.fromTunCh <- pkt:
-		// log.Printf("--> [UDP][%s]", ut.id)
+		if ut.debug {
+			log.Printf("--> [UDP][%s][payload:%d]", ut.id, len(pkt.udp.Payload))
+		}
+		ut.t2s.queued(len(ut.fromTunCh))
 	}
+	return true
 }
 
-func (t2s *Tun2Socks) clearUDPConnTrack(id string) {
+// enqueue queues pkt without blocking, dropping a packet by the queue policy
+// if the queue is full.
+func (ut *udpConnTrack) enqueue(pkt *udpPacket) {
+	for {
+		select {
+		case <-ut.quitByOther:
+			releaseUDPPacket(pkt)
+			return
+		case <-ut.quitBySelf:
+			releaseUDPPacket(pkt)
+			return
+		case ut.fromTunCh <- pkt:
+			ut.t2s.queued(len(ut.fromTunCh))
+			return
+		default:
+		}
+
+		if ut.t2s.udpQueuePolicy == UDP_QUEUE_DROP_NEWEST {
+			atomic.AddUint64(&ut.t2s.stats.UDPQueueDropped, 1)
+			releaseUDPPacket(pkt)
+			return
+		}
+		select {
+		case old := <-ut.fromTunCh:
+			atomic.AddUint64(&ut.t2s.stats.UDPQueueDropped, 1)
+			releaseUDPPacket(old)
+		default:
+			// the relay took a packet meanwhile
+		}
+	}
+}
+
+// queued records a queue depth for the high-water mark.
+func (t2s *Tun2Socks) queued(depth int) {
+	for {
+		high := atomic.LoadUint64(&t2s.stats.UDPQueueHighWater)
+		if uint64(depth) <= high ||
+			atomic.CompareAndSwapUint64(&t2s.stats.UDPQueueHighWater, high, uint64(depth)) {
+			return
+		}
+	}
+}
+
+// udpQueued returns how many packets are queued in all UDP flows.
+func (t2s *Tun2Socks) udpQueued() uint64 {
+	t2s.udpConnTrackLock.Lock()
+	defer t2s.udpConnTrackLock.Unlock()
+
+	var n uint64
+	for _, ut := range t2s.udpConnTrackMap {
+		n += uint64(len(ut.fromTunCh))
+	}
+	return n
+}
+
+func (t2s *Tun2Socks) clearUDPConnTrack(ut *udpConnTrack) {
+	t2s.udpConnTrackLock.Lock()
+	defer t2s.udpConnTrackLock.Unlock()
+
+	// a reaped track may already be replaced
+	if t2s.udpConnTrackMap[ut.key] == ut {
+		delete(t2s.udpConnTrackMap, ut.key)
+	}
+	t2s.forgetQUIC(ut)
+}
+
+// SetStuckTrackWatchdog makes tracks whose relay loop made no progress for
+// longer than threshold get reaped: they are asked to quit and replaced by a
+// fresh track on the next packet of the flow. threshold has to exceed the
+// longest idle timeout, as an idle loop still wakes up at its timeout. 0
+// disables the watchdog.
+func (t2s *Tun2Socks) SetStuckTrackWatchdog(threshold time.Duration) {
+	t2s.stuckThreshold = threshold
+}
+
+func (t2s *Tun2Socks) reapStuckUDPTracks() {
+	threshold := t2s.stuckThreshold
+	if threshold <= 0 {
+		return
+	}
 	t2s.udpConnTrackLock.Lock()
 	defer t2s.udpConnTrackLock.Unlock()
 
-	delete(t2s.udpConnTrackMap, id)
+	now := time.Now().UnixNano()
+	for id, ut := range t2s.udpConnTrackMap {
+		if time.Duration(now-atomic.LoadInt64(&ut.activity)) > threshold {
+			log.Printf("reap stuck udp track %s", id)
+			atomic.AddUint64(&t2s.stats.StuckReaped, 1)
+			delete(t2s.udpConnTrackMap, id)
+			ut.quit(CLOSE_STUCK)
+		}
+	}
 }
 
-func (t2s *Tun2Socks) getUDPConnTrack(id string, ip *packet.IPv4, udp *packet.UDP) *udpConnTrack {
+// getUDPConnTrack returns the track of a flow, starting one for a new flow,
+// or nil if a routing rule or the new flow handler drops the new flow.
+func (t2s *Tun2Socks) getUDPConnTrack(dev *tunDevice, id string, ip *packet.IPv4, udp *packet.UDP) *udpConnTrack {
 	t2s.udpConnTrackLock.Lock()
 	defer t2s.udpConnTrackLock.Unlock()
 
 	track := t2s.udpConnTrackMap[id]
-	if track != nil {
+	if track != nil && atomic.LoadInt32(&track.closing) == 0 {
 		return track
 	} else {
+		rule := t2s.matchRule("udp", ip.DstIP, udp.DstPort)
+		if rule != nil && rule.Decision == ROUTE_DROP {
+			log.Printf("drop udp flow %s by rule", id)
+			return nil
+		}
+		if !t2s.admitted("udp", ip.SrcIP, ip.DstIP, udp.SrcPort, udp.DstPort) {
+			log.Printf("drop udp flow %s by new flow handler", id)
+			return nil
+		}
 		track := &udpConnTrack{
 			t2s:         t2s,
 			id:          id,
-			toTunCh:     t2s.writeCh,
-			fromTunCh:   make(chan *udpPacket, 100),
+			key:         id,
+			replyPort:   uint32(udp.SrcPort),
+			toTunCh:     dev.writeCh,
+			fromTunCh:   make(chan *udpPacket, t2s.udpQueueDepth),
 			socksClosed: make(chan bool),
 			quitBySelf:  make(chan bool),
 			quitByOther: make(chan bool),
+			quitBy:      int32(CLOSE_EXTERNAL_QUIT),
 
 			localPort:  udp.SrcPort,
 			remotePort: udp.DstPort,
@@ -375,111 +941,131 @@ func (t2s *Tun2Socks) getUDPConnTrack(id string, ip *packet.IPv4, udp *packet.UD
 		copy(track.localIP, ip.SrcIP)
 		track.remoteIP = make(net.IP, len(ip.DstIP))
 		copy(track.remoteIP, ip.DstIP)
+		track.debug = t2s.debugged(ConnInfo{
+			Proto:      "udp",
+			ID:         id,
+			LocalIP:    track.localIP,
+			LocalPort:  track.localPort,
+			RemoteIP:   track.remoteIP,
+			RemotePort: track.remotePort,
+			UID:        -1,
+		})
+		rate := 0
+		if rule != nil {
+			if proxy := t2s.proxyFor(-1); rule.Decision == ROUTE_PROXY && proxy != nil && proxy.ProxyType == PROXY_TYPE_SOCKS {
+				track.socksAddr = proxy.IpAddress
+			}
+			rate = rule.RateLimit
+		} else {
+			track.socksAddr, _ = t2s.routeSocks("udp", track.remoteIP, track.remotePort)
+		}
+		track.throttle(rate)
 
+		track.activity = time.Now().UnixNano()
+		track.counters.start = time.Now()
 		t2s.udpConnTrackMap[id] = track
 		go track.run()
 		return track
 	}
 }
 
-func (t2s *Tun2Socks) udp(raw []byte, ip *packet.IPv4, udp *packet.UDP) {
+// SetUDPChecksum sets whether UDP packets written to tun carry a checksum.
+// On by default. Off saves summing every response, which shows on slow
+// devices, as a zero checksum means none over IPv4; but responses corrupted
+// on the way are then handed to apps as is, and client stacks that insist on
+// checksums drop them all.
+func (t2s *Tun2Socks) SetUDPChecksum(enabled bool) {
+	t2s.noUDPChecksum = !enabled
+}
+
+// answerDNS hands a DNS response to the client of a query read from dev
+// without blocking the reader.
+func (t2s *Tun2Socks) answerDNS(dev *tunDevice, ip *packet.IPv4, udp *packet.UDP, data []byte) {
+	if data = t2s.fitDNSResponse(ip.DstIP, data, dnsUDPSize(udp.Payload)); data == nil {
+		return
+	}
+	resp, fragments := t2s.responsePacket(ip.SrcIP, ip.DstIP, udp.SrcPort, udp.DstPort, data, t2s.responseID(ip.Id), ip.TOS)
+	if resp == nil {
+		return
+	}
+	go func(first *udpPacket, frags []*ipPacket) {
+		dev.writeCh <- first
+		for _, frag := range frags {
+			dev.writeCh <- frag
+		}
+	}(resp, fragments)
+}
+
+func (t2s *Tun2Socks) udp(dev *tunDevice, raw []byte, ip *packet.IPv4, udp *packet.UDP) {
 	var buf [1024]byte
 	var done bool
 
+	if t2s.droppedMulticast(dev, ip.DstIP) {
+		return
+	}
+
+	// malformed queries are answered right away rather than relayed
+	if t2s.rejectBadDNS && t2s.isDNS(ip.DstIP.String(), udp.DstPort) {
+		if data, bad := formatError(udp.Payload); bad {
+			if data != nil {
+				log.Printf("answer malformed DNS query with FORMERR")
+				t2s.answerDNS(dev, ip, udp, data)
+			}
+			return
+		}
+	}
+
 	// first look at dns cache
-	if t2s.cache != nil && t2s.isDNS(ip.DstIP.String(), udp.DstPort) {
-		answer := t2s.cache.query(udp.Payload)
+	if t2s.dnsStore != nil && t2s.isDNS(ip.DstIP.String(), udp.DstPort) {
+		start := time.Now()
+		answer := t2s.dnsStore.Query(udp.Payload)
 		if answer != nil {
+			answer.Compress = t2s.dnsCompress
+			// PackBuffer allocates when the answer outgrows buf, so only
+			// the returned slice is used from here on
 			data, e := answer.PackBuffer(buf[:])
 			if e == nil {
-				resp, fragments := responsePacket(ip.SrcIP, ip.DstIP, udp.SrcPort, udp.DstPort, data)
-				go func(first *udpPacket, frags []*ipPacket) {
-					t2s.writeCh <- first
-					if frags != nil {
-						for _, frag := range frags {
-							t2s.writeCh <- frag
-						}
-					}
-				}(resp, fragments)
+				if t2s.dnsHooked() {
+					t2s.logDNS(append([]byte(nil), data...), true, time.Since(start))
+				}
+				t2s.answerDNS(dev, ip, udp, data)
 				done = true
 			}
 		}
+		// a duplicate of a query in flight waits for its answer
+		if !done && t2s.cache != nil && t2s.cache.join(dev, ip, udp) {
+			done = true
+		}
 	}
 
-	// then open a udpConnTrack to forward
-	if !done {
-		connID := udpConnID(ip, udp)
-		pkt := copyUDPPacket(raw, ip, udp)
-		track := t2s.getUDPConnTrack(connID, ip, udp)
-		track.newPacket(pkt)
-	}
-}
-
-type dnsCacheEntry struct {
-	msg *dns.Msg
-	exp time.Time
-}
-
-type dnsCache struct {
-	servers []string
-	mutex   sync.Mutex
-	storage map[string]*dnsCacheEntry
-}
-
-func packUint16(i uint16) []byte { return []byte{byte(i >> 8), byte(i)} }
-
-func cacheKey(q dns.Question) string {
-	return string(append([]byte(q.Name), packUint16(q.Qtype)...))
-}
-
-func (t2s *Tun2Socks) isDNS(remoteIP string, remotePort uint16) bool {
-	return remotePort == 53
-}
-
-func (c *dnsCache) query(payload []byte) *dns.Msg {
-	request := new(dns.Msg)
-	e := request.Unpack(payload)
-	if e != nil {
-		return nil
-	}
-	if len(request.Question) == 0 {
-		return nil
-	}
-
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
-	key := cacheKey(request.Question[0])
-	entry := c.storage[key]
-	if entry == nil {
-		return nil
-	}
-	if time.Now().After(entry.exp) {
-		delete(c.storage, key)
-		return nil
-	}
-	entry.msg.Id = request.Id
-	return entry.msg
-}
-
-func (c *dnsCache) store(payload []byte) {
-	resp := new(dns.Msg)
-	e := resp.Unpack(payload)
-	if e != nil {
-		return
-	}
-	if resp.Rcode != dns.RcodeSuccess {
-		return
-	}
-	if len(resp.Question) == 0 || len(resp.Answer) == 0 {
-		return
+	// DNS over TLS replaces relaying DNS
+	if !done && t2s.dot != nil && t2s.isDNS(ip.DstIP.String(), udp.DstPort) {
+		t2s.forwardDoT(dev, ip, udp)
+		done = true
 	}
 
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
-	key := cacheKey(resp.Question[0])
-	log.Printf("cache DNS response for %s", key)
-	c.storage[key] = &dnsCacheEntry{
-		msg: resp,
-		exp: time.Now().Add(time.Duration(resp.Answer[0].Header().Ttl) * time.Second),
+	// then open a udpConnTrack to forward
+	if !done {
+		connID := dev.flowID(udpConnID(ip, udp))
+		pkt := copyUDPPacket(raw, dev.takeReadBuf(raw), ip, udp)
+		if pkt == nil {
+			atomic.AddUint64(&t2s.stats.UDPMalformed, 1)
+			return
+		}
+		track := t2s.migratedQUICTrack(connID, ip, udp)
+		for {
+			if track == nil {
+				track = t2s.getUDPConnTrack(dev, connID, ip, udp)
+			}
+			if track == nil {
+				releaseUDPPacket(pkt)
+				return
+			}
+			if track.newPacket(pkt) {
+				return
+			}
+			// the flow ended meanwhile
+			track = nil
+		}
 	}
 }
@@ -0,0 +1,901 @@
+package tun2socks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/dkwiebe/gotun2socks/internal/gosocks"
+	"github.com/dkwiebe/gotun2socks/internal/packet"
+	"github.com/dkwiebe/gotun2socks/internal/tun"
+	"github.com/miekg/dns"
+)
+
+func TestStoppedUDPFlowsLeaveNoGoroutines(t *testing.T) {
+	s := newStubSocks(t, echoUDP)
+	dev := tun.NewMemoryTun()
+	t2s := New(dev, false)
+	s.route(t2s)
+	go t2s.Run()
+	before := runtime.NumGoroutine()
+
+	const flows = 20
+	for i := 0; i < flows; i++ {
+		dev.Inject(udpIPv4(clientIP, uint16(5000+i), net.IP{192, 0, 2, 1}, 9, []byte("ping")))
+		if _, udp := nextUDP(t, dev); string(udp.Payload) != "ping" {
+			t.Fatalf("got %q, want ping", udp.Payload)
+		}
+	}
+	t2s.Stop()
+	// tracks, relay readers and monitors, and the proxy's side of them
+	waitGoroutines(t, before)
+}
+
+func TestShortDNSFlowsLeaveNoGoroutines(t *testing.T) {
+	s := newStubSocks(t, stubResolver(answerA))
+	t2s, p := NewTun2SocksWithPipe()
+	s.route(t2s)
+	serve(t, t2s)
+	before := runtime.NumGoroutine()
+
+	// each session ends with its answer; the queries of one port follow
+	// each other as the last session closes
+	for i := 0; i < 200; i++ {
+		port := uint16(4000 + i%2*(i/2))
+		name := fmt.Sprintf("short%d.example.", i)
+		p.Inject(udpIPv4(clientIP, port, resolverIP, 53, packQuery(t, uint16(i), name, dns.TypeA)))
+		if _, udp := nextUDP(t, p); unpackDNS(t, udp).Question[0].Name != name {
+			t.Fatalf("query %d answered for %s", i, unpackDNS(t, udp).Question[0].Name)
+		}
+	}
+	waitGoroutines(t, before)
+}
+
+func TestQuitByOtherClearsTrack(t *testing.T) {
+	s := newStubSocks(t, echoUDP)
+	dev := tun.NewMemoryTun()
+	t2s := New(dev, false)
+	s.route(t2s)
+	serve(t, t2s)
+
+	dev.Inject(udpIPv4(clientIP, 5000, net.IP{192, 0, 2, 1}, 9, []byte("ping")))
+	nextUDP(t, dev)
+	t2s.udpConnTrackLock.Lock()
+	var ut *udpConnTrack
+	for _, ut = range t2s.udpConnTrackMap {
+	}
+	t2s.udpConnTrackLock.Unlock()
+	if ut == nil {
+		t.Fatal("no track")
+	}
+
+	// quit it as Stop does, leaving it in the map
+	close(ut.quitByOther)
+	<-ut.quitBySelf
+	waitFor(t, "track cleared", func() bool {
+		t2s.udpConnTrackLock.Lock()
+		defer t2s.udpConnTrackLock.Unlock()
+		return len(t2s.udpConnTrackMap) == 0
+	})
+}
+
+func TestIPIDFuncInEmittedHeaders(t *testing.T) {
+	s := newStubSocks(t, echoUDP)
+	dev := tun.NewMemoryTun()
+	t2s := New(dev, false)
+	s.route(t2s)
+	t2s.SetIPIDFunc(func() uint16 { return 4242 })
+	serve(t, t2s)
+
+	dev.Inject(udpIPv4(clientIP, 5000, net.IP{192, 0, 2, 1}, 9, []byte("ping")))
+	ip, _ := nextUDP(t, dev)
+	if ip.Id != 4242 {
+		t.Fatalf("IP ID %d, want 4242", ip.Id)
+	}
+}
+
+func TestRelayFailuresReportFlowError(t *testing.T) {
+	for _, refused := range []bool{false, true} {
+		s := newStubSocks(t, echoUDP)
+		s.refuse = refused
+		dev := tun.NewMemoryTun()
+		t2s := New(dev, false)
+		t2s.SetDirectDialer(func(string) (*gosocks.SocksConn, error) {
+			if !refused {
+				return nil, errors.New("unreachable")
+			}
+			return dialStub(s)
+		})
+		errs := make(chan *FlowError, 1)
+		t2s.SetFlowErrorHandler(func(fe *FlowError) { errs <- fe })
+		serve(t, t2s)
+
+		dev.Inject(udpIPv4(clientIP, 5000, net.IP{192, 0, 2, 1}, 9, []byte("ping")))
+		select {
+		case fe := <-errs:
+			if fe.Proto != "udp" || !fe.SrcIP.Equal(clientIP) || fe.SrcPort != 5000 ||
+				!fe.DstIP.Equal(net.IP{192, 0, 2, 1}) || fe.DstPort != 9 || fe.Err == nil {
+				t.Fatalf("got %v", fe)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("failure not reported, UDP associate refused: %v", refused)
+		}
+	}
+}
+
+func TestRelayDialFailureTearsDown(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		e    error
+	}{
+		{"error", fmt.Errorf("dial refused")},
+		{"no conn", nil},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			t2s, p := NewTun2SocksWithPipe()
+			t2s.SetSocksRouter(func(net.IP, uint16, string) string { return "127.0.0.1:1" })
+			t2s.SetRelayDialer(func(*ProxyServer) (*gosocks.SocksConn, error) { return nil, c.e })
+			t2s.SetICMPUnreachable(true)
+			errs := make(chan *FlowError, 1)
+			t2s.SetFlowErrorHandler(func(fe *FlowError) { errs <- fe })
+			closed := make(chan CloseReason, 1)
+			t2s.SetConnCloseHandler(func(id string, reason CloseReason) { closed <- reason })
+			serve(t, t2s)
+			routines := runtime.NumGoroutine()
+
+			p.Inject(udpIPv4(clientIP, 5000, net.IP{192, 0, 2, 1}, 9, []byte("ping")))
+			select {
+			case fe := <-errs:
+				if fe.Proto != "udp" || fe.SrcPort != 5000 || fe.DstPort != 9 || fe.Err == nil {
+					t.Fatalf("got %v", fe)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("dial failure not reported")
+			}
+			select {
+			case reason := <-closed:
+				if reason != CLOSE_DIAL_FAILED {
+					t.Fatalf("closed for %s, want %s", reason, CLOSE_DIAL_FAILED)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("flow not closed")
+			}
+
+			var hdr packet.IPv4
+			var icmp packet.ICMPv4
+			if e := packet.ParseIPv4(nextPacket(t, p), &hdr); e != nil {
+				t.Fatal(e)
+			}
+			if hdr.Protocol != packet.IPProtocolICMPv4 {
+				t.Fatalf("emitted protocol %d, want ICMP", hdr.Protocol)
+			}
+			if e := packet.ParseICMPv4(hdr.Payload, &icmp); e != nil {
+				t.Fatal(e)
+			}
+			if icmp.Code != packet.ICMPv4CodeHostUnreachable {
+				t.Fatalf("ICMP code %d, want host unreachable", icmp.Code)
+			}
+			waitFor(t, "track removed", func() bool {
+				t2s.udpConnTrackLock.Lock()
+				defer t2s.udpConnTrackLock.Unlock()
+				return len(t2s.udpConnTrackMap) == 0
+			})
+			waitGoroutines(t, routines)
+		})
+	}
+}
+
+func TestAdaptiveIdleTimeout(t *testing.T) {
+	t2s := New(nil, false)
+	t2s.SetUDPIdleTimeout(5*time.Second, 2*time.Minute)
+	for _, c := range []struct {
+		name     string
+		gap      time.Duration
+		packets  int
+		min, max time.Duration
+	}{
+		{"silent", 0, 1, 2 * time.Minute, 2 * time.Minute},
+		{"bursty", 10 * time.Millisecond, 20, 5 * time.Second, 5 * time.Second},
+		{"steady", time.Second, 50, 7 * time.Second, 9 * time.Second},
+		{"sparse", time.Minute, 5, 2 * time.Minute, 2 * time.Minute},
+	} {
+		ut := &udpConnTrack{t2s: t2s}
+		now := time.Now()
+		for i := 0; i < c.packets; i++ {
+			ut.observe(now)
+			now = now.Add(c.gap)
+		}
+		if d := ut.idleTimeout(); d < c.min || d > c.max {
+			t.Errorf("%s: idle timeout %s, want within [%s, %s]", c.name, d, c.min, c.max)
+		}
+	}
+
+	// a steady stream turning bursty shortens the timeout gradually
+	ut := &udpConnTrack{t2s: t2s}
+	now := time.Now()
+	for i := 0; i < 50; i++ {
+		ut.observe(now)
+		now = now.Add(2 * time.Second)
+	}
+	steady := ut.idleTimeout()
+	ut.observe(ut.lastPacketTime.Add(10 * time.Millisecond))
+	if d := ut.idleTimeout(); d >= steady || d <= 5*time.Second {
+		t.Errorf("idle timeout %s after one short gap, want between 5s and %s", d, steady)
+	}
+}
+
+func TestMaxFlowLifetime(t *testing.T) {
+	s := newStubSocks(t, echoUDP)
+	t2s, p := NewTun2SocksWithPipe()
+	s.route(t2s)
+	t2s.SetMaxFlowLifetime(200 * time.Millisecond)
+	closed := make(chan CloseReason, 10)
+	t2s.SetConnCloseHandler(func(id string, reason CloseReason) { closed <- reason })
+	serve(t, t2s)
+
+	// a flow kept busy well within the idle timeout
+	start := time.Now()
+	var reason CloseReason
+active:
+	for {
+		p.Inject(udpIPv4(clientIP, 5000, net.IP{192, 0, 2, 1}, 9, []byte("ping")))
+		select {
+		case reason = <-closed:
+			break active
+		case <-time.After(20 * time.Millisecond):
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("active flow outlived its max lifetime")
+		}
+	}
+	if reason != CLOSE_MAX_LIFETIME {
+		t.Fatalf("closed for %s, want %s", reason, CLOSE_MAX_LIFETIME)
+	}
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Fatalf("closed after %s, before its max lifetime", d)
+	}
+
+	// the next datagram opens a new flow
+	time.Sleep(50 * time.Millisecond)
+	for len(p.Emitted()) > 0 {
+		<-p.Emitted()
+	}
+	p.Inject(udpIPv4(clientIP, 5000, net.IP{192, 0, 2, 1}, 9, []byte("again")))
+	if _, udp := nextUDP(t, p); string(udp.Payload) != "again" {
+		t.Fatalf("echoed %q", udp.Payload)
+	}
+}
+
+func TestInconsistentUDPLengths(t *testing.T) {
+	s := newStubSocks(t, echoUDP)
+	p := tun.NewMemoryTun()
+	t2s := New(p, false)
+	s.route(t2s)
+	serve(t, t2s)
+
+	payload := []byte("0123456789abcdef")
+	// claimed UDP lengths, 0 to leave it as built
+	claims := []int{
+		0, 1, 7, 8 + len(payload) + 1, 65535,
+		// shorter than captured, the rest is padding
+		8 + 4, 8,
+	}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		claims = append(claims, r.Intn(1<<16))
+	}
+
+	var malformed uint64
+	for i, claim := range claims {
+		pkt := udpIPv4(clientIP, uint16(6000+i), net.IP{192, 0, 2, 1}, 9, payload)
+		// no checksum, which would no longer match
+		pkt[26], pkt[27] = 0, 0
+		udpLen := 8 + len(payload)
+		if claim != 0 {
+			udpLen = claim
+			binary.BigEndian.PutUint16(pkt[24:], uint16(udpLen))
+		}
+		valid := udpLen >= 8 && udpLen <= len(pkt)-20
+		if !valid {
+			malformed++
+		}
+		p.Inject(pkt)
+		if valid {
+			_, udp := nextUDP(t, p)
+			if string(udp.Payload) != string(payload[:udpLen-8]) {
+				t.Errorf("UDP length %d: echoed %q", udpLen, udp.Payload)
+			}
+		}
+	}
+	waitFor(t, "malformed datagrams counted", func() bool {
+		return t2s.Stats().UDPMalformed == malformed
+	})
+	noPacket(t, p, 50*time.Millisecond)
+
+	if resp, _ := t2s.responsePacket(clientIP, resolverIP, 4000, 53, make([]byte, MAX_UDP_PAYLOAD+1), 0, 0); resp != nil {
+		t.Error("built a response over the UDP maximum")
+	}
+	if n := t2s.Stats().UDPOversized; n != 1 {
+		t.Errorf("%d oversized responses counted, want 1", n)
+	}
+}
+
+func TestTruncatedUDPDropped(t *testing.T) {
+	s := newStubSocks(t, echoUDP)
+	t2s, p := NewTun2SocksWithPipe()
+	s.route(t2s)
+	serve(t, t2s)
+	dst := net.IP{192, 0, 2, 1}
+
+	// the capture stops short of the lengths both headers claim
+	pkt := udpIPv4(clientIP, 5000, dst, 9, []byte("0123456789abcdef"))
+	p.Inject(pkt[:len(pkt)-8])
+	// bytes trailing the IP datagram, claimed by an inflated UDP length
+	pkt = udpIPv4(clientIP, 5001, dst, 9, []byte("ping"))
+	pkt[26], pkt[27] = 0, 0
+	binary.BigEndian.PutUint16(pkt[24:], 8+4+6)
+	p.Inject(append(pkt, "secret"...))
+	waitFor(t, "malformed datagrams counted", func() bool {
+		return t2s.Stats().UDPMalformed == 2
+	})
+	noPacket(t, p, 50*time.Millisecond)
+	select {
+	case req := <-s.requests:
+		t.Fatalf("relayed %q", req.Data)
+	default:
+	}
+
+	// trailing bytes within consistent lengths are left behind
+	pkt = udpIPv4(clientIP, 5002, dst, 9, []byte("ping"))
+	p.Inject(append(pkt, "secret"...))
+	if _, udp := nextUDP(t, p); string(udp.Payload) != "ping" {
+		t.Fatalf("echoed %q", udp.Payload)
+	}
+}
+
+func TestMaxUDPResponseSize(t *testing.T) {
+	s := newStubSocks(t, func(req *gosocks.UDPRequest) []byte {
+		if req.DstPort == 53 {
+			return stubResolver(func(q *dns.Msg) *dns.Msg {
+				resp := answerA(q)
+				for i := 0; i < 20; i++ {
+					resp.Answer = append(resp.Answer, resp.Answer[0])
+				}
+				return resp
+			})(req)
+		}
+		return req.Data
+	})
+	t2s, p := NewTun2SocksWithPipe()
+	s.route(t2s)
+	t2s.SetMaxUDPResponseSize(100)
+	serve(t, t2s)
+
+	dst := net.IP{192, 0, 2, 1}
+	p.Inject(udpIPv4(clientIP, 5000, dst, 9, make([]byte, 100)))
+	if _, udp := nextUDP(t, p); len(udp.Payload) != 100 {
+		t.Fatalf("echoed %d bytes, want 100", len(udp.Payload))
+	}
+	p.Inject(udpIPv4(clientIP, 5000, dst, 9, make([]byte, 101)))
+	noPacket(t, p, 100*time.Millisecond)
+	if n := t2s.Stats().UDPResponseCapped; n != 1 {
+		t.Fatalf("%d responses capped, want 1", n)
+	}
+
+	// DNS clients are told to retry over TCP instead
+	p.Inject(udpIPv4(clientIP, 4000, resolverIP, 53, packQuery(t, 7, "big.example.", dns.TypeA)))
+	_, udp := nextUDP(t, p)
+	if len(udp.Payload) > 100 {
+		t.Fatalf("DNS response of %d bytes over the cap", len(udp.Payload))
+	}
+	if resp := unpackDNS(t, udp); resp.Id != 7 || !resp.Truncated || len(resp.Answer) != 0 {
+		t.Fatalf("got %v, want an empty truncated response", resp)
+	}
+	if n := t2s.Stats().UDPResponseCapped; n != 2 {
+		t.Fatalf("%d responses capped, want 2", n)
+	}
+}
+
+// BenchmarkCopyUDPPacket compares copying a parsed DNS query, taking over
+// its headers, with copying and parsing it again as before.
+func BenchmarkCopyUDPPacket(b *testing.B) {
+	raw := udpIPv4(clientIP, 4000, resolverIP, 53, packQuery(b, 1, "bench.example.", dns.TypeA))
+	var ip packet.IPv4
+	var udp packet.UDP
+	if e := packet.ParseIPv4(raw, &ip); e != nil {
+		b.Fatal(e)
+	}
+	if e := packet.ParseUDP(ip.Payload, &udp); e != nil {
+		b.Fatal(e)
+	}
+
+	b.Run("reuse", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			releaseUDPPacket(copyUDPPacket(raw, nil, &ip, &udp))
+		}
+	})
+	b.Run("reparse", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			pkt := newUDPPacket()
+			buf := newBuffer()
+			pkt.mtuBuf = buf
+			pkt.wire = buf[:copy(buf, raw)]
+			pkt.ip = packet.NewIPv4()
+			pkt.udp = packet.NewUDP()
+			if packet.ParseIPv4(pkt.wire, pkt.ip) != nil || packet.ParseUDP(pkt.ip.Payload, pkt.udp) != nil {
+				b.Fatal("copy doesn't parse")
+			}
+			releaseUDPPacket(pkt)
+		}
+	})
+}
+
+func TestRelayBuffersSet(t *testing.T) {
+	const rcv, snd = 96 << 10, 48 << 10
+	t2s := New(nil, false)
+	t2s.SetRelayBuffers(rcv, snd)
+	conn, e := t2s.listenUDP(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer conn.Close()
+	raw, e := conn.SyscallConn()
+	if e != nil {
+		t.Fatal(e)
+	}
+	for _, c := range []struct {
+		opt  int
+		size int
+		max  string
+	}{
+		{syscall.SO_RCVBUF, rcv, "/proc/sys/net/core/rmem_max"},
+		{syscall.SO_SNDBUF, snd, "/proc/sys/net/core/wmem_max"},
+	} {
+		var got int
+		raw.Control(func(fd uintptr) {
+			got, e = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, c.opt)
+		})
+		if e != nil {
+			t.Fatal(e)
+		}
+		// best effort: the kernel clamps sizes to its maximum
+		if b, e := os.ReadFile(c.max); e == nil {
+			if max, e := strconv.Atoi(strings.TrimSpace(string(b))); e == nil && max < c.size {
+				t.Skipf("%s is %d, below %d", c.max, max, c.size)
+			}
+		}
+		// Linux reports twice the size set
+		if got/2 < c.size {
+			t.Errorf("buffer option %d is %d, want %d", c.opt, got/2, c.size)
+		}
+	}
+}
+
+func TestRelayEgressIP(t *testing.T) {
+	for _, tc := range []struct {
+		egress, want net.IP
+	}{
+		// the whole of 127/8 is local on Linux
+		{net.IP{127, 0, 0, 2}, net.IP{127, 0, 0, 2}},
+		// of another family than the SOCKS endpoint, ignored
+		{net.IPv6loopback, net.IP{127, 0, 0, 1}},
+	} {
+		s := newStubSocks(t, echoUDP)
+		t2s, p := NewTun2SocksWithPipe()
+		s.route(t2s)
+		t2s.SetRelayEgressIP(tc.egress)
+		bound := make(chan net.Addr, 1)
+		t2s.SetRelayBindHandler(func(proto string, local net.Addr) { bound <- local })
+		serve(t, t2s)
+
+		p.Inject(udpIPv4(clientIP, 5000, net.IP{192, 0, 2, 1}, 9, []byte("egress")))
+		// echoed back to the relay at its egress address
+		if _, udp := nextUDP(t, p); string(udp.Payload) != "egress" {
+			t.Fatalf("egress %s: echoed %q", tc.egress, udp.Payload)
+		}
+		if a := (<-bound).(*net.UDPAddr); !a.IP.Equal(tc.want) {
+			t.Errorf("egress %s: relay bound to %s, want %s", tc.egress, a.IP, tc.want)
+		}
+		t2s.Stop()
+	}
+}
+
+func TestCloseReasons(t *testing.T) {
+	for _, tc := range []struct {
+		want  CloseReason
+		setup func(t2s *Tun2Socks)
+		close func(t2s *Tun2Socks)
+	}{
+		{CLOSE_POLICY, nil, func(t2s *Tun2Socks) {
+			t2s.CloseFlows(func(ConnInfo) bool { return true })
+		}},
+		{CLOSE_STUCK, nil, func(t2s *Tun2Socks) {
+			time.Sleep(20 * time.Millisecond)
+			t2s.SetStuckTrackWatchdog(time.Millisecond)
+			t2s.reapStuckUDPTracks()
+		}},
+		{CLOSE_EXTERNAL_QUIT, nil, func(t2s *Tun2Socks) {
+			t2s.Stop()
+		}},
+		{CLOSE_IDLE_TIMEOUT, func(t2s *Tun2Socks) {
+			t2s.SetUDPIdleTimeout(50*time.Millisecond, 50*time.Millisecond)
+		}, nil},
+		{CLOSE_MAX_LIFETIME, func(t2s *Tun2Socks) {
+			t2s.SetMaxFlowLifetime(50 * time.Millisecond)
+		}, nil},
+	} {
+		s := newStubSocks(t, echoUDP)
+		t2s, p := NewTun2SocksWithPipe()
+		s.route(t2s)
+		if tc.setup != nil {
+			tc.setup(t2s)
+		}
+		reasons := make(chan CloseReason, 1)
+		t2s.SetConnCloseHandler(func(id string, reason CloseReason) { reasons <- reason })
+		serve(t, t2s)
+
+		p.Inject(udpIPv4(clientIP, 5000, net.IP{192, 0, 2, 1}, 9, []byte("ping")))
+		nextUDP(t, p)
+		if tc.close != nil {
+			tc.close(t2s)
+		}
+		select {
+		case reason := <-reasons:
+			if reason != tc.want {
+				t.Errorf("closed for %s, want %s", reason, tc.want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("flow not closed, want %s", tc.want)
+		}
+	}
+}
+
+func TestUDPRelayOverIPv6Endpoint(t *testing.T) {
+	if ln, e := net.ListenPacket("udp6", "[::1]:0"); e != nil {
+		t.Skipf("no IPv6 loopback: %s", e)
+	} else {
+		ln.Close()
+	}
+	s := &stubSocks{handle: echoUDP, ipv6: true}
+	s.listen(t)
+	t2s, p := NewTun2SocksWithPipe()
+	s.route(t2s)
+	serve(t, t2s)
+
+	// the guest flow stays IPv4
+	p.Inject(udpIPv4(clientIP, 5000, net.IP{192, 0, 2, 1}, 9, []byte("ping")))
+	ip, udp := nextUDP(t, p)
+	if string(udp.Payload) != "ping" || !ip.SrcIP.Equal(net.IP{192, 0, 2, 1}) {
+		t.Fatalf("got %q from %s", udp.Payload, ip.SrcIP)
+	}
+	if req := <-s.requests; req.DstHost != "192.0.2.1" {
+		t.Fatalf("relayed to %s", req.DstHost)
+	}
+}
+
+func TestStuckTrackReaped(t *testing.T) {
+	// a relay that takes datagrams and never delivers anything back
+	s := newStubSocks(t, nil)
+	t2s, p := NewTun2SocksWithPipe()
+	s.route(t2s)
+	t2s.SetStuckTrackWatchdog(50 * time.Millisecond)
+	serve(t, t2s)
+	tracks := func() []*udpConnTrack {
+		t2s.udpConnTrackLock.Lock()
+		defer t2s.udpConnTrackLock.Unlock()
+		var uts []*udpConnTrack
+		for _, ut := range t2s.udpConnTrackMap {
+			uts = append(uts, ut)
+		}
+		return uts
+	}
+
+	dst := net.IP{192, 0, 2, 1}
+	p.Inject(udpIPv4(clientIP, 5000, dst, 9, []byte("ping")))
+	<-s.requests
+	stuck := tracks()
+	if len(stuck) != 1 {
+		t.Fatalf("%d tracks, want 1", len(stuck))
+	}
+
+	// progressing tracks are left alone
+	t2s.reapStuckUDPTracks()
+	if n := t2s.Stats().StuckReaped; n != 0 {
+		t.Fatalf("%d tracks reaped right away", n)
+	}
+	time.Sleep(100 * time.Millisecond)
+	t2s.reapStuckUDPTracks()
+	if n := t2s.Stats().StuckReaped; n != 1 {
+		t.Fatalf("%d tracks reaped, want 1", n)
+	}
+	select {
+	case <-stuck[0].quitBySelf:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reaped track still running")
+	}
+
+	// the next packet of the flow gets a fresh track
+	p.Inject(udpIPv4(clientIP, 5000, dst, 9, []byte("ping")))
+	<-s.requests
+	if fresh := tracks(); len(fresh) != 1 || fresh[0] == stuck[0] {
+		t.Fatal("flow not given a fresh track")
+	}
+}
+
+func TestTOSPerInstance(t *testing.T) {
+	s := newStubSocks(t, echoUDP)
+	a, pa := NewTun2SocksWithPipe()
+	a.SetTOS(0xb8)
+	b, pb := NewTun2SocksWithPipe()
+	for _, t2s := range []*Tun2Socks{a, b} {
+		s.route(t2s)
+		serve(t, t2s)
+	}
+
+	for _, c := range []struct {
+		t2s *Tun2Socks
+		p   *tun.MemoryTun
+		tos int
+	}{{a, pa, 0xb8}, {b, pb, 0}} {
+		c.p.Inject(udpIPv4(clientIP, 5000, net.IP{192, 0, 2, 1}, 9, []byte("ping")))
+		if ip, _ := nextUDP(t, c.p); int(ip.TOS) != c.tos {
+			t.Errorf("emitted TOS 0x%02x, want 0x%02x", ip.TOS, c.tos)
+		}
+
+		conn, e := c.t2s.listenUDP(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if e != nil {
+			t.Fatal(e)
+		}
+		raw, e := conn.SyscallConn()
+		if e != nil {
+			t.Fatal(e)
+		}
+		var tos int
+		raw.Control(func(fd uintptr) {
+			tos, e = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS)
+		})
+		conn.Close()
+		if e != nil {
+			t.Fatal(e)
+		}
+		if tos != c.tos {
+			t.Errorf("relay socket TOS 0x%02x, want 0x%02x", tos, c.tos)
+		}
+	}
+}
+
+func TestUDPQueueOverflow(t *testing.T) {
+	for _, policy := range []int{UDP_QUEUE_DROP_OLDEST, UDP_QUEUE_DROP_NEWEST} {
+		t2s := New(nil, false)
+		t2s.SetUDPQueue(4, policy)
+		// a track whose relay never takes a packet
+		ut := &udpConnTrack{
+			t2s:         t2s,
+			fromTunCh:   make(chan *udpPacket, t2s.udpQueueDepth),
+			quitBySelf:  make(chan bool),
+			quitByOther: make(chan bool),
+		}
+		t2s.udpConnTrackMap["flow"] = ut
+		before := ReadPoolStats().UDPPacketPuts
+
+		for i := 0; i < 10; i++ {
+			pkt := newUDPPacket()
+			pkt.ip, pkt.udp = packet.NewIPv4(), packet.NewUDP()
+			pkt.udp.Payload = []byte{byte(i)}
+			ut.newPacket(pkt)
+		}
+		stats := t2s.Stats()
+		if stats.UDPQueueDropped != 6 || stats.UDPQueued != 4 || stats.UDPQueueHighWater != 4 {
+			t.Fatalf("policy %d: %d dropped, %d queued, high water %d, want 6, 4, 4",
+				policy, stats.UDPQueueDropped, stats.UDPQueued, stats.UDPQueueHighWater)
+		}
+		// dropped packets went back to the pool
+		if puts := ReadPoolStats().UDPPacketPuts - before; puts < 6 {
+			t.Fatalf("policy %d: %d packets released, want 6", policy, puts)
+		}
+		first := byte(0)
+		if policy == UDP_QUEUE_DROP_OLDEST {
+			first = 6
+		}
+		for i := byte(0); i < 4; i++ {
+			pkt := <-ut.fromTunCh
+			if pkt.udp.Payload[0] != first+i {
+				t.Fatalf("policy %d: queued packet %d, want %d", policy, pkt.udp.Payload[0], first+i)
+			}
+			releaseUDPPacket(pkt)
+		}
+	}
+}
+
+func TestNearMaxRelayedDatagramIntact(t *testing.T) {
+	// the largest payload a relayed datagram over IPv4 leaves room for,
+	// after the SOCKS UDP request header
+	big := make([]byte, MAX_UDP_PAYLOAD-10)
+	rand.New(rand.NewSource(1)).Read(big)
+	s := newStubSocks(t, func(*gosocks.UDPRequest) []byte { return big })
+	t2s, p := NewTun2SocksWithPipe()
+	s.route(t2s)
+	serve(t, t2s)
+
+	p.Inject(udpIPv4(clientIP, 5000, net.IP{192, 0, 2, 1}, 9, []byte("ping")))
+	// written to tun in MTU-sized fragments
+	var datagram []byte
+	for {
+		var ip packet.IPv4
+		if e := packet.ParseIPv4(nextPacket(t, p), &ip); e != nil {
+			t.Fatal(e)
+		}
+		if int(ip.FragOffset)*8 != len(datagram) {
+			t.Fatalf("fragment at offset %d, want %d", int(ip.FragOffset)*8, len(datagram))
+		}
+		datagram = append(datagram, ip.Payload...)
+		if ip.Flags&1 == 0 {
+			break
+		}
+	}
+	if len(datagram) != 8+len(big) || !bytes.Equal(datagram[8:], big) {
+		t.Fatalf("got a datagram of %d bytes, want %d intact", len(datagram)-8, len(big))
+	}
+}
+
+func TestMaxFragments(t *testing.T) {
+	s := newStubSocks(t, func(req *gosocks.UDPRequest) []byte {
+		if req.DstPort == 53 {
+			return stubResolver(func(q *dns.Msg) *dns.Msg {
+				resp := answerA(q)
+				// some 40KB, three fragments
+				for i := 0; i < 1500; i++ {
+					resp.Answer = append(resp.Answer, resp.Answer[0])
+				}
+				return resp
+			})(req)
+		}
+		// a response of the size asked for
+		n, _ := strconv.Atoi(string(req.Data))
+		return make([]byte, n)
+	})
+	t2s, p := NewTun2SocksWithPipe()
+	s.route(t2s)
+	t2s.SetMaxFragments(2)
+	serve(t, t2s)
+
+	dst := net.IP{192, 0, 2, 1}
+	p.Inject(udpIPv4(clientIP, 5000, dst, 9, []byte("20000")))
+	nextPacket(t, p)
+	nextPacket(t, p)
+	p.Inject(udpIPv4(clientIP, 5000, dst, 9, []byte("40000")))
+	noPacket(t, p, 100*time.Millisecond)
+	if n := t2s.Stats().UDPFragmentCapped; n != 1 {
+		t.Fatalf("%d responses capped, want 1", n)
+	}
+
+	// DNS clients are told to retry over TCP instead
+	p.Inject(udpIPv4(clientIP, 4000, resolverIP, 53, packQuery(t, 7, "big.example.", dns.TypeA)))
+	_, udp := nextUDP(t, p)
+	if resp := unpackDNS(t, udp); resp.Id != 7 || !resp.Truncated || len(resp.Answer) != 0 {
+		t.Fatalf("got %v, want an empty truncated response", resp)
+	}
+	if n := t2s.Stats().UDPFragmentCapped; n != 2 {
+		t.Fatalf("%d responses capped, want 2", n)
+	}
+	noPacket(t, p, 50*time.Millisecond)
+}
+
+func TestUDPChecksumOff(t *testing.T) {
+	for _, checksum := range []bool{true, false} {
+		s := newStubSocks(t, echoUDP)
+		t2s, p := NewTun2SocksWithPipe()
+		s.route(t2s)
+		t2s.SetUDPChecksum(checksum)
+		serve(t, t2s)
+
+		p.Inject(udpIPv4(clientIP, 5000, net.IP{192, 0, 2, 1}, 9, []byte("odd length")))
+		ip, udp := nextUDP(t, p)
+		if string(udp.Payload) != "odd length" {
+			t.Fatalf("echoed %q", udp.Payload)
+		}
+		if !checksum {
+			if udp.Checksum != 0 {
+				t.Fatalf("checksum %#04x, want none", udp.Checksum)
+			}
+		} else {
+			pseudo := make([]byte, packet.IPv4_PSEUDO_LENGTH)
+			ip.PseudoHeader(pseudo, packet.IPProtocolUDP, len(ip.Payload))
+			if udp.Checksum == 0 || packet.Checksum(pseudo, ip.Payload) != 0 {
+				t.Fatalf("checksum %#04x doesn't check", udp.Checksum)
+			}
+		}
+		t2s.Stop()
+	}
+}
+
+// withTOS sets the TOS of an IPv4 packet built by udpIPv4 or tcpIPv4.
+func withTOS(tb testing.TB, raw []byte, tos uint8) []byte {
+	tb.Helper()
+	var ip packet.IPv4
+	if e := packet.ParseIPv4(raw, &ip); e != nil {
+		tb.Fatal(e)
+	}
+	ip.TOS = tos
+	if e := ip.Serialize(raw[:20], len(raw)-20); e != nil {
+		tb.Fatal(e)
+	}
+	return raw
+}
+
+func TestECNPassthrough(t *testing.T) {
+	s := newStubSocks(t, echoUDP)
+	t2s, p := NewTun2SocksWithPipe()
+	s.route(t2s)
+	const dscp = 0xb8
+	t2s.SetTOS(dscp)
+	serve(t, t2s)
+
+	dst := net.IP{192, 0, 2, 1}
+	query := packQuery(t, 1, "ecn.example.", dns.TypeA)
+	if e := t2s.PreloadDNS([]PreloadEntry{{Response: packReply(t, query, 300, "192.0.2.1")}}); e != nil {
+		t.Fatal(e)
+	}
+	for _, tc := range []struct {
+		passthrough bool
+		ecn, want   uint8
+	}{
+		{false, ECN_ECT0, 0},
+		{true, 0, 0},
+		{true, ECN_ECT1, ECN_ECT1},
+		{true, ECN_ECT0, ECN_ECT0},
+		// the response didn't meet the congestion
+		{true, ECN_CE, ECN_ECT0},
+	} {
+		t2s.SetECNPassthrough(tc.passthrough)
+		p.Inject(withTOS(t, udpIPv4(clientIP, 5000, dst, 9, []byte("ping")), dscp|tc.ecn))
+		if ip, _ := nextUDP(t, p); ip.TOS != dscp|tc.want {
+			t.Errorf("passthrough %v: answered ECN %d with TOS 0x%02x, want 0x%02x", tc.passthrough, tc.ecn, ip.TOS, dscp|tc.want)
+		}
+		// answers from the cache too
+		p.Inject(withTOS(t, udpIPv4(clientIP, 4000, resolverIP, 53, query), dscp|tc.ecn))
+		if ip, _ := nextUDP(t, p); ip.TOS != dscp|tc.want {
+			t.Errorf("passthrough %v: answered query of ECN %d with TOS 0x%02x, want 0x%02x", tc.passthrough, tc.ecn, ip.TOS, dscp|tc.want)
+		}
+	}
+}
+
+func TestFlowIDIgnoresAddressEncoding(t *testing.T) {
+	s := newStubSocks(t, echoUDP)
+	t2s, p := NewTun2SocksWithPipe()
+	s.route(t2s)
+	serve(t, t2s)
+
+	dst := net.IP{192, 0, 2, 1}
+	p.Inject(udpIPv4(clientIP, 5000, dst, 9, []byte("ping")))
+	nextUDP(t, p)
+
+	// the same flow with its addresses held in 16 bytes
+	ip := &packet.IPv4{SrcIP: clientIP.To16(), DstIP: dst.To16()}
+	udp := &packet.UDP{SrcPort: 5000, DstPort: 9}
+	id := udpConnID(ip, udp)
+	if four := udpConnID(&packet.IPv4{SrcIP: clientIP.To4(), DstIP: dst.To4()}, udp); id != four {
+		t.Fatalf("flow keyed %q and %q", id, four)
+	}
+	if id != tcpConnID(ip, &packet.TCP{SrcPort: 5000, DstPort: 9}) {
+		t.Fatal("TCP and UDP flows keyed differently")
+	}
+	track := t2s.getUDPConnTrack(t2s.devs[0], id, ip, udp)
+	t2s.udpConnTrackLock.Lock()
+	defer t2s.udpConnTrackLock.Unlock()
+	if len(t2s.udpConnTrackMap) != 1 || t2s.udpConnTrackMap[id] != track {
+		t.Fatalf("%d tracks for one flow", len(t2s.udpConnTrackMap))
+	}
+}
@@ -0,0 +1,79 @@
+package tun2socks
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/dkwiebe/gotun2socks/internal/gosocks"
+)
+
+// A SOCKS server may be given as the path of a Unix domain socket, e.g.
+// "unix:/run/socks.sock". Its UDP relay is then a Unix datagram socket: the
+// UDP ASSOCIATE reply carries the relay socket path as a domain name BND.ADDR,
+// and datagrams are exchanged with it from a Unix datagram socket of our own.
+
+var unixRelaySeq uint64
+
+// listenUnixgram binds a Unix datagram socket at a fresh path in the temp
+// directory, for the relay to answer to.
+func listenUnixgram() (*net.UnixConn, error) {
+	name := fmt.Sprintf("gotun2socks-%d-%d.sock", os.Getpid(), atomic.AddUint64(&unixRelaySeq, 1))
+	return net.ListenUnixgram("unixgram", &net.UnixAddr{
+		Name: filepath.Join(os.TempDir(), name),
+		Net:  "unixgram",
+	})
+}
+
+// relayBind binds the socket to exchange datagrams with the UDP relay of
+// conn: a UDP socket of the family of the SOCKS endpoint rather than of the
+// flow, or a Unix datagram socket if conn is to a Unix domain socket.
+func (t2s *Tun2Socks) relayBind(conn *gosocks.SocksConn) (net.PacketConn, error) {
+	socksAddr, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		u, e := listenUnixgram()
+		if e != nil {
+			return nil, e
+		}
+		return u, nil
+	}
+	u, e := t2s.listenUDP(&net.UDPAddr{
+		IP:   t2s.relayBindIP(socksAddr.IP),
+		Port: 0,
+		Zone: socksAddr.Zone,
+	})
+	if e != nil {
+		return nil, e
+	}
+	return u, nil
+}
+
+// closeRelayBind closes bind, removing its socket file if it is a Unix one.
+func closeRelayBind(bind net.PacketConn) {
+	bind.Close()
+	if addr, ok := bind.LocalAddr().(*net.UnixAddr); ok {
+		os.Remove(addr.Name)
+	}
+}
+
+// relayAddress returns the address of the UDP relay in the UDP ASSOCIATE
+// reply of conn.
+func relayAddress(conn *gosocks.SocksConn, reply *gosocks.SocksReply) (net.Addr, error) {
+	if _, ok := conn.RemoteAddr().(*net.UnixAddr); ok {
+		if reply.HostType != gosocks.SocksDomainHost {
+			return nil, fmt.Errorf("socks relay address %s is not a socket path", reply.BndHost)
+		}
+		return &net.UnixAddr{Name: reply.BndHost, Net: "unixgram"}, nil
+	}
+	relayAddr, ok := gosocks.SocksAddrToNetAddr("udp", reply.BndHost, reply.BndPort).(*net.UDPAddr)
+	if !ok {
+		return nil, fmt.Errorf("invalid socks relay address %s", reply.BndHost)
+	}
+	if relayAddr.IP.IsUnspecified() {
+		// the relay listens on the address of the SOCKS server itself
+		relayAddr.IP = conn.RemoteAddr().(*net.TCPAddr).IP
+	}
+	return relayAddr, nil
+}